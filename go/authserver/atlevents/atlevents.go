@@ -0,0 +1,136 @@
+package atlevents
+
+import (
+	"mqttmtd/metrics"
+	"mqttmtd/types"
+	"sync"
+	"time"
+)
+
+/*
+Events of ATL entries, published by the issuer, the verifier, autorevoker and the admin API, and streamed by the
+dashboard. Publish never blocks, so that it can be called with ATL locked: subscribers that fall SUBSCRIBER_BUFFER_LEN
+events behind are dropped, and can resume from the last HISTORY_LEN events by the sequence number.
+*/
+const (
+	EVENT_ISSUE         = "issue"
+	EVENT_ADVANCE       = "advance"       // a token was consumed and the next one is valid
+	EVENT_RELOAD_NEEDED = "reload-needed" // the last token was consumed and the entry removed
+	EVENT_REVOKE        = "revoke"
+	EVENT_EXPIRE        = "expire"
+	EVENT_SUSPICIOUS    = "suspicious" // a token that matched no entry, or the entry of the other access type
+
+	HISTORY_LEN           = 256
+	SUBSCRIBER_BUFFER_LEN = 64
+)
+
+// Reasons of EVENT_REVOKE and EVENT_SUSPICIOUS
+const (
+	REASON_REISSUED      = "reissued" // replaced by a new batch of the same client, topic and access
+	REASON_UNDELIVERED   = "undelivered"
+	REASON_ADMIN         = "admin"
+	REASON_UNKNOWN_TOKEN = "unknown token"
+	REASON_ACCESS_TYPE   = "access type mismatch"
+	REASON_KEY_RATCHET   = "key ratchet failure" // the payload key of the token could not be derived
+)
+
+/*
+Event of an ATL entry, without anything from which tokens could be forged. Entry fields are empty for EVENT_SUSPICIOUS
+of unknown tokens.
+*/
+type Event struct {
+	Seq        uint64    `json:"seq"`
+	Time       time.Time `json:"time"`
+	Kind       string    `json:"kind"`
+	ID         string    `json:"id,omitempty"` // as in the admin API
+	Client     string    `json:"client,omitempty"`
+	Topic      string    `json:"topic,omitempty"`
+	Access     string    `json:"access,omitempty"` // "pub" or "sub"
+	Cover      bool      `json:"cover,omitempty"`
+	TokenIndex uint16    `json:"tokenindex"` // current token index after the event
+	TokenCount uint16    `json:"tokencount"`
+	Reason     string    `json:"reason,omitempty"`
+	Remote     string    `json:"remote,omitempty"`
+}
+
+var hub struct {
+	sync.Mutex
+	seq         uint64
+	history     []Event // ring of the last HISTORY_LEN events
+	subscribers map[chan Event]struct{}
+}
+
+/*
+Publish an event of the entry, which may be nil. Entry fields are read right away, so the caller must hold ATL locked
+unless the entry has been removed from it.
+*/
+func Publish(kind string, entry *types.ATLEntry, reason string, remote string) {
+	e := Event{Time: time.Now(), Kind: kind, Reason: reason, Remote: remote}
+	if entry != nil {
+		e.ID = entry.ID()
+		e.Client = string(entry.ClientName)
+		e.Topic = string(entry.Topic)
+		e.Access = metrics.AccessLabel(entry.AccessTypeIsPub)
+		e.Cover = entry.CoverTraffic
+		e.TokenIndex = entry.CurrentValidTokenIdx
+		e.TokenCount = entry.TokenCount
+	}
+
+	hub.Lock()
+	defer hub.Unlock()
+	hub.seq++
+	e.Seq = hub.seq
+	if len(hub.history) < HISTORY_LEN {
+		hub.history = append(hub.history, e)
+	} else {
+		hub.history[(e.Seq-1)%HISTORY_LEN] = e
+	}
+	for ch := range hub.subscribers {
+		select {
+		case ch <- e:
+		default:
+			delete(hub.subscribers, ch)
+			close(ch)
+		}
+	}
+}
+
+// PublishAll publishes an event for each of entries
+func PublishAll(kind string, entries []*types.ATLEntry, reason string, remote string) {
+	for _, entry := range entries {
+		Publish(kind, entry, reason, remote)
+	}
+}
+
+/*
+Events after the sequence number afterSeq still in the history, followed by the ones published from now on in events,
+which is closed when the subscriber is dropped for falling behind. cancel must be called when done.
+*/
+func Subscribe(afterSeq uint64) (history []Event, events <-chan Event, cancel func()) {
+	ch := make(chan Event, SUBSCRIBER_BUFFER_LEN)
+
+	hub.Lock()
+	defer hub.Unlock()
+	if afterSeq > hub.seq {
+		// Sequence numbers of the authserver before restarting
+		afterSeq = 0
+	}
+	for seq := max(afterSeq+1, hub.seq+1-uint64(len(hub.history))); seq <= hub.seq; seq++ {
+		history = append(history, hub.history[(seq-1)%HISTORY_LEN])
+	}
+	if hub.subscribers == nil {
+		hub.subscribers = make(map[chan Event]struct{})
+	}
+	hub.subscribers[ch] = struct{}{}
+
+	events = ch
+	cancel = func() {
+		hub.Lock()
+		defer hub.Unlock()
+		if _, found := hub.subscribers[ch]; found {
+			delete(hub.subscribers, ch)
+			close(ch)
+		}
+	}
+	return
+}
@@ -2,39 +2,67 @@ package main
 
 import (
 	"flag"
-	"log"
 	"mqttmtd/authserver/autorevoker"
 	"mqttmtd/authserver/dashboardserver"
 	"mqttmtd/authserver/issuer"
 	"mqttmtd/authserver/verifier"
 	"mqttmtd/config"
+	"mqttmtd/logging"
+	"mqttmtd/metrics"
 	"mqttmtd/types"
 )
 
 var (
+	logger = logging.For("authserver")
+
 	acl = &types.AccessControlList{}
 	atl = &types.AuthTokenList{}
 )
 
+func runMetrics() {
+	metrics.NewGaugeFunc("mqttmtd_atl_entries", "Entries in ATL, each a batch of tokens", func() float64 {
+		atl.Lock()
+		defer atl.Unlock()
+		n := 0
+		atl.ForEachEntry(func(int, *types.ATLEntry) { n++ })
+		return float64(n)
+	})
+	logger.Info("starting metrics server", "port", config.Server.Ports.Metrics)
+	if err := metrics.Serve(config.Server.Ports.Metrics); err != nil {
+		logger.Error("failed to start metrics server", "err", err)
+	}
+}
+
 func main() {
 
 	configFilePath := flag.String("conf", "", "path to the server conf file")
 	flag.Parse()
 
 	if err := config.LoadServerConfig(*configFilePath); err != nil {
-		log.Fatalf("Failed to load server config from %s: %v", *configFilePath, err)
-	} else {
-		log.Printf("Server Config Loaded from %s\n", *configFilePath)
+		logging.Fatal(logger, "failed to load server config", "path", *configFilePath, "err", err)
 	}
+	if err := logging.Init(config.Server.Log, "authserver"); err != nil {
+		logging.Fatal(logger, "failed to apply log config", "err", err)
+	}
+	logger.Info("server config loaded", "path", *configFilePath)
 
 	if err := acl.LoadFile(config.Server.FilePaths.AclFilePath); err != nil {
-		log.Fatalf("Failed to load ACL: %v", err)
+		logging.Fatal(logger, "failed to load ACL", "err", err)
 	}
 
 	go issuer.Run(acl, atl)
+	if config.Server.Ports.Ace != 0 {
+		go issuer.RunAce(acl, atl)
+	}
 	go verifier.Run(atl)
+	if config.Server.Ports.HttpAuth != 0 {
+		go verifier.RunHttpAuth(atl)
+	}
 	go autorevoker.Run(atl)
 	go dashboardserver.Run(acl, atl)
+	if config.Server.Ports.Metrics != 0 {
+		go runMetrics()
+	}
 
 	select {}
 }
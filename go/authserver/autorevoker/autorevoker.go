@@ -1,18 +1,22 @@
 package autorevoker
 
 import (
-	"fmt"
+	"mqttmtd/authserver/atlevents"
+	"mqttmtd/logging"
 	"mqttmtd/types"
 	"time"
 )
 
+var logger = logging.For("autorevoker")
+
 func Run(atl *types.AuthTokenList) {
-	fmt.Println("AutoRevoker started")
+	logger.Info("autorevoker started")
 	for {
 		time.Sleep(time.Minute)
 		atl.Lock()
-		atl.RemoveExpired()
+		removed := atl.RemoveExpired()
 		atl.Unlock()
-		fmt.Printf("%s: AutoRevoker removed expired tokens\n", time.Now().Local().Format(time.StampMilli))
+		atlevents.PublishAll(atlevents.EVENT_EXPIRE, removed, "", "")
+		logger.Debug("removed expired tokens", "removed", len(removed))
 	}
 }
@@ -0,0 +1,358 @@
+package dashboardserver
+
+import (
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"mqttmtd/authserver/atlevents"
+	"mqttmtd/config"
+	"mqttmtd/consts"
+	"mqttmtd/types"
+	"net/http"
+	"sort"
+	"strconv"
+	"time"
+)
+
+/*
+JSON admin API, versioned under API_PREFIX. ATL and ACL are locked in the same way as httpServerHandler, so that
+operations take effect on the issuer and the verifier right away:
+
+	GET    /api/v1/atl              entries, filtered by the query client, topic, access (pub or sub) and cover
+	DELETE /api/v1/atl              revoke the entries matching the query, which needs client or topic
+	DELETE /api/v1/atl/{id}         revoke an entry
+	POST   /api/v1/atl/sweep        remove expired entries now instead of waiting for autorevoker
+	GET    /api/v1/acl              grants, filtered by the query client
+	PUT    /api/v1/acl/{client}     add or replace a grant, given as aclGrantJSON
+	DELETE /api/v1/acl/{client}     remove the grant of the query topic, or all grants of the client without it
+	GET    /api/v1/sessions         active sessions of MQTT Interface
+	GET    /api/v1/events           stream of ATL events as Server-Sent Events, see apiStreamEvents
+
+GET is open to read-only users and the others to admins only, see requireRole. Errors are answered with
+{"error": "..."}. ACL edits are not written back to the ACL file.
+*/
+const API_PREFIX = "/api/v1"
+
+type atlEntryJSON struct {
+	ID                string    `json:"id"`    // hex of the timestamp, which identifies the batch
+	Index             int       `json:"index"` // 1-based position in ATL, as in the dashboard
+	Client            string    `json:"client"`
+	Topic             string    `json:"topic"`
+	Access            string    `json:"access"` // "pub" or "sub"
+	Cover             bool      `json:"cover"`
+	TokenFormat       string    `json:"tokenformat"`
+	TokenCount        uint16    `json:"tokencount"`
+	CurrentTokenIndex uint16    `json:"currenttokenindex"`
+	AEAD              string    `json:"aead"`
+	KeyRatchet        bool      `json:"keyratchet"`
+	Padding           string    `json:"padding"`
+	CurrentRandomData string    `json:"currentrandomdata,omitempty"` // hex, for admins only
+	IssuedAt          time.Time `json:"issuedat"`
+	ExpiresAt         time.Time `json:"expiresat"`
+}
+
+type aclPaddingJSON struct {
+	Pub string `json:"pub"` // "none", "bucket:<size>" or "fixed:<size>", none when empty
+	Sub string `json:"sub"`
+}
+
+type aclGrantJSON struct {
+	Client  string         `json:"client,omitempty"` // taken from the path on PUT
+	Topic   string         `json:"topic"`            // topic name or filter
+	Access  string         `json:"access"`           // "Pub", "Sub" or "PubSub"
+	Padding aclPaddingJSON `json:"padding"`
+}
+
+func registerAPI(mux *http.ServeMux) {
+	mux.HandleFunc("GET "+API_PREFIX+"/atl", requireRole(ROLE_READONLY, apiListATL))
+	mux.HandleFunc("DELETE "+API_PREFIX+"/atl", requireRole(ROLE_ADMIN, apiRevokeATL))
+	mux.HandleFunc("DELETE "+API_PREFIX+"/atl/{id}", requireRole(ROLE_ADMIN, apiRevokeATLEntry))
+	mux.HandleFunc("POST "+API_PREFIX+"/atl/sweep", requireRole(ROLE_ADMIN, apiSweepATL))
+	mux.HandleFunc("GET "+API_PREFIX+"/acl", requireRole(ROLE_READONLY, apiListACL))
+	mux.HandleFunc("PUT "+API_PREFIX+"/acl/{client}", requireRole(ROLE_ADMIN, apiPutACLGrant))
+	mux.HandleFunc("DELETE "+API_PREFIX+"/acl/{client}", requireRole(ROLE_ADMIN, apiDeleteACLGrant))
+	mux.HandleFunc("GET "+API_PREFIX+"/sessions", requireRole(ROLE_READONLY, apiListSessions))
+	mux.HandleFunc("GET "+API_PREFIX+"/events", requireRole(ROLE_READONLY, apiStreamEvents))
+}
+
+func writeJSON(w http.ResponseWriter, status int, v any) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	if err := json.NewEncoder(w).Encode(v); err != nil {
+		logger.Warn("failed encoding a response", "err", err)
+	}
+}
+
+func writeError(w http.ResponseWriter, status int, err error) {
+	writeJSON(w, status, map[string]string{"error": err.Error()})
+}
+
+// Filter of ATL entries given by the query, of which empty fields match any
+type atlFilter struct {
+	client string
+	topic  string
+	access string
+	cover  string
+}
+
+func atlFilterFromQuery(req *http.Request) (filter atlFilter, err error) {
+	query := req.URL.Query()
+	filter = atlFilter{client: query.Get("client"), topic: query.Get("topic"), access: query.Get("access"), cover: query.Get("cover")}
+	if filter.access != "" && filter.access != "pub" && filter.access != "sub" {
+		err = fmt.Errorf("invalid access: %s", filter.access)
+	} else if filter.cover != "" {
+		_, err = strconv.ParseBool(filter.cover)
+	}
+	return
+}
+
+func (f atlFilter) matches(entry *types.ATLEntry) bool {
+	if f.client != "" && f.client != string(entry.ClientName) {
+		return false
+	}
+	if f.topic != "" && f.topic != string(entry.Topic) {
+		return false
+	}
+	if f.access != "" && (f.access == "pub") != entry.AccessTypeIsPub {
+		return false
+	}
+	if f.cover != "" {
+		if cover, _ := strconv.ParseBool(f.cover); cover != entry.CoverTraffic {
+			return false
+		}
+	}
+	return true
+}
+
+func atlEntryToJSON(i int, entry *types.ATLEntry, showSecrets bool) (j atlEntryJSON) {
+	access := "sub"
+	if entry.AccessTypeIsPub {
+		access = "pub"
+	}
+	issuedAt := entry.IssuedAt()
+	j = atlEntryJSON{
+		ID:                entry.ID(),
+		Index:             i + 1,
+		Client:            string(entry.ClientName),
+		Topic:             string(entry.Topic),
+		Access:            access,
+		Cover:             entry.CoverTraffic,
+		TokenFormat:       entry.TokenFormat.String(),
+		TokenCount:        entry.TokenCount,
+		CurrentTokenIndex: entry.CurrentValidTokenIdx,
+		AEAD:              entry.PayloadAEADType.String(),
+		KeyRatchet:        entry.PayloadKeyRatchet,
+		Padding:           entry.Padding.String(),
+		IssuedAt:          issuedAt,
+		ExpiresAt:         issuedAt.Add(consts.TOKEN_EXPIRATION_DURATION),
+	}
+	if showSecrets {
+		j.CurrentRandomData = hex.EncodeToString(entry.CurrentValidRandomData)
+	}
+	return
+}
+
+func apiListATL(w http.ResponseWriter, req *http.Request) {
+	filter, err := atlFilterFromQuery(req)
+	if err != nil {
+		writeError(w, http.StatusBadRequest, err)
+		return
+	}
+	entries := []atlEntryJSON{}
+	showSecrets := roleOf(req) >= ROLE_ADMIN
+	myAtl.Lock()
+	myAtl.ForEachEntry(func(i int, entry *types.ATLEntry) {
+		if filter.matches(entry) {
+			entries = append(entries, atlEntryToJSON(i, entry, showSecrets))
+		}
+	})
+	myAtl.Unlock()
+	writeJSON(w, http.StatusOK, map[string]any{"entries": entries})
+}
+
+// Remove the entries for which match returns true, with ATL locked
+func revokeATLEntries(match func(*types.ATLEntry) bool, remoteAddr string) (revoked []atlEntryJSON) {
+	revoked = []atlEntryJSON{}
+	myAtl.Lock()
+	defer myAtl.Unlock()
+	var matched []*types.ATLEntry
+	myAtl.ForEachEntry(func(i int, entry *types.ATLEntry) {
+		if match(entry) {
+			matched = append(matched, entry)
+			revoked = append(revoked, atlEntryToJSON(i, entry, false))
+		}
+	})
+	for _, entry := range matched {
+		myAtl.Remove(entry)
+	}
+	atlevents.PublishAll(atlevents.EVENT_REVOKE, matched, atlevents.REASON_ADMIN, remoteAddr)
+	return
+}
+
+func apiRevokeATL(w http.ResponseWriter, req *http.Request) {
+	filter, err := atlFilterFromQuery(req)
+	if err != nil {
+		writeError(w, http.StatusBadRequest, err)
+		return
+	}
+	if filter.client == "" && filter.topic == "" {
+		writeError(w, http.StatusBadRequest, fmt.Errorf("client or topic is needed to revoke entries"))
+		return
+	}
+	revoked := revokeATLEntries(filter.matches, req.RemoteAddr)
+	logger.Info("revoked ATL entries", "client", filter.client, "topic", filter.topic, "revoked", len(revoked))
+	writeJSON(w, http.StatusOK, map[string]any{"revoked": revoked})
+}
+
+func apiRevokeATLEntry(w http.ResponseWriter, req *http.Request) {
+	id := req.PathValue("id")
+	revoked := revokeATLEntries(func(entry *types.ATLEntry) bool { return entry.ID() == id }, req.RemoteAddr)
+	if len(revoked) == 0 {
+		writeError(w, http.StatusNotFound, fmt.Errorf("entry not found: %s", id))
+		return
+	}
+	logger.Info("revoked an ATL entry", "id", id)
+	writeJSON(w, http.StatusOK, map[string]any{"revoked": revoked})
+}
+
+func apiSweepATL(w http.ResponseWriter, req *http.Request) {
+	myAtl.Lock()
+	removed := myAtl.RemoveExpired()
+	myAtl.Unlock()
+	atlevents.PublishAll(atlevents.EVENT_EXPIRE, removed, "", req.RemoteAddr)
+	logger.Info("swept expired ATL entries", "removed", len(removed))
+	writeJSON(w, http.StatusOK, map[string]any{"removed": len(removed)})
+}
+
+func apiListACL(w http.ResponseWriter, req *http.Request) {
+	client := req.URL.Query().Get("client")
+	grants := []aclGrantJSON{}
+	myAcl.Lock()
+	for clientName, clientACLEntry := range myAcl.Entries {
+		if client != "" && client != clientName {
+			continue
+		}
+		for topic, grant := range clientACLEntry {
+			grants = append(grants, aclGrantJSON{
+				Client:  clientName,
+				Topic:   topic,
+				Access:  grant.Access.String(),
+				Padding: aclPaddingJSON{Pub: grant.Padding.Pub.String(), Sub: grant.Padding.Sub.String()},
+			})
+		}
+	}
+	myAcl.Unlock()
+	sort.Slice(grants, func(i, j int) bool {
+		if grants[i].Client != grants[j].Client {
+			return grants[i].Client < grants[j].Client
+		}
+		return grants[i].Topic < grants[j].Topic
+	})
+	writeJSON(w, http.StatusOK, map[string]any{"grants": grants})
+}
+
+func (g aclGrantJSON) toGrant() (grant types.ACLGrant, err error) {
+	if g.Topic == "" {
+		err = fmt.Errorf("topic is missing")
+		return
+	}
+	if types.IsWildcardTopicFilter(g.Topic) {
+		if err = types.ValidateTopicFilter(g.Topic); err != nil {
+			return
+		}
+	}
+	if grant.Access, err = types.ParseACLAccessType(g.Access); err != nil {
+		return
+	}
+	for _, p := range []struct {
+		s      string
+		policy *types.PaddingPolicy
+	}{{g.Padding.Pub, &grant.Padding.Pub}, {g.Padding.Sub, &grant.Padding.Sub}} {
+		if p.s == "" {
+			continue
+		}
+		if *p.policy, err = types.ParsePaddingPolicyString(p.s); err != nil {
+			return
+		}
+	}
+	return
+}
+
+func apiPutACLGrant(w http.ResponseWriter, req *http.Request) {
+	client := req.PathValue("client")
+	var grantJSON aclGrantJSON
+	decoder := json.NewDecoder(req.Body)
+	decoder.DisallowUnknownFields()
+	if err := decoder.Decode(&grantJSON); err != nil {
+		writeError(w, http.StatusBadRequest, fmt.Errorf("invalid grant: %v", err))
+		return
+	}
+	grant, err := grantJSON.toGrant()
+	if err != nil {
+		writeError(w, http.StatusBadRequest, err)
+		return
+	}
+
+	myAcl.Lock()
+	if myAcl.Entries == nil {
+		myAcl.Entries = make(map[string]map[string]types.ACLGrant)
+	}
+	if myAcl.Entries[client] == nil {
+		myAcl.Entries[client] = make(map[string]types.ACLGrant)
+	}
+	myAcl.Entries[client][grantJSON.Topic] = grant
+	myAcl.Unlock()
+	logger.Info("ACL grant set", "client", client, "topic", grantJSON.Topic, "access", grant.Access.String())
+
+	grantJSON.Client = client
+	writeJSON(w, http.StatusOK, grantJSON)
+}
+
+func apiDeleteACLGrant(w http.ResponseWriter, req *http.Request) {
+	client, topic := req.PathValue("client"), req.URL.Query().Get("topic")
+	myAcl.Lock()
+	clientACLEntry, found := myAcl.Entries[client]
+	if found && topic != "" {
+		if _, found = clientACLEntry[topic]; found {
+			delete(clientACLEntry, topic)
+		}
+	} else if found {
+		delete(myAcl.Entries, client)
+	}
+	myAcl.Unlock()
+	if !found {
+		writeError(w, http.StatusNotFound, fmt.Errorf("grant not found: %s %s", client, topic))
+		return
+	}
+	// Tokens issued before stay valid until revoked through ATL
+	logger.Info("ACL grant removed", "client", client, "topic", topic)
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// Proxied to MQTT Interface, which holds the sessions
+func apiListSessions(w http.ResponseWriter, req *http.Request) {
+	addr := config.Server.Dashboard.MqttInterfaceAddr
+	if addr == "" {
+		if config.Server.Ports.MqttInterfaceAdmin == 0 {
+			writeError(w, http.StatusServiceUnavailable, fmt.Errorf("sessions of MQTT Interface are not served"))
+			return
+		}
+		addr = fmt.Sprintf("localhost:%d", config.Server.Ports.MqttInterfaceAdmin)
+	}
+	client := &http.Client{Timeout: config.Server.SocketTimeout.External}
+	resp, err := client.Get("http://" + addr + API_PREFIX + "/sessions")
+	if err != nil {
+		writeError(w, http.StatusBadGateway, err)
+		return
+	}
+	defer resp.Body.Close()
+	body, err := io.ReadAll(resp.Body)
+	if err != nil {
+		writeError(w, http.StatusBadGateway, err)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(resp.StatusCode)
+	w.Write(body)
+}
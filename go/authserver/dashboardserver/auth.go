@@ -0,0 +1,192 @@
+package dashboardserver
+
+import (
+	"context"
+	"crypto/sha256"
+	"crypto/subtle"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/hex"
+	"fmt"
+	"mqttmtd/config"
+	"mqttmtd/funcs"
+	"net/http"
+	"strings"
+)
+
+/*
+Roles of dashboard users. Read-only users see ACL, ATL and sessions without the current valid random data, from which
+the next token could be forged, while admins see everything and may use the operations of the admin API.
+*/
+type role int
+
+const (
+	ROLE_NONE role = iota
+	ROLE_READONLY
+	ROLE_ADMIN
+)
+
+type DASHBOARD_CONTEXT_KEY string
+
+const ROLE_CONTEXT_KEY DASHBOARD_CONTEXT_KEY = "role"
+
+func parseRole(s string) (r role, err error) {
+	switch s {
+	case "readonly":
+		r = ROLE_READONLY
+	case "admin":
+		r = ROLE_ADMIN
+	default:
+		err = fmt.Errorf("invalid dashboard role: %q", s)
+	}
+	return
+}
+
+func (r role) String() string {
+	return [...]string{"none", "readonly", "admin"}[r]
+}
+
+// Credentials of config.Server.Dashboard, parsed by loadAuth
+var auth struct {
+	anonymous role
+	users     map[string]userCredential // by name
+	tokens    []tokenCredential
+	certRoles map[string]role
+}
+
+type userCredential struct {
+	passwordSHA256 []byte
+	role           role
+}
+
+type tokenCredential struct {
+	tokenSHA256 []byte
+	role        role
+}
+
+func loadAuth() (err error) {
+	conf := &config.Server.Dashboard
+	if conf.AnonymousRole != "" {
+		if auth.anonymous, err = parseRole(conf.AnonymousRole); err != nil {
+			return
+		}
+	}
+	auth.users = make(map[string]userCredential, len(conf.Users))
+	for _, user := range conf.Users {
+		var cred userCredential
+		if cred.passwordSHA256, err = decodeSHA256(user.PasswordSHA256); err != nil {
+			return fmt.Errorf("password of dashboard user %s: %w", user.Name, err)
+		}
+		if cred.role, err = parseRole(user.Role); err != nil {
+			return
+		}
+		auth.users[user.Name] = cred
+	}
+	auth.tokens = nil
+	for i, token := range conf.Tokens {
+		var cred tokenCredential
+		if cred.tokenSHA256, err = decodeSHA256(token.TokenSHA256); err != nil {
+			return fmt.Errorf("dashboard token %d: %w", i, err)
+		}
+		if cred.role, err = parseRole(token.Role); err != nil {
+			return
+		}
+		auth.tokens = append(auth.tokens, cred)
+	}
+	auth.certRoles = make(map[string]role, len(conf.CertRoles))
+	for identity, roleStr := range conf.CertRoles {
+		if auth.certRoles[identity], err = parseRole(roleStr); err != nil {
+			return
+		}
+	}
+	if len(auth.certRoles) > 0 && (!conf.Tls || conf.TlsClientAuth == "" || conf.TlsClientAuth == funcs.TLS_CLIENT_AUTH_NONE) {
+		err = fmt.Errorf("dashboard certroles need tls and tlsclientauth")
+	}
+	return
+}
+
+func decodeSHA256(s string) (digest []byte, err error) {
+	if digest, err = hex.DecodeString(s); err == nil && len(digest) != sha256.Size {
+		err = fmt.Errorf("not a hex of SHA-256")
+	}
+	return
+}
+
+func matchesSHA256(secret string, digest []byte) bool {
+	sum := sha256.Sum256([]byte(secret))
+	return subtle.ConstantTimeCompare(sum[:], digest) == 1
+}
+
+func loadTLSConfig() (*tls.Config, error) {
+	certs := &config.Server.Certs
+	return funcs.LoadServerTLSConfig(certs.ServerCertFilePath, certs.ServerKeyFilePath, certs.CaCertFilePath, config.Server.Dashboard.TlsClientAuth)
+}
+
+// MQTT MTD identity of a verified client certificate, or its common name without one
+func certIdentity(cert *x509.Certificate) string {
+	for _, email := range cert.EmailAddresses {
+		if strings.HasSuffix(email, "@mqtt.mtd") {
+			return strings.TrimSuffix(email, "@mqtt.mtd")
+		}
+	}
+	return cert.Subject.CommonName
+}
+
+/*
+Role of the request by, in order, its verified client certificate, basic auth and bearer auth. Requests without any
+credentials have the anonymous role, but invalid credentials are never given one.
+*/
+func authenticate(req *http.Request) (r role, name string) {
+	if req.TLS != nil && len(req.TLS.VerifiedChains) > 0 {
+		name = certIdentity(req.TLS.VerifiedChains[0][0])
+		if certRole, found := auth.certRoles[name]; found {
+			return certRole, name
+		}
+	}
+	if user, password, ok := req.BasicAuth(); ok {
+		if cred, found := auth.users[user]; found && matchesSHA256(password, cred.passwordSHA256) {
+			return cred.role, user
+		}
+		return ROLE_NONE, user
+	}
+	if token, ok := strings.CutPrefix(req.Header.Get("Authorization"), "Bearer "); ok {
+		for i, cred := range auth.tokens {
+			if matchesSHA256(token, cred.tokenSHA256) {
+				return cred.role, fmt.Sprintf("token%d", i)
+			}
+		}
+		return ROLE_NONE, ""
+	}
+	if req.Header.Get("Authorization") != "" {
+		return ROLE_NONE, ""
+	}
+	return auth.anonymous, name
+}
+
+// Handler accessible with minRole or above, which can tell the role by roleOf
+func requireRole(minRole role, handler http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, req *http.Request) {
+		r, name := authenticate(req)
+		if r == ROLE_NONE {
+			logger.Info("unauthenticated request", "remote", req.RemoteAddr, "user", name, "path", req.URL.Path)
+			if len(auth.users) > 0 {
+				w.Header().Set("WWW-Authenticate", `Basic realm="mqttmtd dashboard"`)
+			} else if len(auth.tokens) > 0 {
+				w.Header().Set("WWW-Authenticate", `Bearer realm="mqttmtd dashboard"`)
+			}
+			http.Error(w, "Unauthorized", http.StatusUnauthorized)
+			return
+		}
+		if r < minRole {
+			logger.Info("forbidden request", "remote", req.RemoteAddr, "user", name, "role", r.String(), "path", req.URL.Path)
+			http.Error(w, "Forbidden", http.StatusForbidden)
+			return
+		}
+		handler(w, req.WithContext(context.WithValue(req.Context(), ROLE_CONTEXT_KEY, r)))
+	}
+}
+
+func roleOf(req *http.Request) role {
+	r, _ := req.Context().Value(ROLE_CONTEXT_KEY).(role)
+	return r
+}
@@ -5,6 +5,8 @@ import (
 	"fmt"
 	"html/template"
 	"mqttmtd/config"
+	"mqttmtd/funcs"
+	"mqttmtd/logging"
 	"mqttmtd/types"
 	"net/http"
 	"sort"
@@ -13,6 +15,9 @@ import (
 	"unsafe"
 )
 
+// In place of values hidden from read-only users
+const HIDDEN = "(hidden)"
+
 type TableData struct {
 	Headers []string
 	Rows    [][]string
@@ -45,6 +50,7 @@ const pageTemplate = `
 </head>
 <body>
 	<h1>Authserver Current Status ({{.Timestamp}})</h1>
+	<p><a href="/events">Live Events</a></p>
 	<h2>Access Control List</h2>
 	<table>
 		<tr>
@@ -81,6 +87,8 @@ const pageTemplate = `
 `
 
 var (
+	logger = logging.For("dashboard")
+
 	myAcl *types.AccessControlList
 	myAtl *types.AuthTokenList
 )
@@ -88,10 +96,34 @@ var (
 func Run(acl *types.AccessControlList, atl *types.AuthTokenList) {
 	myAcl = acl
 	myAtl = atl
-	http.HandleFunc("/", httpServerHandler)
-	fmt.Println("Starting dashboard server on port ", config.Server.Ports.Dashboard)
-	if err := http.ListenAndServe(fmt.Sprintf(":%d", config.Server.Ports.Dashboard), nil); err != nil {
-		fmt.Println("Error starting server: ", err)
+	if err := loadAuth(); err != nil {
+		logging.Fatal(logger, "failed to load dashboard credentials", "err", err)
+	}
+	mux := http.NewServeMux()
+	mux.HandleFunc("/", requireRole(ROLE_READONLY, httpServerHandler))
+	mux.HandleFunc("GET /events", requireRole(ROLE_READONLY, eventsPageHandler))
+	registerAPI(mux)
+	server := &http.Server{
+		Addr:    fmt.Sprintf("%s:%d", config.Server.Dashboard.ListenHost, config.Server.Ports.Dashboard),
+		Handler: mux,
+	}
+
+	var err error
+	if config.Server.Dashboard.Tls {
+		if server.TLSConfig, err = loadTLSConfig(); err != nil {
+			logging.Fatal(logger, "failed to load dashboard TLS config", "err", err)
+		}
+		logger.Info("starting dashboard server with TLS", "port", config.Server.Ports.Dashboard, "clientauth", server.TLSConfig.ClientAuth.String())
+		err = server.ListenAndServeTLS("", "")
+	} else {
+		if config.Server.Dashboard.TlsClientAuth != "" && config.Server.Dashboard.TlsClientAuth != funcs.TLS_CLIENT_AUTH_NONE {
+			logging.Fatal(logger, "dashboard tlsclientauth needs tls")
+		}
+		logger.Info("starting dashboard server", "port", config.Server.Ports.Dashboard)
+		err = server.ListenAndServe()
+	}
+	if err != nil {
+		logger.Error("failed starting dashboard server", "err", err)
 	}
 }
 
@@ -104,7 +136,7 @@ func httpServerHandler(w http.ResponseWriter, req *http.Request) {
 	func() {
 		defer myAcl.Unlock()
 
-		aclTbl.Headers = []string{"CLIENT_NAME", "TOPIC", "ACCESS_TYPE"}
+		aclTbl.Headers = []string{"CLIENT_NAME", "TOPIC", "ACCESS_TYPE", "PADDING_PUB", "PADDING_SUB"}
 		aclTbl.Rows = [][]string{}
 		sortedClientNames := make([]string, 0, len(myAcl.Entries))
 		for k := range myAcl.Entries {
@@ -119,17 +151,21 @@ func httpServerHandler(w http.ResponseWriter, req *http.Request) {
 			}
 			sort.Strings(sortedTopics)
 			for _, topic := range sortedTopics {
-				accessType := permittedAccessDict[topic]
+				grant := permittedAccessDict[topic]
 				newRow := []string{
 					clientName,
 					topic,
-					accessType.String(),
+					grant.Access.String(),
+					grant.Padding.Pub.String(),
+					grant.Padding.Sub.String(),
 				}
 				aclTbl.Rows = append(aclTbl.Rows, newRow)
 			}
 		}
 	}()
 
+	// Enough to forge the next token
+	showSecrets := roleOf(req) >= ROLE_ADMIN
 	myAtl.Lock()
 	func() {
 		defer myAtl.Unlock()
@@ -143,10 +179,17 @@ func httpServerHandler(w http.ResponseWriter, req *http.Request) {
 			} else {
 				accessTypeStr = "Sub"
 			}
+			if entry.CoverTraffic {
+				accessTypeStr += " (cover)"
+			}
+			currentRandomData := HIDDEN
+			if showSecrets {
+				currentRandomData = hex.EncodeToString(entry.CurrentValidRandomData[:])
+			}
 			newRow := []string{
 				strconv.FormatInt(int64(i)+1, 10),
 				fmt.Sprintf("%02X-%s", entry.Timestamp[0], hex.EncodeToString(entry.Timestamp[1:])),
-				hex.EncodeToString(entry.CurrentValidRandomData[:]),
+				currentRandomData,
 				strconv.FormatInt(int64(entry.CurrentValidTokenIdx), 10),
 				unsafe.String(unsafe.SliceData(entry.ClientName), len(entry.ClientName)),
 				accessTypeStr,
@@ -0,0 +1,181 @@
+package dashboardserver
+
+import (
+	"encoding/json"
+	"fmt"
+	"html/template"
+	"mqttmtd/authserver/atlevents"
+	"net/http"
+	"strconv"
+	"time"
+)
+
+// Interval of comments sent on idle event streams, so that proxies keep them open
+const SSE_KEEPALIVE_INTERVAL = 15 * time.Second
+
+/*
+Server-Sent Events of ATL, as atlevents.Event in JSON with the kind as the event name and the sequence number as the
+id. Events still in the history after Last-Event-ID, or all of them without it, are sent first, so that browsers
+reconnecting after being dropped for falling behind miss nothing unless the history has moved on.
+*/
+func apiStreamEvents(w http.ResponseWriter, req *http.Request) {
+	flusher, ok := w.(http.Flusher)
+	if !ok {
+		writeError(w, http.StatusInternalServerError, fmt.Errorf("streaming not supported"))
+		return
+	}
+	var lastSeq uint64
+	if lastEventID := req.Header.Get("Last-Event-ID"); lastEventID != "" {
+		var err error
+		if lastSeq, err = strconv.ParseUint(lastEventID, 10, 64); err != nil {
+			writeError(w, http.StatusBadRequest, fmt.Errorf("invalid Last-Event-ID: %s", lastEventID))
+			return
+		}
+	}
+	history, events, cancel := atlevents.Subscribe(lastSeq)
+	defer cancel()
+
+	w.Header().Set("Content-Type", "text/event-stream")
+	w.Header().Set("Cache-Control", "no-cache")
+	w.Header().Set("X-Accel-Buffering", "no")
+	w.WriteHeader(http.StatusOK)
+	for _, e := range history {
+		if err := writeEvent(w, e); err != nil {
+			return
+		}
+	}
+	flusher.Flush()
+
+	keepalive := time.NewTicker(SSE_KEEPALIVE_INTERVAL)
+	defer keepalive.Stop()
+	for {
+		select {
+		case <-req.Context().Done():
+			return
+		case e, ok := <-events:
+			if !ok {
+				logger.Info("dropped a slow event stream", "remote", req.RemoteAddr)
+				return
+			}
+			if err := writeEvent(w, e); err != nil {
+				return
+			}
+		case <-keepalive.C:
+			if _, err := fmt.Fprint(w, ": keepalive\n\n"); err != nil {
+				return
+			}
+		}
+		flusher.Flush()
+	}
+}
+
+func writeEvent(w http.ResponseWriter, e atlevents.Event) (err error) {
+	data, err := json.Marshal(e)
+	if err != nil {
+		return
+	}
+	_, err = fmt.Fprintf(w, "id: %d\nevent: %s\ndata: %s\n\n", e.Seq, e.Kind, data)
+	return
+}
+
+const eventsPageTemplate = `
+<!DOCTYPE html>
+<html>
+<head>
+	<title>Authserver Live Events</title>
+	<style>
+		body {
+			width: 90%;
+			margin: auto;
+		}
+		table {
+			width: 100%;
+			border-collapse: collapse;
+			margin: 20px 0;
+		}
+		th, td {
+			border: 1px solid #ddd;
+			padding: 8px;
+		}
+		th {
+			background-color: #f2f2f2;
+			text-align: left;
+		}
+		tr.revoke, tr.expire { color: #888; }
+		tr.reload-needed { background-color: #fff8e0; }
+		tr.suspicious { background-color: #fde0e0; }
+	</style>
+</head>
+<body>
+	<h1>Authserver Live Events (<span id="status">connecting</span>)</h1>
+	<p><a href="/">Current Status</a></p>
+	<p id="counts"></p>
+	<table>
+		<thead>
+			<tr>
+				<th>SEQ</th>
+				<th>TIME</th>
+				<th>KIND</th>
+				<th>CLIENT_NAME</th>
+				<th>TOPIC</th>
+				<th>ACCESS_TYPE</th>
+				<th>TOKEN_INDEX</th>
+				<th>ID</th>
+				<th>REASON</th>
+				<th>REMOTE</th>
+			</tr>
+		</thead>
+		<tbody id="events"></tbody>
+	</table>
+	<script>
+		const MAX_ROWS = {{.MaxRows}};
+		const kinds = {{.Kinds}};
+		const counts = {};
+		const tbody = document.getElementById("events");
+		const status = document.getElementById("status");
+
+		function renderCounts() {
+			document.getElementById("counts").textContent = kinds.map(k => k + ": " + (counts[k] || 0)).join(", ");
+		}
+
+		function addRow(e) {
+			const access = e.access ? e.access + (e.cover ? " (cover)" : "") : "";
+			const tokenIndex = e.tokencount ? e.tokenindex + " / " + e.tokencount : "";
+			const tr = document.createElement("tr");
+			tr.className = e.kind;
+			for (const v of [e.seq, new Date(e.time).toLocaleTimeString(), e.kind, e.client, e.topic, access, tokenIndex, e.id, e.reason, e.remote]) {
+				const td = document.createElement("td");
+				td.textContent = v === undefined ? "" : v;
+				tr.appendChild(td);
+			}
+			tbody.insertBefore(tr, tbody.firstChild);
+			while (tbody.childElementCount > MAX_ROWS) {
+				tbody.removeChild(tbody.lastChild);
+			}
+			counts[e.kind] = (counts[e.kind] || 0) + 1;
+			renderCounts();
+		}
+
+		const source = new EventSource("{{.EventsPath}}");
+		source.onopen = () => { status.textContent = "live"; };
+		source.onerror = () => { status.textContent = "reconnecting"; };
+		for (const kind of kinds) {
+			source.addEventListener(kind, msg => addRow(JSON.parse(msg.data)));
+		}
+		renderCounts();
+	</script>
+</body>
+</html>
+`
+
+// Page rendering apiStreamEvents live, with basic auth or the anonymous role as EventSource cannot send bearer tokens
+func eventsPageHandler(w http.ResponseWriter, req *http.Request) {
+	tmpl := template.Must(template.New("events").Parse(eventsPageTemplate))
+	if err := tmpl.Execute(w, map[string]any{
+		"MaxRows":    atlevents.HISTORY_LEN,
+		"Kinds":      []string{atlevents.EVENT_ISSUE, atlevents.EVENT_ADVANCE, atlevents.EVENT_RELOAD_NEEDED, atlevents.EVENT_REVOKE, atlevents.EVENT_EXPIRE, atlevents.EVENT_SUSPICIOUS},
+		"EventsPath": API_PREFIX + "/events",
+	}); err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+	}
+}
@@ -0,0 +1,316 @@
+package issuer
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"mime"
+	"mqttmtd/config"
+	"mqttmtd/consts"
+	"mqttmtd/logging"
+	"mqttmtd/types"
+	"net/http"
+	"strings"
+)
+
+var aceLogger = logging.For("ace")
+
+// ACE-OAuth (RFC 9200) style token endpoint. Requests and responses are CBOR maps with the integer abbreviations of
+// RFC 9200, plus private use parameters (< -65536) for what the binary issuer protocol carries.
+const (
+	ACE_TOKEN_PATH       = "/token"
+	ACE_CONTENT_FORMAT   = "application/ace+cbor"
+	ACE_MAX_REQUEST_SIZE = 4096
+
+	aceParamAccessToken = 1
+	aceParamExpiresIn   = 2
+	aceParamScope       = 9
+	aceParamError       = 30
+	aceParamErrorDesc   = 31
+	aceParamGrantType   = 33
+
+	aceGrantTypeClientCredentials = 2
+
+	aceErrorInvalidRequest       = 1
+	aceErrorInvalidClient        = 2
+	aceErrorUnsupportedGrantType = 5
+	aceErrorInvalidScope         = 6
+
+	// Request: number of tokens (multiple of consts.TOKEN_NUM_MULTIPLIER), types.PayloadAEADType, types.TokenFormat, payload key ratchet
+	aceParamNumTokens         = -65537
+	aceParamPayloadAEADType   = -65538
+	aceParamTokenFormat       = -65539
+	aceParamPayloadKeyRatchet = -65540
+	// Response: fields of types.IssuerResponse
+	aceParamTimestamp     = -65541
+	aceParamRandomBytes   = -65542
+	aceParamTokenSeed     = -65543
+	aceParamCWTTokens     = -65544
+	aceParamEncryptionKey = -65545
+	// Request: decoy tokens for cover traffic
+	aceParamCoverTraffic = -65546
+	// Request: payload padding (bool), Response: padding policy of the topic (types.PADDING_POLICY_LEN bytes)
+	aceParamPadding = -65547
+
+	// Scope is "pub:<topic>" or "sub:<topic>"
+	aceScopePubPrefix = "pub:"
+	aceScopeSubPrefix = "sub:"
+)
+
+func RunAce(acl *types.AccessControlList, atl *types.AuthTokenList) {
+	aceLogger.Info("starting ACE token endpoint", "port", config.Server.Ports.Ace)
+	loadCWTKey()
+
+	mux := http.NewServeMux()
+	mux.HandleFunc(ACE_TOKEN_PATH, func(w http.ResponseWriter, r *http.Request) {
+		aceTokenHandler(w, r, acl, atl)
+	})
+	server := &http.Server{
+		Addr:      fmt.Sprintf(":%d", config.Server.Ports.Ace),
+		Handler:   mux,
+		TLSConfig: loadTLSConfig("ACE"),
+	}
+	if err := server.ListenAndServeTLS("", ""); err != nil {
+		logging.Fatal(aceLogger, "failed to start mTLS listener", "err", err)
+	}
+}
+
+func aceTokenHandler(w http.ResponseWriter, r *http.Request, acl *types.AccessControlList, atl *types.AuthTokenList) {
+	remoteAddr := r.RemoteAddr
+	if r.Method != http.MethodPost {
+		w.Header().Set("Allow", http.MethodPost)
+		http.Error(w, "Method Not Allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	if mediaType, _, _ := mime.ParseMediaType(r.Header.Get("Content-Type")); mediaType != ACE_CONTENT_FORMAT && mediaType != "application/cbor" {
+		http.Error(w, "Unsupported Media Type", http.StatusUnsupportedMediaType)
+		return
+	}
+
+	// mTLS client identity
+	if r.TLS == nil {
+		writeAceError(w, http.StatusUnauthorized, aceErrorInvalidClient, "mTLS required")
+		return
+	}
+	clientName := clientNameFromConnectionState(*r.TLS, remoteAddr)
+	if clientName == "" {
+		writeAceError(w, http.StatusUnauthorized, aceErrorInvalidClient, "no MQTT MTD identity in the client certificate")
+		return
+	}
+
+	// Receive Request
+	body, err := io.ReadAll(io.LimitReader(r.Body, ACE_MAX_REQUEST_SIZE))
+	if err != nil {
+		aceLogger.Warn("failed reading a request", "remote", remoteAddr, "err", err)
+		return
+	}
+	issuerRequest, aceErrorCode, err := parseAceTokenRequest(body)
+	if err != nil {
+		aceLogger.Warn("invalid token request", "remote", remoteAddr, "err", err)
+		writeAceError(w, http.StatusBadRequest, aceErrorCode, err.Error())
+		return
+	}
+
+	// Generate Tokens & Send Response
+	sent := false
+	err = issueTokens(acl, atl, clientName, issuerRequest, remoteAddr, func(issuerResponse types.IssuerResponse) error {
+		sent = true
+		return writeAceTokenResponse(w, issuerRequest, issuerResponse)
+	})
+	switch {
+	case sent:
+	case errors.Is(err, errIssuerAccessDenied):
+		writeAceError(w, http.StatusBadRequest, aceErrorInvalidScope, "scope not permitted")
+	case errors.Is(err, errIssuerRequestInvalid):
+		writeAceError(w, http.StatusBadRequest, aceErrorInvalidRequest, "request not acceptable")
+	default:
+		http.Error(w, "Internal Server Error", http.StatusInternalServerError)
+	}
+}
+
+// Convert an ACE token request to an IssuerRequest. aceErrorCode is set when err != nil.
+func parseAceTokenRequest(body []byte) (request types.IssuerRequest, aceErrorCode int64, err error) {
+	aceErrorCode = aceErrorInvalidRequest
+	decoded, rest, err := types.CBORDecode(body)
+	if err != nil {
+		return
+	}
+	params, ok := decoded.(map[any]any)
+	if !ok || len(rest) != 0 {
+		err = fmt.Errorf("request is not a single CBOR map")
+		return
+	}
+
+	// Grant Type
+	if v, found := types.CBORMapGet(params, aceParamGrantType); found {
+		if grantType, ok := v.(uint64); !ok || grantType != aceGrantTypeClientCredentials {
+			aceErrorCode = aceErrorUnsupportedGrantType
+			err = fmt.Errorf("only client_credentials grant is supported")
+			return
+		}
+	}
+
+	// Scope
+	var scope string
+	switch v, _ := types.CBORMapGet(params, aceParamScope); v := v.(type) {
+	case string:
+		scope = v
+	case []byte:
+		scope = string(v)
+	}
+	switch {
+	case strings.HasPrefix(scope, aceScopePubPrefix):
+		request.AccessTypeIsPub = true
+		request.Topic = []byte(scope[len(aceScopePubPrefix):])
+	case strings.HasPrefix(scope, aceScopeSubPrefix):
+		request.Topic = []byte(scope[len(aceScopeSubPrefix):])
+	default:
+		aceErrorCode = aceErrorInvalidScope
+		err = fmt.Errorf("scope must be %s<topic> or %s<topic>", aceScopePubPrefix, aceScopeSubPrefix)
+		return
+	}
+	if len(request.Topic) == 0 || len(request.Topic) > consts.MAX_UTF8_ENCODED_STRING_SIZE {
+		aceErrorCode = aceErrorInvalidScope
+		err = fmt.Errorf("invalid topic length")
+		return
+	}
+
+	// Number of Tokens
+	numTokens, ok := cborMapGetUint(params, aceParamNumTokens)
+	if !ok || numTokens%consts.TOKEN_NUM_MULTIPLIER != 0 || numTokens < consts.TOKEN_NUM_MULTIPLIER || numTokens > 0x1F*consts.TOKEN_NUM_MULTIPLIER {
+		err = fmt.Errorf("number of tokens must be a multiple of %d in [%d, 0x1F*%d]", consts.TOKEN_NUM_MULTIPLIER, consts.TOKEN_NUM_MULTIPLIER, consts.TOKEN_NUM_MULTIPLIER)
+		return
+	}
+	request.NumberOfTokensDividedByMultiplier = byte(numTokens / consts.TOKEN_NUM_MULTIPLIER)
+
+	// Payload AEAD Type
+	if aeadType, found := cborMapGetUint(params, aceParamPayloadAEADType); found && aeadType != uint64(types.PAYLOAD_AEAD_NONE) {
+		if aeadType > 0xFF {
+			err = fmt.Errorf("invalid payload AEAD type")
+			return
+		}
+		request.PayloadAEADRequested = true
+		request.PayloadAEADType = types.PayloadAEADType(aeadType)
+	}
+
+	// Options
+	if tokenFormat, found := cborMapGetUint(params, aceParamTokenFormat); found {
+		if tokenFormat > 0xFF || !types.TokenFormat(tokenFormat).IsValid() {
+			err = fmt.Errorf("invalid token format")
+			return
+		}
+		request.Options = request.Options.WithTokenFormat(types.TokenFormat(tokenFormat))
+	}
+	if v, found := types.CBORMapGet(params, aceParamPayloadKeyRatchet); found {
+		if ratchet, ok := v.(bool); !ok {
+			err = fmt.Errorf("invalid payload key ratchet parameter")
+			return
+		} else if ratchet {
+			request.Options |= types.OptionPayloadKeyRatchet
+		}
+	}
+	if v, found := types.CBORMapGet(params, aceParamCoverTraffic); found {
+		if coverTraffic, ok := v.(bool); !ok {
+			err = fmt.Errorf("invalid cover traffic parameter")
+			return
+		} else if coverTraffic {
+			request.Options |= types.OptionCoverTraffic
+		}
+	}
+	if v, found := types.CBORMapGet(params, aceParamPadding); found {
+		if padding, ok := v.(bool); !ok {
+			err = fmt.Errorf("invalid padding parameter")
+			return
+		} else if padding {
+			request.Options |= types.OptionPadding
+		}
+	}
+	return
+}
+
+func cborMapGetUint(params map[any]any, key int64) (value uint64, found bool) {
+	v, found := types.CBORMapGet(params, key)
+	if !found {
+		return
+	}
+	value, found = v.(uint64)
+	return
+}
+
+func writeAceTokenResponse(w http.ResponseWriter, request types.IssuerRequest, issuerResponse types.IssuerResponse) (err error) {
+	var (
+		accessToken []byte
+		numParams   int = 3
+	)
+
+	// access_token is the first token of the batch
+	switch tokenFormat := request.Options.TokenFormat(); {
+	case tokenFormat.IsSeedBased():
+		var randomBytes []byte
+		if randomBytes, err = tokenFormat.DeriveRandomBytes(issuerResponse.TokenSeed, uint16(request.NumberOfTokensDividedByMultiplier)*consts.TOKEN_NUM_MULTIPLIER, 0); err != nil {
+			return
+		}
+		accessToken = append(append(accessToken, issuerResponse.Timestamp...), randomBytes...)
+	case tokenFormat == types.TokenFormatCWT:
+		accessToken = issuerResponse.CWTTokens[0]
+	default:
+		accessToken = append(append(accessToken, issuerResponse.Timestamp...), issuerResponse.AllRandomBytes[:consts.RANDOM_BYTES_LEN]...)
+	}
+
+	if len(issuerResponse.EncryptionKey) > 0 {
+		numParams++
+	}
+	if request.Options&types.OptionPadding != 0 {
+		numParams++
+	}
+	if len(issuerResponse.AllRandomBytes) > 0 || len(issuerResponse.TokenSeed) > 0 || len(issuerResponse.CWTTokens) > 0 {
+		numParams++
+	}
+
+	body := types.CBORAppendMapHead(nil, numParams)
+	body = types.CBORAppendInt(body, aceParamAccessToken)
+	body = types.CBORAppendBytes(body, accessToken)
+	body = types.CBORAppendInt(body, aceParamExpiresIn)
+	body = types.CBORAppendInt(body, int64(consts.TOKEN_EXPIRATION_DURATION.Seconds()))
+	body = types.CBORAppendInt(body, aceParamTimestamp)
+	body = types.CBORAppendBytes(body, issuerResponse.Timestamp)
+	if len(issuerResponse.EncryptionKey) > 0 {
+		body = types.CBORAppendInt(body, aceParamEncryptionKey)
+		body = types.CBORAppendBytes(body, issuerResponse.EncryptionKey)
+	}
+	if request.Options&types.OptionPadding != 0 {
+		body = types.CBORAppendInt(body, aceParamPadding)
+		body = types.CBORAppendBytes(body, issuerResponse.Padding.AppendBytes(nil))
+	}
+	switch {
+	case len(issuerResponse.AllRandomBytes) > 0:
+		body = types.CBORAppendInt(body, aceParamRandomBytes)
+		body = types.CBORAppendBytes(body, issuerResponse.AllRandomBytes)
+	case len(issuerResponse.TokenSeed) > 0:
+		body = types.CBORAppendInt(body, aceParamTokenSeed)
+		body = types.CBORAppendBytes(body, issuerResponse.TokenSeed)
+	case len(issuerResponse.CWTTokens) > 0:
+		body = types.CBORAppendInt(body, aceParamCWTTokens)
+		body = types.CBORAppendArrayHead(body, len(issuerResponse.CWTTokens))
+		for _, cwtToken := range issuerResponse.CWTTokens {
+			body = types.CBORAppendBytes(body, cwtToken)
+		}
+	}
+
+	w.Header().Set("Content-Type", ACE_CONTENT_FORMAT)
+	w.WriteHeader(http.StatusCreated)
+	_, err = w.Write(body)
+	return
+}
+
+func writeAceError(w http.ResponseWriter, status int, aceErrorCode int64, description string) {
+	body := types.CBORAppendMapHead(nil, 2)
+	body = types.CBORAppendInt(body, aceParamError)
+	body = types.CBORAppendInt(body, aceErrorCode)
+	body = types.CBORAppendInt(body, aceParamErrorDesc)
+	body = types.CBORAppendText(body, description)
+
+	w.Header().Set("Content-Type", ACE_CONTENT_FORMAT)
+	w.WriteHeader(status)
+	w.Write(body)
+}
@@ -0,0 +1,81 @@
+package issuer
+
+import (
+	"crypto/rand"
+	"mqttmtd/consts"
+	"mqttmtd/types"
+	"time"
+	"unsafe"
+)
+
+// CWT tokens are verified by MQTT Interface on its own, so nothing is added to ATL
+func generateAndSendCWTIssuerResponse(clientName string, request types.IssuerRequest, padding types.PaddingPolicy, remoteAddr string, send func(types.IssuerResponse) error) (err error) {
+	var (
+		now        time.Time = time.Now()
+		nowNano    int64     = now.UnixNano()
+		encKey     []byte
+		n          int
+		timestamp  [1 + consts.TIMESTAMP_LEN]byte
+		batchID    []byte
+		tokenCount uint16 = uint16(request.NumberOfTokensDividedByMultiplier) * consts.TOKEN_NUM_MULTIPLIER
+		cwtTokens  [][]byte
+	)
+
+	// Timestamp
+	for i := consts.TIMESTAMP_LEN; i >= 0; i-- {
+		nowNano >>= 8
+		timestamp[i] = byte(nowNano & 0xFF)
+	}
+
+	// Batch ID (cti): timestamp + random bytes
+	batchID = make([]byte, types.CWT_BATCH_ID_LEN)
+	copy(batchID, timestamp[1:])
+	n, err = rand.Read(batchID[consts.TIMESTAMP_LEN:])
+	if err != nil {
+		logger.Error("failed generating batch id", "remote", remoteAddr, "err", err)
+		return
+	}
+	if n != types.CWT_BATCH_ID_LEN-consts.TIMESTAMP_LEN {
+		logger.Error("failed generating batch id: length is inadequate", "remote", remoteAddr)
+		return
+	}
+
+	if request.PayloadAEADRequested {
+		// Encryption Key, derived so that MQTT Interface can recompute it from the batch id
+		if encKey, err = request.PayloadAEADType.DeriveCWTPayloadKey(cwtKey, batchID); err != nil {
+			logger.Error("failed deriving encryption key", "remote", remoteAddr, "err", err)
+			return
+		}
+	}
+
+	// CWT Tokens
+	claims := types.CWTClaims{
+		ClientName:      unsafe.Slice(unsafe.StringData(clientName), len(clientName)),
+		Topic:           request.Topic,
+		BatchID:         batchID,
+		ExpiresAt:       now.Add(consts.TOKEN_EXPIRATION_DURATION),
+		AccessTypeIsPub: request.AccessTypeIsPub,
+	}
+	if request.PayloadAEADRequested {
+		claims.PayloadAEADType = request.PayloadAEADType
+		claims.Padding = padding
+	}
+	cwtTokens = make([][]byte, tokenCount)
+	for i := range cwtTokens {
+		claims.TokenIndex = uint16(i)
+		cwtTokens[i] = claims.Seal(cwtKey)
+	}
+
+	// Send Response
+	issuerResponse := types.IssuerResponse{
+		EncryptionKey: encKey,
+		Timestamp:     timestamp[1:],
+		Padding:       padding,
+		CWTTokens:     cwtTokens,
+	}
+	if err = send(issuerResponse); err != nil {
+		logger.Warn("failed sending out an issuer response", "remote", remoteAddr, "err", err)
+		return
+	}
+	return
+}
@@ -4,123 +4,309 @@ import (
 	"context"
 	"crypto/tls"
 	"crypto/x509"
+	"errors"
 	"fmt"
-	"log"
+	"mqttmtd/authserver/atlevents"
 	"mqttmtd/config"
+	"mqttmtd/consts"
 	"mqttmtd/funcs"
+	"mqttmtd/logging"
+	"mqttmtd/metrics"
 	"mqttmtd/types"
 	"os"
 	"strings"
+	"sync"
 	"unsafe"
 )
 
+var (
+	logger = logging.For("issuer")
+
+	cwtKey     []byte
+	cwtKeyOnce sync.Once
+
+	errIssuerRequestInvalid = errors.New("invalid issuer request")
+	errIssuerAccessDenied   = errors.New("access denied by ACL")
+
+	issuancesMetric = metrics.NewCounterVec("mqttmtd_issuances_total", "Issuer requests by client, topic, access and result",
+		metrics.LABEL_CLIENT, metrics.LABEL_TOPIC, metrics.LABEL_ACCESS, metrics.LABEL_RESULT)
+	tokensIssuedMetric = metrics.NewCounterVec("mqttmtd_tokens_issued_total", "Tokens issued by client, topic and access",
+		metrics.LABEL_CLIENT, metrics.LABEL_TOPIC, metrics.LABEL_ACCESS)
+)
+
 func Run(acl *types.AccessControlList, atl *types.AuthTokenList) {
-	fmt.Printf("Starting issuer server on port %d\n", config.Server.Ports.Issuer)
+	logger.Info("starting issuer server", "port", config.Server.Ports.Issuer)
+	loadCWTKey()
+	tlsConf := loadTLSConfig("Issuer")
+
+	listener, err := tls.Listen("tcp", fmt.Sprintf(":%d", config.Server.Ports.Issuer), tlsConf)
+	if err != nil {
+		logging.Fatal(logger, "failed to start mTLS listener", "err", err)
+	}
+	defer listener.Close()
+
+	for {
+		conn, err := listener.Accept()
+		if err != nil {
+			logger.Warn("failed to accept mTLS connection", "err", err)
+			continue
+		}
+		logger.Debug("accepted mTLS connection", "remote", conn.RemoteAddr().String())
+		go tokenIssuerHandler(conn.(*tls.Conn), acl, atl)
+	}
+}
+
+func loadCWTKey() {
+	cwtKeyOnce.Do(func() {
+		if config.Server.FilePaths.CwtKeyFilePath == "" {
+			return
+		}
+		var err error
+		if cwtKey, err = types.LoadCWTKey(config.Server.FilePaths.CwtKeyFilePath); err != nil {
+			logging.Fatal(logger, "failed to load cwt key", "err", err)
+		}
+	})
+}
+
+// mTLS configuration shared by the issuer and the ACE endpoint
+func loadTLSConfig(serverName string) *tls.Config {
 	cert, err := tls.LoadX509KeyPair(config.Server.Certs.ServerCertFilePath, config.Server.Certs.ServerKeyFilePath)
 	if err != nil {
-		log.Fatalf("Issuer - Failed to load server certificate: %v", err)
+		logging.Fatal(logger, "failed to load server certificate", "server", serverName, "err", err)
 	}
 
 	caCert, err := os.ReadFile(config.Server.Certs.CaCertFilePath)
 	if err != nil {
-		log.Fatalf("Issuer - Failed to load ca certificate: %v", err)
+		logging.Fatal(logger, "failed to load ca certificate", "server", serverName, "err", err)
 	}
 	caCertPool := x509.NewCertPool()
 	caCertPool.AppendCertsFromPEM(caCert)
 
-	tlsConf := &tls.Config{
+	return &tls.Config{
 		Certificates: []tls.Certificate{cert},
 		ClientAuth:   tls.RequireAndVerifyClientCert,
 		MinVersion:   tls.VersionTLS13,
 		ClientCAs:    caCertPool,
 	}
-
-	listener, err := tls.Listen("tcp", fmt.Sprintf(":%d", config.Server.Ports.Issuer), tlsConf)
-	if err != nil {
-		log.Fatalf("Issuer - Failed to start mTLS listener: %v", err)
-	}
-	defer listener.Close()
-
-	for {
-		conn, err := listener.Accept()
-		if err != nil {
-			fmt.Printf("Issuer - Failed to accept mTLS connection: %v\n", err)
-			continue
-		}
-		fmt.Printf("Issuer - Accepted mTLS connection from %s\n", conn.RemoteAddr().String())
-		go tokenIssuerHandler(conn.(*tls.Conn), acl, atl)
-	}
 }
 
 func tokenIssuerHandler(conn *tls.Conn, acl *types.AccessControlList, atl *types.AuthTokenList) {
 	defer func() {
 		addr := conn.RemoteAddr().String()
 		conn.Close()
-		fmt.Printf("Issuer - Closed mTLS connection with %s\n", addr)
+		logger.Debug("closed mTLS connection", "remote", addr)
 	}()
 	remoteAddr := conn.RemoteAddr().String()
 	if err := conn.Handshake(); err != nil {
-		fmt.Printf("issuer(%s): TLS Handshake failed: %v\n", remoteAddr, err)
+		logger.Warn("TLS handshake failed", "remote", remoteAddr, "err", err)
 		return
 	}
 
 	// mTLS connection validation and client identity extraction
-	state := conn.ConnectionState()
+	clientName := clientNameFromConnectionState(conn.ConnectionState(), remoteAddr)
+	if clientName == "" {
+		return
+	}
+
+	// Receive Request
+	reader := funcs.NewConnReader(context.TODO(), conn)
+	defer reader.Release()
+	issuerRequest, err := funcs.ParseIssuerRequest(reader, config.Server.SocketTimeout.External)
+	if err != nil {
+		logger.Warn("failed reading a request", "remote", remoteAddr, "err", err)
+		return
+	}
+
+	// Generate Tokens & Send Response
+	issueTokens(acl, atl, clientName, issuerRequest, remoteAddr, func(issuerResponse types.IssuerResponse) error {
+		return funcs.SendIssuerResponse(context.TODO(), conn, config.Server.SocketTimeout.External, issuerRequest, issuerResponse)
+	})
+}
+
+// Extract the MQTT MTD identity of a client from its certificate. Returns "" if not found.
+func clientNameFromConnectionState(state tls.ConnectionState, remoteAddr string) (clientName string) {
 	if len(state.PeerCertificates) == 0 {
-		fmt.Printf("issuer(%s): No certificate found %v\n", remoteAddr, state)
+		logger.Warn("no certificate found", "remote", remoteAddr)
 		return
 	}
 	clientCert := state.PeerCertificates[0]
-	clientName := ""
 	for _, email := range clientCert.EmailAddresses {
 		if strings.HasSuffix(email, "@mqtt.mtd") {
 			clientName = email[:len(email)-len("@mqtt.mtd")]
 		}
 	}
 	if clientName == "" {
-		fmt.Printf("issuer(%s): No MQTT MTD identity found!\n", remoteAddr)
-		return
+		logger.Warn("no MQTT MTD identity found", "remote", remoteAddr)
 	}
+	return
+}
 
-	var (
-		err                 error
-		issuerRequest       types.IssuerRequest
-		requestedAccessType types.ACLAccessType
-	)
-	// Receive Request
-	issuerRequest, err = funcs.ParseIssuerRequest(context.TODO(), conn, config.Server.SocketTimeout.External)
-	if err != nil {
-		fmt.Printf("issuer(%s): Failed reading a request: %v\n", remoteAddr, err)
+/*
+Validate the request, check it against ACL, generate tokens and register them to ATL, then hand the response to send.
+Tokens are revoked if send fails. Shared by the binary issuer protocol and the ACE endpoint, so that both issue equivalent tokens.
+*/
+func issueTokens(acl *types.AccessControlList, atl *types.AuthTokenList, clientName string, issuerRequest types.IssuerRequest, remoteAddr string, send func(types.IssuerResponse) error) (err error) {
+	defer func() { countIssuance(clientName, issuerRequest, err) }()
+	if issuerRequest.NumberOfTokensDividedByMultiplier < 1 || issuerRequest.NumberOfTokensDividedByMultiplier > 0x1F {
+		logger.Warn("number of tokens out of range", "remote", remoteAddr, "multiplier", issuerRequest.NumberOfTokensDividedByMultiplier)
+		err = errIssuerRequestInvalid
+		return
+	}
+	if issuerRequest.PayloadAEADRequested && !issuerRequest.PayloadAEADType.IsEncryptionEnabled() {
+		logger.Warn("unknown payload AEAD type requested", "remote", remoteAddr, "aead", issuerRequest.PayloadAEADType)
+		err = errIssuerRequestInvalid
+		return
+	}
+	if issuerRequest.Options&types.OptionPayloadKeyRatchet != 0 && !(issuerRequest.PayloadAEADRequested && issuerRequest.PayloadAEADType.IsEncryptionEnabled()) {
+		logger.Warn("payload key ratchet requested without payload AEAD", "remote", remoteAddr)
+		err = errIssuerRequestInvalid
+		return
+	}
+	if issuerRequest.Options&types.OptionPadding != 0 && !(issuerRequest.PayloadAEADRequested && issuerRequest.PayloadAEADType.IsEncryptionEnabled()) {
+		logger.Warn("padding requested without payload AEAD", "remote", remoteAddr)
+		err = errIssuerRequestInvalid
+		return
+	}
+	if !issuerRequest.Options.TokenFormat().IsValid() {
+		logger.Warn("unknown token format requested", "remote", remoteAddr, "format", issuerRequest.Options.TokenFormat())
+		err = errIssuerRequestInvalid
 		return
 	}
+	if issuerRequest.Options.TokenFormat() == types.TokenFormatCWT {
+		if cwtKey == nil {
+			logger.Warn("CWT tokens requested but no cwt key is configured", "remote", remoteAddr)
+			err = errIssuerRequestInvalid
+			return
+		}
+		if issuerRequest.Options&types.OptionPayloadKeyRatchet != 0 {
+			logger.Warn("payload key ratchet is not available for CWT tokens", "remote", remoteAddr)
+			err = errIssuerRequestInvalid
+			return
+		}
+		if issuerRequest.Options&types.OptionCoverTraffic != 0 {
+			// CWT tokens are verified by MQTT Interface without ATL, which has no record of cover traffic
+			logger.Warn("cover traffic is not available for CWT tokens", "remote", remoteAddr)
+			err = errIssuerRequestInvalid
+			return
+		}
+	}
 
 	// ACL Lookup
+	padding, permitted := isPermittedByACL(acl, clientName, issuerRequest, remoteAddr)
+	if !permitted {
+		err = errIssuerAccessDenied
+		return
+	}
+	if issuerRequest.Options&types.OptionPadding == 0 {
+		// The client would not pad nor unpad
+		padding = types.PaddingPolicy{}
+	}
+
+	// Generate Tokens & Send Response
+	if issuerRequest.Options.TokenFormat().IsSeedBased() {
+		err = generateAndSendSeedIssuerResponse(atl, clientName, issuerRequest, padding, remoteAddr, send)
+	} else if issuerRequest.Options.TokenFormat() == types.TokenFormatCWT {
+		err = generateAndSendCWTIssuerResponse(clientName, issuerRequest, padding, remoteAddr, send)
+	} else {
+		err = generateAndSendIssuerResponse(atl, clientName, issuerRequest, padding, remoteAddr, send)
+	}
+	return
+}
+
+// Check the request against ACL. padding is the policy of the topic for the requested access type.
+func isPermittedByACL(acl *types.AccessControlList, clientName string, issuerRequest types.IssuerRequest, remoteAddr string) (padding types.PaddingPolicy, permitted bool) {
 	acl.Lock()
 	clientACLEntry, found := acl.Entries[clientName]
 	if !found {
-		fmt.Printf("issuer(%s): ClientName %s not found in ACL\n", remoteAddr, clientName)
+		logger.Warn("client not found in ACL", "remote", remoteAddr, "client", clientName)
 		acl.Unlock()
 		return
 	}
 	topicStr := unsafe.String(unsafe.SliceData(issuerRequest.Topic), len(issuerRequest.Topic))
-	grantedAccessType, found := clientACLEntry[topicStr]
+	if types.IsWildcardTopicFilter(topicStr) {
+		// Wildcards are for Sub tokens only
+		if err := types.ValidateTopicFilter(topicStr); err != nil || issuerRequest.AccessTypeIsPub {
+			logger.Warn("topic is not a valid filter for the access type", "remote", remoteAddr, "client", clientName, "topic", topicStr, "access", accessTypeOfRequest(issuerRequest).String())
+			acl.Unlock()
+			return
+		}
+	}
+	grant, found := clientACLEntry[topicStr]
+	if !found {
+		grant, found = lookupWildcardACLEntries(clientACLEntry, topicStr)
+	}
 	if !found {
-		fmt.Printf("issuer(%s): Topic %s for ClientName %s not found in ACL\n", remoteAddr, topicStr, clientName)
+		logger.Warn("topic not found in ACL", "remote", remoteAddr, "client", clientName, "topic", topicStr)
 		acl.Unlock()
 		return
 	}
 	acl.Unlock()
 
+	requestedAccessType := accessTypeOfRequest(issuerRequest)
+	if grant.Access&requestedAccessType == 0 {
+		logger.Warn("topic not permitted for the access type", "remote", remoteAddr, "client", clientName, "topic", topicStr, "access", requestedAccessType.String(), "granted", grant.Access.String())
+		return
+	}
+	padding = grant.Padding.ForAccessType(issuerRequest.AccessTypeIsPub)
+	permitted = true
+	return
+}
+
+func countIssuance(clientName string, issuerRequest types.IssuerRequest, err error) {
+	topic, access := string(issuerRequest.Topic), metrics.AccessLabel(issuerRequest.AccessTypeIsPub)
+	result := metrics.RESULT_OK
+	switch {
+	case err == nil:
+		tokensIssuedMetric.Add(float64(int(issuerRequest.NumberOfTokensDividedByMultiplier)*consts.TOKEN_NUM_MULTIPLIER), clientName, topic, access)
+	case errors.Is(err, errIssuerRequestInvalid):
+		result = metrics.RESULT_INVALID
+	case errors.Is(err, errIssuerAccessDenied):
+		result = metrics.RESULT_DENIED
+	default:
+		result = metrics.RESULT_ERROR
+	}
+	issuancesMetric.Inc(clientName, topic, access, result)
+}
+
+func accessTypeOfRequest(issuerRequest types.IssuerRequest) types.ACLAccessType {
 	if issuerRequest.AccessTypeIsPub {
-		requestedAccessType = types.AccessPub
-	} else {
-		requestedAccessType = types.AccessSub
+		return types.AccessPub
 	}
-	if grantedAccessType&requestedAccessType == 0 {
-		fmt.Printf("issuer(%s): Topic %s for ClientName %s not permitted for accessType %s: granted=%s\n", remoteAddr, topicStr, clientName, requestedAccessType.String(), grantedAccessType.String())
-		return
+	return types.AccessSub
+}
+
+/*
+Access types granted by ACL entries with wildcards that cover the requested topic name or filter. A wildcard entry
+grants Pub on the topic names it matches and Sub on the same or narrower filters. The stronger padding policy is
+taken when several entries cover the topic.
+*/
+func lookupWildcardACLEntries(clientACLEntry map[string]types.ACLGrant, topicStr string) (grant types.ACLGrant, found bool) {
+	for filter, entryGrant := range clientACLEntry {
+		if types.IsWildcardTopicFilter(filter) && types.TopicFilterCovers(filter, topicStr) {
+			grant.Access |= entryGrant.Access
+			grant.Padding.Pub = grant.Padding.Pub.Stronger(entryGrant.Padding.Pub)
+			grant.Padding.Sub = grant.Padding.Sub.Stronger(entryGrant.Padding.Sub)
+			found = true
+		}
 	}
+	return
+}
 
-	// Generate Tokens & Send Response
-	generateAndSendIssuerResponse(atl, conn, clientName, issuerRequest, remoteAddr)
+// Append entry to ATL in place of the one of the same client, topic and access type if any, with ATL locked
+func replaceEntry(atl *types.AuthTokenList, entry *types.ATLEntry, remoteAddr string) {
+	if revoked, _ := atl.RevokeEntry(entry.ClientName, entry.Topic, entry.AccessTypeIsPub, entry.CoverTraffic); revoked != nil {
+		atlevents.Publish(atlevents.EVENT_REVOKE, revoked, atlevents.REASON_REISSUED, remoteAddr)
+	}
+	atl.AppendEntry(entry)
+	atlevents.Publish(atlevents.EVENT_ISSUE, entry, "", remoteAddr)
+}
+
+// Revoke tokens that were registered to ATL but couldn't be delivered
+func revokeUndelivered(atl *types.AuthTokenList, clientName string, request types.IssuerRequest) {
+	atl.Lock()
+	revoked, _ := atl.RevokeEntry(unsafe.Slice(unsafe.StringData(clientName), len(clientName)), request.Topic, request.AccessTypeIsPub, request.Options&types.OptionCoverTraffic != 0)
+	atl.Unlock()
+	if revoked != nil {
+		atlevents.Publish(atlevents.EVENT_REVOKE, revoked, atlevents.REASON_UNDELIVERED, "")
+	}
 }
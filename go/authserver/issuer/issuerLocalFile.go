@@ -3,21 +3,17 @@
 package issuer
 
 import (
-	"context"
 	"crypto/rand"
 	"encoding/base64"
-	"fmt"
 	"mqttmtd/config"
 	"mqttmtd/consts"
-	"mqttmtd/funcs"
 	"mqttmtd/types"
-	"net"
 	"os"
 	"time"
 	"unsafe"
 )
 
-func generateAndSendIssuerResponse(atl *types.AuthTokenList, conn net.Conn, clientName string, request types.IssuerRequest, remoteAddr string) (err error) {
+func generateAndSendIssuerResponse(atl *types.AuthTokenList, clientName string, request types.IssuerRequest, padding types.PaddingPolicy, remoteAddr string, send func(types.IssuerResponse) error) (err error) {
 	var (
 		now                     int64 = time.Now().UnixNano()
 		encKey                  []byte
@@ -38,21 +34,21 @@ func generateAndSendIssuerResponse(atl *types.AuthTokenList, conn net.Conn, clie
 
 	// File creation
 	if err = os.MkdirAll(config.Server.FilePaths.TokensDirPath, 0666); err != nil {
-		fmt.Printf("issuer(%s): Failed mkdir -p to save tokens: %v\n", remoteAddr, err)
+		logger.Error("failed creating the tokens directory", "remote", remoteAddr, "err", err)
 		return
 	}
 	randomBytesFilePath = config.Server.FilePaths.TokensDirPath + base64.URLEncoding.EncodeToString(timestamp[:])
 	randomBytesFile, err = os.Create(randomBytesFilePath)
 	if err != nil {
-		fmt.Printf("issuer(%s): Failed opening file to save random bytes: %v\n", remoteAddr, err)
+		logger.Error("failed opening a file to save random bytes", "remote", remoteAddr, "err", err)
 		return
 	}
 	defer func() {
 		randomBytesFile.Close()
 		if !completed {
-			fmt.Printf("issuer(%s): Ended token generation incomplete : %v\n", remoteAddr, err)
+			logger.Warn("token generation ended incomplete", "remote", remoteAddr, "err", err)
 			if err = os.Remove(randomBytesFilePath); err != nil {
-				fmt.Printf("issuer(%s): Failed removing file %s to recover from tokenFile creation failure: %v\n", remoteAddr, randomBytesFilePath, err)
+				logger.Error("failed removing an incomplete random bytes file", "remote", remoteAddr, "path", randomBytesFilePath, "err", err)
 				return
 			}
 		}
@@ -63,11 +59,11 @@ func generateAndSendIssuerResponse(atl *types.AuthTokenList, conn net.Conn, clie
 		encKey = make([]byte, request.PayloadAEADType.GetKeyLen())
 		n, err = rand.Read(encKey)
 		if err != nil {
-			fmt.Printf("issuer(%s): Error generating encryption key: %v\n", remoteAddr, err)
+			logger.Error("failed generating encryption key", "remote", remoteAddr, "err", err)
 			return
 		}
 		if n != request.PayloadAEADType.GetKeyLen() {
-			fmt.Printf("issuer(%s): Failed generating encryption key: length is inadequate\n", remoteAddr)
+			logger.Error("failed generating encryption key: length is inadequate", "remote", remoteAddr)
 			return
 		}
 	}
@@ -76,48 +72,52 @@ func generateAndSendIssuerResponse(atl *types.AuthTokenList, conn net.Conn, clie
 	allRandomBytes = make([]byte, consts.RANDOM_BYTES_LEN*int(request.NumberOfTokensDividedByMultiplier)*consts.TOKEN_NUM_MULTIPLIER)
 	n, err = rand.Read(allRandomBytes)
 	if err != nil {
-		fmt.Printf("issuer(%s): Error generating random bytes: %v\n", remoteAddr, err)
+		logger.Error("failed generating random bytes", "remote", remoteAddr, "err", err)
 		return
 	}
 	if n != consts.RANDOM_BYTES_LEN*int(request.NumberOfTokensDividedByMultiplier)*consts.TOKEN_NUM_MULTIPLIER {
-		fmt.Printf("issuer(%s): Failed generating random bytes: length is inadequate\n", remoteAddr)
+		logger.Error("failed generating random bytes: length is inadequate", "remote", remoteAddr)
 		return
 	}
 	if _, err = randomBytesFile.Write(allRandomBytes); err != nil {
-		fmt.Printf("issuer(%s): Error writing random bytes to a file: %v\n", remoteAddr, err)
+		logger.Error("failed writing random bytes to a file", "remote", remoteAddr, "err", err)
 		return
 	}
 	currentValidRandomBytes = make([]byte, consts.RANDOM_BYTES_LEN)
 	copy(currentValidRandomBytes, allRandomBytes[:consts.RANDOM_BYTES_LEN])
 
-	// Send Response
-	issuerResponse := types.IssuerResponse{
-		EncryptionKey:  encKey,
-		Timestamp:      timestamp[1:],
-		AllRandomBytes: allRandomBytes,
-	}
-	if err = funcs.SendIssuerResponse(context.TODO(), conn, config.Server.SocketTimeout.External, issuerResponse); err != nil {
-		fmt.Printf("issuer(%s): Error sending out an issue response: %v\n", remoteAddr, err)
-		return
-	}
-
-	// ATL update
+	// ATL update, before sending so that tokens are valid as soon as the client receives them
 	atl.Lock()
-	atl.RevokeEntry(unsafe.Slice(unsafe.StringData(clientName), len(clientName)), request.Topic, request.AccessTypeIsPub)
-	atl.AppendEntry(&types.ATLEntry{
+	replaceEntry(atl, &types.ATLEntry{
 		Topic:                  request.Topic,
 		ClientName:             unsafe.Slice(unsafe.StringData(clientName), len(clientName)),
 		AccessTypeIsPub:        request.AccessTypeIsPub,
 		Timestamp:              timestamp,
 		AllRandomData:          []byte(randomBytesFilePath),
-		TokenCount:             uint16(request.NumberOfTokensDividedByMultiplier)*1 + consts.TOKEN_NUM_MULTIPLIER,
+		TokenCount:             uint16(request.NumberOfTokensDividedByMultiplier) * consts.TOKEN_NUM_MULTIPLIER,
 		CurrentValidRandomData: currentValidRandomBytes,
 		CurrentValidTokenIdx:   0,
 		PayloadAEADType:        request.PayloadAEADType,
 		PayloadEncKey:          encKey,
-	})
+		PayloadKeyRatchet:      request.Options&types.OptionPayloadKeyRatchet != 0,
+		CoverTraffic:           request.Options&types.OptionCoverTraffic != 0,
+		Padding:                padding,
+	}, remoteAddr)
 	atl.Unlock()
 
+	// Send Response
+	issuerResponse := types.IssuerResponse{
+		EncryptionKey:  encKey,
+		Timestamp:      timestamp[1:],
+		Padding:        padding,
+		AllRandomBytes: allRandomBytes,
+	}
+	if err = send(issuerResponse); err != nil {
+		logger.Warn("failed sending out an issuer response", "remote", remoteAddr, "err", err)
+		revokeUndelivered(atl, clientName, request)
+		return
+	}
+
 	completed = true
 	return
 }
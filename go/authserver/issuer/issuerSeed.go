@@ -0,0 +1,93 @@
+package issuer
+
+import (
+	"crypto/rand"
+	"mqttmtd/consts"
+	"mqttmtd/types"
+	"time"
+	"unsafe"
+)
+
+// Seed-based token formats only keep the per-batch seed, so there is no difference between onmemory and localfile builds
+func generateAndSendSeedIssuerResponse(atl *types.AuthTokenList, clientName string, request types.IssuerRequest, padding types.PaddingPolicy, remoteAddr string, send func(types.IssuerResponse) error) (err error) {
+	var (
+		now                     int64 = time.Now().UnixNano()
+		encKey                  []byte
+		n                       int
+		timestamp               [1 + consts.TIMESTAMP_LEN]byte
+		tokenFormat             types.TokenFormat = request.Options.TokenFormat()
+		tokenCount              uint16            = uint16(request.NumberOfTokensDividedByMultiplier) * consts.TOKEN_NUM_MULTIPLIER
+		tokenSeed               []byte
+		currentValidRandomBytes []byte
+	)
+
+	// Timestamp
+	for i := consts.TIMESTAMP_LEN; i >= 0; i-- {
+		now >>= 8
+		timestamp[i] = byte(now & 0xFF)
+	}
+
+	if request.PayloadAEADRequested {
+		// Encryption Key
+		encKey = make([]byte, request.PayloadAEADType.GetKeyLen())
+		n, err = rand.Read(encKey)
+		if err != nil {
+			logger.Error("failed generating encryption key", "remote", remoteAddr, "err", err)
+			return
+		}
+		if n != request.PayloadAEADType.GetKeyLen() {
+			logger.Error("failed generating encryption key: length is inadequate", "remote", remoteAddr)
+			return
+		}
+	}
+
+	// Token Seed
+	tokenSeed = make([]byte, consts.TOKEN_SEED_LEN)
+	n, err = rand.Read(tokenSeed)
+	if err != nil {
+		logger.Error("failed generating token seed", "remote", remoteAddr, "err", err)
+		return
+	}
+	if n != consts.TOKEN_SEED_LEN {
+		logger.Error("failed generating token seed: length is inadequate", "remote", remoteAddr)
+		return
+	}
+	if currentValidRandomBytes, err = tokenFormat.DeriveRandomBytes(tokenSeed, tokenCount, 0); err != nil {
+		logger.Error("failed deriving the first random bytes", "remote", remoteAddr, "err", err)
+		return
+	}
+
+	// ATL update, before sending so that tokens are valid as soon as the client receives them
+	atl.Lock()
+	replaceEntry(atl, &types.ATLEntry{
+		Topic:                  request.Topic,
+		ClientName:             unsafe.Slice(unsafe.StringData(clientName), len(clientName)),
+		AccessTypeIsPub:        request.AccessTypeIsPub,
+		Timestamp:              timestamp,
+		AllRandomData:          tokenSeed,
+		TokenCount:             tokenCount,
+		CurrentValidRandomData: currentValidRandomBytes,
+		CurrentValidTokenIdx:   0,
+		TokenFormat:            tokenFormat,
+		PayloadAEADType:        request.PayloadAEADType,
+		PayloadEncKey:          encKey,
+		PayloadKeyRatchet:      request.Options&types.OptionPayloadKeyRatchet != 0,
+		CoverTraffic:           request.Options&types.OptionCoverTraffic != 0,
+		Padding:                padding,
+	}, remoteAddr)
+	atl.Unlock()
+
+	// Send Response
+	issuerResponse := types.IssuerResponse{
+		EncryptionKey: encKey,
+		Timestamp:     timestamp[1:],
+		Padding:       padding,
+		TokenSeed:     tokenSeed,
+	}
+	if err = send(issuerResponse); err != nil {
+		logger.Warn("failed sending out an issuer response", "remote", remoteAddr, "err", err)
+		revokeUndelivered(atl, clientName, request)
+		return
+	}
+	return
+}
@@ -1,27 +1,41 @@
 package verifier
 
 import (
+	"bytes"
 	"context"
 	"fmt"
-	"log"
+	"mqttmtd/authserver/atlevents"
 	"mqttmtd/config"
 	"mqttmtd/funcs"
+	"mqttmtd/logging"
+	"mqttmtd/metrics"
 	"mqttmtd/types"
 	"net"
+	"strings"
+	"time"
+)
+
+var (
+	logger = logging.For("verifier")
+
+	verificationsMetric = metrics.NewCounterVec(metrics.METRIC_VERIFICATIONS, "Token verifications in ATL by access and result",
+		metrics.LABEL_ACCESS, metrics.LABEL_RESULT)
+	verificationDurationMetric = metrics.NewHistogramVec(metrics.METRIC_VERIFICATION_DURATION, "Duration of token verifications in ATL by access",
+		metrics.LatencyBuckets, metrics.LABEL_ACCESS)
 )
 
 func Run(atl *types.AuthTokenList) {
-	fmt.Printf("Starting verifier server on port %d\n", config.Server.Ports.Verifier)
+	logger.Info("starting verifier server", "port", config.Server.Ports.Verifier)
 	listener, err := net.Listen("tcp", fmt.Sprintf(":%d", config.Server.Ports.Verifier))
 	if err != nil {
-		log.Fatalf("Verifier - Failed to start plain listener: %v", err)
+		logging.Fatal(logger, "failed to start plain listener", "err", err)
 	}
 	defer listener.Close()
 
 	for {
 		conn, err := listener.Accept()
 		if err != nil {
-			log.Println("Verifier - Failed to accept plain connection:", err)
+			logger.Warn("failed to accept plain connection", "err", err)
 			continue
 		}
 		go tokenVerifierHandler(conn, atl)
@@ -32,7 +46,7 @@ func tokenVerifierHandler(conn net.Conn, atl *types.AuthTokenList) {
 	defer func() {
 		addr := conn.RemoteAddr().String()
 		conn.Close()
-		fmt.Printf("Verifier - Closed connection with %s\n", addr)
+		logger.Debug("closed connection", "remote", addr)
 	}()
 	remoteAddr := conn.RemoteAddr().String()
 
@@ -42,66 +56,162 @@ func tokenVerifierHandler(conn net.Conn, atl *types.AuthTokenList) {
 		verifierResponse types.VerifierResponse
 	)
 	// Receive Request
-	verifierRequest, err = funcs.ParseVerifierRequest(context.TODO(), conn, config.Server.SocketTimeout.External)
+	reader := funcs.NewConnReader(context.TODO(), conn)
+	defer reader.Release()
+	verifierRequest, err = funcs.ParseVerifierRequest(reader, config.Server.SocketTimeout.External)
 	if err != nil {
-		fmt.Printf("verifier(%s): Failed reading a request: %v\n", remoteAddr, err)
+		logger.Warn("failed reading a request", "remote", remoteAddr, "err", err)
 		return
 	}
 
-	// ATL Lookup
-	atl.Lock()
-	entry, err := atl.LookupEntryWithToken(verifierRequest.Token)
-	atl.Unlock()
-	if err != nil {
-		fmt.Printf("verifier(%s): Failed token verification with error: %v\n", remoteAddr, err)
+	// Verification
+	acceptedAccessType := types.AccessSub
+	if verifierRequest.AccessTypeIsPub {
+		acceptedAccessType = types.AccessPub
+	}
+	if verifierResponse, _, err = verifyToken(atl, verifierRequest.Token, acceptedAccessType, remoteAddr); err != nil {
 		return
 	}
 
-	// Construct Response
-	if (entry == nil) || (entry.AccessTypeIsPub != verifierRequest.AccessTypeIsPub) {
-		// Verification Failed
-		fmt.Printf("verifier(%s): Verification failed\n", remoteAddr)
-		verifierResponse = types.VerifierResponse{
-			ResultCode: types.VerfFail,
-		}
+	logger.Debug("verified", "remote", remoteAddr, "result", fmt.Sprintf("0x%02x", byte(verifierResponse.ResultCode)))
+
+	if err = funcs.SendVerifierResponse(context.TODO(), conn, config.Server.SocketTimeout.Local, verifierResponse); err != nil {
+		logger.Warn("failed sending out a response", "remote", remoteAddr, "err", err)
+		return
 	}
+}
+
+/*
+Look up the token in ATL and, if its access type is one of acceptedAccessType, consume it and advance the entry.
+Shared by the binary verifier protocol and the HTTP auth backend. err is non-nil only when no response should be made.
+*/
+func verifyToken(atl *types.AuthTokenList, token []byte, acceptedAccessType types.ACLAccessType, remoteAddr string) (verifierResponse types.VerifierResponse, entryAccessTypeIsPub bool, err error) {
+	start := time.Now()
+	defer func() {
+		// "pubsub" for HTTP auth requests accepting either
+		access := strings.ToLower(acceptedAccessType.String())
+		verificationDurationMetric.ObserveSince(start, access)
+		if err != nil {
+			verificationsMetric.Inc(access, metrics.RESULT_ERROR)
+		} else {
+			verificationsMetric.Inc(access, verifierResponse.ResultCode.String())
+		}
+	}()
 	var (
-		curValidTokenIdx uint16                = entry.CurrentValidTokenIdx
-		payloadAEADType  types.PayloadAEADType = entry.PayloadAEADType
-		payloadEncKey    []byte                = entry.PayloadEncKey
-		topic            []byte                = entry.Topic
+		curValidTokenIdx uint16
+		payloadAEADType  types.PayloadAEADType
+		payloadEncKey    []byte
+		padding          types.PaddingPolicy
+		topic            []byte
+		resultCode       types.VerificationResultCode
+		verified         bool
 	)
-	if resultCode, err := updateCurrentValidRandomBytes(atl, entry); err != nil {
-		// Internal Value Refresh Failed
-		fmt.Printf("verifier(%s): Failed token update with error: %v\n", remoteAddr, err)
-		verifierResponse = types.VerifierResponse{
-			ResultCode: types.VerfFail,
+	// Lookup, token update and key ratchet in one critical section, so that concurrent verifications of a batch take
+	// its tokens and chain keys in the same order, and the entry fields are copied out before anyone else updates them
+	func() {
+		atl.Lock()
+		defer atl.Unlock()
+		var entry *types.ATLEntry
+		if entry, err = atl.LookupEntryWithToken(token); err != nil {
+			logger.Warn("failed token verification", "remote", remoteAddr, "err", err)
+			return
 		}
-	} else {
-		// Internal Value Refreshed
-		if resultCode.IsSuccessEncKey() {
-			verifierResponse = types.VerifierResponse{
-				ResultCode:      resultCode,
-				TokenIndex:      curValidTokenIdx,
-				PayloadAEADType: payloadAEADType,
-				EncryptionKey:   payloadEncKey,
-				Topic:           topic,
+		if entry != nil {
+			entryAccessTypeIsPub = entry.AccessTypeIsPub
+		}
+		if (entry == nil) || (entryAccessTypeIsPub && acceptedAccessType&types.AccessPub == 0) || (!entryAccessTypeIsPub && acceptedAccessType&types.AccessSub == 0) {
+			// Verification Failed
+			logger.Info("verification failed", "remote", remoteAddr)
+			if entry == nil {
+				atlevents.Publish(atlevents.EVENT_SUSPICIOUS, nil, atlevents.REASON_UNKNOWN_TOKEN, remoteAddr)
+			} else {
+				atlevents.Publish(atlevents.EVENT_SUSPICIOUS, entry, atlevents.REASON_ACCESS_TYPE, remoteAddr)
 			}
-		} else if resultCode.IsSuccess() {
-			verifierResponse = types.VerifierResponse{
-				ResultCode: resultCode,
-				Topic:      topic,
+			return
+		}
+		verified = true
+		curValidTokenIdx = entry.CurrentValidTokenIdx
+		payloadAEADType = entry.PayloadAEADType
+		payloadEncKey = entry.PayloadEncKey
+		padding = entry.Padding
+		topic = entry.Topic
+
+		// Key for this token, derived on a copy of the chain key before the entry advances, so that both stay as they
+		// are on failure. The entry is of no use then, as every later token would fail the same way.
+		var nextChainKey []byte
+		if entry.SuccessResultCode(false).IsRatchetKey() {
+			nextChainKey = bytes.Clone(entry.PayloadEncKey)
+			var ratchetErr error
+			if payloadEncKey, ratchetErr = payloadAEADType.RatchetPayloadKey(nextChainKey, uint64(curValidTokenIdx)); ratchetErr != nil {
+				logger.Error("failed payload key ratchet, revoking the entry", "remote", remoteAddr, "err", ratchetErr)
+				atl.Remove(entry)
+				atlevents.Publish(atlevents.EVENT_REVOKE, entry, atlevents.REASON_KEY_RATCHET, remoteAddr)
+				resultCode = types.VerfFail
+				return
 			}
+		}
+
+		var updateErr error
+		if entry.TokenFormat.IsSeedBased() {
+			resultCode, updateErr = updateCurrentValidSeedDerivedBytes(atl, entry)
 		} else {
-			fmt.Printf("verifier(%s): Unexpected result code: %d\n", remoteAddr, resultCode)
+			resultCode, updateErr = updateCurrentValidRandomBytes(atl, entry)
+		}
+		if updateErr != nil {
+			// Internal Value Refresh Failed
+			logger.Error("failed token update", "remote", remoteAddr, "err", updateErr)
+			resultCode = types.VerfFail
 			return
 		}
-	}
-
-	fmt.Printf("verifier(%s): ResultCode: 0x%02x\n", remoteAddr, verifierResponse.ResultCode)
 
-	if err = funcs.SendVerifierResponse(context.TODO(), conn, config.Server.SocketTimeout.Local, verifierResponse); err != nil {
-		fmt.Printf("verifier(%s): Error sending out a response: %v\n", remoteAddr, err)
+		// Internal Value Refreshed
+		if nextChainKey != nil {
+			copy(entry.PayloadEncKey, nextChainKey)
+			clear(nextChainKey)
+		}
+		if resultCode.IsReloadNeeded() {
+			atlevents.Publish(atlevents.EVENT_RELOAD_NEEDED, entry, "", remoteAddr)
+		} else {
+			atlevents.Publish(atlevents.EVENT_ADVANCE, entry, "", remoteAddr)
+		}
+	}()
+	if err != nil {
+		return
+	}
+	if !verified {
+		verifierResponse = types.VerifierResponse{
+			ResultCode: types.VerfFail,
+		}
 		return
 	}
+
+	// Construct Response
+	if resultCode.IsSuccessEncKey() {
+		verifierResponse = types.VerifierResponse{
+			ResultCode:      resultCode,
+			TokenIndex:      curValidTokenIdx,
+			PayloadAEADType: payloadAEADType,
+			EncryptionKey:   payloadEncKey,
+			Padding:         padding,
+			Topic:           topic,
+		}
+	} else if resultCode.IsSuccess() {
+		verifierResponse = types.VerifierResponse{
+			ResultCode: resultCode,
+			Topic:      topic,
+		}
+	} else if resultCode.IsCover() {
+		// Consumed as the real ones so that the order in the batch holds, but no topic is given
+		verifierResponse = types.VerifierResponse{
+			ResultCode: resultCode,
+		}
+	} else if resultCode == types.VerfFail {
+		verifierResponse = types.VerifierResponse{
+			ResultCode: resultCode,
+		}
+	} else {
+		logger.Error("unexpected result code", "remote", remoteAddr, "result", resultCode)
+		err = fmt.Errorf("unexpected result code: %d", resultCode)
+	}
+	return
 }
@@ -0,0 +1,266 @@
+package verifier
+
+import (
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"io"
+	"mime"
+	"mqttmtd/config"
+	"mqttmtd/consts"
+	"mqttmtd/logging"
+	"mqttmtd/types"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+)
+
+var httpAuthLogger = logging.For("httpauth")
+
+/*
+HTTP auth backend for brokers without mqttinterface in the data path, following the conventions of mosquitto-go-auth
+(http backend) and EMQX (HTTP authentication / authorization).
+
+  - /auth: a token (base64url) presented as password, or as username if the password is empty, is consumed.
+    The topic and access type of its ATL entry are then granted to the clientid.
+  - /acl: the topic must be the one granted to the clientid with the requested access type. A topic that is a token
+    is denied without being consumed: a stock broker would route the message by the token itself rather than by the
+    real topic, which only mqttinterface swaps in. Tokens go in the password with this backend.
+  - /superuser: always denied.
+
+Parameters are read from a JSON body or form values. With responsemode "status" (default), deny is replied
+with 403, which works with mosquitto-go-auth in any response mode. With "body", every reply is 200 and the
+result is in the JSON body, as EMQX expects.
+*/
+const (
+	HTTP_AUTH_PATH_AUTH      = "/auth"
+	HTTP_AUTH_PATH_ACL       = "/acl"
+	HTTP_AUTH_PATH_SUPERUSER = "/superuser"
+
+	HTTP_AUTH_RESPONSE_MODE_STATUS = "status"
+	HTTP_AUTH_RESPONSE_MODE_BODY   = "body"
+
+	HTTP_AUTH_MAX_REQUEST_SIZE = 4096
+	HTTP_AUTH_GRANT_TTL        = time.Hour
+)
+
+// mosquitto-go-auth acc values
+const (
+	httpAuthAccRead      = "1"
+	httpAuthAccWrite     = "2"
+	httpAuthAccSubscribe = "4"
+)
+
+type httpAuthGrant struct {
+	topic           string
+	accessTypeIsPub bool
+	expiresAt       time.Time
+}
+
+// Topics granted to MQTT client ids through /auth or /acl
+type httpAuthGrants struct {
+	sync.Mutex
+	entries map[string][]httpAuthGrant
+}
+
+var grants = &httpAuthGrants{entries: make(map[string][]httpAuthGrant)}
+
+func (g *httpAuthGrants) add(clientID string, topic string, accessTypeIsPub bool) {
+	now := time.Now()
+	g.Lock()
+	defer g.Unlock()
+	kept := g.entries[clientID][:0]
+	for _, grant := range g.entries[clientID] {
+		if grant.expiresAt.After(now) && (grant.topic != topic || grant.accessTypeIsPub != accessTypeIsPub) {
+			kept = append(kept, grant)
+		}
+	}
+	g.entries[clientID] = append(kept, httpAuthGrant{topic: topic, accessTypeIsPub: accessTypeIsPub, expiresAt: now.Add(HTTP_AUTH_GRANT_TTL)})
+}
+
+func (g *httpAuthGrants) isGranted(clientID string, topic string, accessTypeIsPub bool) bool {
+	now := time.Now()
+	g.Lock()
+	defer g.Unlock()
+	for _, grant := range g.entries[clientID] {
+		if !grant.expiresAt.After(now) || grant.accessTypeIsPub != accessTypeIsPub {
+			continue
+		}
+		// Sub grants may be of a wildcard filter, which covers the topics delivered through it
+		if grant.topic == topic || (!accessTypeIsPub && types.TopicFilterCovers(grant.topic, topic)) {
+			return true
+		}
+	}
+	return false
+}
+
+func (g *httpAuthGrants) removeExpired() {
+	now := time.Now()
+	g.Lock()
+	defer g.Unlock()
+	for clientID, clientGrants := range g.entries {
+		kept := clientGrants[:0]
+		for _, grant := range clientGrants {
+			if grant.expiresAt.After(now) {
+				kept = append(kept, grant)
+			}
+		}
+		if len(kept) == 0 {
+			delete(g.entries, clientID)
+		} else {
+			g.entries[clientID] = kept
+		}
+	}
+}
+
+func RunHttpAuth(atl *types.AuthTokenList) {
+	httpAuthLogger.Info("starting http auth backend", "port", config.Server.Ports.HttpAuth)
+	go func() {
+		for {
+			time.Sleep(HTTP_AUTH_GRANT_TTL)
+			grants.removeExpired()
+		}
+	}()
+
+	mux := http.NewServeMux()
+	mux.HandleFunc(HTTP_AUTH_PATH_AUTH, func(w http.ResponseWriter, r *http.Request) {
+		httpAuthHandler(w, r, atl)
+	})
+	mux.HandleFunc(HTTP_AUTH_PATH_ACL, httpACLHandler)
+	mux.HandleFunc(HTTP_AUTH_PATH_SUPERUSER, func(w http.ResponseWriter, r *http.Request) {
+		writeHttpAuthResult(w, false, "no superuser")
+	})
+	if err := http.ListenAndServe(fmt.Sprintf(":%d", config.Server.Ports.HttpAuth), mux); err != nil {
+		logging.Fatal(httpAuthLogger, "failed to start plain listener", "err", err)
+	}
+}
+
+func httpAuthHandler(w http.ResponseWriter, r *http.Request, atl *types.AuthTokenList) {
+	remoteAddr := r.RemoteAddr
+	params, err := parseHttpAuthParams(r)
+	if err != nil {
+		httpAuthLogger.Warn("failed reading a request", "remote", remoteAddr, "err", err)
+		http.Error(w, "Bad Request", http.StatusBadRequest)
+		return
+	}
+
+	tokenStr := params["password"]
+	if tokenStr == "" {
+		tokenStr = params["username"]
+	}
+	token, ok := decodeHttpAuthToken(tokenStr)
+	if !ok {
+		writeHttpAuthResult(w, false, "no token presented")
+		return
+	}
+
+	verifierResponse, accessTypeIsPub, err := verifyToken(atl, token, types.AccessPubSub, remoteAddr)
+	if err != nil || !verifierResponse.ResultCode.IsSuccess() {
+		writeHttpAuthResult(w, false, "token verification failed")
+		return
+	}
+	grants.add(params["clientid"], string(verifierResponse.Topic), accessTypeIsPub)
+	httpAuthLogger.Info("client authenticated", "remote", remoteAddr, "clientid", params["clientid"], "topic", string(verifierResponse.Topic))
+	writeHttpAuthResult(w, true, "")
+}
+
+func httpACLHandler(w http.ResponseWriter, r *http.Request) {
+	remoteAddr := r.RemoteAddr
+	params, err := parseHttpAuthParams(r)
+	if err != nil {
+		httpAuthLogger.Warn("failed reading a request", "remote", remoteAddr, "err", err)
+		http.Error(w, "Bad Request", http.StatusBadRequest)
+		return
+	}
+
+	var accessTypeIsPub bool
+	switch {
+	case params["acc"] == httpAuthAccWrite || params["action"] == "publish":
+		accessTypeIsPub = true
+	case params["acc"] == httpAuthAccSubscribe || params["action"] == "subscribe":
+	case params["acc"] == httpAuthAccRead:
+		// delivery of a message to a subscriber
+	default:
+		writeHttpAuthResult(w, false, "unsupported access")
+		return
+	}
+
+	topic := params["topic"]
+	if _, ok := decodeHttpAuthToken(topic); ok {
+		writeHttpAuthResult(w, false, "tokens as topics need mqttinterface, present the token as password instead")
+		return
+	}
+
+	if grants.isGranted(params["clientid"], topic, accessTypeIsPub) {
+		writeHttpAuthResult(w, true, "")
+	} else {
+		writeHttpAuthResult(w, false, "topic not granted")
+	}
+}
+
+// Read parameters from a JSON body or form values (query and urlencoded body)
+func parseHttpAuthParams(r *http.Request) (params map[string]string, err error) {
+	params = make(map[string]string)
+	if mediaType, _, _ := mime.ParseMediaType(r.Header.Get("Content-Type")); mediaType == "application/json" {
+		var (
+			body    []byte
+			decoded map[string]any
+		)
+		if body, err = io.ReadAll(io.LimitReader(r.Body, HTTP_AUTH_MAX_REQUEST_SIZE)); err != nil {
+			return
+		}
+		if err = json.Unmarshal(body, &decoded); err != nil {
+			return
+		}
+		for k, v := range decoded {
+			switch v := v.(type) {
+			case string:
+				params[k] = v
+			case float64:
+				params[k] = fmt.Sprintf("%.0f", v)
+			}
+		}
+		return
+	}
+
+	r.Body = http.MaxBytesReader(nil, r.Body, HTTP_AUTH_MAX_REQUEST_SIZE)
+	if err = r.ParseForm(); err != nil {
+		return
+	}
+	for k := range r.Form {
+		params[k] = r.Form.Get(k)
+	}
+	return
+}
+
+// Tokens are base64url encoded as in topic names to mqttinterface
+func decodeHttpAuthToken(s string) (token []byte, ok bool) {
+	var err error
+	s = strings.TrimRight(s, "=")
+	if token, err = base64.RawURLEncoding.DecodeString(s); err != nil || len(token) != consts.TOKEN_SIZE {
+		return nil, false
+	}
+	return token, true
+}
+
+func writeHttpAuthResult(w http.ResponseWriter, allowed bool, reason string) {
+	result := "deny"
+	if allowed {
+		result = "allow"
+	}
+	body, _ := json.Marshal(map[string]any{
+		// EMQX
+		"result":       result,
+		"is_superuser": false,
+		// mosquitto-go-auth json response mode
+		"ok":    allowed,
+		"error": reason,
+	})
+
+	w.Header().Set("Content-Type", "application/json")
+	if !allowed && config.Server.HttpAuth.ResponseMode != HTTP_AUTH_RESPONSE_MODE_BODY {
+		w.WriteHeader(http.StatusForbidden)
+	}
+	w.Write(body)
+}
@@ -7,26 +7,15 @@ import (
 	"mqttmtd/types"
 )
 
+// With ATL locked
 func updateCurrentValidRandomBytes(atl *types.AuthTokenList, entry *types.ATLEntry) (resultCode types.VerificationResultCode, err error) {
 	if entry.CurrentValidTokenIdx+1 >= entry.TokenCount {
-		atl.Lock()
 		atl.Remove(entry)
-		atl.Unlock()
-		if entry.PayloadAEADType.IsEncryptionEnabled() {
-			resultCode = types.VerfSuccessEncKeyReloadNeeded
-		} else {
-			resultCode = types.VerfSuccessReloadNeeded
-		}
+		resultCode = entry.SuccessResultCode(true)
 	} else {
-		atl.Lock()
 		entry.CurrentValidTokenIdx++
 		entry.CurrentValidRandomData = entry.AllRandomData[entry.CurrentValidTokenIdx*consts.RANDOM_BYTES_LEN : (entry.CurrentValidTokenIdx+1)*consts.RANDOM_BYTES_LEN]
-		atl.Unlock()
-		if entry.PayloadAEADType.IsEncryptionEnabled() {
-			resultCode = types.VerfSuccessEncKey
-		} else {
-			resultCode = types.VerfSuccess
-		}
+		resultCode = entry.SuccessResultCode(false)
 	}
 	return
 }
@@ -0,0 +1,23 @@
+package verifier
+
+import (
+	"mqttmtd/types"
+)
+
+// Seed-based token formats derive the next random bytes from the token seed kept in entry.AllRandomData, with ATL locked
+func updateCurrentValidSeedDerivedBytes(atl *types.AuthTokenList, entry *types.ATLEntry) (resultCode types.VerificationResultCode, err error) {
+	if entry.CurrentValidTokenIdx+1 >= entry.TokenCount {
+		atl.Remove(entry)
+		resultCode = entry.SuccessResultCode(true)
+		return
+	}
+
+	var nextRandomBytes []byte
+	if nextRandomBytes, err = entry.TokenFormat.DeriveRandomBytes(entry.AllRandomData, entry.TokenCount, entry.CurrentValidTokenIdx+1); err != nil {
+		return
+	}
+	entry.CurrentValidTokenIdx++
+	entry.CurrentValidRandomData = nextRandomBytes
+	resultCode = entry.SuccessResultCode(false)
+	return
+}
@@ -4,10 +4,11 @@ import (
 	"encoding/base64"
 	"flag"
 	"fmt"
-	"log"
 	"unsafe"
 
+	"mqttmtd/config"
 	"mqttmtd/consts"
+	"mqttmtd/logging"
 	"mqttmtd/tokenmgr"
 	"mqttmtd/types"
 )
@@ -23,6 +24,8 @@ const (
 	TOKEN_NUM_MULTIPLIER = 16
 )
 
+var logger = logging.For("client")
+
 func formatNibbleToCappedAscii(nib byte) byte {
 	s_nib := nib & 0xF
 	if s_nib < 0xA {
@@ -43,13 +46,24 @@ func main() {
 	ntokens := *flag.Int("ntokens", -1, "Number of tokens to be generated")
 	requestAccessType := *flag.String("reqtype", "", "PUB for pub, SUB for sub")
 	topic := *flag.String("topic", "", "MQTT topic name")
+	cover := flag.Bool("cover", false, "Fetches decoy tokens for cover traffic if true, which MQTT Interface discards")
+	configFilePath := flag.String("conf", "", "path to the client conf file, whose log section is applied")
 	flag.Parse()
 
+	if *configFilePath != "" {
+		if err := config.LoadClientConfig(*configFilePath); err != nil {
+			logging.Fatal(logger, "failed to load client config", "path", *configFilePath, "err", err)
+		}
+		if err := logging.Init(config.Client.Log, "client"); err != nil {
+			logging.Fatal(logger, "failed to apply log config", "err", err)
+		}
+	}
+
 	// if returnOnlyToken {
 	// 	tokenmgr.DebugEnabled = false
 	// }
 	if ntokens < TOKEN_NUM_MULTIPLIER || 0x1F*TOKEN_NUM_MULTIPLIER < ntokens || ntokens%TOKEN_NUM_MULTIPLIER != 0 {
-		log.Fatalf("Invalid number of token generation. It must be between [%d, 0x1F*%d] and multiples of %d\n", TOKEN_NUM_MULTIPLIER, TOKEN_NUM_MULTIPLIER, TOKEN_NUM_MULTIPLIER)
+		logging.Fatal(logger, "invalid number of token generation", "tokens", ntokens, "min", TOKEN_NUM_MULTIPLIER, "max", 0x1F*TOKEN_NUM_MULTIPLIER, "multipleof", TOKEN_NUM_MULTIPLIER)
 	}
 	var reqAccessType bool
 	switch requestAccessType {
@@ -58,20 +72,21 @@ func main() {
 	case "SUB":
 		reqAccessType = false
 	default:
-		log.Fatalln("Invalid access type requested. It must be either PUB, SUB or PUBSUB.")
+		logging.Fatal(logger, "invalid access type requested, it must be either PUB or SUB", "reqtype", requestAccessType)
 	}
 	if topic == "" {
-		log.Fatalln("Invalid topic name. It must be an ASCII string with printable characters.")
+		logging.Fatal(logger, "invalid topic name, it must be an ASCII string with printable characters")
 	}
 
 	fetchReq := &tokenmgr.FetchRequest{
 		NumTokens:       uint16(ntokens),
 		AccessTypeIsPub: reqAccessType,
 		PayloadAEADType: types.PAYLOAD_AEAD_NONE,
+		CoverTraffic:    *cover,
 	}
 	_, _, token, err := tokenmgr.GetToken(topic, *fetchReq)
 	if err != nil {
-		log.Fatal(err)
+		logging.Fatal(logger, "failed getting a token", "err", err)
 	}
 
 	var tokenStr string
@@ -14,23 +14,89 @@ type ServerConfig struct {
 	} `yaml:"socktimeout"`
 
 	FilePaths struct {
-		TokensDirPath string `yaml:"tokensdir"`
-		AclFilePath   string `yaml:"aclfile"`
+		TokensDirPath  string `yaml:"tokensdir"`
+		AclFilePath    string `yaml:"aclfile"`
+		CwtKeyFilePath string `yaml:"cwtkey"` // optional, CWT tokens are available only when set
 	} `yaml:"filepaths"`
 
 	Ports struct {
-		Issuer        int `yaml:"issuer"`
-		Verifier      int `yaml:"verifier"`
-		MqttInterface int `yaml:"mqttinterface"`
-		MqttServer    int `yaml:"mqttserver"`
-		Dashboard     int `yaml:"dashboard"`
+		Issuer               int `yaml:"issuer"`
+		Ace                  int `yaml:"ace"` // optional, ACE token endpoint is disabled when 0
+		Verifier             int `yaml:"verifier"`
+		HttpAuth             int `yaml:"httpauth"` // optional, HTTP auth backend for brokers is disabled when 0
+		MqttInterface        int `yaml:"mqttinterface"`
+		MqttInterfaceTls     int `yaml:"mqttinterfacetls"` // optional, TLS listener of MQTT Interface is disabled when 0
+		MqttInterfaceWs      int `yaml:"mqttinterfacews"`  // optional, WebSocket listener of MQTT Interface is disabled when 0
+		MqttServer           int `yaml:"mqttserver"`
+		Dashboard            int `yaml:"dashboard"`
+		Metrics              int `yaml:"metrics"`              // optional, /metrics of the authserver is disabled when 0
+		MqttInterfaceMetrics int `yaml:"mqttinterfacemetrics"` // optional, /metrics of MQTT Interface is disabled when 0
+		MqttInterfaceAdmin   int `yaml:"mqttinterfaceadmin"`   // optional, /api/v1/sessions of MQTT Interface for the dashboard is disabled when 0
 	} `yaml:"ports"`
 
+	HttpAuth struct {
+		ResponseMode string `yaml:"responsemode"` // "status" (default) or "body"
+	} `yaml:"httpauth"`
+
+	Dashboard struct {
+		MqttInterfaceAddr string            `yaml:"mqttinterfaceaddr"` // host:port of /api/v1/sessions of MQTT Interface, "localhost:<ports.mqttinterfaceadmin>" when empty
+		ListenHost        string            `yaml:"listenhost"`        // address to listen on, all interfaces when empty
+		Tls               bool              `yaml:"tls"`               // HTTPS with the server certificate
+		TlsClientAuth     string            `yaml:"tlsclientauth"`     // "none" (default), "request" or "require", client certificates verified with certs.cacert
+		AnonymousRole     string            `yaml:"anonymousrole"`     // "readonly" or "admin" for requests without credentials, which are denied when empty
+		Users             []DashboardUser   `yaml:"users"`             // for basic auth
+		Tokens            []DashboardToken  `yaml:"tokens"`            // for bearer auth
+		CertRoles         map[string]string `yaml:"certroles"`         // roles by MQTT MTD identity or common name of client certificates
+	} `yaml:"dashboard"`
+
+	MqttInterface struct {
+		TlsClientAuth        string `yaml:"tlsclientauth"`        // "none" (default), "request" or "require" (mTLS with certs)
+		RevealWildcardTopics bool   `yaml:"revealwildcardtopics"` // forward topic names of PUBLISH matching wildcard subscriptions, hidden when false
+		AdminHost            string `yaml:"adminhost"`            // address of ports.mqttinterfaceadmin, without authentication, localhost when empty
+		CwtStickyRouting     bool   `yaml:"cwtstickyrouting"`     // required with filepaths.cwtkey, clients always reach the same instance
+
+		Upstream struct {
+			Brokers            []string      `yaml:"brokers"`        // tcp://host:port or tls://host:port, ":<ports.mqttserver>" when empty
+			Strategy           string        `yaml:"strategy"`       // "failover" (default) or "roundrobin"
+			ConnectTimeout     time.Duration `yaml:"connecttimeout"` // socktimeout.external when 0
+			CaCertFilePath     string        `yaml:"cacert"`         // for tls:// brokers, system roots when empty
+			ClientCertFilePath string        `yaml:"clientcert"`     // optional, for mTLS with tls:// brokers
+			ClientKeyFilePath  string        `yaml:"clientkey"`
+		} `yaml:"upstream"`
+
+		VerificationFailure struct {
+			DisconnectAfter int    `yaml:"disconnectafter"` // DISCONNECT 0x87 after this number of failures in a session, never when 0
+			V3Publish       string `yaml:"v3publish"`       // "ack" (default) or "close", for MQTT 3.1.1 PUBLISH at QoS>0
+		} `yaml:"verificationfailure"`
+
+		Deception struct {
+			Listeners   []string      `yaml:"listeners"` // "plain", "tls" or "websocket" routing failed tokens to decoys instead of rejecting
+			Namespace   string        `yaml:"namespace"` // topic prefix of decoys on the broker, "decoy" when empty
+			Interval    time.Duration `yaml:"interval"`  // of fake data published to decoy subscriptions, 5s when 0
+			LogFilePath string        `yaml:"logfile"`   // JSON lines of deception events, stdout when empty
+		} `yaml:"deception"`
+
+		MovingTarget struct {
+			Enabled     bool          `yaml:"enabled"`    // map real topics to pseudo-random broker topics rotated every interval
+			Interval    time.Duration `yaml:"interval"`   // 1h when 0
+			Switchover  time.Duration `yaml:"switchover"` // subscriptions are doubled this long around each rotation, shorter than interval/2, 5s when 0
+			KeyFilePath string        `yaml:"keyfile"`    // shared by the interfaces behind the same broker, random for each process when empty
+		} `yaml:"movingtarget"`
+
+		CoverTraffic struct {
+			Interval time.Duration `yaml:"interval"` // mean interval of dummy PUBLISH sent to each client at random, disabled when 0
+			MinSize  int           `yaml:"minsize"`  // of dummy plaintexts in bytes, padded and sealed as the real ones of the session
+			MaxSize  int           `yaml:"maxsize"`  // minsize when smaller
+		} `yaml:"covertraffic"`
+	} `yaml:"mqttinterface"`
+
 	Certs struct {
 		CaCertFilePath     string `yaml:"cacert"`
 		ServerCertFilePath string `yaml:"servercert"`
 		ServerKeyFilePath  string `yaml:"serverkey"`
 	} `yaml:"certs"`
+
+	Log LogConfig `yaml:"log"`
 }
 
 type ClientConfig struct {
@@ -50,6 +116,27 @@ type ClientConfig struct {
 		ClientCertFilePath string `yaml:"clientcert"`
 		ClientKeyFilePath  string `yaml:"clientkey"`
 	} `yaml:"certs"`
+
+	Log LogConfig `yaml:"log"`
+}
+
+type DashboardUser struct {
+	Name           string `yaml:"name"`
+	PasswordSHA256 string `yaml:"passwordsha256"` // hex, e.g. from `printf %s <password> | sha256sum`
+	Role           string `yaml:"role"`           // "readonly" or "admin"
+}
+
+type DashboardToken struct {
+	TokenSHA256 string `yaml:"tokensha256"` // hex of the bearer token
+	Role        string `yaml:"role"`
+}
+
+// Logging of the server and client binaries, applied by logging.Init
+type LogConfig struct {
+	Level      string            `yaml:"level"`      // "debug", "info" (default), "warn" or "error"
+	Format     string            `yaml:"format"`     // "text" (default) or "json"
+	Components map[string]string `yaml:"components"` // levels by component overriding level, e.g. mqttinterface: debug
+	Unredacted bool              `yaml:"unredacted"` // log keys and tokens as they are, for debugging only
 }
 
 var (
@@ -20,12 +20,12 @@ const (
 )
 
 const (
-	SOCK_CONTEXT_CANCELABLE_KEY = "IsCancelable"
-	NONCE_BASE                  = 123456
+	NONCE_BASE = 123456
 
 	TIMESTAMP_LEN    = 6
 	RANDOM_BYTES_LEN = 6
 	TOKEN_SIZE       = TIMESTAMP_LEN + RANDOM_BYTES_LEN
+	TOKEN_SEED_LEN   = 32
 
 	TOKEN_EXPIRATION_DURATION = time.Hour * 24 * 7
 
@@ -0,0 +1,153 @@
+package funcs
+
+import (
+	"bufio"
+	"context"
+	"io"
+	"net"
+	"sync"
+	"time"
+)
+
+const (
+	CONN_READER_BUF_SIZE = 4096
+	POOLED_BUF_SIZE      = 2048
+)
+
+// A deadline in the past, which interrupts blocked reads and writes
+var deadlinePassed = time.Unix(1, 0)
+
+var (
+	bufReaderPool = sync.Pool{New: func() any { return bufio.NewReaderSize(nil, CONN_READER_BUF_SIZE) }}
+	bufPool       = sync.Pool{New: func() any { buf := make([]byte, 0, POOLED_BUF_SIZE); return &buf }}
+)
+
+// Buffer of zero length and at least POOLED_BUF_SIZE capacity, to be returned by PutBuf
+func GetBuf() *[]byte {
+	return bufPool.Get().(*[]byte)
+}
+
+func PutBuf(buf *[]byte) {
+	*buf = (*buf)[:0]
+	bufPool.Put(buf)
+}
+
+func deadlineAfter(timeout time.Duration) time.Time {
+	if timeout == 0 {
+		return time.Time{}
+	}
+	return time.Now().Add(timeout)
+}
+
+/*
+Buffered reader of a connection with pooled buffers. Each read is bounded by a deadline of its timeout, or has none if
+the timeout is 0, and the cancel of ctx interrupts a blocked read by moving the deadline to the past, so that no
+goroutine is needed per read. A ConnReader is not safe for concurrent use, and must be released after use.
+*/
+type ConnReader struct {
+	conn net.Conn
+	br   *bufio.Reader
+
+	stopWatch func() bool
+	lock      sync.Mutex
+	ctxErr    error // set once ctx is canceled, under lock
+}
+
+func NewConnReader(ctx context.Context, conn net.Conn) (r *ConnReader) {
+	r = &ConnReader{conn: conn, br: bufReaderPool.Get().(*bufio.Reader)}
+	r.br.Reset(conn)
+	if ctx.Done() != nil {
+		r.stopWatch = context.AfterFunc(ctx, func() {
+			r.lock.Lock()
+			defer r.lock.Unlock()
+			r.ctxErr = ctx.Err()
+			r.conn.SetReadDeadline(deadlinePassed)
+		})
+	}
+	return
+}
+
+// Return the buffer to the pool. Data buffered but not read yet is discarded.
+func (r *ConnReader) Release() {
+	if r.stopWatch != nil {
+		r.stopWatch()
+	}
+	if r.br != nil {
+		r.br.Reset(nil)
+		bufReaderPool.Put(r.br)
+		r.br = nil
+	}
+}
+
+func (r *ConnReader) Conn() net.Conn {
+	return r.conn
+}
+
+// The deadline is left untouched when the buffer already holds enough
+func (r *ConnReader) prepare(n int, timeout time.Duration) (err error) {
+	r.lock.Lock()
+	defer r.lock.Unlock()
+	if r.ctxErr != nil {
+		return r.ctxErr
+	}
+	if r.br.Buffered() >= n {
+		return
+	}
+	return r.conn.SetReadDeadline(deadlineAfter(timeout))
+}
+
+// Errors caused by the cancel of ctx are reported as its error
+func (r *ConnReader) translateErr(err error) error {
+	if err == nil {
+		return nil
+	}
+	r.lock.Lock()
+	defer r.lock.Unlock()
+	if r.ctxErr != nil {
+		return r.ctxErr
+	}
+	return err
+}
+
+// Fill dst, waiting up to timeout for the whole of it
+func (r *ConnReader) ReadFull(dst []byte, timeout time.Duration) (n int, err error) {
+	if err = r.prepare(len(dst), timeout); err != nil {
+		return
+	}
+	n, err = io.ReadFull(r.br, dst)
+	err = r.translateErr(err)
+	return
+}
+
+func (r *ConnReader) ReadByteWithin(timeout time.Duration) (b byte, err error) {
+	if err = r.prepare(1, timeout); err != nil {
+		return
+	}
+	b, err = r.br.ReadByte()
+	err = r.translateErr(err)
+	return
+}
+
+/*
+Write data as a whole, waiting up to timeout, or without deadline if it is 0. The cancel of ctx interrupts a blocked
+write by moving the deadline to the past.
+*/
+func ConnWrite(ctx context.Context, conn net.Conn, data []byte, timeout time.Duration) (n int, err error) {
+	if ctx != nil && ctx.Err() != nil {
+		err = ctx.Err()
+		return
+	}
+	if err = conn.SetWriteDeadline(deadlineAfter(timeout)); err != nil {
+		return
+	}
+	if ctx != nil && ctx.Done() != nil {
+		// Registered after the deadline above so that a cancel is never overwritten
+		stopWatch := context.AfterFunc(ctx, func() { conn.SetWriteDeadline(deadlinePassed) })
+		defer func() {
+			if !stopWatch() && err != nil {
+				err = ctx.Err()
+			}
+		}()
+	}
+	return conn.Write(data)
+}
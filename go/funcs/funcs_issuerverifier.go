@@ -13,7 +13,7 @@ import (
 func SendIssuerRequest(ctx context.Context, conn net.Conn, timeout time.Duration, issuerRequest types.IssuerRequest) error {
 	// Prepare the buffer for the entire message
 	topicLen := len(issuerRequest.Topic)
-	buf := make([]byte, 1+1+2+topicLen)
+	buf := make([]byte, 1+1+1+2+topicLen)
 
 	// Set the flag
 	buf[0] = 0
@@ -23,6 +23,9 @@ func SendIssuerRequest(ctx context.Context, conn net.Conn, timeout time.Duration
 	if issuerRequest.PayloadAEADRequested {
 		buf[0] |= consts.BIT_6
 	}
+	if issuerRequest.Options != 0 {
+		buf[0] |= consts.BIT_5
+	}
 	if issuerRequest.NumberOfTokensDividedByMultiplier < 1 || issuerRequest.NumberOfTokensDividedByMultiplier > 0x1F {
 		return fmt.Errorf("field NumberOfTokens is not in the range of [1, 0x1F]")
 	}
@@ -36,6 +39,12 @@ func SendIssuerRequest(ctx context.Context, conn net.Conn, timeout time.Duration
 		offset += 1
 	}
 
+	// Options
+	if issuerRequest.Options != 0 {
+		buf[offset] = byte(issuerRequest.Options)
+		offset += 1
+	}
+
 	// Topic
 	binary.BigEndian.PutUint16(buf[offset:], uint16(topicLen))
 	offset += 2
@@ -46,11 +55,11 @@ func SendIssuerRequest(ctx context.Context, conn net.Conn, timeout time.Duration
 	return err
 }
 
-func ParseIssuerRequest(ctx context.Context, conn net.Conn, timeout time.Duration) (types.IssuerRequest, error) {
+func ParseIssuerRequest(r *ConnReader, timeout time.Duration) (types.IssuerRequest, error) {
 	buf := make([]byte, 2)
 
 	// Read the flag
-	if n, err := ConnRead(ctx, conn, buf[:1], timeout); err != nil || n != 1 {
+	if n, err := r.ReadFull(buf[:1], timeout); err != nil || n != 1 {
 		return types.IssuerRequest{}, fmt.Errorf("failed reading the flag field of an issuer request")
 	}
 	flag := buf[0]
@@ -63,14 +72,22 @@ func ParseIssuerRequest(ctx context.Context, conn net.Conn, timeout time.Duratio
 
 	// Read Payload AEAD Type if requested
 	if request.PayloadAEADRequested {
-		if n, err := ConnRead(ctx, conn, buf[:1], timeout); err != nil || n != 1 {
+		if n, err := r.ReadFull(buf[:1], timeout); err != nil || n != 1 {
 			return request, fmt.Errorf("failed reading payload AEAD type field of an issuer request")
 		}
 		request.PayloadAEADType = types.PayloadAEADType(buf[0])
 	}
 
+	// Read Options if present
+	if (flag & consts.BIT_5) != 0 {
+		if n, err := r.ReadFull(buf[:1], timeout); err != nil || n != 1 {
+			return request, fmt.Errorf("failed reading options field of an issuer request")
+		}
+		request.Options = types.IssuerRequestOptions(buf[0])
+	}
+
 	// Read the topic length
-	if n, err := ConnRead(ctx, conn, buf, timeout); err != nil || n != 2 {
+	if n, err := r.ReadFull(buf, timeout); err != nil || n != 2 {
 		return request, fmt.Errorf("failed reading the length of Topic field of an issuer request")
 	}
 	topicLen := binary.BigEndian.Uint16(buf)
@@ -80,16 +97,26 @@ func ParseIssuerRequest(ctx context.Context, conn net.Conn, timeout time.Duratio
 		return request, fmt.Errorf("invalid Topic length")
 	}
 	request.Topic = make([]byte, topicLen)
-	if n, err := ConnRead(ctx, conn, request.Topic, timeout); err != nil || n != int(topicLen) {
+	if n, err := r.ReadFull(request.Topic, timeout); err != nil || n != int(topicLen) {
 		return request, fmt.Errorf("failed reading Topic field of an issuer request")
 	}
 
 	return request, nil
 }
 
-func SendIssuerResponse(ctx context.Context, conn net.Conn, timeout time.Duration, issuerResponse types.IssuerResponse) error {
+func SendIssuerResponse(ctx context.Context, conn net.Conn, timeout time.Duration, request types.IssuerRequest, issuerResponse types.IssuerResponse) error {
 	keyLen := len(issuerResponse.EncryptionKey)
-	totalLen := keyLen + consts.TIMESTAMP_LEN + len(issuerResponse.AllRandomBytes)
+	paddingLen := 0
+	if request.Options&types.OptionPadding != 0 {
+		paddingLen = types.PADDING_POLICY_LEN
+	}
+	totalLen := keyLen + consts.TIMESTAMP_LEN + paddingLen + len(issuerResponse.AllRandomBytes) + len(issuerResponse.TokenSeed)
+	for _, cwtToken := range issuerResponse.CWTTokens {
+		if len(cwtToken) > 0xFFFF {
+			return fmt.Errorf("cwt token too long")
+		}
+		totalLen += 2 + len(cwtToken)
+	}
 	buf := make([]byte, totalLen)
 
 	offset := 0
@@ -102,32 +129,87 @@ func SendIssuerResponse(ctx context.Context, conn net.Conn, timeout time.Duratio
 	copy(buf[offset:], issuerResponse.Timestamp)
 	offset += consts.TIMESTAMP_LEN
 
-	// All Random Bytes
+	// Padding Policy
+	if paddingLen != 0 {
+		issuerResponse.Padding.AppendBytes(buf[offset:offset])
+		offset += paddingLen
+	}
+
+	// All Random Bytes or Token Seed
 	copy(buf[offset:], issuerResponse.AllRandomBytes)
+	offset += len(issuerResponse.AllRandomBytes)
+	copy(buf[offset:], issuerResponse.TokenSeed)
+	offset += len(issuerResponse.TokenSeed)
+
+	// CWT Tokens
+	for _, cwtToken := range issuerResponse.CWTTokens {
+		binary.BigEndian.PutUint16(buf[offset:], uint16(len(cwtToken)))
+		offset += 2
+		copy(buf[offset:], cwtToken)
+		offset += len(cwtToken)
+	}
 
 	// Write all the data to connection
 	_, err := ConnWrite(ctx, conn, buf, timeout)
 	return err
 }
 
-func ParseIssuerResponse(ctx context.Context, conn net.Conn, timeout time.Duration, request types.IssuerRequest) (types.IssuerResponse, error) {
+func ParseIssuerResponse(r *ConnReader, timeout time.Duration, request types.IssuerRequest) (types.IssuerResponse, error) {
 	keyLen := 0
 	if request.PayloadAEADRequested {
 		keyLen = request.PayloadAEADType.GetKeyLen()
 	}
 
-	totalLen := keyLen + consts.TIMESTAMP_LEN + int(request.NumberOfTokensDividedByMultiplier)*consts.TOKEN_NUM_MULTIPLIER*consts.RANDOM_BYTES_LEN
+	paddingLen := 0
+	if request.Options&types.OptionPadding != 0 {
+		paddingLen = types.PADDING_POLICY_LEN
+	}
+
+	tokenFormat := request.Options.TokenFormat()
+	isSeedBased := tokenFormat.IsSeedBased()
+	totalLen := keyLen + consts.TIMESTAMP_LEN + paddingLen
+	if isSeedBased {
+		totalLen += consts.TOKEN_SEED_LEN
+	} else if tokenFormat != types.TokenFormatCWT {
+		totalLen += int(request.NumberOfTokensDividedByMultiplier) * consts.TOKEN_NUM_MULTIPLIER * consts.RANDOM_BYTES_LEN
+	}
 	buf := make([]byte, totalLen)
 
 	// Read all the data from the connection
-	if n, err := ConnRead(ctx, conn, buf, timeout); err != nil || n != totalLen {
+	if n, err := r.ReadFull(buf, timeout); err != nil || n != totalLen {
 		return types.IssuerResponse{}, fmt.Errorf("failed reading the issuer response")
 	}
 
 	response := types.IssuerResponse{
-		EncryptionKey:  buf[:keyLen],
-		Timestamp:      buf[keyLen : keyLen+consts.TIMESTAMP_LEN],
-		AllRandomBytes: buf[keyLen+consts.TIMESTAMP_LEN:],
+		EncryptionKey: buf[:keyLen],
+		Timestamp:     buf[keyLen : keyLen+consts.TIMESTAMP_LEN],
+	}
+	offset := keyLen + consts.TIMESTAMP_LEN
+	if paddingLen != 0 {
+		var err error
+		if response.Padding, err = types.ParsePaddingPolicy(buf[offset : offset+paddingLen]); err != nil {
+			return response, fmt.Errorf("failed parsing padding policy of the issuer response: %w", err)
+		}
+		offset += paddingLen
+	}
+	if isSeedBased {
+		response.TokenSeed = buf[offset:]
+	} else if tokenFormat != types.TokenFormatCWT {
+		response.AllRandomBytes = buf[offset:]
+	} else {
+		// CWT Tokens
+		tokenCount := int(request.NumberOfTokensDividedByMultiplier) * consts.TOKEN_NUM_MULTIPLIER
+		response.CWTTokens = make([][]byte, tokenCount)
+		lenBuf := make([]byte, 2)
+		for i := range response.CWTTokens {
+			if n, err := r.ReadFull(lenBuf, timeout); err != nil || n != 2 {
+				return response, fmt.Errorf("failed reading the length of a cwt token")
+			}
+			response.CWTTokens[i] = make([]byte, binary.BigEndian.Uint16(lenBuf))
+			if n, err := r.ReadFull(response.CWTTokens[i], timeout); err != nil || n != len(response.CWTTokens[i]) {
+				return response, fmt.Errorf("failed reading a cwt token")
+			}
+		}
 	}
 
 	return response, nil
@@ -151,11 +233,11 @@ func SendVerifierRequest(ctx context.Context, conn net.Conn, timeout time.Durati
 	return err
 }
 
-func ParseVerifierRequest(ctx context.Context, conn net.Conn, timeout time.Duration) (types.VerifierRequest, error) {
+func ParseVerifierRequest(r *ConnReader, timeout time.Duration) (types.VerifierRequest, error) {
 	buf := make([]byte, 1+consts.TOKEN_SIZE)
 
 	// Read the flag and token
-	if n, err := ConnRead(ctx, conn, buf, timeout); err != nil || n != len(buf) {
+	if n, err := r.ReadFull(buf, timeout); err != nil || n != len(buf) {
 		return types.VerifierRequest{}, fmt.Errorf("failed reading verifier request")
 	}
 
@@ -182,6 +264,9 @@ func SendVerifierResponse(ctx context.Context, conn net.Conn, timeout time.Durat
 
 		// Encryption Key
 		buf = append(buf, verifierResponse.EncryptionKey...)
+
+		// Padding Policy
+		buf = verifierResponse.Padding.AppendBytes(buf)
 	}
 
 	if verifierResponse.ResultCode.IsSuccess() {
@@ -197,24 +282,24 @@ func SendVerifierResponse(ctx context.Context, conn net.Conn, timeout time.Durat
 	return err
 }
 
-func ParseVerifierResponse(ctx context.Context, conn net.Conn, timeout time.Duration, request types.VerifierRequest) (types.VerifierResponse, error) {
+func ParseVerifierResponse(r *ConnReader, timeout time.Duration, request types.VerifierRequest) (types.VerifierResponse, error) {
 	buf := make([]byte, 2)
 	var response types.VerifierResponse
 
 	// Read the result code
-	if n, err := ConnRead(ctx, conn, buf[:1], timeout); err != nil || n != 1 {
+	if n, err := r.ReadFull(buf[:1], timeout); err != nil || n != 1 {
 		return response, fmt.Errorf("failed reading the result code field of a verifier response")
 	}
 	response.ResultCode = types.VerificationResultCode(buf[0])
 
 	if response.ResultCode.IsSuccessEncKey() {
 		// Read Token Index and Payload AEAD Type
-		if n, err := ConnRead(ctx, conn, buf, timeout); err != nil || n != 2 {
+		if n, err := r.ReadFull(buf, timeout); err != nil || n != 2 {
 			return response, fmt.Errorf("failed reading Token Index field of a verifier response")
 		}
 		response.TokenIndex = binary.BigEndian.Uint16(buf)
 
-		if n, err := ConnRead(ctx, conn, buf[:1], timeout); err != nil || n != 1 {
+		if n, err := r.ReadFull(buf[:1], timeout); err != nil || n != 1 {
 			return response, fmt.Errorf("failed reading Payload AEAD Type field of a verifier response")
 		}
 		response.PayloadAEADType = types.PayloadAEADType(buf[0])
@@ -222,14 +307,24 @@ func ParseVerifierResponse(ctx context.Context, conn net.Conn, timeout time.Dura
 		// Read Encryption Key
 		keyLen := response.PayloadAEADType.GetKeyLen()
 		response.EncryptionKey = make([]byte, keyLen)
-		if n, err := ConnRead(ctx, conn, response.EncryptionKey, timeout); err != nil || n != keyLen {
+		if n, err := r.ReadFull(response.EncryptionKey, timeout); err != nil || n != keyLen {
 			return response, fmt.Errorf("failed reading Encryption Key field of a verifier response")
 		}
+
+		// Read Padding Policy
+		paddingBytes := make([]byte, types.PADDING_POLICY_LEN)
+		if n, err := r.ReadFull(paddingBytes, timeout); err != nil || n != types.PADDING_POLICY_LEN {
+			return response, fmt.Errorf("failed reading Padding Policy field of a verifier response")
+		}
+		var err error
+		if response.Padding, err = types.ParsePaddingPolicy(paddingBytes); err != nil {
+			return response, fmt.Errorf("failed parsing Padding Policy field of a verifier response: %w", err)
+		}
 	}
 
 	if response.ResultCode.IsSuccess() {
 		// Read Topic Length
-		if n, err := ConnRead(ctx, conn, buf, timeout); err != nil || n != 2 {
+		if n, err := r.ReadFull(buf, timeout); err != nil || n != 2 {
 			return response, fmt.Errorf("failed reading Topic Length field of a verifier response")
 		}
 		topicLen := binary.BigEndian.Uint16(buf)
@@ -239,7 +334,7 @@ func ParseVerifierResponse(ctx context.Context, conn net.Conn, timeout time.Dura
 			return response, fmt.Errorf("invalid Topic length")
 		}
 		response.Topic = make([]byte, topicLen)
-		if n, err := ConnRead(ctx, conn, response.Topic, timeout); err != nil || n != int(topicLen) {
+		if n, err := r.ReadFull(response.Topic, timeout); err != nil || n != int(topicLen) {
 			return response, fmt.Errorf("failed reading Topic field of a verifier response")
 		}
 	}
@@ -0,0 +1,51 @@
+package funcs
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"fmt"
+	"os"
+)
+
+// Values of tlsclientauth of the server conf, for MQTT Interface and the dashboard
+const (
+	TLS_CLIENT_AUTH_NONE    = "none" // TLS only (default)
+	TLS_CLIENT_AUTH_REQUEST = "request"
+	TLS_CLIENT_AUTH_REQUIRE = "require" // mTLS
+)
+
+// TLS 1.3 of a server with its certificate, verifying client certificates with the ca certificate as of clientAuth
+func LoadServerTLSConfig(certFilePath string, keyFilePath string, caCertFilePath string, clientAuth string) (tlsConf *tls.Config, err error) {
+	cert, err := tls.LoadX509KeyPair(certFilePath, keyFilePath)
+	if err != nil {
+		err = fmt.Errorf("failed to load server certificate: %w", err)
+		return
+	}
+	tlsConf = &tls.Config{
+		Certificates: []tls.Certificate{cert},
+		MinVersion:   tls.VersionTLS13,
+	}
+
+	switch clientAuth {
+	case "", TLS_CLIENT_AUTH_NONE:
+		tlsConf.ClientAuth = tls.NoClientCert
+		return
+	case TLS_CLIENT_AUTH_REQUEST:
+		tlsConf.ClientAuth = tls.VerifyClientCertIfGiven
+	case TLS_CLIENT_AUTH_REQUIRE:
+		tlsConf.ClientAuth = tls.RequireAndVerifyClientCert
+	default:
+		err = fmt.Errorf("unknown tlsclientauth %q", clientAuth)
+		return
+	}
+
+	caCert, err := os.ReadFile(caCertFilePath)
+	if err != nil {
+		err = fmt.Errorf("failed to load ca certificate: %w", err)
+		return
+	}
+	caCertPool := x509.NewCertPool()
+	caCertPool.AppendCertsFromPEM(caCert)
+	tlsConf.ClientCAs = caCertPool
+	return
+}
@@ -0,0 +1,3 @@
+module mqttmtd/logging
+
+go 1.22.5
@@ -0,0 +1,163 @@
+package logging
+
+import (
+	"context"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"log/slog"
+	"mqttmtd/config"
+	"os"
+	"slices"
+	"strings"
+	"sync/atomic"
+)
+
+const (
+	FORMAT_TEXT = "text"
+	FORMAT_JSON = "json"
+
+	KEY_COMPONENT = "component"
+
+	REDACTED = "[redacted]"
+)
+
+/*
+Attribute keys whose values are replaced with REDACTED unless config.LogConfig.Unredacted, so that keys and tokens
+logged with them never reach the output. Values of other keys can be hidden with Secret.
+*/
+var sensitiveKeys = []string{"token", "key", "enckey", "seed", "secret"}
+
+// Handler and levels in effect, replaced as a whole by Init
+type state struct {
+	handler    slog.Handler
+	level      slog.Level
+	components map[string]slog.Level
+	unredacted bool
+}
+
+var current atomic.Pointer[state]
+
+func init() {
+	current.Store(&state{handler: newHandler(os.Stdout, FORMAT_TEXT, false), level: slog.LevelInfo})
+}
+
+func newHandler(w io.Writer, format string, unredacted bool) slog.Handler {
+	opts := &slog.HandlerOptions{
+		// Levels are filtered by componentHandler
+		Level: slog.LevelDebug,
+		ReplaceAttr: func(groups []string, a slog.Attr) slog.Attr {
+			if !unredacted && slices.Contains(sensitiveKeys, strings.ToLower(a.Key)) {
+				a.Value = slog.StringValue(REDACTED)
+			}
+			return a
+		},
+	}
+	if format == FORMAT_JSON {
+		return slog.NewJSONHandler(w, opts)
+	}
+	return slog.NewTextHandler(w, opts)
+}
+
+// "debug", "info", "warn" or "error" in any case, info when empty
+func ParseLevel(s string) (level slog.Level, err error) {
+	if s == "" {
+		level = slog.LevelInfo
+		return
+	}
+	if err = level.UnmarshalText([]byte(s)); err != nil {
+		err = fmt.Errorf("invalid log level: %s", s)
+	}
+	return
+}
+
+/*
+Apply the config to the loggers of all components, including those made by For before. The standard log package and
+slog.Default are routed to the logger of defaultComponent as well.
+*/
+func Init(conf config.LogConfig, defaultComponent string) (err error) {
+	newState := &state{components: make(map[string]slog.Level), unredacted: conf.Unredacted}
+	if newState.level, err = ParseLevel(conf.Level); err != nil {
+		return
+	}
+	for component, levelStr := range conf.Components {
+		if newState.components[component], err = ParseLevel(levelStr); err != nil {
+			return
+		}
+	}
+	switch conf.Format {
+	case "", FORMAT_TEXT, FORMAT_JSON:
+	default:
+		err = fmt.Errorf("invalid log format: %s", conf.Format)
+		return
+	}
+	newState.handler = newHandler(os.Stdout, conf.Format, conf.Unredacted)
+	current.Store(newState)
+	slog.SetDefault(For(defaultComponent))
+	return
+}
+
+// Logger of a component, whose records carry it in KEY_COMPONENT
+func For(component string) *slog.Logger {
+	return slog.New(&componentHandler{component: component})
+}
+
+// Log at error level and exit, for failures on startup
+func Fatal(logger *slog.Logger, msg string, args ...any) {
+	logger.Error(msg, args...)
+	os.Exit(1)
+}
+
+/*
+Handler of a component which resolves the handler in effect on each record, so that loggers made before Init follow
+the config. Attributes and groups added by With and WithGroup are replayed on it.
+*/
+type componentHandler struct {
+	component string
+	wrappers  []func(slog.Handler) slog.Handler
+}
+
+func (h *componentHandler) Enabled(_ context.Context, level slog.Level) bool {
+	st := current.Load()
+	if componentLevel, ok := st.components[h.component]; ok {
+		return level >= componentLevel
+	}
+	return level >= st.level
+}
+
+func (h *componentHandler) Handle(ctx context.Context, r slog.Record) error {
+	handler := current.Load().handler.WithAttrs([]slog.Attr{slog.String(KEY_COMPONENT, h.component)})
+	for _, wrap := range h.wrappers {
+		handler = wrap(handler)
+	}
+	return handler.Handle(ctx, r)
+}
+
+func (h *componentHandler) with(wrap func(slog.Handler) slog.Handler) slog.Handler {
+	return &componentHandler{component: h.component, wrappers: append(slices.Clip(h.wrappers), wrap)}
+}
+
+func (h *componentHandler) WithAttrs(attrs []slog.Attr) slog.Handler {
+	return h.with(func(handler slog.Handler) slog.Handler { return handler.WithAttrs(attrs) })
+}
+
+func (h *componentHandler) WithGroup(name string) slog.Handler {
+	return h.with(func(handler slog.Handler) slog.Handler { return handler.WithGroup(name) })
+}
+
+// Bytes logged in hex only if config.LogConfig.Unredacted, such as keys and tokens under keys not in sensitiveKeys
+type Secret []byte
+
+func (s Secret) LogValue() slog.Value {
+	if current.Load().unredacted {
+		return slog.StringValue(hex.EncodeToString(s))
+	}
+	return slog.StringValue(REDACTED)
+}
+
+// Bytes logged in hex, such as packets
+type Hex []byte
+
+func (h Hex) LogValue() slog.Value {
+	return slog.StringValue(hex.EncodeToString(h))
+}
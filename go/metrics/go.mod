@@ -0,0 +1,3 @@
+module mqttmtd/metrics
+
+go 1.22.5
@@ -0,0 +1,363 @@
+package metrics
+
+import (
+	"bufio"
+	"fmt"
+	"math"
+	"net/http"
+	"slices"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+/*
+Metrics in the Prometheus text exposition format, served on /metrics of each binary. Metrics and labels below are shared
+by the authserver and MQTT Interface so that dashboards can put them side by side, told apart by the job of the scrape.
+*/
+const (
+	METRICS_PATH = "/metrics"
+
+	// Verifications by access and result, counted by Verifier and by MQTT Interface, including CWT tokens for the latter
+	METRIC_VERIFICATIONS = "mqttmtd_verifications_total"
+	// Verification latency by access, in Verifier for the former and a round trip to it for the latter
+	METRIC_VERIFICATION_DURATION = "mqttmtd_verification_duration_seconds"
+
+	LABEL_CLIENT    = "client"
+	LABEL_TOPIC     = "topic"
+	LABEL_ACCESS    = "access"    // "pub" or "sub"
+	LABEL_RESULT    = "result"    // see RESULT_*
+	LABEL_AEAD      = "aead"      // types.PayloadAEADType.String()
+	LABEL_OPERATION = "operation" // "seal" or "open"
+	LABEL_LISTENER  = "listener"
+	LABEL_DIRECTION = "direction" // "cli2mqtt" or "mqtt2cli"
+	LABEL_KIND      = "kind"
+
+	ACCESS_PUB = "pub"
+	ACCESS_SUB = "sub"
+
+	// Results of requests other than verifications, which are labeled with types.VerificationResultCode.String()
+	RESULT_OK      = "ok"
+	RESULT_INVALID = "invalid"
+	RESULT_DENIED  = "denied"
+	RESULT_ERROR   = "error"
+
+	TYPE_COUNTER   = "counter"
+	TYPE_GAUGE     = "gauge"
+	TYPE_HISTOGRAM = "histogram"
+)
+
+// Buckets of latencies in seconds, from 100us to 1s
+var LatencyBuckets = []float64{0.0001, 0.00025, 0.0005, 0.001, 0.0025, 0.005, 0.01, 0.025, 0.05, 0.1, 0.25, 0.5, 1}
+
+func AccessLabel(accessTypeIsPub bool) string {
+	if accessTypeIsPub {
+		return ACCESS_PUB
+	}
+	return ACCESS_SUB
+}
+
+type collector interface {
+	write(w *bufio.Writer)
+}
+
+var registry struct {
+	sync.Mutex
+	collectors []collector
+	names      map[string]struct{}
+}
+
+func register(name string, c collector) {
+	registry.Lock()
+	defer registry.Unlock()
+	if _, found := registry.names[name]; found {
+		panic("metrics: " + name + " registered twice")
+	}
+	if registry.names == nil {
+		registry.names = make(map[string]struct{})
+	}
+	registry.names[name] = struct{}{}
+	registry.collectors = append(registry.collectors, c)
+}
+
+// Float64 updated atomically
+type atomicFloat struct {
+	bits atomic.Uint64
+}
+
+func (f *atomicFloat) add(v float64) {
+	for {
+		old := f.bits.Load()
+		if f.bits.CompareAndSwap(old, math.Float64bits(math.Float64frombits(old)+v)) {
+			return
+		}
+	}
+}
+
+func (f *atomicFloat) set(v float64) {
+	f.bits.Store(math.Float64bits(v))
+}
+
+func (f *atomicFloat) load() float64 {
+	return math.Float64frombits(f.bits.Load())
+}
+
+/*
+Series of a metric by label values, created on first use. Label values must be given in the order of the label names.
+*/
+type vec[S any] struct {
+	name       string
+	help       string
+	typ        string
+	labelNames []string
+	newSeries  func() *S
+
+	lock   sync.RWMutex
+	series map[string]*labeledSeries[S]
+}
+
+type labeledSeries[S any] struct {
+	labelValues []string
+	s           *S
+}
+
+func newVec[S any](name, help, typ string, labelNames []string, newSeries func() *S) *vec[S] {
+	return &vec[S]{name: name, help: help, typ: typ, labelNames: labelNames, newSeries: newSeries, series: make(map[string]*labeledSeries[S])}
+}
+
+func (v *vec[S]) with(labelValues []string) *S {
+	if len(labelValues) != len(v.labelNames) {
+		panic(fmt.Sprintf("metrics: %s takes %d label values, got %d", v.name, len(v.labelNames), len(labelValues)))
+	}
+	key := strings.Join(labelValues, "\xff")
+	v.lock.RLock()
+	ls, found := v.series[key]
+	v.lock.RUnlock()
+	if found {
+		return ls.s
+	}
+
+	v.lock.Lock()
+	defer v.lock.Unlock()
+	if ls, found = v.series[key]; !found {
+		ls = &labeledSeries[S]{labelValues: slices.Clone(labelValues), s: v.newSeries()}
+		v.series[key] = ls
+	}
+	return ls.s
+}
+
+// Series sorted by label values, so that the output is stable
+func (v *vec[S]) sorted() (series []*labeledSeries[S]) {
+	v.lock.RLock()
+	for _, ls := range v.series {
+		series = append(series, ls)
+	}
+	v.lock.RUnlock()
+	slices.SortFunc(series, func(a, b *labeledSeries[S]) int { return slices.Compare(a.labelValues, b.labelValues) })
+	return
+}
+
+func (v *vec[S]) writeHeader(w *bufio.Writer) {
+	fmt.Fprintf(w, "# HELP %s %s\n# TYPE %s %s\n", v.name, escapeHelp(v.help), v.name, v.typ)
+}
+
+type CounterVec struct {
+	*vec[atomicFloat]
+}
+
+func NewCounterVec(name, help string, labelNames ...string) (c *CounterVec) {
+	c = &CounterVec{newVec(name, help, TYPE_COUNTER, labelNames, func() *atomicFloat { return &atomicFloat{} })}
+	register(name, c)
+	return
+}
+
+func (c *CounterVec) Inc(labelValues ...string) {
+	c.with(labelValues).add(1)
+}
+
+// v must not be negative
+func (c *CounterVec) Add(v float64, labelValues ...string) {
+	c.with(labelValues).add(v)
+}
+
+func (c *CounterVec) write(w *bufio.Writer) {
+	c.writeHeader(w)
+	for _, ls := range c.sorted() {
+		writeSample(w, c.name, c.labelNames, ls.labelValues, "", "", ls.s.load())
+	}
+}
+
+type GaugeVec struct {
+	*vec[atomicFloat]
+}
+
+func NewGaugeVec(name, help string, labelNames ...string) (g *GaugeVec) {
+	g = &GaugeVec{newVec(name, help, TYPE_GAUGE, labelNames, func() *atomicFloat { return &atomicFloat{} })}
+	register(name, g)
+	return
+}
+
+func (g *GaugeVec) Set(v float64, labelValues ...string) {
+	g.with(labelValues).set(v)
+}
+
+func (g *GaugeVec) Add(v float64, labelValues ...string) {
+	g.with(labelValues).add(v)
+}
+
+func (g *GaugeVec) Inc(labelValues ...string) {
+	g.with(labelValues).add(1)
+}
+
+func (g *GaugeVec) Dec(labelValues ...string) {
+	g.with(labelValues).add(-1)
+}
+
+func (g *GaugeVec) write(w *bufio.Writer) {
+	g.writeHeader(w)
+	for _, ls := range g.sorted() {
+		writeSample(w, g.name, g.labelNames, ls.labelValues, "", "", ls.s.load())
+	}
+}
+
+// Gauge of an unlabeled value taken on each scrape, such as the size of a list
+type GaugeFunc struct {
+	name string
+	help string
+	f    func() float64
+}
+
+func NewGaugeFunc(name, help string, f func() float64) (g *GaugeFunc) {
+	g = &GaugeFunc{name: name, help: help, f: f}
+	register(name, g)
+	return
+}
+
+func (g *GaugeFunc) write(w *bufio.Writer) {
+	fmt.Fprintf(w, "# HELP %s %s\n# TYPE %s %s\n", g.name, escapeHelp(g.help), g.name, TYPE_GAUGE)
+	writeSample(w, g.name, nil, nil, "", "", g.f())
+}
+
+type histogram struct {
+	counts []atomic.Uint64 // by bucket, not cumulative, the last one for +Inf
+	sum    atomicFloat
+}
+
+type HistogramVec struct {
+	*vec[histogram]
+	buckets []float64
+}
+
+// buckets are upper bounds in ascending order, +Inf is added
+func NewHistogramVec(name, help string, buckets []float64, labelNames ...string) (h *HistogramVec) {
+	buckets = slices.Clone(buckets)
+	h = &HistogramVec{
+		vec: newVec(name, help, TYPE_HISTOGRAM, labelNames, func() *histogram {
+			return &histogram{counts: make([]atomic.Uint64, len(buckets)+1)}
+		}),
+		buckets: buckets,
+	}
+	register(name, h)
+	return
+}
+
+func (h *HistogramVec) Observe(v float64, labelValues ...string) {
+	s := h.with(labelValues)
+	i, _ := slices.BinarySearch(h.buckets, v)
+	s.counts[i].Add(1)
+	s.sum.add(v)
+}
+
+// Seconds elapsed since start
+func (h *HistogramVec) ObserveSince(start time.Time, labelValues ...string) {
+	h.Observe(time.Since(start).Seconds(), labelValues...)
+}
+
+func (h *HistogramVec) write(w *bufio.Writer) {
+	h.writeHeader(w)
+	for _, ls := range h.sorted() {
+		var cumulative uint64
+		for i := range ls.s.counts {
+			cumulative += ls.s.counts[i].Load()
+			le := "+Inf"
+			if i < len(h.buckets) {
+				le = formatFloat(h.buckets[i])
+			}
+			writeSample(w, h.name+"_bucket", h.labelNames, ls.labelValues, "le", le, float64(cumulative))
+		}
+		writeSample(w, h.name+"_sum", h.labelNames, ls.labelValues, "", "", ls.s.sum.load())
+		writeSample(w, h.name+"_count", h.labelNames, ls.labelValues, "", "", float64(cumulative))
+	}
+}
+
+func writeSample(w *bufio.Writer, name string, labelNames, labelValues []string, extraName, extraValue string, v float64) {
+	w.WriteString(name)
+	if len(labelNames) > 0 || extraName != "" {
+		w.WriteByte('{')
+		for i, labelName := range labelNames {
+			if i > 0 {
+				w.WriteByte(',')
+			}
+			fmt.Fprintf(w, "%s=\"%s\"", labelName, escapeLabelValue(labelValues[i]))
+		}
+		if extraName != "" {
+			if len(labelNames) > 0 {
+				w.WriteByte(',')
+			}
+			fmt.Fprintf(w, "%s=\"%s\"", extraName, extraValue)
+		}
+		w.WriteByte('}')
+	}
+	w.WriteByte(' ')
+	w.WriteString(formatFloat(v))
+	w.WriteByte('\n')
+}
+
+func formatFloat(v float64) string {
+	switch {
+	case math.IsInf(v, 1):
+		return "+Inf"
+	case math.IsInf(v, -1):
+		return "-Inf"
+	case math.IsNaN(v):
+		return "NaN"
+	}
+	return strconv.FormatFloat(v, 'g', -1, 64)
+}
+
+var (
+	helpReplacer       = strings.NewReplacer(`\`, `\\`, "\n", `\n`)
+	labelValueReplacer = strings.NewReplacer(`\`, `\\`, "\n", `\n`, `"`, `\"`)
+)
+
+func escapeHelp(s string) string {
+	return helpReplacer.Replace(s)
+}
+
+func escapeLabelValue(s string) string {
+	return labelValueReplacer.Replace(s)
+}
+
+// All metrics registered, in the order of registration
+func Handler() http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "text/plain; version=0.0.4; charset=utf-8")
+		bw := bufio.NewWriter(w)
+		registry.Lock()
+		collectors := slices.Clone(registry.collectors)
+		registry.Unlock()
+		for _, c := range collectors {
+			c.write(bw)
+		}
+		bw.Flush()
+	})
+}
+
+// Serve Handler on METRICS_PATH of the port until it fails
+func Serve(port int) error {
+	mux := http.NewServeMux()
+	mux.Handle(METRICS_PATH, Handler())
+	return http.ListenAndServe(fmt.Sprintf(":%d", port), mux)
+}
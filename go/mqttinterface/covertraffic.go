@@ -0,0 +1,167 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	crand "crypto/rand"
+	"encoding/binary"
+	"fmt"
+	"math/rand"
+	"mqttmtd/config"
+	"mqttmtd/mqttinterface/mqttparser"
+	"mqttmtd/types"
+	"strings"
+	"sync/atomic"
+	"time"
+)
+
+/*
+Cover traffic. Clients may send PUBLISH and SUBSCRIBE with decoy tokens issued with types.OptionCoverTraffic, which the
+verifier answers with VerfCover; they are acknowledged as real ones and discarded. MQTT Interface in turn sends dummy
+PUBLISH to each client at random intervals, when config.Server.MqttInterface.CoverTraffic.Interval is set, so that an
+observer can infer neither the activity of devices from timing nor the real messages from sizes. They carry the topic
+name of the last real PUBLISH to the client and random bytes of the length of a sealed payload of the session, which
+the client discards as it fails to open them.
+*/
+type trafficKind int
+
+const (
+	TRAFFIC_REAL_PUBLISH    trafficKind = iota // forwarded from the client
+	TRAFFIC_COVER_PUBLISH                      // from the client, discarded
+	TRAFFIC_REAL_SUBSCRIBE                     // topic filters forwarded from the client
+	TRAFFIC_COVER_SUBSCRIBE                    // topic filters from the client, discarded
+	TRAFFIC_COVER_SENT                         // dummy PUBLISH sent to the client
+	NUM_TRAFFIC_KINDS
+)
+
+var trafficKindNames = [NUM_TRAFFIC_KINDS]string{"realpublish", "coverpublish", "realsubscribe", "coversubscribe", "coversent"}
+
+func (k trafficKind) String() string {
+	return trafficKindNames[k]
+}
+
+// Number of messages of each trafficKind, of a session or in total
+type trafficCounters [NUM_TRAFFIC_KINDS]atomic.Uint64
+
+func (c *trafficCounters) String() string {
+	var sb strings.Builder
+	for kind := range NUM_TRAFFIC_KINDS {
+		if kind > 0 {
+			sb.WriteByte(' ')
+		}
+		fmt.Fprintf(&sb, "%s=%d", kind, c[kind].Load())
+	}
+	return sb.String()
+}
+
+var totalTraffic trafficCounters
+
+func (s *mqttSession) countTraffic(kind trafficKind) {
+	s.traffic[kind].Add(1)
+	totalTraffic[kind].Add(1)
+	trafficMetric.Inc(kind.String())
+}
+
+// Answer a PUBLISH with a cover traffic token as if it were forwarded, and drop it
+func (s *mqttSession) discardCoverPublish(ctx context.Context, qos int, contentBetween []byte) (err error) {
+	s.countTraffic(TRAFFIC_COVER_PUBLISH)
+	if qos == 0 {
+		return
+	}
+	responseType := MqttControlPUBACK
+	packetID := binary.BigEndian.Uint16(contentBetween[:2])
+	if qos == 2 {
+		responseType = MqttControlPUBREC
+		s.droppedQoS2[packetID] = struct{}{}
+	}
+	err = s.writeToClient(ctx, newPubResponsePacket(responseType, s.cliMqttVersion, packetID, REASON_CODE_SUCCESS))
+	return
+}
+
+// What cover traffic imitates of the real PUBLISH to the client of a session
+type coverShape struct {
+	topicName []byte
+	aeadType  types.PayloadAEADType
+	padding   types.PaddingPolicy
+}
+
+// Let cover traffic take the topic name sent to the client and the current sealing of the session
+func (s *mqttSession) imitateInCoverTraffic(topicName []byte) {
+	if config.Server.MqttInterface.CoverTraffic.Interval <= 0 {
+		return
+	}
+	s.coverShape.Store(&coverShape{
+		topicName: bytes.Clone(topicName),
+		aeadType:  s.aeadInfo.AEADType,
+		padding:   s.aeadInfo.Padding,
+	})
+}
+
+/*
+Dummy QoS 0 PUBLISH of the shape. The payload is random bytes of the length of a plaintext of size in [minsize, maxsize]
+once padded and sealed, as is without encryption. The topic name is HIDDEN_TOPIC_NAME before any real PUBLISH.
+*/
+func newCoverPublishPacket(mqttVersion byte, shape *coverShape) (packet []byte, err error) {
+	if shape == nil {
+		shape = &coverShape{topicName: []byte(HIDDEN_TOPIC_NAME)}
+	}
+	policy := config.Server.MqttInterface.CoverTraffic
+	size := policy.MinSize
+	if policy.MaxSize > policy.MinSize {
+		size += rand.Intn(policy.MaxSize - policy.MinSize + 1)
+	}
+	if shape.aeadType.IsEncryptionEnabled() {
+		if shape.padding.Mode == types.PADDING_FIXED {
+			// Real payloads too long for the size are not sent
+			size = min(size, int(shape.padding.Size)-1)
+		}
+		if size, err = shape.padding.PaddedLen(size); err != nil {
+			return
+		}
+		size += shape.aeadType.GetTagLen()
+	}
+
+	varHdrAndPayload := binary.BigEndian.AppendUint16(nil, uint16(len(shape.topicName)))
+	varHdrAndPayload = append(varHdrAndPayload, shape.topicName...)
+	if mqttVersion >= 5 {
+		varHdrAndPayload = append(varHdrAndPayload, 0x00)
+	}
+	payload := make([]byte, size)
+	if _, err = crand.Read(payload); err != nil {
+		return
+	}
+	varHdrAndPayload = append(varHdrAndPayload, payload...)
+
+	var encodedRemainingLen []byte
+	if encodedRemainingLen, err = mqttparser.EncodeToVariableByteInteger(len(varHdrAndPayload)); err != nil {
+		return
+	}
+	packet = append(append([]byte{byte(MqttControlPUBLISH) << 4}, encodedRemainingLen...), varHdrAndPayload...)
+	return
+}
+
+/*
+Send dummy PUBLISH to the client of the session until ctx is done. Intervals are exponentially distributed around
+config.Server.MqttInterface.CoverTraffic.Interval, as of a Poisson process, so that they are not periodic.
+*/
+func runCoverTraffic(ctx context.Context, sess *mqttSession) {
+	interval := config.Server.MqttInterface.CoverTraffic.Interval
+	for {
+		timer := time.NewTimer(time.Duration(rand.ExpFloat64() * float64(interval)))
+		select {
+		case <-ctx.Done():
+			timer.Stop()
+			return
+		case <-timer.C:
+		}
+		packet, err := newCoverPublishPacket(sess.cliMqttVersion, sess.coverShape.Load())
+		if err != nil {
+			sess.mqtt2CliLogger.Error("failed preparing cover PUBLISH", "err", err)
+			return
+		}
+		if err = sess.writeToClient(ctx, packet); err != nil {
+			return
+		}
+		sess.countTraffic(TRAFFIC_COVER_SENT)
+	}
+}
@@ -0,0 +1,110 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"mqttmtd/config"
+	"mqttmtd/consts"
+	"mqttmtd/logging"
+	"mqttmtd/metrics"
+	"mqttmtd/types"
+	"time"
+)
+
+const (
+	CWT_REPLAY_GUARD_SWEEP_INTERVAL = time.Minute
+)
+
+var (
+	cwtKey         []byte
+	cwtReplayGuard = &types.CWTReplayGuard{}
+
+	cwtLogger = logging.For("cwt")
+)
+
+/*
+CWT tokens are verified without Verifier, and replays are caught by cwtReplayGuard of this instance only. Behind a load
+balancer, a token could be replayed once on every other instance, so the configuration must state that each client is
+always routed to the same instance.
+*/
+func loadCWTKey() (err error) {
+	if config.Server.FilePaths.CwtKeyFilePath == "" {
+		return
+	}
+	if !config.Server.MqttInterface.CwtStickyRouting {
+		return fmt.Errorf("cwt tokens need mqttinterface.cwtstickyrouting, as replay protection is per instance")
+	}
+	cwtKey, err = types.LoadCWTKey(config.Server.FilePaths.CwtKeyFilePath)
+	return
+}
+
+func runCWTReplayGuardSweeper() {
+	for {
+		time.Sleep(CWT_REPLAY_GUARD_SWEEP_INTERVAL)
+		if removed := cwtReplayGuard.RemoveExpired(time.Now()); removed > 0 {
+			cwtLogger.Debug("forgot expired batches", "removed", removed)
+		}
+	}
+}
+
+// Tokens of TOKEN_SIZE are sent to Verifier, others are taken as CWT tokens and verified here
+func verifyToken(ctx context.Context, accessTypeIsPub bool, token []byte) (response types.VerifierResponse, err error) {
+	start, access := time.Now(), metrics.AccessLabel(accessTypeIsPub)
+	defer func() {
+		verificationDurationMetric.ObserveSince(start, access)
+		if err != nil {
+			verificationsMetric.Inc(access, metrics.RESULT_ERROR)
+		} else {
+			verificationsMetric.Inc(access, response.ResultCode.String())
+		}
+	}()
+	if len(token) == consts.TOKEN_SIZE {
+		return communicateWithVerifier(ctx, types.VerifierRequest{
+			AccessTypeIsPub: accessTypeIsPub,
+			Token:           token,
+		})
+	}
+	return verifyCWTToken(accessTypeIsPub, token), nil
+}
+
+func verifyCWTToken(accessTypeIsPub bool, token []byte) (response types.VerifierResponse) {
+	response.ResultCode = types.VerfFail
+	if cwtKey == nil {
+		cwtLogger.Info("token is not of TOKEN_SIZE, but no cwt key is configured")
+		return
+	}
+	claims, err := types.OpenCWTToken(token, cwtKey)
+	if err != nil {
+		cwtLogger.Info("verification failed", "err", err)
+		return
+	}
+	if claims.AccessTypeIsPub != accessTypeIsPub {
+		cwtLogger.Info("access type mismatch")
+		return
+	}
+	if claims.ExpiresAt.Before(time.Now()) {
+		cwtLogger.Info("token expired")
+		return
+	}
+	if !cwtReplayGuard.MarkUsed(claims) {
+		cwtLogger.Warn("token replayed", "client", claims.ClientName, "index", claims.TokenIndex)
+		response.ResultCode = types.VerfSuspicious
+		return
+	}
+
+	if claims.PayloadAEADType.IsEncryptionEnabled() {
+		if response.EncryptionKey, err = claims.PayloadAEADType.DeriveCWTPayloadKey(cwtKey, claims.BatchID); err != nil {
+			cwtLogger.Info("verification failed", "err", err)
+			response.EncryptionKey = nil
+			return
+		}
+		response.ResultCode = types.VerfSuccessEncKey
+		response.TokenIndex = claims.TokenIndex
+		response.PayloadAEADType = claims.PayloadAEADType
+		response.Padding = claims.Padding
+	} else {
+		response.ResultCode = types.VerfSuccess
+	}
+	response.Topic = claims.Topic
+	return
+}
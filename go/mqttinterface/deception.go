@@ -0,0 +1,213 @@
+package main
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/binary"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"math/rand"
+	"mqttmtd/config"
+	"mqttmtd/funcs"
+	"mqttmtd/logging"
+	"mqttmtd/mqttinterface/mqttparser"
+	"net"
+	"os"
+	"slices"
+	"sync"
+	"time"
+)
+
+// Listeners of MQTT Interface, as referred to by config.Server.MqttInterface.Deception.Listeners
+const (
+	LISTENER_PLAIN     = "plain"
+	LISTENER_TLS       = "tls"
+	LISTENER_WEBSOCKET = "websocket"
+)
+
+const (
+	DEFAULT_DECEPTION_NAMESPACE     = "decoy"
+	DEFAULT_DECEPTION_INTERVAL      = time.Second * 5
+	DECEPTION_TOKEN_DIGEST_LEN  int = 8
+	DECEPTION_FINGERPRINT_LEN   int = 16
+)
+
+/*
+Deception mode. Tokens failing verification on the listeners of config.Server.MqttInterface.Deception.Listeners are not
+rejected, but routed to decoy topics on the broker as if they were valid, so that attackers can be studied instead of
+disconnected. Decoy subscriptions are fed with fake data, and events are recorded in the deception log with the
+fingerprint of the session. Whether listener is one of them.
+*/
+func isDeceptionListener(listener string) bool {
+	return slices.Contains(config.Server.MqttInterface.Deception.Listeners, listener)
+}
+
+// Values of deceptionEvent.Event
+const (
+	DECEPTION_EVENT_SESSION        = "session"
+	DECEPTION_EVENT_PUBLISH        = "publish"
+	DECEPTION_EVENT_SUBSCRIBE      = "subscribe"
+	DECEPTION_EVENT_RESPONSE_TOPIC = "responsetopic"
+	DECEPTION_EVENT_WILL           = "will"
+)
+
+type deceptionEvent struct {
+	Time        time.Time `json:"time"`
+	Event       string    `json:"event"`
+	Remote      string    `json:"remote"`
+	Listener    string    `json:"listener"`
+	Fingerprint string    `json:"fingerprint"`
+	Token       string    `json:"token,omitempty"` // hex
+	DecoyTopic  string    `json:"decoytopic,omitempty"`
+	Detail      string    `json:"detail,omitempty"`
+}
+
+var deceptionLogger = logging.For("deception")
+
+var deceptionLog = struct {
+	sync.Mutex
+	once sync.Once
+	f    *os.File // stdout when config.Server.MqttInterface.Deception.LogFilePath is empty
+}{}
+
+func logDeceptionEvent(event deceptionEvent) {
+	deceptionLog.once.Do(func() {
+		deceptionLog.f = os.Stdout
+		if path := config.Server.MqttInterface.Deception.LogFilePath; path != "" {
+			f, err := os.OpenFile(path, os.O_APPEND|os.O_CREATE|os.O_WRONLY, 0644)
+			if err != nil {
+				deceptionLogger.Warn("failed opening log file, using stdout", "path", path, "err", err)
+				return
+			}
+			deceptionLog.f = f
+		}
+	})
+	event.Time = time.Now()
+	line, err := json.Marshal(event)
+	if err != nil {
+		deceptionLogger.Error("failed encoding event", "err", err)
+		return
+	}
+	deceptionLog.Lock()
+	defer deceptionLog.Unlock()
+	if deceptionLog.f == os.Stdout {
+		// token is redacted unless the log config says otherwise
+		deceptionLogger.Warn(event.Event, "remote", event.Remote, "listener", event.Listener, "fingerprint", event.Fingerprint,
+			"token", event.Token, "decoytopic", event.DecoyTopic, "detail", event.Detail)
+		return
+	}
+	if _, err = deceptionLog.f.Write(append(line, '\n')); err != nil {
+		deceptionLogger.Error("failed writing log file", "err", err)
+	}
+}
+
+/*
+Fingerprint of a client by its CONNECT, from what tends to be fixed for each client implementation and host: remote IP,
+protocol name and level, connect flags, keep alive, property identifiers and client identifier. detail describes them.
+*/
+func fingerprintConnect(remoteAddr net.Addr, mqttVersion byte, varHdrAndPayload []byte) (fingerprint string, detail string) {
+	host := remoteAddr.String()
+	if h, _, err := net.SplitHostPort(host); err == nil {
+		host = h
+	}
+	h := sha256.New()
+	h.Write([]byte(host))
+	h.Write([]byte{0})
+	if len(varHdrAndPayload) >= 10 {
+		// Protocol Name, Protocol Level, Connect Flags and Keep Alive
+		h.Write(varHdrAndPayload[:10])
+	}
+	var propertyIDs []byte
+	if mqttVersion >= 5 && len(varHdrAndPayload) > 10 {
+		if propertiesLen, propertiesLenLen, err := decodeVariableByteInteger(varHdrAndPayload[10:]); err == nil && 10+propertiesLenLen+propertiesLen <= len(varHdrAndPayload) {
+			if properties, err := parseProperties(varHdrAndPayload[10+propertiesLenLen : 10+propertiesLenLen+propertiesLen]); err == nil {
+				for _, property := range properties {
+					propertyIDs = append(propertyIDs, property.ID)
+				}
+			}
+		}
+	}
+	h.Write(propertyIDs)
+	clientID, _, _ := getClientIDFromConnect(mqttVersion, varHdrAndPayload)
+	h.Write([]byte{0})
+	h.Write(clientID)
+
+	fingerprint = hex.EncodeToString(h.Sum(nil))[:DECEPTION_FINGERPRINT_LEN]
+	keepAlive := 0
+	connectFlags := byte(0)
+	if len(varHdrAndPayload) >= 10 {
+		connectFlags = varHdrAndPayload[7]
+		keepAlive = int(binary.BigEndian.Uint16(varHdrAndPayload[8:10]))
+	}
+	detail = fmt.Sprintf("version=%d flags=0x%02x keepalive=%d properties=%x clientid=%q", mqttVersion, connectFlags, keepAlive, propertyIDs, clientID)
+	return
+}
+
+// Decoy topic of a failed token, the same for the same token in a session so that PUBLISH reaches SUBSCRIBE
+func decoyTopic(fingerprint string, token []byte) []byte {
+	namespace := config.Server.MqttInterface.Deception.Namespace
+	if namespace == "" {
+		namespace = DEFAULT_DECEPTION_NAMESPACE
+	}
+	digest := sha256.Sum256(token)
+	return fmt.Appendf(nil, "%s/%s/%s", namespace, fingerprint, hex.EncodeToString(digest[:DECEPTION_TOKEN_DIGEST_LEN]))
+}
+
+// Plausible sensor readings, drifting from the previous ones
+type fakeReading struct {
+	Temperature float64 `json:"temperature"`
+	Humidity    float64 `json:"humidity"`
+	Timestamp   int64   `json:"timestamp"`
+}
+
+func (r *fakeReading) next() []byte {
+	if r.Timestamp == 0 {
+		r.Temperature = 18 + rand.Float64()*8
+		r.Humidity = 35 + rand.Float64()*25
+	}
+	r.Temperature += (rand.Float64() - 0.5) * 0.4
+	r.Humidity += (rand.Float64() - 0.5) * 1.0
+	r.Temperature = float64(int(r.Temperature*10)) / 10
+	r.Humidity = float64(int(r.Humidity*10)) / 10
+	r.Timestamp = time.Now().Unix()
+	payload, _ := json.Marshal(r)
+	return payload
+}
+
+/*
+Publish fake data to topic through the broker connection of the session at QoS 0, until ctx is done. The broker delivers
+them to the decoy subscription as it does for real ones.
+*/
+func runDecoyFeeder(ctx context.Context, brokerConn net.Conn, mqttVersion byte, topic []byte) {
+	interval := config.Server.MqttInterface.Deception.Interval
+	if interval <= 0 {
+		interval = DEFAULT_DECEPTION_INTERVAL
+	}
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	reading := &fakeReading{}
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+		brokerTopic := toCurrentBrokerTopic(topic)
+		varHdrAndPayload := binary.BigEndian.AppendUint16(nil, uint16(len(brokerTopic)))
+		varHdrAndPayload = append(varHdrAndPayload, brokerTopic...)
+		if mqttVersion >= 5 {
+			varHdrAndPayload = append(varHdrAndPayload, 0x00)
+		}
+		varHdrAndPayload = append(varHdrAndPayload, reading.next()...)
+		encodedRemainingLen, err := mqttparser.EncodeToVariableByteInteger(len(varHdrAndPayload))
+		if err != nil {
+			return
+		}
+		packet := append(append([]byte{byte(MqttControlPUBLISH) << 4}, encodedRemainingLen...), varHdrAndPayload...)
+		if _, err = funcs.ConnWrite(ctx, brokerConn, packet, config.Server.SocketTimeout.External); err != nil {
+			deceptionLogger.Warn("failed feeding decoy", "decoytopic", string(topic), "err", err)
+			return
+		}
+	}
+}
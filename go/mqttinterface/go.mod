@@ -1,3 +1,5 @@
 module mqttmtd/mqttinterface
 
 go 1.22.5
+
+require github.com/gorilla/websocket v1.5.3
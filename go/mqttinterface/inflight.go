@@ -0,0 +1,143 @@
+package main
+
+import (
+	"bytes"
+	"mqttmtd/types"
+	"sync"
+	"time"
+)
+
+const (
+	INFLIGHT_PUBLISH_TTL            = time.Minute * 10
+	INFLIGHT_PUBLISH_SWEEP_INTERVAL = time.Minute
+)
+
+/*
+QoS 1/2 PUBLISH from a client whose token was verified but whose flow is not complete yet. A retransmission with DUP=1
+carrying the same token is forwarded with this verification result, instead of spending another token.
+*/
+type inflightPublish struct {
+	token          []byte
+	verfResponse   types.VerifierResponse
+	responseTopic  []byte // real Response Topic swapped in for its token, nil if none
+	pubrecReceived bool   // QoS 2, no more PUBLISH retransmissions expected and released on PUBCOMP
+	expiresAt      time.Time
+}
+
+// In-flight PUBLISH by packet identifier, of an MQTT session which may span several connections with the same client id
+type inflightPublishes struct {
+	sync.Mutex
+	entries     map[uint16]*inflightPublish
+	connections int // connections currently using this session, not swept while positive
+}
+
+func newInflightPublishes() *inflightPublishes {
+	return &inflightPublishes{entries: make(map[uint16]*inflightPublish)}
+}
+
+// Sessions with non-empty client ids, kept beyond connections
+var inflightSessions = struct {
+	sync.Mutex
+	entries map[string]*inflightPublishes
+}{entries: make(map[string]*inflightPublishes)}
+
+// In-flight PUBLISH of the session of clientID. cleanStart discards the existing one. Empty client ids are not shared.
+// release must be called when the connection is closed.
+func loadInflightPublishes(clientID []byte, cleanStart bool) *inflightPublishes {
+	if len(clientID) == 0 {
+		return newInflightPublishes()
+	}
+	inflightSessions.Lock()
+	defer inflightSessions.Unlock()
+	inflight, found := inflightSessions.entries[string(clientID)]
+	if !found || cleanStart {
+		inflight = newInflightPublishes()
+		inflightSessions.entries[string(clientID)] = inflight
+	}
+	inflight.Lock()
+	inflight.connections++
+	inflight.Unlock()
+	return inflight
+}
+
+// Called when the connection that loaded p is closed
+func (p *inflightPublishes) release() {
+	p.Lock()
+	defer p.Unlock()
+	p.connections--
+}
+
+// Verification results of a retransmitted PUBLISH. found is unset unless packetID is in flight with the same token.
+func (p *inflightPublishes) lookupRetransmission(packetID uint16, token []byte) (verfResponse types.VerifierResponse, responseTopic []byte, found bool) {
+	p.Lock()
+	defer p.Unlock()
+	inflight, exists := p.entries[packetID]
+	if !exists || inflight.pubrecReceived || !bytes.Equal(inflight.token, token) {
+		return
+	}
+	inflight.expiresAt = time.Now().Add(INFLIGHT_PUBLISH_TTL)
+	return inflight.verfResponse, inflight.responseTopic, true
+}
+
+func (p *inflightPublishes) add(packetID uint16, token []byte, verfResponse types.VerifierResponse, responseTopic []byte) {
+	p.Lock()
+	defer p.Unlock()
+	p.entries[packetID] = &inflightPublish{
+		token:         bytes.Clone(token),
+		verfResponse:  verfResponse,
+		responseTopic: responseTopic,
+		expiresAt:     time.Now().Add(INFLIGHT_PUBLISH_TTL),
+	}
+}
+
+/*
+Advance the flow of packetID by a response from the broker which has been forwarded to the client. PUBACK, PUBCOMP and
+failed PUBREC end it. Responses lost with the connection leave it in flight, so that the retransmission after reconnection
+is accepted.
+*/
+func (p *inflightPublishes) onResponseForwarded(ctrlType MQTTControlPacketType, packetID uint16, reasonCode byte) {
+	p.Lock()
+	defer p.Unlock()
+	inflight, exists := p.entries[packetID]
+	if !exists {
+		return
+	}
+	if ctrlType == MqttControlPUBREC && reasonCode < 0x80 {
+		inflight.pubrecReceived = true
+		return
+	}
+	delete(p.entries, packetID)
+}
+
+func (p *inflightPublishes) removeExpired(now time.Time) (removed int) {
+	p.Lock()
+	defer p.Unlock()
+	for packetID, inflight := range p.entries {
+		if inflight.expiresAt.Before(now) {
+			delete(p.entries, packetID)
+			removed++
+		}
+	}
+	return
+}
+
+func runInflightPublishSweeper() {
+	for {
+		time.Sleep(INFLIGHT_PUBLISH_SWEEP_INTERVAL)
+		removed := 0
+		now := time.Now()
+		inflightSessions.Lock()
+		for clientID, inflight := range inflightSessions.entries {
+			removed += inflight.removeExpired(now)
+			inflight.Lock()
+			if len(inflight.entries) == 0 && inflight.connections <= 0 {
+				delete(inflightSessions.entries, clientID)
+			}
+			inflight.Unlock()
+		}
+		inflightSessions.Unlock()
+		if removed > 0 {
+			logger.Debug("forgot expired inflight PUBLISH", "removed", removed)
+		}
+	}
+}
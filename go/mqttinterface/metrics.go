@@ -0,0 +1,41 @@
+package main
+
+import (
+	"fmt"
+	"mqttmtd/config"
+	"mqttmtd/metrics"
+	"net/http"
+)
+
+const (
+	DIRECTION_CLI2MQTT = "cli2mqtt"
+	DIRECTION_MQTT2CLI = "mqtt2cli"
+
+	AEAD_OPERATION_SEAL = "seal"
+	AEAD_OPERATION_OPEN = "open"
+)
+
+var (
+	verificationsMetric = metrics.NewCounterVec(metrics.METRIC_VERIFICATIONS, "Token verifications by access and result, including CWT tokens",
+		metrics.LABEL_ACCESS, metrics.LABEL_RESULT)
+	verificationDurationMetric = metrics.NewHistogramVec(metrics.METRIC_VERIFICATION_DURATION, "Duration of token verifications by access, including the round trip to Verifier",
+		metrics.LatencyBuckets, metrics.LABEL_ACCESS)
+	sessionsMetric = metrics.NewGaugeVec("mqttmtd_interface_sessions", "Active sessions by listener",
+		metrics.LABEL_LISTENER)
+	bytesMetric = metrics.NewCounterVec("mqttmtd_interface_bytes_total", "Bytes of packets proxied by direction",
+		metrics.LABEL_DIRECTION)
+	trafficMetric = metrics.NewCounterVec("mqttmtd_interface_messages_total", "Messages by kind of real and cover traffic",
+		metrics.LABEL_KIND)
+	aeadFailuresMetric = metrics.NewCounterVec("mqttmtd_aead_failures_total", "Failures sealing or opening payloads by operation and AEAD",
+		metrics.LABEL_OPERATION, metrics.LABEL_AEAD)
+	droppedDeliveriesMetric = metrics.NewCounterVec("mqttmtd_interface_dropped_deliveries_total", "PUBLISH to subscribers dropped as too long for their fixed padding")
+)
+
+func runMetrics() {
+	logger.Info("starting metrics server", "port", config.Server.Ports.MqttInterfaceMetrics)
+	mux := http.NewServeMux()
+	mux.Handle(metrics.METRICS_PATH, metrics.Handler())
+	if err := http.ListenAndServe(fmt.Sprintf(":%d", config.Server.Ports.MqttInterfaceMetrics), mux); err != nil {
+		logger.Error("failed to start metrics server", "err", err)
+	}
+}
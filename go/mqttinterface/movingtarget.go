@@ -0,0 +1,302 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/binary"
+	"encoding/hex"
+	"fmt"
+	"math"
+	"mqttmtd/config"
+	"mqttmtd/funcs"
+	"mqttmtd/mqttinterface/mqttparser"
+	"mqttmtd/types"
+	"os"
+	"sort"
+	"sync"
+	"time"
+)
+
+const (
+	DEFAULT_MOVING_TARGET_INTERVAL   = time.Hour
+	DEFAULT_MOVING_TARGET_SWITCHOVER = time.Second * 5
+	MOVING_TARGET_KEY_MIN_LEN        = 32
+	MOVING_TARGET_LEVEL_LEN          = 16 // hex characters of a broker topic level
+)
+
+/*
+Moving target topics. Each level of real topic names and filters is replaced with a keyed hash of the level and the epoch,
+so that the broker only sees opaque names changing every interval. Wildcards are kept, as the hash of each level does not
+depend on the others. Subscriptions are made for the next epoch switchover before each rotation, and those of the
+previous epoch are removed switchover after it.
+Retained messages and Will Messages published after a rotation stay under the topics of the epoch they were sent in.
+SUBSCRIBE and UNSUBSCRIBE of MQTT Interface itself share the packet identifiers of the client on its connection, so they
+take ones that no flow of the client is using, and a packet of the client reusing one of them waits for the response.
+*/
+var movingTarget = struct {
+	sync.Mutex
+	key    []byte
+	levels map[int64]map[string]string // broker topic level to real one, by epoch
+}{levels: make(map[int64]map[string]string)}
+
+func loadMovingTargetKey() (err error) {
+	if !config.Server.MqttInterface.MovingTarget.Enabled {
+		return
+	}
+	if path := config.Server.MqttInterface.MovingTarget.KeyFilePath; path != "" {
+		var key []byte
+		if key, err = os.ReadFile(path); err != nil {
+			return
+		}
+		if len(key) < MOVING_TARGET_KEY_MIN_LEN {
+			return fmt.Errorf("length of moving target key %d is less than %d", len(key), MOVING_TARGET_KEY_MIN_LEN)
+		}
+		movingTarget.key = key
+		return
+	}
+	movingTarget.key = make([]byte, MOVING_TARGET_KEY_MIN_LEN)
+	_, err = rand.Read(movingTarget.key)
+	return
+}
+
+func movingTargetInterval() time.Duration {
+	if interval := config.Server.MqttInterface.MovingTarget.Interval; interval > 0 {
+		return interval
+	}
+	return DEFAULT_MOVING_TARGET_INTERVAL
+}
+
+func movingTargetSwitchover() time.Duration {
+	if switchover := config.Server.MqttInterface.MovingTarget.Switchover; switchover > 0 {
+		return switchover
+	}
+	return DEFAULT_MOVING_TARGET_SWITCHOVER
+}
+
+func movingTargetEpoch(t time.Time) int64 {
+	return t.UnixNano() / int64(movingTargetInterval())
+}
+
+func movingTargetEpochStart(epoch int64) time.Time {
+	return time.Unix(0, epoch*int64(movingTargetInterval()))
+}
+
+// Broker topic name or filter of topic in epoch. Topics starting with "$" are kept as they are, as well as every topic
+// when moving target is disabled.
+func toBrokerTopic(topic []byte, epoch int64) []byte {
+	if !config.Server.MqttInterface.MovingTarget.Enabled || bytes.HasPrefix(topic, []byte(types.TOPIC_SYSTEM_TOPIC_PREFIX)) {
+		return topic
+	}
+	movingTarget.Lock()
+	defer movingTarget.Unlock()
+	levels, found := movingTarget.levels[epoch]
+	if !found {
+		levels = make(map[string]string)
+		movingTarget.levels[epoch] = levels
+		for known := range movingTarget.levels {
+			if known < epoch-1 {
+				delete(movingTarget.levels, known)
+			}
+		}
+	}
+
+	var epochBytes [8]byte
+	binary.BigEndian.PutUint64(epochBytes[:], uint64(epoch))
+	topicLevels := bytes.Split(topic, []byte(types.TOPIC_LEVEL_SEPARATOR))
+	for i, level := range topicLevels {
+		if string(level) == types.TOPIC_WILDCARD_SINGLE || string(level) == types.TOPIC_WILDCARD_MULTI {
+			continue
+		}
+		mac := hmac.New(sha256.New, movingTarget.key)
+		mac.Write(epochBytes[:])
+		mac.Write(level)
+		brokerLevel := hex.EncodeToString(mac.Sum(nil))[:MOVING_TARGET_LEVEL_LEN]
+		levels[brokerLevel] = string(level)
+		topicLevels[i] = []byte(brokerLevel)
+	}
+	return bytes.Join(topicLevels, []byte(types.TOPIC_LEVEL_SEPARATOR))
+}
+
+func toCurrentBrokerTopic(topic []byte) []byte {
+	return toBrokerTopic(topic, movingTargetEpoch(time.Now()))
+}
+
+// Real topic name of a broker topic name. Levels not mapped by this process are kept as they are.
+func fromBrokerTopic(brokerTopic []byte) []byte {
+	if !config.Server.MqttInterface.MovingTarget.Enabled {
+		return brokerTopic
+	}
+	movingTarget.Lock()
+	defer movingTarget.Unlock()
+	topicLevels := bytes.Split(brokerTopic, []byte(types.TOPIC_LEVEL_SEPARATOR))
+	for i, level := range topicLevels {
+		for _, levels := range movingTarget.levels {
+			if realLevel, found := levels[string(level)]; found {
+				topicLevels[i] = []byte(realLevel)
+				break
+			}
+		}
+	}
+	return bytes.Join(topicLevels, []byte(types.TOPIC_LEVEL_SEPARATOR))
+}
+
+// Record a real topic filter forwarded to the broker, which is also subscribed for the next epoch if it is ahead already
+func (s *mqttSession) addSubscription(ctx context.Context, filter []byte, options byte) (err error) {
+	s.subscriptionsLock.Lock()
+	defer s.subscriptionsLock.Unlock()
+	s.subscriptions[string(filter)] = options
+	if aheadEpoch := movingTargetEpoch(time.Now()) + 1; s.aheadEpoch == aheadEpoch {
+		err = s.sendOwnSubscriptionPacket(ctx, MqttControlSUBSCRIBE, map[string]byte{string(filter): options}, aheadEpoch, aheadEpoch-1)
+	}
+	return
+}
+
+/*
+SUBSCRIBE or UNSUBSCRIBE of MQTT Interface itself for the broker topics of filters in epoch, except those which are the
+same in otherEpoch, as they are kept across the rotation. Called with subscriptionsLock held.
+*/
+func (s *mqttSession) sendOwnSubscriptionPacket(ctx context.Context, ctrlType MQTTControlPacketType, filters map[string]byte, epoch int64, otherEpoch int64) (err error) {
+	realFilters := make([]string, 0, len(filters))
+	for filter := range filters {
+		realFilters = append(realFilters, filter)
+	}
+	sort.Strings(realFilters)
+
+	var payload []byte
+	for _, filter := range realFilters {
+		brokerFilter := toBrokerTopic([]byte(filter), epoch)
+		if bytes.Equal(brokerFilter, toBrokerTopic([]byte(filter), otherEpoch)) {
+			continue
+		}
+		payload = binary.BigEndian.AppendUint16(payload, uint16(len(brokerFilter)))
+		payload = append(payload, brokerFilter...)
+		if ctrlType == MqttControlSUBSCRIBE {
+			payload = append(payload, filters[filter])
+		}
+	}
+	if len(payload) == 0 {
+		return
+	}
+
+	packetID, found := s.nextOwnPacketID()
+	if !found {
+		err = fmt.Errorf("moving target found no packet identifier available")
+		return
+	}
+	s.ownPacketIDs[packetID] = make(chan struct{})
+	varHdrAndPayload := binary.BigEndian.AppendUint16(nil, packetID)
+	if s.cliMqttVersion >= 5 {
+		varHdrAndPayload = append(varHdrAndPayload, 0x00)
+	}
+	varHdrAndPayload = append(varHdrAndPayload, payload...)
+
+	var encodedRemainingLen []byte
+	if encodedRemainingLen, err = mqttparser.EncodeToVariableByteInteger(len(varHdrAndPayload)); err != nil {
+		return
+	}
+	// Reserved flags of SUBSCRIBE and UNSUBSCRIBE
+	packet := append(append([]byte{byte(ctrlType)<<4 | 0x02}, encodedRemainingLen...), varHdrAndPayload...)
+	if _, err = funcs.ConnWrite(ctx, s.brokerConn, packet, config.Server.SocketTimeout.External); err != nil {
+		s.cli2MqttLogger.Warn("moving target failed sending a packet to broker", "packet", ctrlType, "err", err)
+	}
+	return
+}
+
+// Packet identifier used neither by the client nor by MQTT Interface itself. Called with subscriptionsLock held.
+func (s *mqttSession) nextOwnPacketID() (packetID uint16, found bool) {
+	for range math.MaxUint16 {
+		if s.ownPacketID++; s.ownPacketID == 0 {
+			s.ownPacketID = 1
+		}
+		_, usedByClient := s.cliPacketIDs[s.ownPacketID]
+		_, usedByOwn := s.ownPacketIDs[s.ownPacketID]
+		if !usedByClient && !usedByOwn {
+			return s.ownPacketID, true
+		}
+	}
+	return
+}
+
+// Whether SUBACK or UNSUBACK of packetID from the broker answers MQTT Interface itself, and is not to be forwarded
+func (s *mqttSession) isOwnSubscriptionResponse(packetID uint16) bool {
+	s.subscriptionsLock.Lock()
+	defer s.subscriptionsLock.Unlock()
+	answered, found := s.ownPacketIDs[packetID]
+	if !found {
+		return false
+	}
+	delete(s.ownPacketIDs, packetID)
+	close(answered)
+	return true
+}
+
+// Record packetID of a packet of the client about to be forwarded, after the response to an own packet using it
+func (s *mqttSession) useClientPacketID(ctx context.Context, packetID uint16) (err error) {
+	timer := time.NewTimer(config.Server.SocketTimeout.External)
+	defer timer.Stop()
+	for {
+		s.subscriptionsLock.Lock()
+		answered, found := s.ownPacketIDs[packetID]
+		if !found {
+			s.cliPacketIDs[packetID] = struct{}{}
+			s.subscriptionsLock.Unlock()
+			return
+		}
+		s.subscriptionsLock.Unlock()
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		case <-timer.C:
+			return fmt.Errorf("packet identifier %d of the client is kept by moving target", packetID)
+		case <-answered:
+		}
+	}
+}
+
+// Release packetID of a flow of the client completed by a response of the broker
+func (s *mqttSession) releaseClientPacketID(packetID uint16) {
+	s.subscriptionsLock.Lock()
+	defer s.subscriptionsLock.Unlock()
+	delete(s.cliPacketIDs, packetID)
+}
+
+// Move the subscriptions of the session to the broker topics of each new epoch, until ctx is done
+func runMovingTargetSwitchover(ctx context.Context, sess *mqttSession) {
+	wait := func(until time.Time) bool {
+		timer := time.NewTimer(time.Until(until))
+		defer timer.Stop()
+		select {
+		case <-ctx.Done():
+			return false
+		case <-timer.C:
+			return true
+		}
+	}
+	for {
+		epoch := movingTargetEpoch(time.Now())
+		next := movingTargetEpochStart(epoch + 1)
+		if !wait(next.Add(-movingTargetSwitchover())) {
+			return
+		}
+		sess.subscriptionsLock.Lock()
+		sess.aheadEpoch = epoch + 1
+		err := sess.sendOwnSubscriptionPacket(ctx, MqttControlSUBSCRIBE, sess.subscriptions, epoch+1, epoch)
+		sess.subscriptionsLock.Unlock()
+		if err != nil {
+			return
+		}
+
+		if !wait(next.Add(movingTargetSwitchover())) {
+			return
+		}
+		sess.subscriptionsLock.Lock()
+		err = sess.sendOwnSubscriptionPacket(ctx, MqttControlUNSUBSCRIBE, sess.subscriptions, epoch, epoch+1)
+		sess.subscriptionsLock.Unlock()
+		if err != nil {
+			return
+		}
+	}
+}
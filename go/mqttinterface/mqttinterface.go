@@ -5,12 +5,12 @@ import (
 	"context"
 	"encoding/base64"
 	"encoding/binary"
-	"encoding/hex"
+	"errors"
 	"flag"
 	"fmt"
-	"log"
 	"mqttmtd/config"
 	"mqttmtd/funcs"
+	"mqttmtd/logging"
 	"mqttmtd/mqttinterface/mqttparser"
 	"mqttmtd/types"
 	"net"
@@ -19,21 +19,27 @@ import (
 
 const (
 	BUF_SIZE int = 1024
+	// Sent to clients in place of topic names not revealed
+	HIDDEN_TOPIC_NAME = "A"
 )
 
 type MQTT_INTERFACE_CONTEXT_KEY string
 
+var logger = logging.For("mqttinterface")
+
 type AEADInfo struct {
-	AEADType  types.PayloadAEADType
-	EncKey    []byte
-	PubSeqNum uint64
+	AEADType   types.PayloadAEADType
+	EncKey     []byte // chain key of the payload key ratchet if KeyRatchet
+	PubSeqNum  uint64
+	KeyRatchet bool
+	Padding    types.PaddingPolicy // applied before sealing
 }
 
 func run() {
-	fmt.Printf("Starting mqtt interface server on port %d\n", config.Server.Ports.MqttInterface)
+	logger.Info("starting mqtt interface server", "port", config.Server.Ports.MqttInterface)
 	listener, err := net.Listen("tcp", fmt.Sprintf(":%d", config.Server.Ports.MqttInterface))
 	if err != nil {
-		fmt.Println("Failed to start plain listener: ", err)
+		logger.Error("failed to start plain listener", "err", err)
 		return
 	}
 	defer listener.Close()
@@ -41,17 +47,17 @@ func run() {
 	for {
 		conn, err := listener.Accept()
 		if err != nil {
-			fmt.Println("Failed to accept plain connection:", err)
+			logger.Warn("failed to accept plain connection", "err", err)
 			continue
 		}
-		go mqttInterfaceHandler(conn)
+		go mqttInterfaceHandler(conn, LISTENER_PLAIN)
 	}
 }
 
 func communicateWithVerifier(ctx context.Context, verifierRequest types.VerifierRequest) (response types.VerifierResponse, err error) {
 	conn, err := net.Dial("tcp", fmt.Sprintf(":%d", config.Server.Ports.Verifier))
 	if err != nil {
-		fmt.Println("Error connecting To Verifier: ", err)
+		logger.Error("failed connecting to verifier", "err", err)
 		return
 	}
 	defer conn.Close()
@@ -62,12 +68,19 @@ func communicateWithVerifier(ctx context.Context, verifierRequest types.Verifier
 	}
 
 	// Receive Response
-	return funcs.ParseVerifierResponse(ctx, conn, config.Server.SocketTimeout.Local, verifierRequest)
+	reader := funcs.NewConnReader(ctx, conn)
+	defer reader.Release()
+	return funcs.ParseVerifierResponse(reader, config.Server.SocketTimeout.Local, verifierRequest)
 }
 
-func clientToMqttHandler(ctx context.Context, buf []byte, incomingConn net.Conn, brokerConn net.Conn, cliMqttVersion *byte, aeadInfo *AEADInfo) (shouldCloseSock bool, err error) {
+// bufp is kept across packets, so that a buffer once grown is reused
+func clientToMqttHandler(ctx context.Context, bufp *[]byte, sess *mqttSession) (shouldCloseSock bool, err error) {
 	shouldCloseSock = false
+	buf := *bufp
+	defer func() { *bufp = buf[:0] }()
+	incomingConn, brokerConn := sess.incomingConn, sess.brokerConn
 	incomingAddr := incomingConn.RemoteAddr()
+	logger := sess.cli2MqttLogger
 
 	select {
 	case <-ctx.Done():
@@ -75,9 +88,9 @@ func clientToMqttHandler(ctx context.Context, buf []byte, incomingConn net.Conn,
 		return
 	default:
 	}
-	fixedHdr, err := getFixedHeader(ctx, incomingConn, config.Server.SocketTimeout.External)
+	fixedHdr, err := getFixedHeader(sess.incomingReader, sess.idleTimeout(), config.Server.SocketTimeout.External)
 	if err != nil || fixedHdr.RemainingLength > BUF_SIZE {
-		fmt.Printf("cli2Mqtt(%s): Failed getting fixed header: %v\n", incomingAddr, err)
+		logger.Debug("failed getting fixed header", "err", err)
 		return
 	}
 
@@ -88,27 +101,30 @@ func clientToMqttHandler(ctx context.Context, buf []byte, incomingConn net.Conn,
 	default:
 	}
 	funcs.SetLen(&buf, fixedHdr.RemainingLength)
-	if _, err = funcs.ConnRead(ctx, incomingConn, buf, config.Server.SocketTimeout.External); err != nil {
-		fmt.Printf("cli2Mqtt(%s): Failed getting remaining part: %v\n", incomingAddr, err)
+	if _, err = sess.incomingReader.ReadFull(buf, config.Server.SocketTimeout.External); err != nil {
+		logger.Warn("failed getting remaining part", "err", err)
 		return
 	}
 
-	if fixedHdr.ControlPacketType == MqttControlPUBLISH || fixedHdr.ControlPacketType == MqttControlSUBSCRIBE {
-		// When packet is PUBLISH/SUBSCRIBE
-		// cyberdeception??
+	if fixedHdr.ControlPacketType == MqttControlPUBLISH || fixedHdr.ControlPacketType == MqttControlSUBSCRIBE || fixedHdr.ControlPacketType == MqttControlCONNECT {
+		// When packet is PUBLISH/SUBSCRIBE, or CONNECT which may have a Will
 		bb := &bytes.Buffer{}
 
 		decodeIfB64 := func(topic *[]byte, topicType string) (err error) {
 			if len(*topic)%4 != 0 {
-				// cyberdeception
-				fmt.Printf("cli2Mqtt(%s): Seems not a b64 encoded\n", incomingAddr)
+				// verified as it is, and fails, or routed to a decoy in deception mode
+				logger.Debug("seems not b64 encoded", "field", topicType)
 			} else {
-				decodedTopic := make([]byte, len(*topic)/4*3)
-				if _, err = base64.URLEncoding.Decode(decodedTopic, *topic); err != nil {
-					fmt.Printf("cli2Mqtt(%s): Failed decoding the given %s: %v\n", incomingAddr, topicType, err)
+				decodedTopic := make([]byte, base64.URLEncoding.DecodedLen(len(*topic)))
+				var n int
+				if n, err = base64.URLEncoding.Decode(decodedTopic, *topic); err != nil {
+					// verified as it is, and fails
+					logger.Debug("failed decoding b64", "field", topicType, "err", err)
+					err = nil
 					return
 				}
-				fmt.Printf("cli2Mqtt(%s): %s Bytes B64Decoded: %s\n", incomingAddr, topicType, hex.EncodeToString(decodedTopic))
+				decodedTopic = decodedTopic[:n]
+				logger.Debug("b64 decoded", "field", topicType, "token", logging.Secret(decodedTopic))
 				funcs.SetLen(topic, len(decodedTopic))
 				copy(*topic, decodedTopic)
 			}
@@ -119,100 +135,424 @@ func clientToMqttHandler(ctx context.Context, buf []byte, incomingConn net.Conn,
 			var (
 				topicName      []byte
 				contentBetween []byte
-				verfRequest    types.VerifierRequest
 				verfResponse   types.VerifierResponse
 				payload        []byte
 			)
-			topicName, contentBetween, payload, err = getTopicNameFromPublish(*cliMqttVersion, buf, (int(fixedHdr.Flags)>>1)&0x3)
+			qos := (int(fixedHdr.Flags) >> 1) & 0x3
+			topicName, contentBetween, payload, err = getTopicNameFromPublish(sess.cliMqttVersion, buf, qos)
 			if err != nil {
-				fmt.Printf("cli2Mqtt(%s): Failed getting topicName: %v\n", incomingAddr, err)
+				logger.Warn("failed getting topic name", "err", err)
 				return
 			}
-			fmt.Printf("cli2Mqtt(%s): Topic Name Bytes: %s\n", incomingAddr, hex.EncodeToString(topicName))
+			logger.Debug("PUBLISH", "topicname", logging.Secret(topicName))
 
-			if err = decodeIfB64(&topicName, "Topic Name"); err != nil {
-				return
+			identifierLen := 0
+			if qos > 0 {
+				identifierLen = 2
+			}
+			var separateTokens [][]byte
+			if sess.cliMqttVersion >= 5 {
+				var kept []byte
+				if kept, separateTokens, _, err = takeTokenUserProperties(contentBetween[identifierLen:]); err != nil {
+					logger.Warn("failed getting properties", "err", err)
+					return
+				}
+				contentBetween = append(contentBetween[:identifierLen:identifierLen], kept...)
 			}
 
-			verfRequest = types.VerifierRequest{
-				AccessTypeIsPub: true,
-				Token:           topicName,
+			// Token in the topic name, unless carried apart, in which case the topic name is the real one
+			var token []byte
+			if len(separateTokens) > 1 {
+				logger.Info("multiple tokens in a PUBLISH", "tokens", len(separateTokens))
+				return sess.rejectPublish(ctx, qos, contentBetween)
+			} else if len(separateTokens) == 1 {
+				token = separateTokens[0]
+				if err = decodeIfB64(&token, "Token User Property"); err != nil {
+					return
+				}
+			} else if sess.authToken != nil {
+				token = sess.authToken
+				sess.authToken = nil
+			} else {
+				if err = decodeIfB64(&topicName, "Topic Name"); err != nil {
+					return
+				}
+				token = topicName
+				topicName = nil
 			}
 
-			if verfResponse, err = communicateWithVerifier(ctx, verfRequest); err != nil {
-				return
+			var packetID uint16
+			if qos > 0 {
+				packetID = binary.BigEndian.Uint16(contentBetween[:2])
+			}
+			inflight := sess.inflight.Load()
+			retransmitted := false
+			var responseTopic []byte
+			if isDup := fixedHdr.Flags&0x08 != 0; isDup && qos > 0 {
+				// Verified already when first sent, so that no more token is spent
+				if verfResponse, responseTopic, retransmitted = inflight.lookupRetransmission(packetID, token); retransmitted {
+					logger.Debug("retransmission verified already", "packetid", packetID)
+				}
+			}
+			if !retransmitted {
+				if verfResponse, err = verifyToken(ctx, true, token); err != nil {
+					return
+				}
+				if verfResponse.ResultCode.IsCover() {
+					logger.Debug("cover traffic discarded", "token", logging.Secret(token))
+					err = sess.discardCoverPublish(ctx, qos, contentBetween)
+					return
+				}
+				failed := false
+				if !verfResponse.ResultCode.IsSuccess() {
+					logger.Info("verification failed", "token", logging.Secret(token))
+					failed = true
+				} else if topicName != nil && !bytes.Equal(topicName, verfResponse.Topic) {
+					logger.Info("topic name does not match the token", "topic", string(topicName))
+					failed = true
+				}
+				if failed {
+					if !sess.deception {
+						return sess.rejectPublish(ctx, qos, contentBetween)
+					}
+					verfResponse = types.VerifierResponse{Topic: sess.deceive(ctx, DECEPTION_EVENT_PUBLISH, token)}
+				}
+			}
+
+			if sess.cliMqttVersion >= 5 {
+				// Response Topic is a Pub token too, as the responses are published there
+				responseTopicRejected := false
+				var properties []byte
+				if properties, _, err = rewriteProperties(contentBetween[identifierLen:], func(property mqttProperty) (raw []byte, err error) {
+					if property.ID != PROPERTY_RESPONSE_TOPIC {
+						return property.Raw, nil
+					}
+					if responseTopic == nil {
+						responseToken := bytes.Clone(property.Value)
+						if err = decodeIfB64(&responseToken, "Response Topic"); err != nil {
+							return
+						}
+						var responseVerfResponse types.VerifierResponse
+						if responseVerfResponse, err = verifyToken(ctx, true, responseToken); err != nil {
+							return
+						}
+						if !responseVerfResponse.ResultCode.IsSuccess() {
+							logger.Info("response topic verification failed", "token", logging.Secret(responseToken))
+							if !sess.deception {
+								responseTopicRejected = true
+								return property.Raw, nil
+							}
+							responseVerfResponse.Topic = sess.deceive(ctx, DECEPTION_EVENT_RESPONSE_TOPIC, responseToken)
+						}
+						responseTopic = responseVerfResponse.Topic
+					}
+					return newBinaryProperty(PROPERTY_RESPONSE_TOPIC, toCurrentBrokerTopic(responseTopic)), nil
+				}); err != nil {
+					logger.Warn("failed rewriting properties", "err", err)
+					return
+				}
+				if responseTopicRejected {
+					return sess.rejectPublish(ctx, qos, contentBetween)
+				}
+				contentBetween = append(contentBetween[:identifierLen:identifierLen], properties...)
+			}
+			if !retransmitted {
+				if qos > 0 {
+					inflight.add(packetID, token, verfResponse, responseTopic)
+				}
+				sess.countTraffic(TRAFFIC_REAL_PUBLISH)
 			}
 
+			brokerTopic := toCurrentBrokerTopic(verfResponse.Topic)
 			funcs.SetLen(&buf, 2)
-			binary.BigEndian.PutUint16(buf, uint16(len(verfResponse.Topic)))
+			binary.BigEndian.PutUint16(buf, uint16(len(brokerTopic)))
 			bb.Write(buf)
-			bb.Write(verfResponse.Topic)
+			bb.Write(brokerTopic)
 			bb.Write(contentBetween)
 
 			if verfResponse.PayloadAEADType.IsEncryptionEnabled() {
 				var decrypted []byte
 				if decrypted, err = verfResponse.PayloadAEADType.OpenMessage(payload, verfResponse.EncryptionKey, uint64(verfResponse.TokenIndex)); err != nil {
+					logger.Warn("failed opening payload", "err", err)
+					aeadFailuresMetric.Inc(AEAD_OPERATION_OPEN, verfResponse.PayloadAEADType.String())
+					return
+				}
+				if decrypted, err = verfResponse.Padding.Unpad(decrypted); err != nil {
+					logger.Warn("failed removing padding", "err", err)
 					return
 				}
 				bb.Write(decrypted)
 			} else {
 				bb.Write(payload)
 			}
-		} else {
+		} else if fixedHdr.ControlPacketType == MqttControlSUBSCRIBE {
 			var (
 				topicFiltersWithOptions [][]byte
-				verfRequest             types.VerifierRequest
 				verfResponse            types.VerifierResponse
 				contentBefore           []byte
 				contentAfter            []byte
 			)
-			contentBefore, topicFiltersWithOptions, contentAfter, err = getTopicFiltersFromSubscribe(*cliMqttVersion, buf)
-			fmt.Printf("contentBefore: %s\n", hex.EncodeToString(contentBefore))
-			fmt.Printf("contentAfter: %s\n", hex.EncodeToString(contentAfter))
+			contentBefore, topicFiltersWithOptions, contentAfter, err = getTopicFiltersFromSubscribe(sess.cliMqttVersion, buf)
+			logger.Debug("SUBSCRIBE", "before", logging.Hex(contentBefore), "after", logging.Hex(contentAfter))
 			if err != nil {
-				fmt.Printf("cli2Mqtt(%s): Failed getting topicFilters: %v\n", incomingAddr, err)
+				logger.Warn("failed getting topic filters", "err", err)
 				return
 			}
+			packetID := binary.BigEndian.Uint16(contentBefore[:2])
+
+			/*
+				Tokens carried apart from the topic filters, in which case the filters are real ones. Either one token
+				for each filter, or a single token covering all of them.
+			*/
+			var separateTokens [][]byte
+			if sess.cliMqttVersion >= 5 {
+				var kept []byte
+				if kept, separateTokens, _, err = takeTokenUserProperties(contentBefore[2:]); err != nil {
+					logger.Warn("failed getting properties", "err", err)
+					return
+				}
+				for i := range separateTokens {
+					if err = decodeIfB64(&separateTokens[i], "Token User Property"); err != nil {
+						return
+					}
+				}
+				contentBefore = append(contentBefore[:2:2], kept...)
+			}
+			if len(separateTokens) == 0 && sess.authToken != nil {
+				separateTokens = [][]byte{sess.authToken}
+				sess.authToken = nil
+			}
+			separateResponses := make(map[int]types.VerifierResponse)
 			bb.Write(contentBefore)
 
-			// TODO: disable z filters for now
-			for _, filterWithOption := range topicFiltersWithOptions {
+			/*
+				Filters not forwarded, answered with these return codes in SUBACK: failure for those whose tokens failed,
+				and granted QoS 0 for cover traffic
+			*/
+			discarded := make(map[int]byte)
+			rejected := false
+
+			for i, filterWithOption := range topicFiltersWithOptions {
 				topicFilter := filterWithOption[:len(filterWithOption)-1]
 				topicFilterOption := filterWithOption[len(filterWithOption)-1]
-				fmt.Printf("cli2Mqtt(%s): Topic Filter Bytes: %s, Option: 0x%02x\n", incomingAddr, hex.EncodeToString(topicFilter), topicFilterOption)
+				logger.Debug("SUBSCRIBE", "topicfilter", logging.Secret(topicFilter), "option", topicFilterOption)
+
+				// Token which failed, routed to a decoy in deception mode and rejected otherwise
+				var failedToken []byte
+				cover := false
+				if separateTokens == nil {
+					if err = decodeIfB64(&topicFilter, "Topic Filter"); err != nil {
+						return
+					}
+					if verfResponse, err = verifyToken(ctx, false, topicFilter); err != nil {
+						return
+					}
+					if verfResponse.ResultCode.IsCover() {
+						cover = true
+					} else if !verfResponse.ResultCode.IsSuccess() {
+						logger.Info("verification failed", "token", logging.Secret(topicFilter))
+						failedToken = topicFilter
+					} else {
+						topicFilter = verfResponse.Topic
+					}
+				} else if len(separateTokens) != 1 && len(separateTokens) != len(topicFiltersWithOptions) {
+					logger.Info("numbers of tokens and topic filters mismatch", "tokens", len(separateTokens), "filters", len(topicFiltersWithOptions))
+					failedToken = topicFilter
+				} else {
+					j := i
+					if len(separateTokens) == 1 {
+						j = 0
+					}
+					var verified bool
+					if verfResponse, verified = separateResponses[j]; !verified {
+						if verfResponse, err = verifyToken(ctx, false, separateTokens[j]); err != nil {
+							return
+						}
+						separateResponses[j] = verfResponse
+					}
+					if verfResponse.ResultCode.IsCover() {
+						cover = true
+					} else if !verfResponse.ResultCode.IsSuccess() {
+						logger.Info("verification failed", "token", logging.Secret(separateTokens[j]))
+						failedToken = separateTokens[j]
+					} else if !types.TopicFilterCovers(string(verfResponse.Topic), string(topicFilter)) {
+						logger.Info("topic filter is not covered by the token", "filter", string(topicFilter))
+						failedToken = separateTokens[j]
+					}
+				}
+				if cover {
+					logger.Debug("cover traffic discarded", "filterindex", i)
+					sess.countTraffic(TRAFFIC_COVER_SUBSCRIBE)
+					discarded[i] = SUBACK_GRANTED_QOS_0
+					continue
+				}
+				if failedToken != nil {
+					if !sess.deception {
+						discarded[i] = sess.subackFailureCode()
+						rejected = true
+						continue
+					}
+					topicFilter = sess.deceive(ctx, DECEPTION_EVENT_SUBSCRIBE, failedToken)
+				}
 
-				if err = decodeIfB64(&topicFilter, "Topic Filter"); err != nil {
-					return
+				brokerFilter := toCurrentBrokerTopic(topicFilter)
+				funcs.SetLen(&buf, 2)
+				binary.BigEndian.PutUint16(buf, uint16(len(brokerFilter)))
+				bb.Write(buf)
+				bb.Write(brokerFilter)
+				bb.WriteByte(topicFilterOption)
+				if config.Server.MqttInterface.MovingTarget.Enabled {
+					if err = sess.addSubscription(ctx, topicFilter, topicFilterOption); err != nil {
+						return
+					}
+				}
+				if failedToken != nil {
+					continue
+				}
+				sess.countTraffic(TRAFFIC_REAL_SUBSCRIBE)
+				if separateTokens != nil || (config.Server.MqttInterface.RevealWildcardTopics && types.IsWildcardTopicFilter(string(topicFilter))) {
+					// The client knows the topics already
+					sess.addRevealedFilter(topicFilter)
 				}
 
-				verfRequest = types.VerifierRequest{
-					AccessTypeIsPub: false,
-					Token:           topicFilter,
+				// Context settings for Server->Client Publish Encryption
+				if verfResponse.PayloadAEADType.IsEncryptionEnabled() {
+					var pubSeqNum uint64 = 0
+					sess.aeadInfo.AEADType = verfResponse.PayloadAEADType
+					sess.aeadInfo.EncKey = verfResponse.EncryptionKey
+					sess.aeadInfo.PubSeqNum = pubSeqNum
+					sess.aeadInfo.KeyRatchet = verfResponse.ResultCode.IsRatchetKey()
+					sess.aeadInfo.Padding = verfResponse.Padding
+					sess.imitateInCoverTraffic([]byte(HIDDEN_TOPIC_NAME))
 				}
+			}
+
+			bb.Write(contentAfter)
 
-				if verfResponse, err = communicateWithVerifier(ctx, verfRequest); err != nil {
+			if rejected {
+				if shouldCloseSock, err = sess.onVerificationFailure(ctx); shouldCloseSock || err != nil {
 					return
 				}
-				if !verfResponse.ResultCode.IsSuccess() {
-					fmt.Printf("cli2Mqtt(%s): Topic Filter Bytes %s: verification failed\n", incomingAddr, hex.EncodeToString(topicFilter))
+			}
+			if len(discarded) > 0 {
+				if len(discarded) == len(topicFiltersWithOptions) {
+					// Nothing to forward
+					returnCodes := make([]byte, len(discarded))
+					for i := range returnCodes {
+						returnCodes[i] = discarded[i]
+					}
+					var suback []byte
+					if suback, err = newSubackPacket(sess.cliMqttVersion, packetID, returnCodes); err != nil {
+						return
+					}
+					err = sess.writeToClient(ctx, suback)
 					return
 				}
+				sess.addPendingSuback(packetID, len(topicFiltersWithOptions), discarded)
+			}
+		} else {
+			if sess.cliMqttVersion, err = getMQTTVersionFromConnect(buf); err != nil {
+				logger.Warn("failed getting MQTT version", "err", err)
+				return
+			} else {
+				logger.Debug("CONNECT", "version", sess.cliMqttVersion)
+			}
 
-				funcs.SetLen(&buf, 2)
-				binary.BigEndian.PutUint16(buf, uint16(len(verfResponse.Topic)))
-				bb.Write(buf)
-				bb.Write(verfResponse.Topic)
-				bb.WriteByte(topicFilterOption)
+			var keepAlive uint16
+			if keepAlive, err = getKeepAliveFromConnect(buf); err != nil {
+				logger.Warn("failed getting keep alive", "err", err)
+				return
 			}
+			sess.setKeepAlive(keepAlive)
 
-			bb.Write(contentAfter)
+			var (
+				clientID   []byte
+				cleanStart bool
+			)
+			if clientID, cleanStart, err = getClientIDFromConnect(sess.cliMqttVersion, buf); err != nil {
+				logger.Warn("failed getting client identifier", "err", err)
+				return
+			}
+			sess.inflight.Store(loadInflightPublishes(clientID, cleanStart))
+			sess.connectInfo.Store(&sessionConnectInfo{MqttVersion: sess.cliMqttVersion, ClientID: string(clientID), KeepAlive: keepAlive})
+			if sess.deception {
+				sess.fingerprint, sess.connectDetail = fingerprintConnect(incomingAddr, sess.cliMqttVersion, buf)
+			}
 
-			// Context settings for Server->Client Publish Encryption
-			if verfResponse.PayloadAEADType.IsEncryptionEnabled() {
-				var pubSeqNum uint64 = 0
-				aeadInfo.AEADType = verfResponse.PayloadAEADType
-				aeadInfo.EncKey = verfResponse.EncryptionKey
-				aeadInfo.PubSeqNum = pubSeqNum
+			if sess.cliMqttVersion >= 5 {
+				// Token authentication is completed by MQTT Interface, and hidden from the broker
+				var (
+					kept     []byte
+					rest     []byte
+					authData []byte
+				)
+				// Protocol Name, Protocol Level, Connect Flags and Keep Alive
+				propertiesOffset := 10
+				if kept, sess.tokenAuthEnabled, authData, rest, err = takeTokenAuthentication(buf[propertiesOffset:]); err != nil {
+					logger.Warn("failed getting properties", "err", err)
+					return
+				}
+				if sess.tokenAuthEnabled {
+					logger.Debug("token authentication enabled")
+					if authData != nil {
+						sess.authToken = bytes.Clone(authData)
+					}
+					buf = append(append(bytes.Clone(buf[:propertiesOffset]), kept...), rest...)
+				}
+			}
+
+			var (
+				contentBefore []byte
+				willTopic     []byte
+				willPayload   []byte
+				contentAfter  []byte
+				verfResponse  types.VerifierResponse
+			)
+			if contentBefore, willTopic, willPayload, contentAfter, err = getWillFromConnect(sess.cliMqttVersion, buf); err != nil {
+				logger.Warn("failed getting will", "err", err)
+				return
+			}
+			if willTopic == nil {
+				bb.Write(buf)
+			} else {
+				// Will Topic is a Pub token, as the Will Message is published by the server on behalf of the client
+				logger.Debug("will", "willtopic", logging.Secret(willTopic))
+				if err = decodeIfB64(&willTopic, "Will Topic"); err != nil {
+					return
+				}
+
+				if verfResponse, err = verifyToken(ctx, true, willTopic); err != nil {
+					return
+				}
+				if !verfResponse.ResultCode.IsSuccess() {
+					logger.Info("will topic verification failed", "token", logging.Secret(willTopic))
+					if !sess.deception {
+						return sess.rejectConnect(ctx)
+					}
+					verfResponse = types.VerifierResponse{Topic: sess.deceive(ctx, DECEPTION_EVENT_WILL, willTopic)}
+				}
+				if verfResponse.PayloadAEADType.IsEncryptionEnabled() {
+					if willPayload, err = verfResponse.PayloadAEADType.OpenMessage(willPayload, verfResponse.EncryptionKey, uint64(verfResponse.TokenIndex)); err != nil {
+						logger.Warn("failed opening will payload", "err", err)
+						aeadFailuresMetric.Inc(AEAD_OPERATION_OPEN, verfResponse.PayloadAEADType.String())
+						return sess.rejectConnect(ctx)
+					}
+					if willPayload, err = verfResponse.Padding.Unpad(willPayload); err != nil {
+						logger.Warn("failed removing padding of will payload", "err", err)
+						return sess.rejectConnect(ctx)
+					}
+				}
+
+				bb.Write(contentBefore)
+				brokerTopic := toCurrentBrokerTopic(verfResponse.Topic)
+				funcs.SetLen(&buf, 2)
+				binary.BigEndian.PutUint16(buf, uint16(len(brokerTopic)))
+				bb.Write(buf)
+				bb.Write(brokerTopic)
+				binary.BigEndian.PutUint16(buf, uint16(len(willPayload)))
+				bb.Write(buf)
+				bb.Write(willPayload)
+				bb.Write(contentAfter)
 			}
 		}
 
@@ -226,12 +566,14 @@ func clientToMqttHandler(ctx context.Context, buf []byte, incomingConn net.Conn,
 		copy(buf[1+len(encodedRemainingLen):], bb.Bytes())
 	} else {
 
-		if fixedHdr.ControlPacketType == MqttControlCONNECT {
-			if *cliMqttVersion, err = getMQTTVersionFromConnect(buf); err != nil {
-				fmt.Printf("cli2Mqtt(%s): Failed getting MQTT Version: %v\n", incomingAddr, err)
+		if fixedHdr.ControlPacketType == MqttControlAUTH && sess.tokenAuthEnabled {
+			return sess.acceptTokenAuth(ctx, buf)
+		}
+
+		if fixedHdr.ControlPacketType == MqttControlPUBREL && len(buf) >= 2 {
+			var handled bool
+			if handled, err = sess.completeDroppedQoS2(ctx, binary.BigEndian.Uint16(buf[:2])); handled || err != nil {
 				return
-			} else {
-				fmt.Printf("cli2Mqtt(%s): Client MQTT Version: %d\n", incomingAddr, *cliMqttVersion)
 			}
 		}
 
@@ -251,15 +593,31 @@ func clientToMqttHandler(ctx context.Context, buf []byte, incomingConn net.Conn,
 		return
 	default:
 	}
-	if _, err = funcs.ConnWrite(ctx, brokerConn, buf, config.Server.SocketTimeout.External); err != nil {
-		fmt.Printf("cli2Mqtt(%s): Error sending out a packet to broker: %v\n", incomingAddr, err)
+	if config.Server.MqttInterface.MovingTarget.Enabled {
+		if packetID, found := getClientFlowPacketID(buf); found {
+			if err = sess.useClientPacketID(ctx, packetID); err != nil {
+				logger.Warn("failed sending out a packet to broker", "err", err)
+				return
+			}
+		}
+	}
+	n, err := funcs.ConnWrite(ctx, brokerConn, buf, config.Server.SocketTimeout.External)
+	bytesMetric.Add(float64(n), DIRECTION_CLI2MQTT)
+	if err != nil {
+		logger.Warn("failed sending out a packet to broker", "err", err)
 		return
 	}
 	return
 }
 
-func mqttToClientHandler(ctx context.Context, buf []byte, incomingConn net.Conn, brokerConn net.Conn, cliMqttVersion *byte, aeadInfo *AEADInfo) (err error) {
+// brokerLost is set when the broker connection is closed or broken, not by the client side.
+// bufp is kept across packets, so that a buffer once grown is reused
+func mqttToClientHandler(ctx context.Context, bufp *[]byte, sess *mqttSession) (brokerLost bool, err error) {
+	buf := *bufp
+	defer func() { *bufp = buf[:0] }()
+	incomingConn := sess.incomingConn
 	incomingAddr := incomingConn.RemoteAddr()
+	logger := sess.mqtt2CliLogger
 
 	select {
 	case <-ctx.Done():
@@ -267,9 +625,14 @@ func mqttToClientHandler(ctx context.Context, buf []byte, incomingConn net.Conn,
 		return
 	default:
 	}
-	fixedHdr, err := getFixedHeader(ctx, brokerConn, config.Server.SocketTimeout.External)
+	// Flows of PUBLISH from the client advance once the responses have reached the client
+	var afterForwarded func()
+
+	// The broker may stay silent as long as the client keeps publishing, and the connection ends with the client one
+	fixedHdr, err := getFixedHeader(sess.brokerReader, 0, config.Server.SocketTimeout.External)
 	if err != nil || fixedHdr.RemainingLength > BUF_SIZE {
-		fmt.Printf("mqtt2Cli(%s): Failed getting fixed header: %v\n", incomingAddr, err)
+		logger.Debug("failed getting fixed header", "err", err)
+		brokerLost = isBrokerLost(ctx, err)
 		return
 	}
 
@@ -280,8 +643,9 @@ func mqttToClientHandler(ctx context.Context, buf []byte, incomingConn net.Conn,
 	default:
 	}
 	funcs.SetLen(&buf, fixedHdr.RemainingLength)
-	if _, err = funcs.ConnRead(ctx, brokerConn, buf, config.Server.SocketTimeout.External); err != nil {
-		fmt.Printf("mqtt2Cli(%s): Failed getting remaining part: %v\n", incomingAddr, err)
+	if _, err = sess.brokerReader.ReadFull(buf, config.Server.SocketTimeout.External); err != nil {
+		logger.Warn("failed getting remaining part", "err", err)
+		brokerLost = isBrokerLost(ctx, err)
 		return
 	}
 
@@ -292,28 +656,75 @@ func mqttToClientHandler(ctx context.Context, buf []byte, incomingConn net.Conn,
 			contentBetween []byte
 			payload        []byte
 		)
-		topicName, contentBetween, payload, err = getTopicNameFromPublish(*cliMqttVersion, buf, (int(fixedHdr.Flags)>>1)&0x3)
+		qos := (int(fixedHdr.Flags) >> 1) & 0x3
+		topicName, contentBetween, payload, err = getTopicNameFromPublish(sess.cliMqttVersion, buf, qos)
 		if err != nil {
-			fmt.Printf("mqtt2Cli(%s): Failed getting topicName: %v\n", incomingAddr, err)
+			logger.Warn("failed getting topic name", "err", err)
 			return
 		}
-		fmt.Printf("mqtt2Cli(%s): Topic Name Bytes: %s\n", incomingAddr, hex.EncodeToString(topicName))
-
-		if aeadInfo.AEADType.IsEncryptionEnabled() {
-			payload, err = aeadInfo.AEADType.SealMessage(payload, aeadInfo.EncKey, aeadInfo.PubSeqNum)
+		logger.Debug("PUBLISH", "topic", string(topicName))
+		topicName = fromBrokerTopic(topicName)
+
+		if sess.aeadInfo.AEADType.IsEncryptionEnabled() {
+			encKey := sess.aeadInfo.EncKey
+			if sess.aeadInfo.KeyRatchet {
+				if encKey, err = sess.aeadInfo.AEADType.RatchetPayloadKey(sess.aeadInfo.EncKey, sess.aeadInfo.PubSeqNum); err != nil {
+					logger.Error("failed payload key ratchet", "err", err)
+					return
+				}
+			}
+			if payload, err = sess.aeadInfo.Padding.Pad(payload); err != nil {
+				// Too long for a fixed size, which costs the message but not the session
+				logger.Warn("dropping PUBLISH that does not fit in the padding", "err", err)
+				err = sess.dropDelivery(ctx, qos, contentBetween)
+				return
+			}
+			payload, err = sess.aeadInfo.AEADType.SealMessage(payload, encKey, sess.aeadInfo.PubSeqNum)
 			if err != nil {
-				fmt.Printf("mqtt2Cli(%s): Failed sealing payload: %v\n", incomingAddr, err)
+				logger.Error("failed sealing payload", "err", err)
+				aeadFailuresMetric.Inc(AEAD_OPERATION_SEAL, sess.aeadInfo.AEADType.String())
 				return
 			}
+			if sess.aeadInfo.KeyRatchet {
+				sess.aeadInfo.PubSeqNum++
+			}
 		}
 
-		// Topic Name
+		// Topic Name, hidden unless revealed by policy
+		revealed := sess.matchesRevealedFilter(topicName)
+		if !revealed {
+			topicName = []byte(HIDDEN_TOPIC_NAME)
+		}
 		funcs.SetLen(&buf, 2)
-		binary.BigEndian.PutUint16(buf, 1)
+		binary.BigEndian.PutUint16(buf, uint16(len(topicName)))
 		bb.Write(buf)
-		bb.WriteByte('A')
+		bb.Write(topicName)
+		sess.imitateInCoverTraffic(topicName)
 
 		// Id and properties
+		if sess.cliMqttVersion >= 5 {
+			identifierLen := 0
+			if qos > 0 {
+				identifierLen = 2
+			}
+			var properties []byte
+			if properties, _, err = rewriteProperties(contentBetween[identifierLen:], func(property mqttProperty) ([]byte, error) {
+				switch {
+				case property.ID != PROPERTY_RESPONSE_TOPIC && property.ID != PROPERTY_CORRELATION_DATA:
+					return property.Raw, nil
+				case !revealed:
+					// Response Topic would tell a real topic name, and Correlation Data is of no use without it
+					return nil, nil
+				case property.ID == PROPERTY_RESPONSE_TOPIC:
+					return newBinaryProperty(PROPERTY_RESPONSE_TOPIC, fromBrokerTopic(property.Value)), nil
+				}
+				return property.Raw, nil
+			}); err != nil {
+				logger.Warn("failed getting properties", "err", err)
+				return
+			}
+			contentBetween = append(contentBetween[:identifierLen:identifierLen], properties...)
+		}
 		bb.Write(contentBetween)
 		bb.Write(payload)
 
@@ -326,6 +737,57 @@ func mqttToClientHandler(ctx context.Context, buf []byte, incomingConn net.Conn,
 		copy(buf[1:1+len(encodedRemainingLen)], encodedRemainingLen)
 		copy(buf[1+len(encodedRemainingLen):], bb.Bytes())
 	} else {
+		if ctrlType := fixedHdr.ControlPacketType; (ctrlType == MqttControlPUBACK || ctrlType == MqttControlPUBREC || ctrlType == MqttControlPUBCOMP) && len(buf) >= 2 {
+			// Reason Code is omitted when success
+			packetID, reasonCode := binary.BigEndian.Uint16(buf[:2]), REASON_CODE_SUCCESS
+			if len(buf) >= 3 {
+				reasonCode = buf[2]
+			}
+			afterForwarded = func() { sess.inflight.Load().onResponseForwarded(ctrlType, packetID, reasonCode) }
+		}
+
+		if fixedHdr.ControlPacketType == MqttControlPUBREL && len(buf) >= 2 {
+			var handled bool
+			if handled, err = sess.completeDroppedDelivery(ctx, binary.BigEndian.Uint16(buf[:2])); handled || err != nil {
+				return
+			}
+		}
+
+		if ctrlType := fixedHdr.ControlPacketType; (ctrlType == MqttControlSUBACK || ctrlType == MqttControlUNSUBACK) && len(buf) >= 2 && sess.isOwnSubscriptionResponse(binary.BigEndian.Uint16(buf[:2])) {
+			// Moving target switchover
+			return
+		}
+
+		if ctrlType := fixedHdr.ControlPacketType; config.Server.MqttInterface.MovingTarget.Enabled && len(buf) >= 2 {
+			// Reason Code of PUBREC is omitted when success, and one of 0x80 or greater ends the flow
+			switch {
+			case ctrlType == MqttControlSUBACK || ctrlType == MqttControlUNSUBACK || ctrlType == MqttControlPUBACK || ctrlType == MqttControlPUBCOMP,
+				ctrlType == MqttControlPUBREC && len(buf) >= 3 && buf[2] >= 0x80:
+				sess.releaseClientPacketID(binary.BigEndian.Uint16(buf[:2]))
+			}
+		}
+
+		if fixedHdr.ControlPacketType == MqttControlCONNACK && sess.cliMqttVersion >= 5 {
+			var (
+				serverKeepAlive uint16
+				found           bool
+			)
+			if serverKeepAlive, found, err = getServerKeepAliveFromConnack(buf); err != nil {
+				logger.Warn("failed getting server keep alive", "err", err)
+				return
+			} else if found {
+				sess.setKeepAlive(serverKeepAlive)
+			}
+		}
+
+		if fixedHdr.ControlPacketType == MqttControlSUBACK {
+			if buf, err = sess.mergeDiscardedIntoSuback(buf); err != nil {
+				logger.Warn("failed merging SUBACK", "err", err)
+				return
+			}
+			fixedHdr.RemainingLength = len(buf)
+		}
+
 		var encodedRemainingLen []byte
 		if encodedRemainingLen, err = mqttparser.EncodeToVariableByteInteger(fixedHdr.RemainingLength); err != nil {
 			return
@@ -342,49 +804,73 @@ func mqttToClientHandler(ctx context.Context, buf []byte, incomingConn net.Conn,
 		return
 	default:
 	}
-	if _, err = funcs.ConnWrite(ctx, incomingConn, buf, config.Server.SocketTimeout.External); err != nil {
-		fmt.Printf("mqtt2Cli(%s): Error sending out a packet to client: %v\n", incomingAddr, err)
+	n, err := funcs.ConnWrite(ctx, incomingConn, buf, config.Server.SocketTimeout.External)
+	bytesMetric.Add(float64(n), DIRECTION_MQTT2CLI)
+	if err != nil {
+		logger.Warn("failed sending out a packet to client", "err", err)
 		return
 	}
+	if fixedHdr.ControlPacketType == MqttControlCONNACK {
+		sess.connackForwarded = true
+		if accepted := len(buf) >= 4 && buf[3] == REASON_CODE_SUCCESS; accepted && config.Server.MqttInterface.CoverTraffic.Interval > 0 {
+			go runCoverTraffic(ctx, sess)
+		}
+	}
+	if afterForwarded != nil {
+		afterForwarded()
+	}
 	return
 }
 
-func mqttInterfaceHandler(incomingConn net.Conn) {
+// Errors reading from the broker other than cancel by the client side and timeouts
+func isBrokerLost(ctx context.Context, err error) bool {
+	var netErr net.Error
+	return err != nil && ctx.Err() == nil && !(errors.As(err, &netErr) && netErr.Timeout())
+}
+
+func mqttInterfaceHandler(incomingConn net.Conn, listener string) {
+	connLogger := logger.With("remote", incomingConn.RemoteAddr().String())
 	defer func() {
-		addr := incomingConn.RemoteAddr().String()
 		incomingConn.Close()
-		fmt.Printf("Closed connection with %s (client)\n", addr)
+		connLogger.Info("closed connection with client")
 	}()
 
-	brokerConn, err := net.Dial("tcp", fmt.Sprintf(":%d", config.Server.Ports.MqttServer))
+	brokerConn, err := dialUpstreamBroker()
 	if err != nil {
-		fmt.Printf("Error connecting To MQTT Broker: %v\n", err)
+		connLogger.Error("failed connecting to MQTT broker", "err", err)
+		rejectConnectWithServerUnavailable(incomingConn)
 		return
 	}
 	defer func() {
 		addr := brokerConn.RemoteAddr().String()
 		brokerConn.Close()
-		fmt.Printf("Closed connection with %s (broker)\n", addr)
+		connLogger.Debug("closed connection with broker", "broker", addr)
 	}()
 
 	var wg sync.WaitGroup
-	ctx, cancel := funcs.NewCancelableContext(true)
-	var cliMqttVersion byte = 0xFF
-	aeadInfo := AEADInfo{
-		AEADType: types.PAYLOAD_AEAD_NONE,
+	ctx, cancel := context.WithCancel(context.Background())
+	sess := newMqttSession(ctx, incomingConn, brokerConn, listener)
+	defer sess.release()
+	sessionsMetric.Inc(listener)
+	defer sessionsMetric.Dec(listener)
+	addActiveSession(sess)
+	defer removeActiveSession(sess)
+	if config.Server.MqttInterface.MovingTarget.Enabled {
+		go runMovingTargetSwitchover(ctx, sess)
 	}
 
 	wg.Add(2)
 	go func() {
 		defer wg.Done()
-		buf := make([]byte, BUF_SIZE)
+		bufp := funcs.GetBuf()
+		defer funcs.PutBuf(bufp)
 		for {
 			select {
 			case <-ctx.Done():
 				return
 			default:
-				if shouldCloseSock, err := clientToMqttHandler(ctx, buf, incomingConn, brokerConn, &cliMqttVersion, &aeadInfo); err != nil {
-					fmt.Println("clientToMqttHandler failed: ", err)
+				if shouldCloseSock, err := clientToMqttHandler(ctx, bufp, sess); err != nil {
+					connLogger.Debug("cli2Mqtt ended", "err", err)
 					cancel()
 					return
 				} else if shouldCloseSock {
@@ -397,14 +883,18 @@ func mqttInterfaceHandler(incomingConn net.Conn) {
 
 	go func() {
 		defer wg.Done()
-		buf := make([]byte, BUF_SIZE)
+		bufp := funcs.GetBuf()
+		defer funcs.PutBuf(bufp)
 		for {
 			select {
 			case <-ctx.Done():
 				return
 			default:
-				if err := mqttToClientHandler(ctx, buf, incomingConn, brokerConn, &cliMqttVersion, &aeadInfo); err != nil {
-					fmt.Println("mqttToClientHandler failed: ", err)
+				if brokerLost, err := mqttToClientHandler(ctx, bufp, sess); err != nil {
+					connLogger.Debug("mqtt2Cli ended", "err", err)
+					if brokerLost {
+						notifyBrokerLost(ctx, incomingConn, sess.cliMqttVersion, sess.connackForwarded)
+					}
 					cancel()
 					return
 				}
@@ -413,7 +903,7 @@ func mqttInterfaceHandler(incomingConn net.Conn) {
 	}()
 
 	wg.Wait()
-	fmt.Println("mqttInterfaceHandler ended")
+	connLogger.Info("session ended", "traffic", sess.traffic.String(), "total", totalTraffic.String())
 }
 
 func main() {
@@ -421,11 +911,43 @@ func main() {
 	flag.Parse()
 
 	if err := config.LoadServerConfig(*configFilePath); err != nil {
-		log.Fatalf("Failed to load server config from %s: %v", *configFilePath, err)
-	} else {
-		log.Printf("Server Config Loaded from %s\n", *configFilePath)
+		logging.Fatal(logger, "failed to load server config", "path", *configFilePath, "err", err)
+	}
+	if err := logging.Init(config.Server.Log, "mqttinterface"); err != nil {
+		logging.Fatal(logger, "failed to apply log config", "err", err)
 	}
+	logger.Info("server config loaded", "path", *configFilePath)
 
+	if err := loadUpstreamBrokers(); err != nil {
+		logging.Fatal(logger, "failed to load upstream brokers", "err", err)
+	}
+
+	if err := loadMovingTargetKey(); err != nil {
+		logging.Fatal(logger, "failed to load moving target key", "err", err)
+	}
+
+	if err := loadCWTKey(); err != nil {
+		logging.Fatal(logger, "failed to load cwt key", "path", config.Server.FilePaths.CwtKeyFilePath, "err", err)
+	}
+
+	if config.Server.Ports.MqttInterfaceMetrics != 0 {
+		go runMetrics()
+	}
+	if config.Server.Ports.MqttInterfaceAdmin != 0 {
+		go runAdminAPI()
+	}
 	go run()
+	if config.Server.Ports.MqttInterfaceTls != 0 {
+		tlsConf, err := loadTLSConfig()
+		if err != nil {
+			logging.Fatal(logger, "failed to load TLS config", "err", err)
+		}
+		go runTLS(tlsConf)
+	}
+	if config.Server.Ports.MqttInterfaceWs != 0 {
+		go runWebSocket()
+	}
+	go runCWTReplayGuardSweeper()
+	go runInflightPublishSweeper()
 	select {}
 }
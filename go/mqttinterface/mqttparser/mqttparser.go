@@ -3,6 +3,8 @@ package mqttparser
 import (
 	"encoding/binary"
 	"fmt"
+	"mqttmtd/funcs"
+	"time"
 	"unsafe"
 )
 
@@ -27,6 +29,48 @@ func decodeVariableByteInteger(src []byte) (value int, len int, err error) {
 	return
 }
 
+func decodeVariableByteIntegerFromConn(r *funcs.ConnReader, timeout time.Duration) (value int, len int, err error) {
+	ended := false
+	var i int = 0
+	var b byte
+	for i < 4 {
+		if b, err = r.ReadByteWithin(timeout); err != nil {
+			goto decodeVariableByteIntegerFromConnError
+		} else {
+			encodedByte := int(b)
+			value += (encodedByte & 0x7F) << (7 * i)
+			i++
+			if encodedByte&0x80 == 0 {
+				ended = true
+				break
+			}
+		}
+	}
+	if !ended {
+		err = fmt.Errorf("decoding of a variable byte integer ended unexpectedly. i=%d", i)
+		goto decodeVariableByteIntegerFromConnError
+	}
+	len = i
+	return
+
+decodeVariableByteIntegerFromConnError:
+	value = 0
+	len = 0
+	return
+}
+
+/*
+Read the fixed header of the next packet. The first byte is awaited up to idleTimeout, or without deadline if it is 0,
+while the Remaining Length must follow within timeout. Shared by MQTT Interface and the benchmarks of tokenmgr/tests.
+*/
+func ReadFixedHeader(r *funcs.ConnReader, idleTimeout time.Duration, timeout time.Duration) (firstByte byte, remainingLength int, remainingLengthLen int, err error) {
+	if firstByte, err = r.ReadByteWithin(idleTimeout); err != nil {
+		return
+	}
+	remainingLength, remainingLengthLen, err = decodeVariableByteIntegerFromConn(r, timeout)
+	return
+}
+
 func EncodeToVariableByteInteger(value int) (encoded []byte, err error) {
 	encoded = make([]byte, 4)
 	ended := false
@@ -0,0 +1,88 @@
+package main
+
+import (
+	"encoding/binary"
+	"mqttmtd/mqttinterface/mqttparser"
+)
+
+// MQTT v5.0 reason codes sent by MQTT Interface itself
+const (
+	REASON_CODE_SUCCESS                   byte = 0x00
+	REASON_CODE_NOT_AUTHORIZED            byte = 0x87
+	REASON_CODE_SERVER_UNAVAILABLE        byte = 0x88
+	REASON_CODE_SERVER_BUSY               byte = 0x89
+	REASON_CODE_BAD_AUTHENTICATION_METHOD byte = 0x8C
+)
+
+// CONNACK and SUBACK return codes of MQTT v3.1.1
+const (
+	CONNACK_V3_ACCEPTED           byte = 0x00
+	CONNACK_V3_SERVER_UNAVAILABLE byte = 0x03
+	CONNACK_V3_NOT_AUTHORIZED     byte = 0x05
+
+	SUBACK_V3_FAILURE byte = 0x80
+)
+
+// SUBACK return code of MQTT v3.1.1, and reason code of v5.0, granting QoS 0
+const SUBACK_GRANTED_QOS_0 byte = 0x00
+
+// CONNACK return code for MQTT v3.1.1 corresponding to a v5.0 reason code
+func connackV3ReturnCode(reasonCode byte) byte {
+	switch reasonCode {
+	case REASON_CODE_SUCCESS:
+		return CONNACK_V3_ACCEPTED
+	case REASON_CODE_NOT_AUTHORIZED:
+		return CONNACK_V3_NOT_AUTHORIZED
+	default:
+		return CONNACK_V3_SERVER_UNAVAILABLE
+	}
+}
+
+// CONNACK without session present flag and properties. reasonCode is of MQTT v5.0, and converted for older versions.
+func newConnackPacket(mqttVersion byte, reasonCode byte) []byte {
+	if mqttVersion >= 5 {
+		return []byte{byte(MqttControlCONNACK) << 4, 3, 0x00, reasonCode, 0x00}
+	}
+	return []byte{byte(MqttControlCONNACK) << 4, 2, 0x00, connackV3ReturnCode(reasonCode)}
+}
+
+// DISCONNECT from server side, which exists only in MQTT v5.0. nil for older versions.
+func newDisconnectPacket(mqttVersion byte, reasonCode byte) []byte {
+	if mqttVersion < 5 || mqttVersion == 0xFF {
+		return nil
+	}
+	return []byte{byte(MqttControlDISCONNECT) << 4, 2, reasonCode, 0x00}
+}
+
+// PUBACK, PUBREC or PUBCOMP. The reason code is omitted when it is success or for older versions.
+func newPubResponsePacket(ctrlType MQTTControlPacketType, mqttVersion byte, packetID uint16, reasonCode byte) []byte {
+	if mqttVersion >= 5 && mqttVersion != 0xFF && reasonCode != REASON_CODE_SUCCESS {
+		return []byte{byte(ctrlType) << 4, 3, byte(packetID >> 8), byte(packetID), reasonCode}
+	}
+	return []byte{byte(ctrlType) << 4, 2, byte(packetID >> 8), byte(packetID)}
+}
+
+// SUBACK without properties
+func newSubackPacket(mqttVersion byte, packetID uint16, returnCodes []byte) (packet []byte, err error) {
+	varHdrAndPayload := []byte{byte(packetID >> 8), byte(packetID)}
+	if mqttVersion >= 5 && mqttVersion != 0xFF {
+		varHdrAndPayload = append(varHdrAndPayload, 0x00)
+	}
+	varHdrAndPayload = append(varHdrAndPayload, returnCodes...)
+
+	var encodedRemainingLen []byte
+	if encodedRemainingLen, err = mqttparser.EncodeToVariableByteInteger(len(varHdrAndPayload)); err != nil {
+		return
+	}
+	packet = append(append([]byte{byte(MqttControlSUBACK) << 4}, encodedRemainingLen...), varHdrAndPayload...)
+	return
+}
+
+// AUTH with TOKEN_AUTHENTICATION_METHOD, which exists only in MQTT v5.0
+func newTokenAuthPacket(reasonCode byte) []byte {
+	properties := []byte{PROPERTY_AUTHENTICATION_METHOD}
+	properties = binary.BigEndian.AppendUint16(properties, uint16(len(TOKEN_AUTHENTICATION_METHOD)))
+	properties = append(properties, TOKEN_AUTHENTICATION_METHOD...)
+	varHdr := append([]byte{reasonCode, byte(len(properties))}, properties...)
+	return append([]byte{byte(MqttControlAUTH) << 4, byte(len(varHdr))}, varHdr...)
+}
@@ -1,51 +1,14 @@
 package main
 
 import (
-	"context"
 	"encoding/binary"
 	"fmt"
 	"mqttmtd/funcs"
-	"net"
+	"mqttmtd/mqttinterface/mqttparser"
 	"time"
 	"unsafe"
 )
 
-func decodeVariableByteIntegerFromConn(ctx context.Context, conn net.Conn, timeout time.Duration) (value int, len int, err error) {
-	ended := false
-	var i int = 0
-	buf := make([]byte, 1)
-	for i < 4 {
-		select {
-		case <-ctx.Done():
-			err = fmt.Errorf("decodeVariableByteIntegerFromConn interrupted by context cancel")
-			goto decodeVariableByteIntegerFromConnError
-		default:
-		}
-		if _, err = funcs.ConnRead(ctx, conn, buf, timeout); err != nil {
-			goto decodeVariableByteIntegerFromConnError
-		} else {
-			encodedByte := int(buf[0])
-			value += (encodedByte & 0x7F) << (7 * i)
-			i++
-			if encodedByte&0x80 == 0 {
-				ended = true
-				break
-			}
-		}
-	}
-	if !ended {
-		err = fmt.Errorf("decoding of a variable byte integer ended unexpectedly. i=%d", i)
-		goto decodeVariableByteIntegerFromConnError
-	}
-	len = i
-	return
-
-decodeVariableByteIntegerFromConnError:
-	value = 0
-	len = 0
-	return
-}
-
 func decodeVariableByteInteger(buf []byte) (value int, length int, err error) {
 	ended := false
 	var i int = 0
@@ -142,26 +105,14 @@ type FixedHeader struct {
 	RemainingLength   int
 }
 
-func getFixedHeader(ctx context.Context, conn net.Conn, timeout time.Duration) (fixedHeader *FixedHeader, err error) {
-	fixedHeader = &FixedHeader{}
-	var (
-		n   int
-		buf []byte = make([]byte, 1)
-	)
-	if n, err = funcs.ConnRead(ctx, conn, buf, timeout); err != nil {
-		return
-	}
-	if n != 1 {
-		err = fmt.Errorf("fixedHeader read nothing")
-		return
-	}
-	fixedHeader.ControlPacketType = MQTTControlPacketType(buf[0] >> 4)
-	fixedHeader.Flags = buf[0] & 0xF
-
-	remainingLength, remainingLengthLen, err := decodeVariableByteIntegerFromConn(ctx, conn, timeout)
+// Fixed header of the next packet, read by mqttparser.ReadFixedHeader
+func getFixedHeader(r *funcs.ConnReader, idleTimeout time.Duration, timeout time.Duration) (fixedHeader FixedHeader, err error) {
+	firstByte, remainingLength, remainingLengthLen, err := mqttparser.ReadFixedHeader(r, idleTimeout, timeout)
 	if err != nil {
 		return
 	}
+	fixedHeader.ControlPacketType = MQTTControlPacketType(firstByte >> 4)
+	fixedHeader.Flags = firstByte & 0xF
 	fixedHeader.Length = 1 + remainingLengthLen
 	fixedHeader.RemainingLength = remainingLength
 	return
@@ -180,6 +131,142 @@ func getMQTTVersionFromConnect(varHdrAndPayload []byte) (mqttVersion byte, err e
 	return
 }
 
+// Keep Alive of CONNECT in seconds, 0 if disabled
+func getKeepAliveFromConnect(varHdrAndPayload []byte) (keepAlive uint16, err error) {
+	// Protocol Name, Protocol Level and Connect Flags
+	if len(varHdrAndPayload) < 10 {
+		err = fmt.Errorf("length inadequate")
+		return
+	}
+	keepAlive = binary.BigEndian.Uint16(varHdrAndPayload[8:10])
+	return
+}
+
+// Server Keep Alive of CONNACK of MQTT v5.0 in seconds. found is false if absent.
+func getServerKeepAliveFromConnack(varHdrAndPayload []byte) (serverKeepAlive uint16, found bool, err error) {
+	// Connect Acknowledge Flags and Reason Code
+	offset := 2
+	if len(varHdrAndPayload) <= offset {
+		// Property Length may be omitted without properties
+		return
+	}
+	var (
+		propertiesLen, propertiesLenLen int
+		properties                      []mqttProperty
+	)
+	if propertiesLen, propertiesLenLen, err = decodeVariableByteInteger(varHdrAndPayload[offset:]); err != nil {
+		return
+	}
+	offset += propertiesLenLen
+	if offset+propertiesLen > len(varHdrAndPayload) {
+		err = fmt.Errorf("length inadequate")
+		return
+	}
+	if properties, err = parseProperties(varHdrAndPayload[offset : offset+propertiesLen]); err != nil {
+		return
+	}
+	for _, property := range properties {
+		if property.ID == PROPERTY_SERVER_KEEP_ALIVE {
+			serverKeepAlive, found = binary.BigEndian.Uint16(property.Raw[1:]), true
+		}
+	}
+	return
+}
+
+// Client Identifier and Clean Start (Clean Session for MQTT v3.1.1) flag of CONNECT
+func getClientIDFromConnect(mqttVersion byte, varHdrAndPayload []byte) (clientID []byte, cleanStart bool, err error) {
+	// Protocol Name, Protocol Level, Connect Flags and Keep Alive
+	offset := 10
+	if len(varHdrAndPayload) < offset {
+		err = fmt.Errorf("length inadequate")
+		return
+	}
+	cleanStart = varHdrAndPayload[7]&0x02 != 0
+	if mqttVersion >= 5 {
+		var propertiesLen, propertiesLenLen int
+		if propertiesLen, propertiesLenLen, err = decodeVariableByteInteger(varHdrAndPayload[offset:]); err != nil {
+			return
+		}
+		offset += propertiesLenLen + propertiesLen
+	}
+	if offset+2 > len(varHdrAndPayload) {
+		err = fmt.Errorf("length inadequate")
+		return
+	}
+	length := int(binary.BigEndian.Uint16(varHdrAndPayload[offset : offset+2]))
+	if offset+2+length > len(varHdrAndPayload) {
+		err = fmt.Errorf("length inadequate")
+		return
+	}
+	clientID = varHdrAndPayload[offset+2 : offset+2+length]
+	return
+}
+
+/*
+Will Topic and Will Payload of CONNECT, with the rest of the packet before and after them. willTopic is nil when the Will
+Flag is not set.
+*/
+func getWillFromConnect(mqttVersion byte, varHdrAndPayload []byte) (contentBefore []byte, willTopic []byte, willPayload []byte, contentAfter []byte, err error) {
+	if len(varHdrAndPayload) < 10 {
+		err = fmt.Errorf("length inadequate")
+		return
+	}
+	if varHdrAndPayload[7]&0x04 == 0 {
+		return
+	}
+
+	// Protocol Name, Protocol Level, Connect Flags and Keep Alive
+	offset := 10
+	skipProperties := func() (err error) {
+		var propertiesLen, propertiesLenLen int
+		if propertiesLen, propertiesLenLen, err = decodeVariableByteInteger(varHdrAndPayload[offset:]); err != nil {
+			return
+		}
+		offset += propertiesLenLen + propertiesLen
+		return
+	}
+	readLengthPrefixed := func() (field []byte, err error) {
+		if offset+2 > len(varHdrAndPayload) {
+			err = fmt.Errorf("length inadequate")
+			return
+		}
+		length := int(binary.BigEndian.Uint16(varHdrAndPayload[offset : offset+2]))
+		if offset+2+length > len(varHdrAndPayload) {
+			err = fmt.Errorf("length inadequate")
+			return
+		}
+		field = varHdrAndPayload[offset+2 : offset+2+length]
+		offset += 2 + length
+		return
+	}
+
+	if mqttVersion >= 5 {
+		// Properties
+		if err = skipProperties(); err != nil {
+			return
+		}
+	}
+	// Client Identifier
+	if _, err = readLengthPrefixed(); err != nil {
+		return
+	}
+	if mqttVersion >= 5 {
+		// Will Properties
+		if err = skipProperties(); err != nil {
+			return
+		}
+	}
+	contentBefore = varHdrAndPayload[:offset]
+	if willTopic, err = readLengthPrefixed(); err != nil {
+		return
+	}
+	if willPayload, err = readLengthPrefixed(); err != nil {
+		return
+	}
+	contentAfter = varHdrAndPayload[offset:]
+	return
+}
+
 func getTopicNameFromPublish(mqttVersion byte, varHdrAndPayload []byte, qos int) (topicName []byte, contentBetween []byte, payload []byte, err error) {
 	if mqttVersion == 0xFF {
 		err = fmt.Errorf("mqttVersion  invalid")
@@ -236,3 +323,29 @@ func getTopicFiltersFromSubscribe(mqttVersion byte, varHdrAndPayload []byte) (co
 	contentAfter = varHdrAndPayload[offset:]
 	return
 }
+
+// Packet Identifier of a packet from the client that starts or continues a flow with the broker, found is unset for others
+func getClientFlowPacketID(packet []byte) (packetID uint16, found bool) {
+	if len(packet) < 2 {
+		return
+	}
+	_, remainingLengthLen, err := decodeVariableByteInteger(packet[1:])
+	if err != nil {
+		return
+	}
+	varHdr := packet[1+remainingLengthLen:]
+	switch MQTTControlPacketType(packet[0] >> 4) {
+	case MqttControlPUBLISH:
+		if (packet[0]>>1)&0x3 == 0 || len(varHdr) < 2 {
+			return
+		}
+		varHdr = varHdr[min(2+int(binary.BigEndian.Uint16(varHdr)), len(varHdr)):]
+	case MqttControlPUBREL, MqttControlSUBSCRIBE, MqttControlUNSUBSCRIBE:
+	default:
+		return
+	}
+	if len(varHdr) < 2 {
+		return
+	}
+	return binary.BigEndian.Uint16(varHdr), true
+}
@@ -0,0 +1,265 @@
+package main
+
+import (
+	"encoding/binary"
+	"fmt"
+	"mqttmtd/mqttinterface/mqttparser"
+)
+
+// MQTT v5.0 property identifiers referred to by MQTT Interface
+const (
+	PROPERTY_RESPONSE_TOPIC        byte = 0x08
+	PROPERTY_CORRELATION_DATA      byte = 0x09
+	PROPERTY_SERVER_KEEP_ALIVE     byte = 0x13
+	PROPERTY_AUTHENTICATION_METHOD byte = 0x15
+	PROPERTY_AUTHENTICATION_DATA   byte = 0x16
+	PROPERTY_USER_PROPERTY         byte = 0x26
+)
+
+/*
+Tokens carried apart from the topic, so that clients use real topic names and filters.
+A PUBLISH/SUBSCRIBE has the token Base64 encoded in a user property of TOKEN_USER_PROPERTY_NAME, or the raw token is sent
+beforehand as the Authentication Data of an AUTH re-authentication with TOKEN_AUTHENTICATION_METHOD, which requires the
+method in CONNECT too. Both are removed before forwarding to the broker.
+*/
+const (
+	TOKEN_USER_PROPERTY_NAME    string = "mqttmtd-token"
+	TOKEN_AUTHENTICATION_METHOD string = "mqttmtd-token"
+)
+
+type mqttPropertyType int
+
+const (
+	mqttPropertyByte mqttPropertyType = iota
+	mqttPropertyTwoByteInteger
+	mqttPropertyFourByteInteger
+	mqttPropertyVariableByteInteger
+	mqttPropertyBinary // UTF-8 Encoded String included
+	mqttPropertyStringPair
+)
+
+var mqttPropertyTypes = map[byte]mqttPropertyType{
+	0x01: mqttPropertyByte,                // Payload Format Indicator
+	0x02: mqttPropertyFourByteInteger,     // Message Expiry Interval
+	0x03: mqttPropertyBinary,              // Content Type
+	0x08: mqttPropertyBinary,              // Response Topic
+	0x09: mqttPropertyBinary,              // Correlation Data
+	0x0B: mqttPropertyVariableByteInteger, // Subscription Identifier
+	0x11: mqttPropertyFourByteInteger,     // Session Expiry Interval
+	0x12: mqttPropertyBinary,              // Assigned Client Identifier
+	0x13: mqttPropertyTwoByteInteger,      // Server Keep Alive
+	0x15: mqttPropertyBinary,              // Authentication Method
+	0x16: mqttPropertyBinary,              // Authentication Data
+	0x17: mqttPropertyByte,                // Request Problem Information
+	0x18: mqttPropertyFourByteInteger,     // Will Delay Interval
+	0x19: mqttPropertyByte,                // Request Response Information
+	0x1A: mqttPropertyBinary,              // Response Information
+	0x1C: mqttPropertyBinary,              // Server Reference
+	0x1F: mqttPropertyBinary,              // Reason String
+	0x21: mqttPropertyTwoByteInteger,      // Receive Maximum
+	0x22: mqttPropertyTwoByteInteger,      // Topic Alias Maximum
+	0x23: mqttPropertyTwoByteInteger,      // Topic Alias
+	0x24: mqttPropertyByte,                // Maximum QoS
+	0x25: mqttPropertyByte,                // Retain Available
+	0x26: mqttPropertyStringPair,          // User Property
+	0x27: mqttPropertyFourByteInteger,     // Maximum Packet Size
+	0x28: mqttPropertyByte,                // Wildcard Subscription Available
+	0x29: mqttPropertyByte,                // Subscription Identifier Available
+	0x2A: mqttPropertyByte,                // Shared Subscription Available
+}
+
+type mqttProperty struct {
+	ID    byte
+	Raw   []byte // identifier and value as encoded
+	Value []byte // content of binary and string values, or the name of a user property
+	Pair  []byte // value of a user property
+}
+
+// Properties without the preceding Property Length
+func parseProperties(properties []byte) (parsed []mqttProperty, err error) {
+	for offset := 0; offset < len(properties); {
+		property := mqttProperty{ID: properties[offset]}
+		propertyType, found := mqttPropertyTypes[property.ID]
+		if !found {
+			err = fmt.Errorf("unknown property identifier 0x%02x", property.ID)
+			return
+		}
+		valueOffset := offset + 1
+		end := valueOffset
+		switch propertyType {
+		case mqttPropertyByte:
+			end += 1
+		case mqttPropertyTwoByteInteger:
+			end += 2
+		case mqttPropertyFourByteInteger:
+			end += 4
+		case mqttPropertyVariableByteInteger:
+			var lengthLen int
+			if _, lengthLen, err = decodeVariableByteInteger(properties[valueOffset:]); err != nil {
+				return
+			}
+			end += lengthLen
+		case mqttPropertyBinary:
+			if property.Value, end, err = readTwoByteLengthPrefixed(properties, valueOffset); err != nil {
+				return
+			}
+		case mqttPropertyStringPair:
+			if property.Value, end, err = readTwoByteLengthPrefixed(properties, valueOffset); err != nil {
+				return
+			}
+			if property.Pair, end, err = readTwoByteLengthPrefixed(properties, end); err != nil {
+				return
+			}
+		}
+		if end > len(properties) {
+			err = fmt.Errorf("property 0x%02x length inadequate", property.ID)
+			return
+		}
+		property.Raw = properties[offset:end]
+		parsed = append(parsed, property)
+		offset = end
+	}
+	return
+}
+
+func readTwoByteLengthPrefixed(buf []byte, offset int) (field []byte, end int, err error) {
+	if offset+2 > len(buf) {
+		err = fmt.Errorf("length inadequate")
+		return
+	}
+	end = offset + 2 + int(binary.BigEndian.Uint16(buf[offset:offset+2]))
+	if end > len(buf) {
+		err = fmt.Errorf("length inadequate")
+		return
+	}
+	field = buf[offset+2 : end]
+	return
+}
+
+// Property Length followed by the properties
+func encodeProperties(properties []mqttProperty) (encoded []byte, err error) {
+	length := 0
+	for _, property := range properties {
+		length += len(property.Raw)
+	}
+	if encoded, err = mqttparser.EncodeToVariableByteInteger(length); err != nil {
+		return
+	}
+	for _, property := range properties {
+		encoded = append(encoded, property.Raw...)
+	}
+	return
+}
+
+// Binary Data or UTF-8 Encoded String property
+func newBinaryProperty(id byte, value []byte) []byte {
+	property := binary.BigEndian.AppendUint16([]byte{id}, uint16(len(value)))
+	return append(property, value...)
+}
+
+/*
+Replace each property with the identifier and value returned by rewrite, or remove it if nil is returned, in properties
+preceded by Property Length at the head of lengthAndProperties. rest is what follows the properties.
+*/
+func rewriteProperties(lengthAndProperties []byte, rewrite func(mqttProperty) ([]byte, error)) (rewritten []byte, rest []byte, err error) {
+	propertiesLen, propertiesLenLen, err := decodeVariableByteInteger(lengthAndProperties)
+	if err != nil {
+		return
+	}
+	if propertiesLenLen+propertiesLen > len(lengthAndProperties) {
+		err = fmt.Errorf("properties length inadequate")
+		return
+	}
+	rest = lengthAndProperties[propertiesLenLen+propertiesLen:]
+
+	var parsed []mqttProperty
+	if parsed, err = parseProperties(lengthAndProperties[propertiesLenLen : propertiesLenLen+propertiesLen]); err != nil {
+		return
+	}
+	var rewrittenProperties []mqttProperty
+	for _, property := range parsed {
+		var raw []byte
+		if raw, err = rewrite(property); err != nil {
+			return
+		}
+		if raw != nil {
+			rewrittenProperties = append(rewrittenProperties, mqttProperty{ID: property.ID, Raw: raw})
+		}
+	}
+	rewritten, err = encodeProperties(rewrittenProperties)
+	return
+}
+
+/*
+Remove the properties for which drop returns true, from properties preceded by Property Length at the head of
+lengthAndProperties. rest is what follows the properties. Dropped ones are returned in order.
+*/
+func dropProperties(lengthAndProperties []byte, drop func(mqttProperty) bool) (kept []byte, dropped []mqttProperty, rest []byte, err error) {
+	propertiesLen, propertiesLenLen, err := decodeVariableByteInteger(lengthAndProperties)
+	if err != nil {
+		return
+	}
+	if propertiesLenLen+propertiesLen > len(lengthAndProperties) {
+		err = fmt.Errorf("properties length inadequate")
+		return
+	}
+	rest = lengthAndProperties[propertiesLenLen+propertiesLen:]
+
+	var parsed []mqttProperty
+	if parsed, err = parseProperties(lengthAndProperties[propertiesLenLen : propertiesLenLen+propertiesLen]); err != nil {
+		return
+	}
+	var keptProperties []mqttProperty
+	for _, property := range parsed {
+		if drop(property) {
+			dropped = append(dropped, property)
+		} else {
+			keptProperties = append(keptProperties, property)
+		}
+	}
+	if len(dropped) == 0 {
+		kept = lengthAndProperties[:propertiesLenLen+propertiesLen]
+		return
+	}
+	kept, err = encodeProperties(keptProperties)
+	return
+}
+
+// Values of the token user properties, removed from properties preceded by Property Length
+func takeTokenUserProperties(lengthAndProperties []byte) (kept []byte, tokens [][]byte, rest []byte, err error) {
+	var dropped []mqttProperty
+	kept, dropped, rest, err = dropProperties(lengthAndProperties, func(property mqttProperty) bool {
+		return property.ID == PROPERTY_USER_PROPERTY && string(property.Value) == TOKEN_USER_PROPERTY_NAME
+	})
+	for _, property := range dropped {
+		tokens = append(tokens, property.Pair)
+	}
+	return
+}
+
+/*
+Remove Authentication Method and Data from properties preceded by Property Length, if the method is
+TOKEN_AUTHENTICATION_METHOD. Properties of other methods are kept as they are, with enabled unset.
+*/
+func takeTokenAuthentication(lengthAndProperties []byte) (kept []byte, enabled bool, authData []byte, rest []byte, err error) {
+	var dropped []mqttProperty
+	kept, dropped, rest, err = dropProperties(lengthAndProperties, func(property mqttProperty) bool {
+		if property.ID == PROPERTY_AUTHENTICATION_METHOD && string(property.Value) == TOKEN_AUTHENTICATION_METHOD {
+			enabled = true
+		}
+		return property.ID == PROPERTY_AUTHENTICATION_METHOD || property.ID == PROPERTY_AUTHENTICATION_DATA
+	})
+	if err != nil {
+		return
+	}
+	if !enabled {
+		kept = lengthAndProperties[:len(lengthAndProperties)-len(rest)]
+		return
+	}
+	for _, property := range dropped {
+		if property.ID == PROPERTY_AUTHENTICATION_DATA {
+			authData = property.Value
+		}
+	}
+	return
+}
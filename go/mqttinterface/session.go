@@ -0,0 +1,369 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/binary"
+	"encoding/hex"
+	"fmt"
+	"log/slog"
+	"mqttmtd/config"
+	"mqttmtd/funcs"
+	"mqttmtd/types"
+	"net"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// Values of config.Server.MqttInterface.VerificationFailure.V3Publish
+const (
+	V3_PUBLISH_FAILURE_ACK   = "ack" // acknowledged and dropped (default)
+	V3_PUBLISH_FAILURE_CLOSE = "close"
+)
+
+// State of a client connection shared by clientToMqttHandler and mqttToClientHandler
+type mqttSession struct {
+	incomingConn   net.Conn
+	brokerConn     net.Conn
+	incomingReader *funcs.ConnReader // read by cli2Mqtt only
+	brokerReader   *funcs.ConnReader // read by mqtt2Cli only
+	listener       string            // LISTENER_PLAIN, LISTENER_TLS or LISTENER_WEBSOCKET
+	cli2MqttLogger *slog.Logger
+	mqtt2CliLogger *slog.Logger
+	cliMqttVersion byte
+	aeadInfo       AEADInfo
+
+	inflight atomic.Pointer[inflightPublishes] // replaced on CONNECT by the one of the client id
+
+	// cli2Mqtt only
+	verificationFailures int
+	droppedQoS2          map[uint16]struct{} // packet ids of QoS 2 PUBLISH acknowledged but not forwarded (MQTT 3.1.1)
+	tokenAuthEnabled     bool                // CONNECT had TOKEN_AUTHENTICATION_METHOD
+	authToken            []byte              // sent by AUTH, spent by the next PUBLISH or SUBSCRIBE without a token user property
+	deception            bool                // failed tokens are routed to decoys, see isDeceptionListener
+	fingerprint          string              // of CONNECT, in deception mode
+	connectDetail        string
+	deceived             bool                // any decoy used in this session
+	decoyFeeds           map[string]struct{} // decoy topics fed with fake data
+
+	// mqtt2Cli only
+	connackForwarded    bool
+	droppedDeliveryQoS2 map[uint16]struct{} // packet ids of QoS 2 PUBLISH from the broker acknowledged but not forwarded
+
+	pendingSubacksLock sync.Mutex
+	pendingSubacks     map[uint16]pendingSuback // SUBSCRIBE forwarded without the rejected filters
+
+	revealedFiltersLock sync.Mutex
+	revealedFilters     []string // granted by Sub tokens, whose matching topic names are forwarded as they are
+
+	// Moving target topics
+	subscriptionsLock sync.Mutex
+	subscriptions     map[string]byte // real topic filters forwarded to the broker, with subscription options
+	aheadEpoch        int64           // whose broker topics are subscribed before the rotation
+	ownPacketID       uint16
+	ownPacketIDs      map[uint16]chan struct{} // of SUBSCRIBE/UNSUBSCRIBE sent by MQTT Interface itself, closed when answered
+	cliPacketIDs      map[uint16]struct{}      // of flows of the client with the broker not complete yet
+
+	traffic    trafficCounters
+	coverShape atomic.Pointer[coverShape] // imitated by cover traffic, nil before the first SUBSCRIBE or PUBLISH to the client
+
+	idleTimeoutNanos atomic.Int64 // read deadline of the client between packets, see setKeepAlive
+
+	started     time.Time
+	connectInfo atomic.Pointer[sessionConnectInfo] // set on CONNECT, read by sessionsHandler
+}
+
+type pendingSuback struct {
+	numFilters int
+	discarded  map[int]byte // return codes of the filters not forwarded, by index in the original SUBSCRIBE
+}
+
+// Reads of the connections are interrupted when ctx is canceled
+func newMqttSession(ctx context.Context, incomingConn net.Conn, brokerConn net.Conn, listener string) *mqttSession {
+	sess := &mqttSession{
+		incomingConn:   incomingConn,
+		brokerConn:     brokerConn,
+		incomingReader: funcs.NewConnReader(ctx, incomingConn),
+		brokerReader:   funcs.NewConnReader(ctx, brokerConn),
+		listener:       listener,
+		deception:      isDeceptionListener(listener),
+		decoyFeeds:     make(map[string]struct{}),
+		subscriptions:  make(map[string]byte),
+		ownPacketIDs:   make(map[uint16]chan struct{}),
+		cliPacketIDs:   make(map[uint16]struct{}),
+		cliMqttVersion: 0xFF,
+		aeadInfo:       AEADInfo{AEADType: types.PAYLOAD_AEAD_NONE},
+		droppedQoS2:    make(map[uint16]struct{}),
+		pendingSubacks: make(map[uint16]pendingSuback),
+		started:        time.Now(),
+	}
+	remote := incomingConn.RemoteAddr().String()
+	sess.cli2MqttLogger = logger.With("remote", remote, "flow", "cli2Mqtt")
+	sess.mqtt2CliLogger = logger.With("remote", remote, "flow", "mqtt2Cli")
+	sess.inflight.Store(newInflightPublishes())
+	// Until CONNECT tells the Keep Alive
+	sess.idleTimeoutNanos.Store(int64(config.Server.SocketTimeout.External))
+	return sess
+}
+
+// Called once both handlers have ended
+func (s *mqttSession) release() {
+	s.inflight.Load().release()
+	s.incomingReader.Release()
+	s.brokerReader.Release()
+}
+
+/*
+Keep Alive of CONNECT, or Server Keep Alive of CONNACK that overrides it, in seconds. The client may stay silent for up
+to one and a half times of it before being disconnected, and without limit if it is 0.
+*/
+func (s *mqttSession) setKeepAlive(keepAlive uint16) {
+	idleTimeout := time.Duration(keepAlive) * time.Second * 3 / 2
+	s.idleTimeoutNanos.Store(int64(idleTimeout))
+	s.cli2MqttLogger.Debug("keep alive set", "keepalive", keepAlive, "idletimeout", idleTimeout)
+}
+
+func (s *mqttSession) idleTimeout() time.Duration {
+	return time.Duration(s.idleTimeoutNanos.Load())
+}
+
+func (s *mqttSession) writeToClient(ctx context.Context, packet []byte) (err error) {
+	if _, err = funcs.ConnWrite(ctx, s.incomingConn, packet, config.Server.SocketTimeout.External); err != nil {
+		s.mqtt2CliLogger.Warn("failed sending out a packet to client", "err", err)
+	}
+	return
+}
+
+func (s *mqttSession) writeToBroker(ctx context.Context, packet []byte) (err error) {
+	n, err := funcs.ConnWrite(ctx, s.brokerConn, packet, config.Server.SocketTimeout.External)
+	bytesMetric.Add(float64(n), DIRECTION_CLI2MQTT)
+	if err != nil {
+		s.mqtt2CliLogger.Warn("failed sending out a packet to broker", "err", err)
+	}
+	return
+}
+
+// SUBACK return code for a rejected filter
+func (s *mqttSession) subackFailureCode() byte {
+	if s.cliMqttVersion >= 5 {
+		return REASON_CODE_NOT_AUTHORIZED
+	}
+	return SUBACK_V3_FAILURE
+}
+
+// Count a verification failure. shouldCloseSock is set when it reaches disconnectafter, after DISCONNECT 0x87 is sent
+// to MQTT 5.0 clients.
+func (s *mqttSession) onVerificationFailure(ctx context.Context) (shouldCloseSock bool, err error) {
+	s.verificationFailures++
+	limit := config.Server.MqttInterface.VerificationFailure.DisconnectAfter
+	if limit <= 0 || s.verificationFailures < limit {
+		return
+	}
+	s.cli2MqttLogger.Info("disconnecting after verification failures", "failures", s.verificationFailures)
+	shouldCloseSock = true
+	if packet := newDisconnectPacket(s.cliMqttVersion, REASON_CODE_NOT_AUTHORIZED); packet != nil {
+		err = s.writeToClient(ctx, packet)
+	}
+	return
+}
+
+// Answer a PUBLISH whose token failed verification, instead of forwarding it
+func (s *mqttSession) rejectPublish(ctx context.Context, qos int, contentBetween []byte) (shouldCloseSock bool, err error) {
+	if shouldCloseSock, err = s.onVerificationFailure(ctx); shouldCloseSock || err != nil || qos == 0 {
+		return
+	}
+
+	responseType := MqttControlPUBACK
+	if qos == 2 {
+		responseType = MqttControlPUBREC
+	}
+	packetID := binary.BigEndian.Uint16(contentBetween[:2])
+	if s.cliMqttVersion >= 5 {
+		err = s.writeToClient(ctx, newPubResponsePacket(responseType, s.cliMqttVersion, packetID, REASON_CODE_NOT_AUTHORIZED))
+		return
+	}
+
+	// MQTT 3.1.1 has no way to tell the failure, so either acknowledge positively or close [MQTT-3.3.5-2]
+	if config.Server.MqttInterface.VerificationFailure.V3Publish == V3_PUBLISH_FAILURE_CLOSE {
+		shouldCloseSock = true
+		return
+	}
+	if qos == 2 {
+		s.droppedQoS2[packetID] = struct{}{}
+	}
+	err = s.writeToClient(ctx, newPubResponsePacket(responseType, s.cliMqttVersion, packetID, REASON_CODE_SUCCESS))
+	return
+}
+
+// Acknowledge a PUBLISH from the broker to the broker as the client would, instead of forwarding it
+func (s *mqttSession) dropDelivery(ctx context.Context, qos int, contentBetween []byte) (err error) {
+	droppedDeliveriesMetric.Inc()
+	if qos == 0 {
+		return
+	}
+	responseType := MqttControlPUBACK
+	packetID := binary.BigEndian.Uint16(contentBetween[:2])
+	if qos == 2 {
+		responseType = MqttControlPUBREC
+		if s.droppedDeliveryQoS2 == nil {
+			s.droppedDeliveryQoS2 = make(map[uint16]struct{})
+		}
+		s.droppedDeliveryQoS2[packetID] = struct{}{}
+	}
+	err = s.writeToBroker(ctx, newPubResponsePacket(responseType, s.cliMqttVersion, packetID, REASON_CODE_SUCCESS))
+	return
+}
+
+// Answer PUBREL from the broker for a dropped QoS 2 PUBLISH. handled is set when packetID is of such PUBLISH.
+func (s *mqttSession) completeDroppedDelivery(ctx context.Context, packetID uint16) (handled bool, err error) {
+	if _, handled = s.droppedDeliveryQoS2[packetID]; !handled {
+		return
+	}
+	delete(s.droppedDeliveryQoS2, packetID)
+	err = s.writeToBroker(ctx, newPubResponsePacket(MqttControlPUBCOMP, s.cliMqttVersion, packetID, REASON_CODE_SUCCESS))
+	return
+}
+
+// Answer CONNECT whose Will token failed verification with CONNACK, instead of forwarding it
+func (s *mqttSession) rejectConnect(ctx context.Context) (shouldCloseSock bool, err error) {
+	shouldCloseSock = true
+	err = s.writeToClient(ctx, newConnackPacket(s.cliMqttVersion, REASON_CODE_NOT_AUTHORIZED))
+	return
+}
+
+// Answer PUBREL for a dropped QoS 2 PUBLISH. handled is set when packetID is of such PUBLISH.
+func (s *mqttSession) completeDroppedQoS2(ctx context.Context, packetID uint16) (handled bool, err error) {
+	if _, handled = s.droppedQoS2[packetID]; !handled {
+		return
+	}
+	delete(s.droppedQoS2, packetID)
+	err = s.writeToClient(ctx, newPubResponsePacket(MqttControlPUBCOMP, s.cliMqttVersion, packetID, REASON_CODE_SUCCESS))
+	return
+}
+
+func (s *mqttSession) addPendingSuback(packetID uint16, numFilters int, discarded map[int]byte) {
+	s.pendingSubacksLock.Lock()
+	defer s.pendingSubacksLock.Unlock()
+	s.pendingSubacks[packetID] = pendingSuback{numFilters: numFilters, discarded: discarded}
+}
+
+// Insert the return codes of discarded filters into SUBACK from the broker, so that the client sees one code per filter
+func (s *mqttSession) mergeDiscardedIntoSuback(varHdrAndPayload []byte) (merged []byte, err error) {
+	if len(varHdrAndPayload) < 2 {
+		err = fmt.Errorf("SUBACK length inadequate")
+		return
+	}
+	packetID := binary.BigEndian.Uint16(varHdrAndPayload[:2])
+	s.pendingSubacksLock.Lock()
+	pending, found := s.pendingSubacks[packetID]
+	delete(s.pendingSubacks, packetID)
+	s.pendingSubacksLock.Unlock()
+	if !found {
+		return varHdrAndPayload, nil
+	}
+
+	varHdrLen := 2
+	if s.cliMqttVersion >= 5 {
+		var propertiesLen, propertiesLenLen int
+		if propertiesLen, propertiesLenLen, err = decodeVariableByteInteger(varHdrAndPayload[2:]); err != nil {
+			return
+		}
+		varHdrLen += propertiesLenLen + propertiesLen
+	}
+	if varHdrLen > len(varHdrAndPayload) {
+		err = fmt.Errorf("SUBACK length inadequate")
+		return
+	}
+	brokerCodes := varHdrAndPayload[varHdrLen:]
+
+	// leave room for the fixed header, which is prepended in place by the caller
+	merged = make([]byte, varHdrLen, 5+varHdrLen+pending.numFilters)
+	copy(merged, varHdrAndPayload[:varHdrLen])
+	for i, j := 0, 0; i < pending.numFilters; i++ {
+		if code, found := pending.discarded[i]; found {
+			merged = append(merged, code)
+		} else if j < len(brokerCodes) {
+			merged = append(merged, brokerCodes[j])
+			j++
+		}
+	}
+	return
+}
+
+func (s *mqttSession) addRevealedFilter(filter []byte) {
+	s.revealedFiltersLock.Lock()
+	defer s.revealedFiltersLock.Unlock()
+	for _, existing := range s.revealedFilters {
+		if existing == string(filter) {
+			return
+		}
+	}
+	s.revealedFilters = append(s.revealedFilters, string(filter))
+}
+
+// Whether topicName of a PUBLISH from the broker matches any of the revealed filters subscribed in this session
+func (s *mqttSession) matchesRevealedFilter(topicName []byte) bool {
+	s.revealedFiltersLock.Lock()
+	defer s.revealedFiltersLock.Unlock()
+	for _, filter := range s.revealedFilters {
+		if types.TopicFilterCovers(filter, string(topicName)) {
+			return true
+		}
+	}
+	return false
+}
+
+// Answer AUTH re-authentication carrying a token, which is kept for the next PUBLISH or SUBSCRIBE. Other methods are
+// not supported, and the client is disconnected.
+func (s *mqttSession) acceptTokenAuth(ctx context.Context, varHdrAndPayload []byte) (shouldCloseSock bool, err error) {
+	var (
+		enabled  bool
+		authData []byte
+	)
+	if len(varHdrAndPayload) > 1 {
+		if _, enabled, authData, _, err = takeTokenAuthentication(varHdrAndPayload[1:]); err != nil {
+			return
+		}
+	}
+	if !enabled || authData == nil {
+		s.cli2MqttLogger.Info("AUTH without a token")
+		shouldCloseSock = true
+		err = s.writeToClient(ctx, newDisconnectPacket(s.cliMqttVersion, REASON_CODE_BAD_AUTHENTICATION_METHOD))
+		return
+	}
+	s.authToken = bytes.Clone(authData)
+	err = s.writeToClient(ctx, newTokenAuthPacket(REASON_CODE_SUCCESS))
+	return
+}
+
+/*
+Decoy topic in place of a failed token in deception mode, recorded with event naming what the token was for. Decoy
+subscriptions are fed with fake data while the session lasts.
+*/
+func (s *mqttSession) deceive(ctx context.Context, event string, token []byte) (topic []byte) {
+	topic = decoyTopic(s.fingerprint, token)
+	base := deceptionEvent{
+		Remote:      s.incomingConn.RemoteAddr().String(),
+		Listener:    s.listener,
+		Fingerprint: s.fingerprint,
+	}
+	if !s.deceived {
+		s.deceived = true
+		sessionEvent := base
+		sessionEvent.Event = DECEPTION_EVENT_SESSION
+		sessionEvent.Detail = s.connectDetail
+		logDeceptionEvent(sessionEvent)
+	}
+	base.Event = event
+	base.Token = hex.EncodeToString(token)
+	base.DecoyTopic = string(topic)
+	logDeceptionEvent(base)
+	s.cli2MqttLogger.Info("routed to decoy", "event", event, "decoytopic", string(topic))
+
+	if _, feeding := s.decoyFeeds[string(topic)]; event == DECEPTION_EVENT_SUBSCRIBE && !feeding {
+		s.decoyFeeds[string(topic)] = struct{}{}
+		go runDecoyFeeder(ctx, s.brokerConn, s.cliMqttVersion, topic)
+	}
+	return
+}
@@ -0,0 +1,100 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"mqttmtd/config"
+	"net/http"
+	"sort"
+	"sync"
+	"time"
+)
+
+// Sessions in progress, listed by the admin API of the dashboard through ports.mqttinterfaceadmin
+const SESSIONS_PATH = "/api/v1/sessions"
+
+var activeSessions = struct {
+	sync.Mutex
+	entries map[*mqttSession]struct{}
+}{entries: make(map[*mqttSession]struct{})}
+
+// Fields of CONNECT, set once it is received
+type sessionConnectInfo struct {
+	MqttVersion byte
+	ClientID    string
+	KeepAlive   uint16
+}
+
+type sessionJSON struct {
+	Remote      string    `json:"remote"`
+	Listener    string    `json:"listener"`
+	Started     time.Time `json:"started"`
+	Connected   bool      `json:"connected"` // CONNECT received
+	MqttVersion byte      `json:"mqttversion,omitempty"`
+	ClientID    string    `json:"clientid,omitempty"`
+	KeepAlive   uint16    `json:"keepalive,omitempty"`
+	Messages    uint64    `json:"messages"` // of all trafficKind, as real and cover traffic must not be told apart
+}
+
+func addActiveSession(sess *mqttSession) {
+	activeSessions.Lock()
+	activeSessions.entries[sess] = struct{}{}
+	activeSessions.Unlock()
+}
+
+func removeActiveSession(sess *mqttSession) {
+	activeSessions.Lock()
+	delete(activeSessions.entries, sess)
+	activeSessions.Unlock()
+}
+
+func (s *mqttSession) toJSON() (j sessionJSON) {
+	j = sessionJSON{
+		Remote:   s.incomingConn.RemoteAddr().String(),
+		Listener: s.listener,
+		Started:  s.started,
+	}
+	if info := s.connectInfo.Load(); info != nil {
+		j.Connected = true
+		j.MqttVersion = info.MqttVersion
+		j.ClientID = info.ClientID
+		j.KeepAlive = info.KeepAlive
+	}
+	for kind := range NUM_TRAFFIC_KINDS {
+		j.Messages += s.traffic[kind].Load()
+	}
+	return
+}
+
+// Active sessions, oldest first
+func sessionsHandler(w http.ResponseWriter, r *http.Request) {
+	activeSessions.Lock()
+	sessions := make([]sessionJSON, 0, len(activeSessions.entries))
+	for sess := range activeSessions.entries {
+		sessions = append(sessions, sess.toJSON())
+	}
+	activeSessions.Unlock()
+	sort.Slice(sessions, func(i, j int) bool { return sessions[i].Started.Before(sessions[j].Started) })
+
+	w.Header().Set("Content-Type", "application/json")
+	if err := json.NewEncoder(w).Encode(map[string]any{"sessions": sessions}); err != nil {
+		logger.Warn("failed encoding sessions", "err", err)
+	}
+}
+
+/*
+SESSIONS_PATH for the dashboard, which checks the roles of its users. It has no authentication of its own, so it listens
+on localhost unless config.Server.MqttInterface.AdminHost is set, apart from the metrics port open to scrapers.
+*/
+func runAdminAPI() {
+	host := config.Server.MqttInterface.AdminHost
+	if host == "" {
+		host = "localhost"
+	}
+	logger.Info("starting admin api server", "host", host, "port", config.Server.Ports.MqttInterfaceAdmin)
+	mux := http.NewServeMux()
+	mux.HandleFunc("GET "+SESSIONS_PATH, sessionsHandler)
+	if err := http.ListenAndServe(fmt.Sprintf("%s:%d", host, config.Server.Ports.MqttInterfaceAdmin), mux); err != nil {
+		logger.Error("failed to start admin api server", "err", err)
+	}
+}
@@ -0,0 +1,44 @@
+package main
+
+import (
+	"context"
+	"crypto/tls"
+	"fmt"
+	"mqttmtd/config"
+	"mqttmtd/funcs"
+	"net"
+)
+
+func loadTLSConfig() (*tls.Config, error) {
+	certs := &config.Server.Certs
+	return funcs.LoadServerTLSConfig(certs.ServerCertFilePath, certs.ServerKeyFilePath, certs.CaCertFilePath, config.Server.MqttInterface.TlsClientAuth)
+}
+
+func runTLS(tlsConf *tls.Config) {
+	logger.Info("starting mqtt interface server with TLS", "port", config.Server.Ports.MqttInterfaceTls, "clientauth", tlsConf.ClientAuth.String())
+	listener, err := tls.Listen("tcp", fmt.Sprintf(":%d", config.Server.Ports.MqttInterfaceTls), tlsConf)
+	if err != nil {
+		logger.Error("failed to start TLS listener", "err", err)
+		return
+	}
+	defer listener.Close()
+
+	for {
+		conn, err := listener.Accept()
+		if err != nil {
+			logger.Warn("failed to accept TLS connection", "err", err)
+			continue
+		}
+		go func(conn net.Conn) {
+			// Handshake before dialing the broker, so that clients failing TLS never reach it
+			ctx, cancel := context.WithTimeout(context.Background(), config.Server.SocketTimeout.External)
+			defer cancel()
+			if err := conn.(*tls.Conn).HandshakeContext(ctx); err != nil {
+				logger.Warn("TLS handshake failed", "remote", conn.RemoteAddr().String(), "err", err)
+				conn.Close()
+				return
+			}
+			mqttInterfaceHandler(conn, LISTENER_TLS)
+		}(conn)
+	}
+}
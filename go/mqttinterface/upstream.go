@@ -0,0 +1,181 @@
+package main
+
+import (
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"errors"
+	"fmt"
+	"mqttmtd/config"
+	"mqttmtd/funcs"
+	"net"
+	"net/url"
+	"os"
+	"sync/atomic"
+)
+
+// Values of config.Server.MqttInterface.Upstream.Strategy
+const (
+	UPSTREAM_STRATEGY_FAILOVER    = "failover" // always from the first broker (default)
+	UPSTREAM_STRATEGY_ROUND_ROBIN = "roundrobin"
+)
+
+type upstreamBroker struct {
+	url     string
+	addr    string
+	tlsConf *tls.Config // nil for plain TCP
+}
+
+var (
+	upstreamBrokers []upstreamBroker
+	upstreamNext    atomic.Uint32
+)
+
+func loadUpstreamBrokers() (err error) {
+	upstreamConf := &config.Server.MqttInterface.Upstream
+	switch upstreamConf.Strategy {
+	case "", UPSTREAM_STRATEGY_FAILOVER, UPSTREAM_STRATEGY_ROUND_ROBIN:
+	default:
+		return fmt.Errorf("unknown upstream strategy %q", upstreamConf.Strategy)
+	}
+
+	if len(upstreamConf.Brokers) == 0 {
+		// Broker on the same host
+		upstreamBrokers = []upstreamBroker{{
+			url:  fmt.Sprintf("tcp://:%d", config.Server.Ports.MqttServer),
+			addr: fmt.Sprintf(":%d", config.Server.Ports.MqttServer),
+		}}
+		return
+	}
+
+	var tlsConf *tls.Config
+	for _, brokerURL := range upstreamConf.Brokers {
+		var u *url.URL
+		if u, err = url.Parse(brokerURL); err != nil {
+			return fmt.Errorf("invalid broker url %s: %w", brokerURL, err)
+		}
+		broker := upstreamBroker{url: brokerURL, addr: u.Host}
+		switch u.Scheme {
+		case "tcp", "mqtt":
+			if u.Port() == "" {
+				broker.addr = net.JoinHostPort(u.Hostname(), "1883")
+			}
+		case "tls", "ssl", "mqtts":
+			if u.Port() == "" {
+				broker.addr = net.JoinHostPort(u.Hostname(), "8883")
+			}
+			if tlsConf == nil {
+				if tlsConf, err = loadUpstreamTLSConfig(); err != nil {
+					return
+				}
+			}
+			broker.tlsConf = tlsConf.Clone()
+			broker.tlsConf.ServerName = u.Hostname()
+		default:
+			return fmt.Errorf("unsupported scheme of broker url %s", brokerURL)
+		}
+		upstreamBrokers = append(upstreamBrokers, broker)
+	}
+	return
+}
+
+func loadUpstreamTLSConfig() (tlsConf *tls.Config, err error) {
+	upstreamConf := &config.Server.MqttInterface.Upstream
+	tlsConf = &tls.Config{
+		MinVersion: tls.VersionTLS12,
+	}
+
+	if upstreamConf.CaCertFilePath != "" {
+		var caCert []byte
+		if caCert, err = os.ReadFile(upstreamConf.CaCertFilePath); err != nil {
+			err = fmt.Errorf("failed to load upstream ca certificate: %w", err)
+			return
+		}
+		caCertPool := x509.NewCertPool()
+		caCertPool.AppendCertsFromPEM(caCert)
+		tlsConf.RootCAs = caCertPool
+	}
+
+	if upstreamConf.ClientCertFilePath != "" || upstreamConf.ClientKeyFilePath != "" {
+		var cert tls.Certificate
+		if cert, err = tls.LoadX509KeyPair(upstreamConf.ClientCertFilePath, upstreamConf.ClientKeyFilePath); err != nil {
+			err = fmt.Errorf("failed to load upstream client certificate: %w", err)
+			return
+		}
+		tlsConf.Certificates = []tls.Certificate{cert}
+	}
+	return
+}
+
+// Connect to one of the upstream brokers, trying each of them once in the order of the strategy
+func dialUpstreamBroker() (conn net.Conn, err error) {
+	timeout := config.Server.MqttInterface.Upstream.ConnectTimeout
+	if timeout == 0 {
+		timeout = config.Server.SocketTimeout.External
+	}
+
+	start := 0
+	if config.Server.MqttInterface.Upstream.Strategy == UPSTREAM_STRATEGY_ROUND_ROBIN {
+		start = int((upstreamNext.Add(1) - 1) % uint32(len(upstreamBrokers)))
+	}
+
+	var errs []error
+	for i := range upstreamBrokers {
+		broker := &upstreamBrokers[(start+i)%len(upstreamBrokers)]
+		ctx, cancel := context.WithTimeout(context.Background(), timeout)
+		if broker.tlsConf == nil {
+			conn, err = (&net.Dialer{}).DialContext(ctx, "tcp", broker.addr)
+		} else {
+			conn, err = (&tls.Dialer{Config: broker.tlsConf}).DialContext(ctx, "tcp", broker.addr)
+		}
+		cancel()
+		if err == nil {
+			return
+		}
+		logger.Warn("failed connecting to MQTT broker", "broker", broker.url, "err", err)
+		errs = append(errs, err)
+	}
+	err = fmt.Errorf("no MQTT Broker available: %w", errors.Join(errs...))
+	return
+}
+
+// Reply to the CONNECT of a client with Server unavailable, when no broker is available
+func rejectConnectWithServerUnavailable(incomingConn net.Conn) {
+	incomingAddr := incomingConn.RemoteAddr()
+	ctx := context.Background()
+
+	reader := funcs.NewConnReader(ctx, incomingConn)
+	defer reader.Release()
+	fixedHdr, err := getFixedHeader(reader, config.Server.SocketTimeout.External, config.Server.SocketTimeout.External)
+	if err != nil || fixedHdr.ControlPacketType != MqttControlCONNECT || fixedHdr.RemainingLength > BUF_SIZE {
+		return
+	}
+	buf := make([]byte, fixedHdr.RemainingLength)
+	if _, err = reader.ReadFull(buf, config.Server.SocketTimeout.External); err != nil {
+		return
+	}
+	cliMqttVersion, err := getMQTTVersionFromConnect(buf)
+	if err != nil {
+		logger.Warn("failed getting MQTT version", "remote", incomingAddr, "err", err)
+		return
+	}
+	if _, err = funcs.ConnWrite(ctx, incomingConn, newConnackPacket(cliMqttVersion, REASON_CODE_SERVER_UNAVAILABLE), config.Server.SocketTimeout.External); err != nil {
+		logger.Warn("failed sending out a packet to client", "remote", incomingAddr, "err", err)
+	}
+}
+
+// Tell the client that the broker is lost in the middle of a session, so that it reconnects to an available one
+func notifyBrokerLost(ctx context.Context, incomingConn net.Conn, cliMqttVersion byte, connackForwarded bool) {
+	var packet []byte
+	if connackForwarded {
+		packet = newDisconnectPacket(cliMqttVersion, REASON_CODE_SERVER_BUSY)
+	} else if cliMqttVersion != 0xFF {
+		packet = newConnackPacket(cliMqttVersion, REASON_CODE_SERVER_UNAVAILABLE)
+	}
+	if packet == nil {
+		return
+	}
+	if _, err := funcs.ConnWrite(ctx, incomingConn, packet, config.Server.SocketTimeout.External); err != nil {
+		logger.Warn("failed sending out a packet to client", "remote", incomingConn.RemoteAddr().String(), "err", err)
+	}
+}
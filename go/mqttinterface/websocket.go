@@ -0,0 +1,106 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"mqttmtd/config"
+	"net"
+	"net/http"
+	"slices"
+	"sync"
+	"time"
+
+	"github.com/gorilla/websocket"
+)
+
+const (
+	WS_PATH        = "/mqtt"
+	WS_SUBPROTOCOL = "mqtt"
+)
+
+/*
+net.Conn over a WebSocket connection, so that mqttInterfaceHandler can handle it as a TCP connection.
+MQTT packets are carried in binary messages, and a message may hold any part of a packet (MQTT v5.0 6.0).
+*/
+type wsConn struct {
+	*websocket.Conn
+	reader  io.Reader
+	writeMu sync.Mutex
+}
+
+func (c *wsConn) Read(p []byte) (n int, err error) {
+	for {
+		if c.reader == nil {
+			var messageType int
+			if messageType, c.reader, err = c.NextReader(); err != nil {
+				return
+			}
+			if messageType != websocket.BinaryMessage {
+				err = fmt.Errorf("non-binary websocket message")
+				return
+			}
+		}
+		n, err = c.reader.Read(p)
+		if err == io.EOF {
+			c.reader = nil
+			if n == 0 {
+				continue
+			}
+			err = nil
+		}
+		return
+	}
+}
+
+func (c *wsConn) Write(p []byte) (n int, err error) {
+	c.writeMu.Lock()
+	defer c.writeMu.Unlock()
+	if err = c.WriteMessage(websocket.BinaryMessage, p); err != nil {
+		return
+	}
+	return len(p), nil
+}
+
+func (c *wsConn) SetDeadline(t time.Time) (err error) {
+	if err = c.SetReadDeadline(t); err != nil {
+		return
+	}
+	return c.SetWriteDeadline(t)
+}
+
+func (c *wsConn) Close() error {
+	c.WriteControl(websocket.CloseMessage, websocket.FormatCloseMessage(websocket.CloseNormalClosure, ""), time.Now().Add(config.Server.SocketTimeout.External))
+	return c.Conn.Close()
+}
+
+var _ net.Conn = (*wsConn)(nil)
+
+func runWebSocket() {
+	logger.Info("starting mqtt interface server with WebSocket", "port", config.Server.Ports.MqttInterfaceWs)
+	upgrader := websocket.Upgrader{
+		HandshakeTimeout: config.Server.SocketTimeout.External,
+		ReadBufferSize:   BUF_SIZE,
+		WriteBufferSize:  BUF_SIZE,
+		Subprotocols:     []string{WS_SUBPROTOCOL},
+		// Browser dashboards are served from other origins, and tokens are what authorize clients
+		CheckOrigin: func(r *http.Request) bool { return true },
+	}
+
+	mux := http.NewServeMux()
+	mux.HandleFunc(WS_PATH, func(w http.ResponseWriter, r *http.Request) {
+		if !slices.Contains(websocket.Subprotocols(r), WS_SUBPROTOCOL) {
+			logger.Warn("WebSocket connection without subprotocol", "remote", r.RemoteAddr, "subprotocol", WS_SUBPROTOCOL)
+			http.Error(w, "Bad Request", http.StatusBadRequest)
+			return
+		}
+		ws, err := upgrader.Upgrade(w, r, nil)
+		if err != nil {
+			logger.Warn("failed to accept WebSocket connection", "err", err)
+			return
+		}
+		mqttInterfaceHandler(&wsConn{Conn: ws}, LISTENER_WEBSOCKET)
+	})
+	if err := http.ListenAndServe(fmt.Sprintf(":%d", config.Server.Ports.MqttInterfaceWs), mux); err != nil {
+		logger.Error("failed to start WebSocket listener", "err", err)
+	}
+}
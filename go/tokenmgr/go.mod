@@ -2,9 +2,9 @@ module mqttmtd/tokenmgr
 
 go 1.22.5
 
-require github.com/eclipse/paho.golang v0.21.0
-
 require (
-	github.com/gorilla/websocket v1.5.3 // indirect
-	golang.org/x/net v0.28.0 // indirect
+	github.com/eclipse/paho.golang v0.21.0
+	github.com/gorilla/websocket v1.5.3
 )
+
+require golang.org/x/net v0.28.0 // indirect
@@ -7,6 +7,7 @@ import (
 	"mqttmtd/tokenmgr/tests/t01gettoken"
 	"mqttmtd/tokenmgr/tests/t02publish"
 	"mqttmtd/tokenmgr/tests/t03subscribe"
+	"mqttmtd/tokenmgr/tests/t22connio"
 	"mqttmtd/tokenmgr/tests/testutil"
 	"reflect"
 	"regexp"
@@ -23,6 +24,7 @@ var (
 	t01Benchmarks = t01gettoken.Benchmarks
 	t02Benchmarks = t02publish.Benchmarks
 	t03Benchmarks = t03subscribe.Benchmarks
+	t22Benchmarks = t22connio.Benchmarks
 )
 
 func main() {
@@ -43,6 +45,8 @@ func main() {
 		benchmarkFuncs = t02Benchmarks
 	case 3:
 		benchmarkFuncs = t03Benchmarks
+	case 22:
+		benchmarkFuncs = t22Benchmarks
 	default:
 		log.Fatal("Illegal test index")
 	}
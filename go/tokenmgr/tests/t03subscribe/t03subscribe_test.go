@@ -22,6 +22,8 @@ func TestSubscribe_PubToken_Single(t *testing.T) {
 	fetchReq := testutil.PrepareFetchReq(true, types.PAYLOAD_AEAD_NONE)
 	_, _, token := testutil.GetTokenTest(t, topic, *fetchReq, true)
 	testutil.AutopahoSubscribe(t, token, true, nil, []byte{}, types.PAYLOAD_AEAD_NONE, nil)
+	// The token of the wrong access type is not consumed by the server, so the local index of the batch is now ahead of it
+	testutil.RemoveTokenFile(topic, *fetchReq)
 }
 
 func TestSubscribe_Cycle(t *testing.T) {
@@ -0,0 +1,100 @@
+package t06pubsubratchet
+
+import (
+	"fmt"
+	"mqttmtd/tokenmgr/tests/testutil"
+	"mqttmtd/types"
+	"sync"
+	"testing"
+	"time"
+)
+
+// pushd ../../certcreate; ./generate_certs.sh -c ../certs; popd
+// go test -x -v
+func TestPubSubRatchet_Single(t *testing.T) {
+	topic := testutil.SAMPLE_TOPIC_PUBSUB
+	aeadType := types.PAYLOAD_AEAD_CHACHA20_POLY1305
+	testutil.LoadClientConfig(t)
+	fetchReqSub := testutil.PrepareFetchReq(false, aeadType)
+	fetchReqSub.PayloadKeyRatchet = true
+	fetchReqPub := testutil.PrepareFetchReq(true, aeadType)
+	fetchReqPub.PayloadKeyRatchet = true
+	testutil.RemoveTokenFile(topic, *fetchReqSub)
+	testutil.RemoveTokenFile(topic, *fetchReqPub)
+	defer testutil.RemoveTokenFile(topic, *fetchReqSub)
+	defer testutil.RemoveTokenFile(topic, *fetchReqPub)
+	expired := make(chan struct{})
+	subDone := make(chan struct{})
+	done := make(chan struct{})
+	go func() {
+		var wg sync.WaitGroup
+		wg.Add(2)
+		go func() {
+			encKey, _, token := testutil.GetTokenTest(t, topic, *fetchReqSub, true)
+			testutil.AutopahoSubscribeRatchet(t, token, false, subDone, []byte("TestPubSubRatchet_Single"), aeadType, encKey)
+			wg.Done()
+		}()
+		go func() {
+			<-subDone
+			encKey, tokenIndex, token := testutil.GetTokenTest(t, topic, *fetchReqPub, true)
+			testutil.AutopahoPublish(t, token, []byte("TestPubSubRatchet_Single"), aeadType, encKey, tokenIndex)
+			wg.Done()
+		}()
+		wg.Wait()
+		done <- struct{}{}
+	}()
+	go func() {
+		time.Sleep(time.Second * 10)
+		expired <- struct{}{}
+	}()
+	select {
+	case <-expired:
+		t.Fatal()
+	case <-done:
+	}
+}
+
+func TestPubSubRatchet_Cycle(t *testing.T) {
+	topic := testutil.SAMPLE_TOPIC_PUBSUB
+	aeadType := types.PAYLOAD_AEAD_CHACHA20_POLY1305
+	testutil.LoadClientConfig(t)
+	fetchReqSub := testutil.PrepareFetchReq(false, aeadType)
+	fetchReqSub.PayloadKeyRatchet = true
+	fetchReqPub := testutil.PrepareFetchReq(true, aeadType)
+	fetchReqPub.PayloadKeyRatchet = true
+	testutil.RemoveTokenFile(topic, *fetchReqSub)
+	testutil.RemoveTokenFile(topic, *fetchReqPub)
+	for i := 0; i < int(fetchReqSub.NumTokens); i++ {
+		expired := make(chan struct{})
+		subDone := make(chan struct{})
+		done := make(chan struct{})
+		go func() {
+			var wg sync.WaitGroup
+			wg.Add(2)
+			go func() {
+				encKey, _, token := testutil.GetTokenTest(t, topic, *fetchReqSub, true)
+				testutil.AutopahoSubscribeRatchet(t, token, false, subDone, []byte(fmt.Sprintf("TestPubSubRatchet_Cycle%d", i)), aeadType, encKey)
+				wg.Done()
+			}()
+			go func() {
+				<-subDone
+				encKey, tokenIndex, token := testutil.GetTokenTest(t, topic, *fetchReqPub, true)
+				testutil.AutopahoPublish(t, token, []byte(fmt.Sprintf("TestPubSubRatchet_Cycle%d", i)), aeadType, encKey, tokenIndex)
+				wg.Done()
+			}()
+			wg.Wait()
+			done <- struct{}{}
+		}()
+		go func() {
+			time.Sleep(time.Second * 10)
+			expired <- struct{}{}
+		}()
+		select {
+		case <-expired:
+			t.Fatal()
+		case <-done:
+		}
+	}
+	testutil.RemoveTokenFile(topic, *fetchReqSub)
+	testutil.RemoveTokenFile(topic, *fetchReqPub)
+}
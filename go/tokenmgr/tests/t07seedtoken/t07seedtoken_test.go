@@ -0,0 +1,106 @@
+package t07seedtoken
+
+import (
+	"bytes"
+	"fmt"
+	"mqttmtd/consts"
+	"mqttmtd/tokenmgr/tests/testutil"
+	"mqttmtd/types"
+	"sync"
+	"testing"
+	"time"
+)
+
+// pushd ../../certcreate; ./generate_certs.sh -c ../certs; popd
+// go test -x -v
+func testSeedToken_Pub_Cycle(t *testing.T, tokenFormat types.TokenFormat) {
+	topic := testutil.SAMPLE_TOPIC_PUB
+	testutil.LoadClientConfig(t)
+	fetchReq := testutil.PrepareFetchReq(true, types.PAYLOAD_AEAD_NONE)
+	fetchReq.TokenFormat = tokenFormat
+	testutil.RemoveTokenFile(topic, *fetchReq)
+	for i := 0; i < int(fetchReq.NumTokens); i++ {
+		_, _, token := testutil.GetTokenTest(t, topic, *fetchReq, true)
+		testutil.AutopahoPublish(t, token, []byte(fmt.Sprintf("TestSeedToken_%s_Pub_Cycle%d", tokenFormat, i)), types.PAYLOAD_AEAD_NONE, nil, 0)
+	}
+	testutil.RemoveTokenFile(topic, *fetchReq)
+}
+
+func testSeedToken_PubSubAEAD_Cycle(t *testing.T, tokenFormat types.TokenFormat) {
+	topic := testutil.SAMPLE_TOPIC_PUBSUB
+	aeadType := types.PAYLOAD_AEAD_AES_128_GCM
+	testutil.LoadClientConfig(t)
+	fetchReqSub := testutil.PrepareFetchReq(false, aeadType)
+	fetchReqSub.TokenFormat = tokenFormat
+	fetchReqPub := testutil.PrepareFetchReq(true, aeadType)
+	fetchReqPub.TokenFormat = tokenFormat
+	testutil.RemoveTokenFile(topic, *fetchReqSub)
+	testutil.RemoveTokenFile(topic, *fetchReqPub)
+	for i := 0; i < int(fetchReqSub.NumTokens); i++ {
+		expired := make(chan struct{})
+		subDone := make(chan struct{})
+		done := make(chan struct{})
+		msg := []byte(fmt.Sprintf("TestSeedToken_%s_PubSubAEAD_Cycle%d", tokenFormat, i))
+		go func() {
+			var wg sync.WaitGroup
+			wg.Add(2)
+			go func() {
+				encKey, _, token := testutil.GetTokenTest(t, topic, *fetchReqSub, true)
+				testutil.AutopahoSubscribe(t, token, false, subDone, msg, aeadType, encKey)
+				wg.Done()
+			}()
+			go func() {
+				<-subDone
+				encKey, tokenIndex, token := testutil.GetTokenTest(t, topic, *fetchReqPub, true)
+				testutil.AutopahoPublish(t, token, msg, aeadType, encKey, tokenIndex)
+				wg.Done()
+			}()
+			wg.Wait()
+			done <- struct{}{}
+		}()
+		go func() {
+			time.Sleep(time.Second * 10)
+			expired <- struct{}{}
+		}()
+		select {
+		case <-expired:
+			t.Fatal()
+		case <-done:
+		}
+	}
+	testutil.RemoveTokenFile(topic, *fetchReqSub)
+	testutil.RemoveTokenFile(topic, *fetchReqPub)
+}
+
+func TestSeedToken_SeedHMAC_Pub_Cycle(t *testing.T) {
+	testSeedToken_Pub_Cycle(t, types.TokenFormatSeedHMAC)
+}
+
+func TestSeedToken_HashChain_Pub_Cycle(t *testing.T) {
+	testSeedToken_Pub_Cycle(t, types.TokenFormatHashChain)
+}
+
+func TestSeedToken_SeedHMAC_PubSubAEAD_Cycle(t *testing.T) {
+	testSeedToken_PubSubAEAD_Cycle(t, types.TokenFormatSeedHMAC)
+}
+
+func TestSeedToken_HashChain_PubSubAEAD_Cycle(t *testing.T) {
+	testSeedToken_PubSubAEAD_Cycle(t, types.TokenFormatHashChain)
+}
+
+// A token file fetched with other options is not popped in its format but replaced
+func TestSeedToken_FormatSwitch(t *testing.T) {
+	topic := testutil.SAMPLE_TOPIC_PUB
+	testutil.LoadClientConfig(t)
+	fetchReq := testutil.PrepareFetchReq(true, types.PAYLOAD_AEAD_NONE)
+	testutil.RemoveTokenFile(topic, *fetchReq)
+	defer testutil.RemoveTokenFile(topic, *fetchReq)
+
+	_, _, randomBytesToken := testutil.GetTokenTest(t, topic, *fetchReq, true)
+	fetchReq.TokenFormat = types.TokenFormatSeedHMAC
+	_, _, seedToken := testutil.GetTokenTest(t, topic, *fetchReq, true)
+	if bytes.Equal(randomBytesToken[:consts.TIMESTAMP_LEN], seedToken[:consts.TIMESTAMP_LEN]) {
+		t.Fatal("token of the random bytes batch popped for a seed-based request")
+	}
+	testutil.AutopahoPublish(t, seedToken, []byte("TestSeedToken_FormatSwitch"), types.PAYLOAD_AEAD_NONE, nil, 0)
+}
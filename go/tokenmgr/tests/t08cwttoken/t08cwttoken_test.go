@@ -0,0 +1,72 @@
+package t08cwttoken
+
+import (
+	"fmt"
+	"mqttmtd/tokenmgr/tests/testutil"
+	"mqttmtd/types"
+	"sync"
+	"testing"
+	"time"
+)
+
+// pushd ../../certcreate; ./generate_certs.sh -c ../certs; popd
+// head -c 32 /dev/urandom > cwt.key, and set its path to filepaths.cwtkey of the server conf, with mqttinterface.cwtstickyrouting
+// go test -x -v
+func TestCWTToken_Pub_Cycle(t *testing.T) {
+	topic := testutil.SAMPLE_TOPIC_PUB
+	testutil.LoadClientConfig(t)
+	fetchReq := testutil.PrepareFetchReq(true, types.PAYLOAD_AEAD_NONE)
+	fetchReq.TokenFormat = types.TokenFormatCWT
+	testutil.RemoveTokenFile(topic, *fetchReq)
+	for i := 0; i < int(fetchReq.NumTokens); i++ {
+		_, _, token := testutil.GetTokenTest(t, topic, *fetchReq, true)
+		testutil.AutopahoPublish(t, token, []byte(fmt.Sprintf("TestCWTToken_Pub_Cycle%d", i)), types.PAYLOAD_AEAD_NONE, nil, 0)
+	}
+	testutil.RemoveTokenFile(topic, *fetchReq)
+}
+
+func TestCWTToken_PubSubAEAD_Cycle(t *testing.T) {
+	topic := testutil.SAMPLE_TOPIC_PUBSUB
+	aeadType := types.PAYLOAD_AEAD_AES_128_GCM
+	testutil.LoadClientConfig(t)
+	fetchReqSub := testutil.PrepareFetchReq(false, aeadType)
+	fetchReqSub.TokenFormat = types.TokenFormatCWT
+	fetchReqPub := testutil.PrepareFetchReq(true, aeadType)
+	fetchReqPub.TokenFormat = types.TokenFormatCWT
+	testutil.RemoveTokenFile(topic, *fetchReqSub)
+	testutil.RemoveTokenFile(topic, *fetchReqPub)
+	for i := 0; i < int(fetchReqSub.NumTokens); i++ {
+		expired := make(chan struct{})
+		subDone := make(chan struct{})
+		done := make(chan struct{})
+		msg := []byte(fmt.Sprintf("TestCWTToken_PubSubAEAD_Cycle%d", i))
+		go func() {
+			var wg sync.WaitGroup
+			wg.Add(2)
+			go func() {
+				encKey, _, token := testutil.GetTokenTest(t, topic, *fetchReqSub, true)
+				testutil.AutopahoSubscribe(t, token, false, subDone, msg, aeadType, encKey)
+				wg.Done()
+			}()
+			go func() {
+				<-subDone
+				encKey, tokenIndex, token := testutil.GetTokenTest(t, topic, *fetchReqPub, true)
+				testutil.AutopahoPublish(t, token, msg, aeadType, encKey, tokenIndex)
+				wg.Done()
+			}()
+			wg.Wait()
+			done <- struct{}{}
+		}()
+		go func() {
+			time.Sleep(time.Second * 10)
+			expired <- struct{}{}
+		}()
+		select {
+		case <-expired:
+			t.Fatal()
+		case <-done:
+		}
+	}
+	testutil.RemoveTokenFile(topic, *fetchReqSub)
+	testutil.RemoveTokenFile(topic, *fetchReqPub)
+}
@@ -0,0 +1,73 @@
+package t09httpauth
+
+import (
+	"bytes"
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"mqttmtd/tokenmgr/tests/testutil"
+	"mqttmtd/types"
+	"net/http"
+	"net/url"
+	"testing"
+)
+
+func postForm(t *testing.T, path string, values url.Values, expectedStatus int) {
+	resp, err := http.PostForm(testutil.ADDR_HTTP_AUTH+path, values)
+	if err != nil {
+		testutil.Fatal(t, err)
+	}
+	resp.Body.Close()
+	if resp.StatusCode != expectedStatus {
+		testutil.Fatal(t, fmt.Errorf("%s %v: status %d, expected %d", path, values, resp.StatusCode, expectedStatus))
+	}
+}
+
+func postJSON(t *testing.T, path string, params map[string]any, expectedStatus int) {
+	body, _ := json.Marshal(params)
+	resp, err := http.Post(testutil.ADDR_HTTP_AUTH+path, "application/json", bytes.NewReader(body))
+	if err != nil {
+		testutil.Fatal(t, err)
+	}
+	resp.Body.Close()
+	if resp.StatusCode != expectedStatus {
+		testutil.Fatal(t, fmt.Errorf("%s %v: status %d, expected %d", path, params, resp.StatusCode, expectedStatus))
+	}
+}
+
+// pushd ../../certcreate; ./generate_certs.sh -c ../certs; popd
+// set ports.httpauth of the server conf
+// go test -x -v
+func TestHttpAuth_PasswordToken(t *testing.T) {
+	topic := testutil.SAMPLE_TOPIC_PUB
+	testutil.LoadClientConfig(t)
+	fetchReq := testutil.PrepareFetchReq(true, types.PAYLOAD_AEAD_NONE)
+	_, _, token := testutil.GetTokenTest(t, topic, *fetchReq, true)
+	b64Encoded := base64.URLEncoding.EncodeToString(token)
+
+	postForm(t, "/auth", url.Values{"username": {"client"}, "password": {b64Encoded}, "clientid": {"t09"}}, http.StatusOK)
+	// one-time
+	postForm(t, "/auth", url.Values{"username": {"client"}, "password": {b64Encoded}, "clientid": {"t09"}}, http.StatusForbidden)
+
+	postForm(t, "/acl", url.Values{"username": {"client"}, "clientid": {"t09"}, "topic": {topic}, "acc": {"2"}}, http.StatusOK)
+	postForm(t, "/acl", url.Values{"username": {"client"}, "clientid": {"t09"}, "topic": {topic}, "acc": {"4"}}, http.StatusForbidden)
+	postForm(t, "/acl", url.Values{"username": {"client"}, "clientid": {"other"}, "topic": {topic}, "acc": {"2"}}, http.StatusForbidden)
+	postForm(t, "/superuser", url.Values{"username": {"client"}}, http.StatusForbidden)
+}
+
+func TestHttpAuth_TopicToken_JSON(t *testing.T) {
+	topic := testutil.SAMPLE_TOPIC_SUB
+	testutil.LoadClientConfig(t)
+	fetchReq := testutil.PrepareFetchReq(false, types.PAYLOAD_AEAD_NONE)
+	_, _, token := testutil.GetTokenTest(t, topic, *fetchReq, true)
+	b64Encoded := base64.URLEncoding.EncodeToString(token)
+
+	// a stock broker would route by the token, so tokens as topics are denied and not consumed by that
+	postJSON(t, "/acl", map[string]any{"clientid": "t09", "topic": b64Encoded, "action": "publish"}, http.StatusForbidden)
+	postJSON(t, "/acl", map[string]any{"clientid": "t09", "topic": b64Encoded, "action": "subscribe"}, http.StatusForbidden)
+	postJSON(t, "/acl", map[string]any{"clientid": "t09", "topic": b64Encoded, "acc": 4}, http.StatusForbidden)
+
+	postJSON(t, "/auth", map[string]any{"clientid": "t09", "username": "client", "password": b64Encoded}, http.StatusOK)
+	postJSON(t, "/acl", map[string]any{"clientid": "t09", "topic": topic, "action": "subscribe"}, http.StatusOK)
+	postJSON(t, "/acl", map[string]any{"clientid": "t09", "topic": topic, "acc": 1}, http.StatusOK)
+}
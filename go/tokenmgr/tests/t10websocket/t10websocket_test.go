@@ -0,0 +1,109 @@
+package t10websocket
+
+import (
+	"fmt"
+	"mqttmtd/tokenmgr/tests/testutil"
+	"mqttmtd/types"
+	"net/http"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/gorilla/websocket"
+)
+
+// pushd ../../certcreate; ./generate_certs.sh -c ../certs; popd
+// set ports.mqttinterfacews of the server conf
+// go test -x -v
+func TestWebSocket_PubSub_Cycle(t *testing.T) {
+	testPubSubCycle(t, "TestWebSocket_PubSub_Cycle", types.PAYLOAD_AEAD_NONE)
+}
+
+func TestWebSocket_PubSubAEAD_Cycle(t *testing.T) {
+	testPubSubCycle(t, "TestWebSocket_PubSubAEAD_Cycle", types.PAYLOAD_AEAD_AES_128_GCM)
+}
+
+func testPubSubCycle(t *testing.T, name string, aeadType types.PayloadAEADType) {
+	topic := testutil.SAMPLE_TOPIC_PUBSUB
+	testutil.SetMqttInterfaceAddr(testutil.ADDR_MQTT_INTERFACE_WS)
+	testutil.LoadClientConfig(t)
+	fetchReqSub := testutil.PrepareFetchReq(false, aeadType)
+	fetchReqPub := testutil.PrepareFetchReq(true, aeadType)
+	testutil.RemoveTokenFile(topic, *fetchReqSub)
+	testutil.RemoveTokenFile(topic, *fetchReqPub)
+	for i := 0; i < int(fetchReqSub.NumTokens); i++ {
+		expired := make(chan struct{})
+		subDone := make(chan struct{})
+		done := make(chan struct{})
+		go func() {
+			var wg sync.WaitGroup
+			wg.Add(2)
+			go func() {
+				encKey, _, token := testutil.GetTokenTest(t, topic, *fetchReqSub, true)
+				testutil.AutopahoSubscribe(t, token, false, subDone, []byte(fmt.Sprintf("%s%d", name, i)), aeadType, encKey)
+				wg.Done()
+			}()
+			go func() {
+				<-subDone
+				encKey, tokenIndex, token := testutil.GetTokenTest(t, topic, *fetchReqPub, true)
+				testutil.AutopahoPublish(t, token, []byte(fmt.Sprintf("%s%d", name, i)), aeadType, encKey, tokenIndex)
+				wg.Done()
+			}()
+			wg.Wait()
+			done <- struct{}{}
+		}()
+		go func() {
+			time.Sleep(time.Second * 10)
+			expired <- struct{}{}
+		}()
+		select {
+		case <-expired:
+			t.Fatal()
+		case <-done:
+		}
+	}
+	testutil.RemoveTokenFile(topic, *fetchReqSub)
+	testutil.RemoveTokenFile(topic, *fetchReqPub)
+}
+
+// A packet split over WebSocket messages is reassembled
+func TestWebSocket_SplitConnect(t *testing.T) {
+	dialer := websocket.Dialer{
+		Subprotocols:     []string{"mqtt"},
+		HandshakeTimeout: time.Second * 5,
+	}
+	ws, _, err := dialer.Dial(testutil.ADDR_MQTT_INTERFACE_WS, nil)
+	if err != nil {
+		testutil.Fatal(t, err)
+	}
+	defer ws.Close()
+
+	// MQTT v3.1.1 CONNECT, clean session, keepalive 60, empty client id
+	connect := []byte{0x10, 0x0C, 0x00, 0x04, 'M', 'Q', 'T', 'T', 0x04, 0x02, 0x00, 0x3C, 0x00, 0x00}
+	for _, part := range [][]byte{connect[:3], connect[3:9], connect[9:]} {
+		if err = ws.WriteMessage(websocket.BinaryMessage, part); err != nil {
+			testutil.Fatal(t, err)
+		}
+	}
+
+	ws.SetReadDeadline(time.Now().Add(time.Second * 5))
+	messageType, connack, err := ws.ReadMessage()
+	if err != nil {
+		testutil.Fatal(t, err)
+	}
+	if messageType != websocket.BinaryMessage || len(connack) != 4 || connack[0] != 0x20 || connack[3] != 0x00 {
+		testutil.Fatal(t, fmt.Errorf("unexpected CONNACK: %x", connack))
+	}
+}
+
+func TestWebSocket_NoSubprotocol(t *testing.T) {
+	dialer := websocket.Dialer{HandshakeTimeout: time.Second * 5}
+	ws, resp, err := dialer.Dial(testutil.ADDR_MQTT_INTERFACE_WS, nil)
+	if err == nil {
+		ws.Close()
+		testutil.Fatal(t, fmt.Errorf("connection without subprotocol accepted"))
+	}
+	if resp == nil || resp.StatusCode != http.StatusBadRequest {
+		testutil.Fatal(t, fmt.Errorf("unexpected response: %v", err))
+	}
+}
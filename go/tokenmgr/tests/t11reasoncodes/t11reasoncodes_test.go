@@ -0,0 +1,157 @@
+package t11reasoncodes
+
+import (
+	"bytes"
+	"context"
+	"encoding/base64"
+	"encoding/binary"
+	"fmt"
+	"mqttmtd/tokenmgr/tests/testutil"
+	"mqttmtd/types"
+	"net"
+	"testing"
+	"time"
+
+	"github.com/eclipse/paho.golang/paho"
+)
+
+const (
+	REASON_CODE_NOT_AUTHORIZED byte = 0x87
+	SUBACK_V3_FAILURE          byte = 0x80
+)
+
+// pushd ../../certcreate; ./generate_certs.sh -c ../certs; popd
+// set mqttinterface.verificationfailure of the server conf to disconnectafter: 3, v3publish: ack
+// go test -x -v
+func TestReasonCode_Subscribe_Mixed(t *testing.T) {
+	testutil.LoadClientConfig(t)
+	fetchReq := testutil.PrepareFetchReq(false, types.PAYLOAD_AEAD_NONE)
+	// Fresh batch, as the local index of the one left by other tests may be ahead of the server, which does not consume tokens of the wrong access type
+	testutil.RemoveTokenFile(testutil.SAMPLE_TOPIC_SUB, *fetchReq)
+	_, _, token := testutil.GetTokenTest(t, testutil.SAMPLE_TOPIC_SUB, *fetchReq, true)
+
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second*10)
+	defer cancel()
+	c := connectV5(t, ctx, nil)
+	defer c.Disconnect(&paho.Disconnect{})
+
+	suback, _ := c.Subscribe(ctx, &paho.Subscribe{
+		Subscriptions: []paho.SubscribeOptions{
+			{Topic: testutil.InvalidToken(t)},
+			{Topic: base64.URLEncoding.EncodeToString(token)},
+			{Topic: testutil.InvalidToken(t)},
+		},
+	})
+	if suback == nil || !bytes.Equal(suback.Reasons, []byte{REASON_CODE_NOT_AUTHORIZED, 0x00, REASON_CODE_NOT_AUTHORIZED}) {
+		testutil.Fatal(t, fmt.Errorf("unexpected SUBACK: %+v", suback))
+	}
+}
+
+func TestReasonCode_Subscribe_AllRejected(t *testing.T) {
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second*10)
+	defer cancel()
+	c := connectV5(t, ctx, nil)
+	defer c.Disconnect(&paho.Disconnect{})
+
+	suback, _ := c.Subscribe(ctx, &paho.Subscribe{
+		Subscriptions: []paho.SubscribeOptions{{Topic: testutil.InvalidToken(t)}},
+	})
+	if suback == nil || !bytes.Equal(suback.Reasons, []byte{REASON_CODE_NOT_AUTHORIZED}) {
+		testutil.Fatal(t, fmt.Errorf("unexpected SUBACK: %+v", suback))
+	}
+}
+
+func TestReasonCode_Publish_QoS1(t *testing.T) {
+	testPublishReasonCode(t, 1)
+}
+
+func TestReasonCode_Publish_QoS2(t *testing.T) {
+	testPublishReasonCode(t, 2)
+}
+
+func testPublishReasonCode(t *testing.T, qos byte) {
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second*10)
+	defer cancel()
+	c := connectV5(t, ctx, nil)
+	defer c.Disconnect(&paho.Disconnect{})
+
+	response, _ := c.Publish(ctx, &paho.Publish{
+		QoS:     qos,
+		Topic:   testutil.InvalidToken(t),
+		Payload: []byte("TestReasonCode_Publish"),
+	})
+	if response == nil || response.ReasonCode != REASON_CODE_NOT_AUTHORIZED {
+		testutil.Fatal(t, fmt.Errorf("unexpected response: %+v", response))
+	}
+}
+
+func TestReasonCode_Disconnect(t *testing.T) {
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second*10)
+	defer cancel()
+	disconnected := make(chan byte, 1)
+	c := connectV5(t, ctx, func(d *paho.Disconnect) { disconnected <- d.ReasonCode })
+	defer c.Disconnect(&paho.Disconnect{})
+
+	// QoS 0 so that no acknowledgement is awaited
+	for i := 0; i < 3; i++ {
+		c.Publish(ctx, &paho.Publish{
+			QoS:     0,
+			Topic:   testutil.InvalidToken(t),
+			Payload: []byte("TestReasonCode_Disconnect"),
+		})
+	}
+	select {
+	case <-ctx.Done():
+		testutil.Fatal(t, fmt.Errorf("no DISCONNECT"))
+	case reasonCode := <-disconnected:
+		if reasonCode != REASON_CODE_NOT_AUTHORIZED {
+			testutil.Fatal(t, fmt.Errorf("unexpected DISCONNECT reason code: 0x%02x", reasonCode))
+		}
+	}
+}
+
+func TestReasonCode_V311(t *testing.T) {
+	conn := connectV311(t)
+	defer conn.Close()
+
+	// SUBSCRIBE, packet id 1
+	filter := testutil.InvalidToken(t)
+	subscribe := binary.BigEndian.AppendUint16([]byte{0x00, 0x01}, uint16(len(filter)))
+	subscribe = append(append(subscribe, filter...), 0x00)
+	testutil.WriteRawPacket(t, conn, 0x82, subscribe)
+	if suback := testutil.ReadRawPacket(t, conn); !bytes.Equal(suback, []byte{0x90, 0x03, 0x00, 0x01, SUBACK_V3_FAILURE}) {
+		testutil.Fatal(t, fmt.Errorf("unexpected SUBACK: %x", suback))
+	}
+
+	// PUBLISH at QoS 1, packet id 2, acknowledged and dropped
+	topic := testutil.InvalidToken(t)
+	publish := binary.BigEndian.AppendUint16(nil, uint16(len(topic)))
+	publish = append(append(publish, topic...), 0x00, 0x02)
+	publish = append(publish, "TestReasonCode_V311"...)
+	testutil.WriteRawPacket(t, conn, 0x32, publish)
+	if puback := testutil.ReadRawPacket(t, conn); !bytes.Equal(puback, []byte{0x40, 0x02, 0x00, 0x02}) {
+		testutil.Fatal(t, fmt.Errorf("unexpected PUBACK: %x", puback))
+	}
+}
+
+func connectV5(tb testing.TB, ctx context.Context, onServerDisconnect func(*paho.Disconnect)) *paho.Client {
+	conn := testutil.DialMqttInterface(tb)
+	c := paho.NewClient(paho.ClientConfig{
+		Conn:               conn,
+		OnServerDisconnect: onServerDisconnect,
+	})
+	if _, err := c.Connect(ctx, &paho.Connect{KeepAlive: 20, CleanStart: true}); err != nil {
+		testutil.Fatal(tb, err)
+	}
+	return c
+}
+
+func connectV311(tb testing.TB) net.Conn {
+	conn := testutil.DialMqttInterface(tb)
+	// clean session, keepalive 60, empty client id
+	testutil.WriteRawPacket(tb, conn, 0x10, []byte{0x00, 0x04, 'M', 'Q', 'T', 'T', 0x04, 0x02, 0x00, 0x3C, 0x00, 0x00})
+	if connack := testutil.ReadRawPacket(tb, conn); !bytes.Equal(connack, []byte{0x20, 0x02, 0x00, 0x00}) {
+		testutil.Fatal(tb, fmt.Errorf("unexpected CONNACK: %x", connack))
+	}
+	return conn
+}
@@ -0,0 +1,78 @@
+package t12wildcard
+
+import (
+	"mqttmtd/tokenmgr/tests/testutil"
+	"mqttmtd/types"
+	"sync"
+	"testing"
+	"time"
+)
+
+const (
+	SAMPLE_TOPIC_WILDCARD_MULTI  string = "/sample/wildcard/#"
+	SAMPLE_TOPIC_WILDCARD_SINGLE string = "/sample/wildcard/+"
+	SAMPLE_TOPIC_WILDCARD_LEAF   string = "/sample/wildcard/a"
+)
+
+// pushd ../../certcreate; ./generate_certs.sh -c ../certs; popd
+// add "/sample/wildcard/#: PubSub" to the acl of the client
+// go test -x -v
+func TestWildcard_PubSub(t *testing.T) {
+	for _, filter := range []string{SAMPLE_TOPIC_WILDCARD_MULTI, SAMPLE_TOPIC_WILDCARD_SINGLE} {
+		expired := make(chan struct{})
+		subDone := make(chan struct{})
+		done := make(chan struct{})
+		testutil.LoadClientConfig(t)
+		fetchReqSub := testutil.PrepareFetchReq(false, types.PAYLOAD_AEAD_NONE)
+		fetchReqPub := testutil.PrepareFetchReq(true, types.PAYLOAD_AEAD_NONE)
+		go func() {
+			var wg sync.WaitGroup
+			wg.Add(2)
+			go func() {
+				_, _, token := testutil.GetTokenTest(t, filter, *fetchReqSub, true)
+				testutil.AutopahoSubscribe(t, token, false, subDone, []byte("TestWildcard_PubSub"+filter), types.PAYLOAD_AEAD_NONE, nil)
+				wg.Done()
+			}()
+			go func() {
+				<-subDone
+				_, _, token := testutil.GetTokenTest(t, SAMPLE_TOPIC_WILDCARD_LEAF, *fetchReqPub, true)
+				testutil.AutopahoPublish(t, token, []byte("TestWildcard_PubSub"+filter), types.PAYLOAD_AEAD_NONE, nil, 0)
+				wg.Done()
+			}()
+			wg.Wait()
+			done <- struct{}{}
+		}()
+		go func() {
+			time.Sleep(time.Second * 10)
+			expired <- struct{}{}
+		}()
+		select {
+		case <-expired:
+			t.Fatal()
+		case <-done:
+		}
+	}
+}
+
+func TestWildcard_Issuance(t *testing.T) {
+	testutil.LoadClientConfig(t)
+	fetchReqSub := testutil.PrepareFetchReq(false, types.PAYLOAD_AEAD_NONE)
+	fetchReqPub := testutil.PrepareFetchReq(true, types.PAYLOAD_AEAD_NONE)
+
+	// Narrower filter than the ACL entry. The batch is discarded, as the tokens must be used in order.
+	testutil.RemoveTokenFile(SAMPLE_TOPIC_WILDCARD_SINGLE, *fetchReqSub)
+	testutil.GetTokenTest(t, SAMPLE_TOPIC_WILDCARD_SINGLE, *fetchReqSub, true)
+	testutil.RemoveTokenFile(SAMPLE_TOPIC_WILDCARD_SINGLE, *fetchReqSub)
+
+	// Pub tokens for filters
+	testutil.RemoveTokenFile(SAMPLE_TOPIC_WILDCARD_MULTI, *fetchReqPub)
+	testutil.GetTokenTest(t, SAMPLE_TOPIC_WILDCARD_MULTI, *fetchReqPub, false)
+
+	// Broader filter than the ACL entry
+	testutil.RemoveTokenFile("/sample/+/a", *fetchReqSub)
+	testutil.GetTokenTest(t, "/sample/+/a", *fetchReqSub, false)
+
+	// Invalid filter
+	testutil.RemoveTokenFile("/sample/wildcard/a#", *fetchReqSub)
+	testutil.GetTokenTest(t, "/sample/wildcard/a#", *fetchReqSub, false)
+}
@@ -0,0 +1,101 @@
+package t13qosflow
+
+import (
+	"fmt"
+	"mqttmtd/tokenmgr/tests/testutil"
+	"testing"
+	"time"
+)
+
+const (
+	FIRST_BYTE_PUBLISH_QOS1     byte = 0x32
+	FIRST_BYTE_PUBLISH_QOS1_DUP byte = 0x3A
+	FIRST_BYTE_PUBLISH_QOS2     byte = 0x34
+	FIRST_BYTE_PUBLISH_QOS2_DUP byte = 0x3C
+	FIRST_BYTE_PUBREL           byte = 0x62
+	FIRST_BYTE_PUBACK           byte = 0x40
+	FIRST_BYTE_PUBREC           byte = 0x50
+	FIRST_BYTE_PUBCOMP          byte = 0x70
+)
+
+// pushd ../../certcreate; ./generate_certs.sh -c ../certs; popd
+// go test -x -v
+func TestQoSFlow_Dup_QoS1(t *testing.T) {
+	conn := testutil.ConnectV5RawWithClientID(t, "TestQoSFlow_Dup_QoS1", nil)
+	defer conn.Close()
+
+	publish := newPublish(t, 1, "TestQoSFlow_Dup_QoS1")
+	testutil.WriteRawPacket(t, conn, FIRST_BYTE_PUBLISH_QOS1, publish)
+	testutil.ExpectPubResponse(t, testutil.ReadRawPacket(t, conn), 0x40, 1, false)
+
+	// Retransmission after PUBACK, whose token is spent already
+	testutil.WriteRawPacket(t, conn, FIRST_BYTE_PUBLISH_QOS1_DUP, publish)
+	testutil.ExpectPubResponse(t, testutil.ReadRawPacket(t, conn), 0x40, 1, true)
+}
+
+func TestQoSFlow_Dup_QoS2(t *testing.T) {
+	conn := testutil.ConnectV5RawWithClientID(t, "TestQoSFlow_Dup_QoS2", nil)
+	defer conn.Close()
+
+	publish := newPublish(t, 2, "TestQoSFlow_Dup_QoS2")
+	testutil.WriteRawPacket(t, conn, FIRST_BYTE_PUBLISH_QOS2, publish)
+	testutil.ExpectPubResponse(t, testutil.ReadRawPacket(t, conn), 0x50, 2, false)
+
+	// No more retransmission of PUBLISH after PUBREC
+	testutil.WriteRawPacket(t, conn, FIRST_BYTE_PUBLISH_QOS2_DUP, publish)
+	testutil.ExpectPubResponse(t, testutil.ReadRawPacket(t, conn), 0x50, 2, true)
+
+	testutil.WriteRawPacket(t, conn, FIRST_BYTE_PUBREL, []byte{0x00, 0x02})
+	testutil.ExpectPubResponse(t, testutil.ReadRawPacket(t, conn), 0x70, 2, false)
+}
+
+func TestQoSFlow_Dup_InFlight(t *testing.T) {
+	topic := testutil.SAMPLE_TOPIC_PUBSUB
+	subConn := testutil.ConnectV5Raw(t, nil)
+	defer subConn.Close()
+	testutil.SubscribeRaw(t, subConn, 1, testutil.NewTokenB64(t, topic, false, false), nil)
+
+	conn := testutil.ConnectV5RawWithClientID(t, "TestQoSFlow_Dup_InFlight", nil)
+	defer conn.Close()
+
+	// Retransmission before PUBREC is forwarded with the verification of the original, and deduplicated by the broker
+	publish := testutil.NewPublish(testutil.NewTokenB64(t, topic, true, false), 4, nil, []byte("TestQoSFlow_Dup_InFlight"))
+	packets := append(testutil.EncodeRawPacket(FIRST_BYTE_PUBLISH_QOS2, publish), testutil.EncodeRawPacket(FIRST_BYTE_PUBLISH_QOS2_DUP, publish)...)
+	if _, err := conn.Write(packets); err != nil {
+		testutil.Fatal(t, err)
+	}
+	testutil.ExpectPubResponse(t, testutil.ReadRawPacket(t, conn), FIRST_BYTE_PUBREC, 4, false)
+	testutil.ExpectPubResponse(t, testutil.ReadRawPacket(t, conn), FIRST_BYTE_PUBREC, 4, false)
+	testutil.WriteRawPacket(t, conn, FIRST_BYTE_PUBREL, []byte{0x00, 0x04})
+	testutil.ExpectPubResponse(t, testutil.ReadRawPacket(t, conn), FIRST_BYTE_PUBCOMP, 4, false)
+
+	// Delivered exactly once
+	if _, _, payload := testutil.ParseRawPublish(t, testutil.ReadRawPacket(t, subConn)); string(payload) != "TestQoSFlow_Dup_InFlight" {
+		testutil.Fatal(t, fmt.Errorf("unexpected payload: %q", payload))
+	}
+	subConn.SetReadDeadline(time.Now().Add(time.Second))
+	if packet, err := testutil.TryReadRawPacket(subConn); err == nil {
+		testutil.Fatal(t, fmt.Errorf("unexpected packet: %x", packet))
+	}
+
+	// Only one token spent, so the next one of the batch is still valid
+	testutil.WriteRawPacket(t, conn, FIRST_BYTE_PUBLISH_QOS1, testutil.NewPublish(testutil.NewTokenB64(t, topic, true, false), 5, nil, []byte("TestQoSFlow_Dup_InFlight_Next")))
+	testutil.ExpectPubResponse(t, testutil.ReadRawPacket(t, conn), FIRST_BYTE_PUBACK, 5, false)
+}
+
+func TestQoSFlow_NotDup(t *testing.T) {
+	conn := testutil.ConnectV5RawWithClientID(t, "TestQoSFlow_NotDup", nil)
+	defer conn.Close()
+
+	// Same token without DUP is verified again
+	publish := newPublish(t, 3, "TestQoSFlow_NotDup")
+	testutil.WriteRawPacket(t, conn, FIRST_BYTE_PUBLISH_QOS1, publish)
+	testutil.ExpectPubResponse(t, testutil.ReadRawPacket(t, conn), 0x40, 3, false)
+	testutil.WriteRawPacket(t, conn, FIRST_BYTE_PUBLISH_QOS1, publish)
+	testutil.ExpectPubResponse(t, testutil.ReadRawPacket(t, conn), 0x40, 3, true)
+}
+
+// PUBLISH of MQTT v5.0 with a new Pub token, without properties
+func newPublish(tb testing.TB, packetID uint16, payload string) (varHdrAndPayload []byte) {
+	return testutil.NewPublish(testutil.NewTokenB64(tb, testutil.SAMPLE_TOPIC_PUB, true, false), packetID, nil, []byte(payload))
+}
@@ -0,0 +1,96 @@
+package t14will
+
+import (
+	"bytes"
+	"context"
+	"encoding/base64"
+	"encoding/binary"
+	"fmt"
+	"mqttmtd/tokenmgr/tests/testutil"
+	"mqttmtd/types"
+	"testing"
+	"time"
+
+	"github.com/eclipse/paho.golang/paho"
+)
+
+const (
+	REASON_CODE_NOT_AUTHORIZED byte = 0x87
+	CONNACK_V3_NOT_AUTHORIZED  byte = 0x05
+)
+
+// pushd ../../certcreate; ./generate_certs.sh -c ../certs; popd
+// go test -x -v
+func TestWill_Published(t *testing.T) {
+	topic := testutil.SAMPLE_TOPIC_PUBSUB
+	expired := make(chan struct{})
+	subDone := make(chan struct{})
+	done := make(chan struct{})
+	testutil.LoadClientConfig(t)
+	fetchReqSub := testutil.PrepareFetchReq(false, types.PAYLOAD_AEAD_NONE)
+	fetchReqPub := testutil.PrepareFetchReq(true, types.PAYLOAD_AEAD_NONE)
+	go func() {
+		go func() {
+			<-subDone
+			_, _, token := testutil.GetTokenTest(t, topic, *fetchReqPub, true)
+			conn := testutil.DialMqttInterface(t)
+			ctx, cancel := context.WithTimeout(context.Background(), time.Second*5)
+			defer cancel()
+			c := paho.NewClient(paho.ClientConfig{Conn: conn})
+			if _, err := c.Connect(ctx, &paho.Connect{
+				KeepAlive:  20,
+				CleanStart: true,
+				WillMessage: &paho.WillMessage{
+					Topic:   base64.URLEncoding.EncodeToString(token),
+					Payload: []byte("TestWill_Published"),
+				},
+			}); err != nil {
+				testutil.Fatal(t, err)
+			}
+			// Closed without DISCONNECT, so that the Will Message is published
+			conn.Close()
+		}()
+		_, _, token := testutil.GetTokenTest(t, topic, *fetchReqSub, true)
+		testutil.AutopahoSubscribe(t, token, false, subDone, []byte("TestWill_Published"), types.PAYLOAD_AEAD_NONE, nil)
+		done <- struct{}{}
+	}()
+	go func() {
+		time.Sleep(time.Second * 10)
+		expired <- struct{}{}
+	}()
+	select {
+	case <-expired:
+		t.Fatal()
+	case <-done:
+	}
+}
+
+func TestWill_Rejected(t *testing.T) {
+	for _, mqttVersion := range []byte{4, 5} {
+		conn := testutil.DialMqttInterface(t)
+		defer conn.Close()
+
+		// clean start, will flag, keepalive 60, empty client id
+		connect := []byte{0x00, 0x04, 'M', 'Q', 'T', 'T', mqttVersion, 0x06, 0x00, 0x3C}
+		if mqttVersion >= 5 {
+			// properties, client id, will properties
+			connect = append(connect, 0x00, 0x00, 0x00, 0x00)
+		} else {
+			connect = append(connect, 0x00, 0x00)
+		}
+		willTopic := testutil.InvalidToken(t)
+		connect = binary.BigEndian.AppendUint16(connect, uint16(len(willTopic)))
+		connect = append(connect, willTopic...)
+		connect = binary.BigEndian.AppendUint16(connect, uint16(len("TestWill_Rejected")))
+		connect = append(connect, "TestWill_Rejected"...)
+		testutil.WriteRawPacket(t, conn, 0x10, connect)
+
+		expected := []byte{0x20, 0x02, 0x00, CONNACK_V3_NOT_AUTHORIZED}
+		if mqttVersion >= 5 {
+			expected = []byte{0x20, 0x03, 0x00, REASON_CODE_NOT_AUTHORIZED, 0x00}
+		}
+		if connack := testutil.ReadRawPacket(t, conn); !bytes.Equal(connack, expected) {
+			testutil.Fatal(t, fmt.Errorf("unexpected CONNACK for MQTT version %d: %x", mqttVersion, connack))
+		}
+	}
+}
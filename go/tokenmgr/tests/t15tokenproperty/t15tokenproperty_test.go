@@ -0,0 +1,97 @@
+package t15tokenproperty
+
+import (
+	"bytes"
+	"encoding/binary"
+	"fmt"
+	"mqttmtd/tokenmgr/tests/testutil"
+	"net"
+	"testing"
+)
+
+const (
+	TOKEN_PROPERTY_NAME        string = "mqttmtd-token"
+	REASON_CODE_REAUTHENTICATE byte   = 0x19
+
+	FIRST_BYTE_PUBLISH_QOS1 byte = 0x32
+	FIRST_BYTE_PUBACK       byte = 0x40
+	FIRST_BYTE_AUTH         byte = 0xF0
+)
+
+// pushd ../../certcreate; ./generate_certs.sh -c ../certs; popd
+// go test -x -v
+func TestTokenProperty_PubSub(t *testing.T) {
+	topic := testutil.SAMPLE_TOPIC_PUBSUB
+	subConn := testutil.ConnectV5Raw(t, nil)
+	defer subConn.Close()
+	testutil.SubscribeRaw(t, subConn, 1, topic, userProperty(TOKEN_PROPERTY_NAME, testutil.NewTokenB64(t, topic, false, false)))
+
+	pubConn := testutil.ConnectV5Raw(t, nil)
+	defer pubConn.Close()
+	testutil.WriteRawPacket(t, pubConn, FIRST_BYTE_PUBLISH_QOS1, testutil.NewPublish(topic, 1, userProperty(TOKEN_PROPERTY_NAME, testutil.NewTokenB64(t, topic, true, false)), []byte("TestTokenProperty_PubSub")))
+	testutil.ExpectPubResponse(t, testutil.ReadRawPacket(t, pubConn), FIRST_BYTE_PUBACK, 1, false)
+
+	expectPublish(t, testutil.ReadRawPacket(t, subConn), topic, "TestTokenProperty_PubSub")
+}
+
+func TestTokenProperty_TopicMismatch(t *testing.T) {
+	conn := testutil.ConnectV5Raw(t, nil)
+	defer conn.Close()
+
+	// Token of another topic
+	token := testutil.NewTokenB64(t, testutil.SAMPLE_TOPIC_PUB, true, false)
+	testutil.WriteRawPacket(t, conn, FIRST_BYTE_PUBLISH_QOS1, testutil.NewPublish(testutil.SAMPLE_TOPIC_PUBSUB, 2, userProperty(TOKEN_PROPERTY_NAME, token), []byte("TestTokenProperty_TopicMismatch")))
+	testutil.ExpectPubResponse(t, testutil.ReadRawPacket(t, conn), FIRST_BYTE_PUBACK, 2, true)
+}
+
+func TestTokenAuth_PubSub(t *testing.T) {
+	topic := testutil.SAMPLE_TOPIC_PUBSUB
+	authMethod := stringProperty(0x15, TOKEN_PROPERTY_NAME)
+
+	subConn := testutil.ConnectV5Raw(t, authMethod)
+	defer subConn.Close()
+	authenticate(t, subConn, testutil.NewToken(t, topic, false, false))
+	testutil.SubscribeRaw(t, subConn, 1, topic, nil)
+
+	pubConn := testutil.ConnectV5Raw(t, authMethod)
+	defer pubConn.Close()
+	authenticate(t, pubConn, testutil.NewToken(t, topic, true, false))
+	testutil.WriteRawPacket(t, pubConn, FIRST_BYTE_PUBLISH_QOS1, testutil.NewPublish(topic, 1, nil, []byte("TestTokenAuth_PubSub")))
+	testutil.ExpectPubResponse(t, testutil.ReadRawPacket(t, pubConn), FIRST_BYTE_PUBACK, 1, false)
+
+	expectPublish(t, testutil.ReadRawPacket(t, subConn), topic, "TestTokenAuth_PubSub")
+}
+
+func stringProperty(id byte, value string) []byte {
+	property := binary.BigEndian.AppendUint16([]byte{id}, uint16(len(value)))
+	return append(property, value...)
+}
+
+func userProperty(name string, value string) []byte {
+	property := stringProperty(0x26, name)
+	property = binary.BigEndian.AppendUint16(property, uint16(len(value)))
+	return append(property, value...)
+}
+
+// AUTH re-authentication with the raw token as Authentication Data
+func authenticate(tb testing.TB, conn net.Conn, token []byte) {
+	properties := stringProperty(0x15, TOKEN_PROPERTY_NAME)
+	properties = append(properties, 0x16)
+	properties = binary.BigEndian.AppendUint16(properties, uint16(len(token)))
+	properties = append(properties, token...)
+	testutil.WriteRawPacket(tb, conn, FIRST_BYTE_AUTH, append([]byte{REASON_CODE_REAUTHENTICATE, byte(len(properties))}, properties...))
+	if auth := testutil.ReadRawPacket(tb, conn); len(auth) < 3 || auth[0] != FIRST_BYTE_AUTH || auth[2] != 0x00 {
+		testutil.Fatal(tb, fmt.Errorf("unexpected AUTH: %x", auth))
+	}
+}
+
+// PUBLISH at QoS 0 forwarded with the real topic name and without the token property
+func expectPublish(tb testing.TB, packet []byte, topic string, payload string) {
+	topicName, properties, received := testutil.ParseRawPublish(tb, packet)
+	if topicName != topic {
+		testutil.Fatal(tb, fmt.Errorf("unexpected topic name: %q", topicName))
+	}
+	if bytes.Contains(properties, []byte(TOKEN_PROPERTY_NAME)) || string(received) != payload {
+		testutil.Fatal(tb, fmt.Errorf("unexpected PUBLISH: %x", packet))
+	}
+}
@@ -0,0 +1,91 @@
+package t16responsetopic
+
+import (
+	"encoding/binary"
+	"fmt"
+	"mqttmtd/tokenmgr/tests/testutil"
+	"testing"
+)
+
+const (
+	TOKEN_PROPERTY_NAME string = "mqttmtd-token"
+
+	PROPERTY_RESPONSE_TOPIC   byte = 0x08
+	PROPERTY_CORRELATION_DATA byte = 0x09
+	PROPERTY_USER_PROPERTY    byte = 0x26
+
+	FIRST_BYTE_PUBLISH_QOS1 byte = 0x32
+	FIRST_BYTE_PUBACK       byte = 0x40
+)
+
+// pushd ../../certcreate; ./generate_certs.sh -c ../certs; popd
+// go test -x -v
+func TestResponseTopic_PubSub(t *testing.T) {
+	topic := testutil.SAMPLE_TOPIC_PUBSUB
+
+	// Subscribed with the real topic filter, to which real topic names are revealed
+	revealedConn := testutil.ConnectV5Raw(t, nil)
+	defer revealedConn.Close()
+	testutil.SubscribeRaw(t, revealedConn, 1, topic, binaryProperty(PROPERTY_USER_PROPERTY, TOKEN_PROPERTY_NAME, testutil.NewTokenB64(t, topic, false, false)))
+
+	// Subscribed with the token as the topic filter
+	hiddenConn := testutil.ConnectV5Raw(t, nil)
+	defer hiddenConn.Close()
+	testutil.SubscribeRaw(t, hiddenConn, 1, testutil.NewTokenB64(t, topic, false, false), nil)
+
+	pubConn := testutil.ConnectV5Raw(t, nil)
+	defer pubConn.Close()
+	properties := binaryProperty(PROPERTY_RESPONSE_TOPIC, testutil.NewTokenB64(t, testutil.SAMPLE_TOPIC_PUB, true, false))
+	properties = append(properties, binaryProperty(PROPERTY_CORRELATION_DATA, "TestResponseTopic_PubSub")...)
+	testutil.WriteRawPacket(t, pubConn, FIRST_BYTE_PUBLISH_QOS1, testutil.NewPublish(testutil.NewTokenB64(t, topic, true, false), 1, properties, []byte("TestResponseTopic_PubSub")))
+	testutil.ExpectPubResponse(t, testutil.ReadRawPacket(t, pubConn), FIRST_BYTE_PUBACK, 1, false)
+
+	topicName, received := parsePublish(t, testutil.ReadRawPacket(t, revealedConn))
+	if topicName != topic || string(received[PROPERTY_RESPONSE_TOPIC]) != testutil.SAMPLE_TOPIC_PUB || string(received[PROPERTY_CORRELATION_DATA]) != "TestResponseTopic_PubSub" {
+		testutil.Fatal(t, fmt.Errorf("unexpected PUBLISH to revealed subscriber: %q %q", topicName, received))
+	}
+
+	topicName, received = parsePublish(t, testutil.ReadRawPacket(t, hiddenConn))
+	if _, found := received[PROPERTY_RESPONSE_TOPIC]; found || topicName == topic {
+		testutil.Fatal(t, fmt.Errorf("unexpected PUBLISH to hidden subscriber: %q %q", topicName, received))
+	}
+	if _, found := received[PROPERTY_CORRELATION_DATA]; found {
+		testutil.Fatal(t, fmt.Errorf("unexpected PUBLISH to hidden subscriber: %q %q", topicName, received))
+	}
+}
+
+func TestResponseTopic_Rejected(t *testing.T) {
+	conn := testutil.ConnectV5Raw(t, nil)
+	defer conn.Close()
+
+	// Token of TOKEN_SIZE which is not issued
+	properties := binaryProperty(PROPERTY_RESPONSE_TOPIC, testutil.InvalidToken(t))
+	testutil.WriteRawPacket(t, conn, FIRST_BYTE_PUBLISH_QOS1, testutil.NewPublish(testutil.NewTokenB64(t, testutil.SAMPLE_TOPIC_PUB, true, false), 2, properties, []byte("TestResponseTopic_Rejected")))
+	testutil.ExpectPubResponse(t, testutil.ReadRawPacket(t, conn), FIRST_BYTE_PUBACK, 2, true)
+}
+
+// Property of length-prefixed values, such as strings, binary data and string pairs
+func binaryProperty(id byte, values ...string) []byte {
+	property := []byte{id}
+	for _, value := range values {
+		property = binary.BigEndian.AppendUint16(property, uint16(len(value)))
+		property = append(property, value...)
+	}
+	return property
+}
+
+// Topic name and properties of a QoS 0 PUBLISH, whose properties are all of length-prefixed values
+func parsePublish(tb testing.TB, packet []byte) (topicName string, properties map[byte][]byte) {
+	topicName, raw, _ := testutil.ParseRawPublish(tb, packet)
+	properties = make(map[byte][]byte)
+	for offset := 0; offset < len(raw); {
+		id := raw[offset]
+		valueLen := int(binary.BigEndian.Uint16(raw[offset+1:]))
+		properties[id] = raw[offset+3 : offset+3+valueLen]
+		offset += 3 + valueLen
+		if id == PROPERTY_USER_PROPERTY {
+			offset += 2 + int(binary.BigEndian.Uint16(raw[offset:]))
+		}
+	}
+	return
+}
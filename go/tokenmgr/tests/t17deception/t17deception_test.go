@@ -0,0 +1,130 @@
+package t17deception
+
+import (
+	"bytes"
+	"encoding/binary"
+	"fmt"
+	"mqttmtd/tokenmgr/tests/testutil"
+	"testing"
+	"time"
+
+	"github.com/gorilla/websocket"
+)
+
+const (
+	FIRST_BYTE_PUBLISH_QOS1 byte = 0x32
+	FIRST_BYTE_SUBSCRIBE    byte = 0x82
+
+	// Fake data is published at mqttinterface.deception.interval, 5s by default
+	DECOY_FEED_TIMEOUT = time.Second * 15
+)
+
+// pushd ../../certcreate; ./generate_certs.sh -c ../certs; popd
+// set ports.mqttinterfacews, and mqttinterface.deception.listeners to [websocket] of the server conf
+// go test -x -v
+func TestDeception_FakeData(t *testing.T) {
+	ws := connectV5(t)
+	defer ws.Close()
+
+	subscribe(t, ws, testutil.InvalidToken(t))
+
+	// Fed with fake data, under the placeholder topic name as real ones
+	topicName, payload := readPublish(t, ws, DECOY_FEED_TIMEOUT)
+	if topicName != "A" || !bytes.Contains(payload, []byte("temperature")) {
+		testutil.Fatal(t, fmt.Errorf("unexpected fake data: %q %q", topicName, payload))
+	}
+}
+
+func TestDeception_PubSub(t *testing.T) {
+	ws := connectV5(t)
+	defer ws.Close()
+
+	// The same forged token reaches the same decoy
+	token := testutil.InvalidToken(t)
+	subscribe(t, ws, token)
+
+	publish := binary.BigEndian.AppendUint16(nil, uint16(len(token)))
+	publish = append(publish, token...)
+	publish = append(publish, 0x00, 0x01, 0x00)
+	publish = append(publish, "TestDeception_PubSub"...)
+	writePacket(t, ws, FIRST_BYTE_PUBLISH_QOS1, publish)
+
+	pubackReceived, publishReceived := false, false
+	for deadline := time.Now().Add(DECOY_FEED_TIMEOUT); !(pubackReceived && publishReceived) && time.Now().Before(deadline); {
+		packet := readPacket(t, ws, time.Until(deadline))
+		switch packet[0] & 0xF0 {
+		case 0x40:
+			// Acknowledged as if the token were valid
+			if !bytes.Equal(packet, []byte{0x40, 0x02, 0x00, 0x01}) {
+				testutil.Fatal(t, fmt.Errorf("unexpected PUBACK: %x", packet))
+			}
+			pubackReceived = true
+		case 0x30:
+			publishReceived = publishReceived || bytes.HasSuffix(packet, []byte("TestDeception_PubSub"))
+		}
+	}
+	if !pubackReceived || !publishReceived {
+		testutil.Fatal(t, fmt.Errorf("PUBACK received: %v, PUBLISH received: %v", pubackReceived, publishReceived))
+	}
+}
+
+func connectV5(tb testing.TB) *websocket.Conn {
+	dialer := websocket.Dialer{
+		Subprotocols:     []string{"mqtt"},
+		HandshakeTimeout: time.Second * 5,
+	}
+	ws, _, err := dialer.Dial(testutil.ADDR_MQTT_INTERFACE_WS, nil)
+	if err != nil {
+		testutil.Fatal(tb, err)
+	}
+	// clean start, keepalive 60, no properties, empty client id
+	writePacket(tb, ws, 0x10, []byte{0x00, 0x04, 'M', 'Q', 'T', 'T', 0x05, 0x02, 0x00, 0x3C, 0x00, 0x00, 0x00})
+	if connack := readPacket(tb, ws, time.Second*5); len(connack) < 4 || connack[0] != 0x20 || connack[3] != 0x00 {
+		testutil.Fatal(tb, fmt.Errorf("unexpected CONNACK: %x", connack))
+	}
+	return ws
+}
+
+// SUBSCRIBE at QoS 0, expected to be granted as if the token were valid
+func subscribe(tb testing.TB, ws *websocket.Conn, filter string) {
+	subscribe := []byte{0x00, 0x01, 0x00}
+	subscribe = binary.BigEndian.AppendUint16(subscribe, uint16(len(filter)))
+	subscribe = append(append(subscribe, filter...), 0x00)
+	writePacket(tb, ws, FIRST_BYTE_SUBSCRIBE, subscribe)
+	if suback := readPacket(tb, ws, time.Second*5); !bytes.Equal(suback, []byte{0x90, 0x04, 0x00, 0x01, 0x00, 0x00}) {
+		testutil.Fatal(tb, fmt.Errorf("unexpected SUBACK: %x", suback))
+	}
+}
+
+// Packets shorter than 128 bytes only
+func writePacket(tb testing.TB, ws *websocket.Conn, firstByte byte, varHdrAndPayload []byte) {
+	if err := ws.WriteMessage(websocket.BinaryMessage, testutil.EncodeRawPacket(firstByte, varHdrAndPayload)); err != nil {
+		testutil.Fatal(tb, err)
+	}
+}
+
+// A packet in a WebSocket message, as MQTT Interface sends
+func readPacket(tb testing.TB, ws *websocket.Conn, timeout time.Duration) []byte {
+	ws.SetReadDeadline(time.Now().Add(timeout))
+	_, packet, err := ws.ReadMessage()
+	if err != nil {
+		testutil.Fatal(tb, err)
+	}
+	if len(packet) < 2 {
+		testutil.Fatal(tb, fmt.Errorf("unexpected packet: %x", packet))
+	}
+	return packet
+}
+
+// QoS 0 PUBLISH of MQTT v5.0
+func readPublish(tb testing.TB, ws *websocket.Conn, timeout time.Duration) (topicName string, payload []byte) {
+	packet := readPacket(tb, ws, timeout)
+	if packet[0]&0xF6 != 0x30 || packet[1]&0x80 != 0 {
+		testutil.Fatal(tb, fmt.Errorf("unexpected packet: %x", packet))
+	}
+	topicLen := int(binary.BigEndian.Uint16(packet[2:4]))
+	topicName = string(packet[4 : 4+topicLen])
+	propertiesLen := int(packet[4+topicLen])
+	payload = packet[4+topicLen+1+propertiesLen:]
+	return
+}
@@ -0,0 +1,96 @@
+package t18movingtarget
+
+import (
+	"bytes"
+	"fmt"
+	"mqttmtd/tokenmgr/tests/testutil"
+	"net"
+	"testing"
+	"time"
+)
+
+const (
+	// mqttinterface.movingtarget.interval of the server conf
+	MOVING_TARGET_INTERVAL = time.Second * 3
+
+	FIRST_BYTE_PUBLISH_QOS1 byte = 0x32
+	FIRST_BYTE_PUBLISH_QOS2 byte = 0x34
+	FIRST_BYTE_PUBREC       byte = 0x50
+	FIRST_BYTE_PUBREL       byte = 0x62
+	FIRST_BYTE_PUBCOMP      byte = 0x70
+	FIRST_BYTE_PINGREQ      byte = 0xC0
+
+	// Below socktimeout.external of the server conf, so that idle connections are not closed while waiting
+	PING_INTERVAL = time.Second
+)
+
+// pushd ../../certcreate; ./generate_certs.sh -c ../certs; popd
+// set mqttinterface.movingtarget of the server conf, enabled with interval MOVING_TARGET_INTERVAL
+// go test -x -v
+func TestMovingTarget_Rotation(t *testing.T) {
+	topic := testutil.SAMPLE_TOPIC_PUBSUB
+	subConn := testutil.ConnectV5Raw(t, nil)
+	defer subConn.Close()
+	testutil.SubscribeRaw(t, subConn, 1, testutil.NewTokenB64(t, topic, false, false), nil)
+
+	pubConn := testutil.ConnectV5Raw(t, nil)
+	defer pubConn.Close()
+
+	// Subscription is carried over the rotations, at the boundaries and in the middle of epochs
+	for i, wait := range []time.Duration{0, MOVING_TARGET_INTERVAL, MOVING_TARGET_INTERVAL / 2, MOVING_TARGET_INTERVAL} {
+		keepAlive(t, wait, subConn, pubConn)
+		payload := fmt.Sprintf("TestMovingTarget_Rotation%d", i)
+		packetID := uint16(i + 1)
+		token := testutil.NewTokenB64(t, topic, true, false)
+		testutil.WriteRawPacket(t, pubConn, FIRST_BYTE_PUBLISH_QOS1, testutil.NewPublish(token, packetID, nil, []byte(payload)))
+		if puback := testutil.ReadRawPacket(t, pubConn); !bytes.Equal(puback, []byte{0x40, 0x02, byte(packetID >> 8), byte(packetID)}) {
+			testutil.Fatal(t, fmt.Errorf("unexpected PUBACK: %x", puback))
+		}
+
+		topicName, _, received := testutil.ParseRawPublish(t, testutil.ReadRawPacket(t, subConn))
+		if string(received) != payload {
+			testutil.Fatal(t, fmt.Errorf("unexpected payload: %q", received))
+		}
+		// Real topic name hidden as usual, not the broker one
+		if topicName != "A" {
+			testutil.Fatal(t, fmt.Errorf("unexpected topic name: %q", topicName))
+		}
+	}
+}
+
+func TestMovingTarget_ClientPacketIDs(t *testing.T) {
+	topic := testutil.SAMPLE_TOPIC_PUBSUB
+	conn := testutil.ConnectV5Raw(t, nil)
+	defer conn.Close()
+
+	// QoS 2 flow kept open across a rotation, whose packet identifier is not taken by the resubscription
+	testutil.WriteRawPacket(t, conn, FIRST_BYTE_PUBLISH_QOS2, testutil.NewPublish(testutil.NewTokenB64(t, testutil.SAMPLE_TOPIC_PUB, true, false), 1, nil, []byte("TestMovingTarget_ClientPacketIDs")))
+	testutil.ExpectPubResponse(t, testutil.ReadRawPacket(t, conn), FIRST_BYTE_PUBREC, 1, false)
+	// Identifiers of any range, which MQTT Interface does not reserve for itself
+	testutil.SubscribeRaw(t, conn, 0xFF00, testutil.NewTokenB64(t, topic, false, false), nil)
+	keepAlive(t, MOVING_TARGET_INTERVAL, conn)
+	testutil.SubscribeRaw(t, conn, 0xFF01, testutil.NewTokenB64(t, topic, false, false), nil)
+	testutil.WriteRawPacket(t, conn, FIRST_BYTE_PUBREL, []byte{0x00, 0x01})
+	testutil.ExpectPubResponse(t, testutil.ReadRawPacket(t, conn), FIRST_BYTE_PUBCOMP, 1, false)
+
+	pubConn := testutil.ConnectV5Raw(t, nil)
+	defer pubConn.Close()
+	testutil.WriteRawPacket(t, pubConn, FIRST_BYTE_PUBLISH_QOS1, testutil.NewPublish(testutil.NewTokenB64(t, topic, true, false), 1, nil, []byte("TestMovingTarget_ClientPacketIDs")))
+	testutil.ExpectPubResponse(t, testutil.ReadRawPacket(t, pubConn), 0x40, 1, false)
+	if _, _, received := testutil.ParseRawPublish(t, testutil.ReadRawPacket(t, conn)); string(received) != "TestMovingTarget_ClientPacketIDs" {
+		testutil.Fatal(t, fmt.Errorf("unexpected payload: %q", received))
+	}
+}
+
+// Wait for d, pinging conns every PING_INTERVAL
+func keepAlive(tb testing.TB, d time.Duration, conns ...net.Conn) {
+	for deadline := time.Now().Add(d); time.Now().Before(deadline); {
+		time.Sleep(min(PING_INTERVAL, time.Until(deadline)))
+		for _, conn := range conns {
+			testutil.WriteRawPacket(tb, conn, FIRST_BYTE_PINGREQ, nil)
+			if pingresp := testutil.ReadRawPacket(tb, conn); !bytes.Equal(pingresp, []byte{0xD0, 0x00}) {
+				testutil.Fatal(tb, fmt.Errorf("unexpected PINGRESP: %x", pingresp))
+			}
+		}
+	}
+}
@@ -0,0 +1,130 @@
+package t19covertraffic
+
+import (
+	"bytes"
+	"fmt"
+	"mqttmtd/tokenmgr/tests/testutil"
+	"net"
+	"testing"
+	"time"
+)
+
+const (
+	// Topic name of the PUBLISH to the client before any real one, mqttinterface.HIDDEN_TOPIC_NAME
+	HIDDEN_TOPIC_NAME = "A"
+	// Longer than mqttinterface.covertraffic.interval of the server conf
+	COVER_TRAFFIC_TIMEOUT = time.Second * 5
+
+	FIRST_BYTE_PUBLISH_QOS0 byte = 0x30
+	FIRST_BYTE_PUBLISH_QOS1 byte = 0x32
+	FIRST_BYTE_SUBSCRIBE    byte = 0x82
+)
+
+// pushd ../../certcreate; ./generate_certs.sh -c ../certs; popd
+// set mqttinterface.covertraffic.interval of the server conf, such as 1s
+// go test -x -v
+func TestCoverTraffic_Publish(t *testing.T) {
+	topic := testutil.SAMPLE_TOPIC_PUBSUB
+	subConn := testutil.ConnectV5Raw(t, nil)
+	defer subConn.Close()
+	subscribe(t, subConn, testutil.NewTokenB64(t, topic, false, false), 0x00)
+
+	// Acknowledged as real ones, but not forwarded
+	pubConn := testutil.ConnectV5Raw(t, nil)
+	defer pubConn.Close()
+	testutil.WriteRawPacket(t, pubConn, FIRST_BYTE_PUBLISH_QOS1, testutil.NewPublish(testutil.NewTokenB64(t, topic, true, true), 1, nil, []byte("TestCoverTraffic_Publish_Cover")))
+	expectPuback(t, pubConn, 1)
+	testutil.WriteRawPacket(t, pubConn, FIRST_BYTE_PUBLISH_QOS1, testutil.NewPublish(testutil.NewTokenB64(t, topic, true, false), 2, nil, []byte("TestCoverTraffic_Publish_Real")))
+	expectPuback(t, pubConn, 2)
+
+	readPublish(t, subConn, []byte("TestCoverTraffic_Publish_Real"))
+}
+
+func TestCoverTraffic_Subscribe(t *testing.T) {
+	topic := testutil.SAMPLE_TOPIC_PUBSUB
+
+	// Granted as real ones, but not forwarded
+	coverConn := testutil.ConnectV5Raw(t, nil)
+	defer coverConn.Close()
+	subscribe(t, coverConn, testutil.NewTokenB64(t, topic, false, true), 0x00)
+
+	pubConn := testutil.ConnectV5Raw(t, nil)
+	defer pubConn.Close()
+	testutil.WriteRawPacket(t, pubConn, FIRST_BYTE_PUBLISH_QOS1, testutil.NewPublish(testutil.NewTokenB64(t, topic, true, false), 1, nil, []byte("TestCoverTraffic_Subscribe")))
+	expectPuback(t, pubConn, 1)
+
+	// Nothing but cover traffic until the deadline
+	coverConn.SetReadDeadline(time.Now().Add(time.Second))
+	for {
+		packet, err := testutil.TryReadRawPacket(coverConn)
+		if err != nil {
+			break
+		}
+		if packet[0] != FIRST_BYTE_PUBLISH_QOS0 {
+			testutil.Fatal(t, fmt.Errorf("unexpected packet: %x", packet))
+		}
+		if _, _, payload := testutil.ParseRawPublish(t, packet); bytes.Equal(payload, []byte("TestCoverTraffic_Subscribe")) {
+			testutil.Fatal(t, fmt.Errorf("real message forwarded to cover subscription"))
+		}
+	}
+}
+
+func TestCoverTraffic_Received(t *testing.T) {
+	conn := testutil.ConnectV5Raw(t, nil)
+	defer conn.Close()
+
+	// Sent by MQTT Interface without subscriptions, with the topic name of real ones
+	conn.SetReadDeadline(time.Now().Add(COVER_TRAFFIC_TIMEOUT))
+	packet, err := testutil.TryReadRawPacket(conn)
+	if err != nil {
+		testutil.Fatal(t, err)
+	}
+	if packet[0] != FIRST_BYTE_PUBLISH_QOS0 {
+		testutil.Fatal(t, fmt.Errorf("unexpected packet: %x", packet))
+	}
+	if topicName, _, _ := testutil.ParseRawPublish(t, packet); topicName != HIDDEN_TOPIC_NAME {
+		testutil.Fatal(t, fmt.Errorf("unexpected topic name: %q", topicName))
+	}
+}
+
+// SUBSCRIBE at QoS 0, expected to be answered with returnCode
+func subscribe(tb testing.TB, conn net.Conn, filter string, returnCode byte) {
+	testutil.WriteRawPacket(tb, conn, FIRST_BYTE_SUBSCRIBE, testutil.NewSubscribe(1, filter, nil))
+	if suback := readNonCoverPacket(tb, conn); !bytes.Equal(suback, []byte{0x90, 0x04, 0x00, 0x01, 0x00, returnCode}) {
+		testutil.Fatal(tb, fmt.Errorf("unexpected SUBACK: %x", suback))
+	}
+}
+
+func expectPuback(tb testing.TB, conn net.Conn, packetID uint16) {
+	if puback := readNonCoverPacket(tb, conn); !bytes.Equal(puback, []byte{0x40, 0x02, byte(packetID >> 8), byte(packetID)}) {
+		testutil.Fatal(tb, fmt.Errorf("unexpected PUBACK: %x", puback))
+	}
+}
+
+// The next packet, skipping cover traffic, which is the only QoS 0 PUBLISH to connections without subscriptions
+func readNonCoverPacket(tb testing.TB, conn net.Conn) []byte {
+	conn.SetReadDeadline(time.Now().Add(COVER_TRAFFIC_TIMEOUT))
+	for {
+		packet, err := testutil.TryReadRawPacket(conn)
+		if err != nil {
+			testutil.Fatal(tb, err)
+		}
+		if packet[0] != FIRST_BYTE_PUBLISH_QOS0 {
+			return packet
+		}
+	}
+}
+
+// Wait for the QoS 0 PUBLISH of the payload, skipping cover traffic, which cannot be told apart but by the payload
+func readPublish(tb testing.TB, conn net.Conn, payload []byte) {
+	conn.SetReadDeadline(time.Now().Add(COVER_TRAFFIC_TIMEOUT))
+	for {
+		packet, err := testutil.TryReadRawPacket(conn)
+		if err != nil {
+			testutil.Fatal(tb, err)
+		}
+		if _, _, received := testutil.ParseRawPublish(tb, packet); bytes.Equal(received, payload) {
+			return
+		}
+	}
+}
@@ -0,0 +1,165 @@
+package t20padding
+
+import (
+	"bytes"
+	"encoding/base64"
+	"fmt"
+	"mqttmtd/tokenmgr"
+	"mqttmtd/tokenmgr/tests/testutil"
+	"mqttmtd/types"
+	"testing"
+	"time"
+)
+
+const (
+	// Topic of the ACL with padding {pub: "bucket:64", sub: "fixed:256"}
+	SAMPLE_TOPIC_PADDED string = "/sample/padded/pubsub"
+	PUB_BUCKET_SIZE            = 64
+	SUB_FIXED_SIZE             = 256
+
+	// Topic covered by ACL entries with wildcards /sample/padded/merged/# of padding "fixed:64" and
+	// /sample/padded/merged/+ of padding "bucket:256", both PubSub
+	SAMPLE_TOPIC_PADDED_MERGED string = "/sample/padded/merged/topic"
+	MERGED_BUCKET_SIZE                = 256
+
+	FIRST_BYTE_PUBLISH_QOS1 byte = 0x32
+)
+
+// pushd ../../certcreate; ./generate_certs.sh -c ../certs; popd
+// add SAMPLE_TOPIC_PADDED and the entries covering SAMPLE_TOPIC_PADDED_MERGED to the acl of the server with the padding above
+// go test -x -v
+func TestPadding_PubSub(t *testing.T) {
+	aeadType := types.PAYLOAD_AEAD_AES_128_GCM
+	msg := []byte("TestPadding_PubSub")
+
+	subEncKey, _, subToken, subPadding := getPaddedToken(t, SAMPLE_TOPIC_PADDED, false, aeadType)
+	if subPadding != (types.PaddingPolicy{Mode: types.PADDING_FIXED, Size: SUB_FIXED_SIZE}) {
+		testutil.Fatal(t, fmt.Errorf("unexpected padding of sub token: %s", subPadding))
+	}
+	subConn := testutil.ConnectV5Raw(t, nil)
+	defer subConn.Close()
+	testutil.SubscribeRaw(t, subConn, 1, base64.URLEncoding.EncodeToString(subToken), nil)
+
+	pubEncKey, tokenIndex, pubToken, pubPadding := getPaddedToken(t, SAMPLE_TOPIC_PADDED, true, aeadType)
+	if pubPadding != (types.PaddingPolicy{Mode: types.PADDING_BUCKET, Size: PUB_BUCKET_SIZE}) {
+		testutil.Fatal(t, fmt.Errorf("unexpected padding of pub token: %s", pubPadding))
+	}
+	pubConn := testutil.ConnectV5Raw(t, nil)
+	defer pubConn.Close()
+	padded, err := pubPadding.Pad(msg)
+	if err != nil {
+		testutil.Fatal(t, err)
+	}
+	if len(padded) != PUB_BUCKET_SIZE {
+		testutil.Fatal(t, fmt.Errorf("unexpected padded length: %d", len(padded)))
+	}
+	sealed, err := aeadType.SealMessage(padded, pubEncKey, uint64(tokenIndex))
+	if err != nil {
+		testutil.Fatal(t, err)
+	}
+	testutil.WriteRawPacket(t, pubConn, FIRST_BYTE_PUBLISH_QOS1, testutil.NewPublish(base64.URLEncoding.EncodeToString(pubToken), 1, nil, sealed))
+	if puback := testutil.ReadRawPacket(t, pubConn); !bytes.Equal(puback, []byte{0x40, 0x02, 0x00, 0x01}) {
+		testutil.Fatal(t, fmt.Errorf("unexpected PUBACK: %x", puback))
+	}
+
+	// Padded to the fixed size whatever the length of the message
+	_, _, payload := testutil.ParseRawPublish(t, testutil.ReadRawPacket(t, subConn))
+	if len(payload) != SUB_FIXED_SIZE+16 {
+		testutil.Fatal(t, fmt.Errorf("unexpected sealed length: %d", len(payload)))
+	}
+	opened, err := aeadType.OpenMessage(payload, subEncKey, 0)
+	if err != nil {
+		testutil.Fatal(t, err)
+	}
+	if opened, err = subPadding.Unpad(opened); err != nil {
+		testutil.Fatal(t, err)
+	}
+	if !bytes.Equal(opened, msg) {
+		testutil.Fatal(t, fmt.Errorf("unexpected payload: %q", opened))
+	}
+}
+
+func TestPadding_Unpadded(t *testing.T) {
+	aeadType := types.PAYLOAD_AEAD_AES_128_GCM
+
+	// Refused, since the length does not follow the policy of the token
+	pubEncKey, tokenIndex, pubToken, _ := getPaddedToken(t, SAMPLE_TOPIC_PADDED, true, aeadType)
+	pubConn := testutil.ConnectV5Raw(t, nil)
+	defer pubConn.Close()
+	sealed, err := aeadType.SealMessage([]byte("TestPadding_Unpadded"), pubEncKey, uint64(tokenIndex))
+	if err != nil {
+		testutil.Fatal(t, err)
+	}
+	testutil.WriteRawPacket(t, pubConn, FIRST_BYTE_PUBLISH_QOS1, testutil.NewPublish(base64.URLEncoding.EncodeToString(pubToken), 1, nil, sealed))
+	pubConn.SetReadDeadline(time.Now().Add(time.Second * 5))
+	if packet, err := testutil.TryReadRawPacket(pubConn); err == nil {
+		testutil.Fatal(t, fmt.Errorf("unexpected packet: %x", packet))
+	}
+}
+
+func TestPadding_DeliveryTooLong(t *testing.T) {
+	aeadType := types.PAYLOAD_AEAD_AES_128_GCM
+	subEncKey, _, subToken, subPadding := getPaddedToken(t, SAMPLE_TOPIC_PADDED, false, aeadType)
+	subConn := testutil.ConnectV5Raw(t, nil)
+	defer subConn.Close()
+	testutil.SubscribeRaw(t, subConn, 1, base64.URLEncoding.EncodeToString(subToken), nil)
+
+	pubConn := testutil.ConnectV5Raw(t, nil)
+	defer pubConn.Close()
+	publish := func(packetID uint16, msg []byte) {
+		pubEncKey, tokenIndex, pubToken, pubPadding := getPaddedToken(t, SAMPLE_TOPIC_PADDED, true, aeadType)
+		padded, err := pubPadding.Pad(msg)
+		if err != nil {
+			testutil.Fatal(t, err)
+		}
+		sealed, err := aeadType.SealMessage(padded, pubEncKey, uint64(tokenIndex))
+		if err != nil {
+			testutil.Fatal(t, err)
+		}
+		testutil.WriteRawPacket(t, pubConn, FIRST_BYTE_PUBLISH_QOS1, testutil.NewPublish(base64.URLEncoding.EncodeToString(pubToken), packetID, nil, sealed))
+		testutil.ExpectPubResponse(t, testutil.ReadRawPacket(t, pubConn), 0x40, packetID, false)
+	}
+
+	// Dropped, since it does not fit in the fixed size of the subscriber
+	publish(1, bytes.Repeat([]byte{'a'}, SUB_FIXED_SIZE))
+	subConn.SetReadDeadline(time.Now().Add(time.Second))
+	if packet, err := testutil.TryReadRawPacket(subConn); err == nil {
+		testutil.Fatal(t, fmt.Errorf("unexpected packet: %x", packet))
+	}
+
+	// The session stays open
+	msg := []byte("TestPadding_DeliveryTooLong")
+	publish(2, msg)
+	_, _, payload := testutil.ParseRawPublish(t, testutil.ReadRawPacket(t, subConn))
+	opened, err := aeadType.OpenMessage(payload, subEncKey, 0)
+	if err != nil {
+		testutil.Fatal(t, err)
+	}
+	if opened, err = subPadding.Unpad(opened); err != nil {
+		testutil.Fatal(t, err)
+	}
+	if !bytes.Equal(opened, msg) {
+		testutil.Fatal(t, fmt.Errorf("unexpected payload: %q", opened))
+	}
+}
+
+func TestPadding_WildcardMerged(t *testing.T) {
+	// The larger size is stronger than fixed of a smaller one
+	for _, accessTypeIsPub := range []bool{true, false} {
+		_, _, _, padding := getPaddedToken(t, SAMPLE_TOPIC_PADDED_MERGED, accessTypeIsPub, types.PAYLOAD_AEAD_AES_128_GCM)
+		if padding != (types.PaddingPolicy{Mode: types.PADDING_BUCKET, Size: MERGED_BUCKET_SIZE}) {
+			testutil.Fatal(t, fmt.Errorf("unexpected padding of token with pub %v: %s", accessTypeIsPub, padding))
+		}
+	}
+}
+
+func getPaddedToken(tb testing.TB, topic string, accessTypeIsPub bool, aeadType types.PayloadAEADType) (encKey []byte, tokenIndex uint16, token []byte, padding types.PaddingPolicy) {
+	testutil.LoadClientConfig(tb)
+	fetchReq := testutil.PrepareFetchReq(accessTypeIsPub, aeadType)
+	fetchReq.Padding = true
+	var err error
+	if encKey, tokenIndex, token, padding, err = tokenmgr.GetPaddedToken(topic, *fetchReq); err != nil {
+		testutil.Fatal(tb, err)
+	}
+	return
+}
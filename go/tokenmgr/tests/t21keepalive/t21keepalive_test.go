@@ -0,0 +1,56 @@
+package t21keepalive
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"mqttmtd/tokenmgr/tests/testutil"
+	"net"
+	"testing"
+	"time"
+)
+
+// pushd ../../certcreate; ./generate_certs.sh -c ../certs; popd
+// go test -x -v
+func TestKeepAlive_IdleWithinKeepAlive(t *testing.T) {
+	for _, mqttVersion := range []byte{4, 5} {
+		conn := testutil.DialMqttInterface(t)
+		defer conn.Close()
+		connect(t, conn, mqttVersion, 60)
+
+		// Longer than the socket timeout, shorter than the Keep Alive
+		time.Sleep(time.Second * 6)
+		testutil.WriteRawPacket(t, conn, 0xC0, nil)
+		if pingresp := testutil.ReadRawPacket(t, conn); !bytes.Equal(pingresp, []byte{0xD0, 0x00}) {
+			testutil.Fatal(t, fmt.Errorf("unexpected PINGRESP for MQTT version %d: %x", mqttVersion, pingresp))
+		}
+	}
+}
+
+func TestKeepAlive_IdleBeyondKeepAlive(t *testing.T) {
+	conn := testutil.DialMqttInterface(t)
+	defer conn.Close()
+	connect(t, conn, 4, 2)
+
+	// Disconnected after one and a half times of the Keep Alive
+	conn.SetReadDeadline(time.Now().Add(time.Second * 6))
+	if _, err := conn.Read(make([]byte, 1)); !errors.Is(err, io.EOF) {
+		testutil.Fatal(t, fmt.Errorf("connection not closed: %v", err))
+	}
+}
+
+// CONNECT with clean start and empty client id, and CONNACK
+func connect(tb testing.TB, conn net.Conn, mqttVersion byte, keepAlive uint16) {
+	packet := binary.BigEndian.AppendUint16([]byte{0x00, 0x04, 'M', 'Q', 'T', 'T', mqttVersion, 0x02}, keepAlive)
+	if mqttVersion >= 5 {
+		// properties
+		packet = append(packet, 0x00)
+	}
+	packet = append(packet, 0x00, 0x00)
+	testutil.WriteRawPacket(tb, conn, 0x10, packet)
+	if connack := testutil.ReadRawPacket(tb, conn); len(connack) < 4 || connack[0] != 0x20 || connack[3] != 0x00 {
+		testutil.Fatal(tb, fmt.Errorf("unexpected CONNACK for MQTT version %d: %x", mqttVersion, connack))
+	}
+}
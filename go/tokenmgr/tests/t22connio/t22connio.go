@@ -0,0 +1,368 @@
+package t22connio
+
+import (
+	"context"
+	"encoding/binary"
+	"fmt"
+	"mqttmtd/consts"
+	"mqttmtd/funcs"
+	"mqttmtd/mqttinterface/mqttparser"
+	"mqttmtd/types"
+	"net"
+	"testing"
+	"time"
+)
+
+var Benchmarks = []func(*testing.B){
+	BenchmarkConnIO_ReadPacket,
+	BenchmarkConnIO_ReadPacket_Legacy,
+	BenchmarkConnIO_ParseVerifierRequest,
+	BenchmarkConnIO_ParseVerifierRequest_Legacy,
+	BenchmarkConnIO_ParseIssuerRequest,
+	BenchmarkConnIO_ParseIssuerRequest_Legacy,
+	BenchmarkConnIO_RoundTrip,
+}
+
+const (
+	// PUBLISH with a topic of 16 bytes and a payload of 64 bytes
+	samplePayloadLen = 64
+	sampleTopicLen   = 16
+)
+
+func samplePublish() []byte {
+	remainingLen := 2 + sampleTopicLen + samplePayloadLen
+	packet := []byte{0x30, byte(remainingLen), 0x00, sampleTopicLen}
+	packet = append(packet, make([]byte, sampleTopicLen+samplePayloadLen)...)
+	return packet
+}
+
+func sampleVerifierRequest() types.VerifierRequest {
+	return types.VerifierRequest{AccessTypeIsPub: true, Token: make([]byte, consts.TOKEN_SIZE)}
+}
+
+func sampleIssuerRequest() types.IssuerRequest {
+	return types.IssuerRequest{
+		AccessTypeIsPub:                   true,
+		PayloadAEADRequested:              true,
+		PayloadAEADType:                   types.PAYLOAD_AEAD_AES_128_GCM,
+		NumberOfTokensDividedByMultiplier: 1,
+		Topic:                             make([]byte, sampleTopicLen),
+	}
+}
+
+// Pair of TCP connections over loopback
+func tcpPipe(tb testing.TB) (client net.Conn, server net.Conn) {
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		tb.Fatal(err)
+	}
+	defer listener.Close()
+	accepted := make(chan net.Conn)
+	go func() {
+		conn, _ := listener.Accept()
+		accepted <- conn
+	}()
+	if client, err = net.Dial("tcp", listener.Addr().String()); err != nil {
+		tb.Fatal(err)
+	}
+	if server = <-accepted; server == nil {
+		tb.Fatal("failed accepting")
+	}
+	return
+}
+
+// Calls write n times in the background, as the peer writing ahead of the reads being measured
+func writeAhead(n int, write func() error) {
+	go func() {
+		for i := 0; i < n; i++ {
+			if err := write(); err != nil {
+				return
+			}
+		}
+	}()
+}
+
+// Fixed header and the rest of a packet, as cli2Mqtt of MQTT Interface reads them
+func readPacket(r *funcs.ConnReader, buf *[]byte, timeout time.Duration) (err error) {
+	_, remainingLen, _, err := mqttparser.ReadFixedHeader(r, 0, timeout)
+	if err != nil {
+		return
+	}
+	funcs.SetLen(buf, remainingLen)
+	_, err = r.ReadFull(*buf, timeout)
+	return
+}
+
+/*
+funcs.ConnRead with a cancelable context before the pooled readers, which started a goroutine per read, for comparison
+only. The debug print of every read is left out.
+*/
+func legacyConnRead(ctx context.Context, conn net.Conn, dst []byte, timeout time.Duration) (n int, err error) {
+	total := 0
+	result := make(chan struct {
+		n   int
+		err error
+	})
+
+	for total < len(dst) {
+		go func() {
+			if timeout != 0 {
+				if err := conn.SetReadDeadline(time.Now().Add(timeout)); err != nil {
+					result <- struct {
+						n   int
+						err error
+					}{0, err}
+					return
+				}
+			}
+			n, err := conn.Read(dst[total:])
+			result <- struct {
+				n   int
+				err error
+			}{n, err}
+		}()
+
+		select {
+		case <-ctx.Done():
+			return total, ctx.Err()
+		case res := <-result:
+			if res.err != nil {
+				return total, res.err
+			}
+			total += res.n
+		}
+	}
+	return total, nil
+}
+
+// readPacket as MQTT Interface did with legacyConnRead, a byte at a time for the fixed header
+func legacyReadPacket(ctx context.Context, conn net.Conn, buf *[]byte, timeout time.Duration) (err error) {
+	b := make([]byte, 1)
+	if _, err = legacyConnRead(ctx, conn, b, timeout); err != nil {
+		return
+	}
+	remainingLen := 0
+	for i := 0; i < 4; i++ {
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		default:
+		}
+		if _, err = legacyConnRead(ctx, conn, b, timeout); err != nil {
+			return
+		}
+		remainingLen += int(b[0]&0x7F) << (7 * i)
+		if b[0]&0x80 == 0 {
+			funcs.SetLen(buf, remainingLen)
+			_, err = legacyConnRead(ctx, conn, *buf, timeout)
+			return
+		}
+	}
+	return fmt.Errorf("malformed remaining length")
+}
+
+// funcs.ParseVerifierRequest with legacyConnRead
+func legacyParseVerifierRequest(ctx context.Context, conn net.Conn, timeout time.Duration) (types.VerifierRequest, error) {
+	buf := make([]byte, 1+consts.TOKEN_SIZE)
+	if n, err := legacyConnRead(ctx, conn, buf, timeout); err != nil || n != len(buf) {
+		return types.VerifierRequest{}, fmt.Errorf("failed reading verifier request")
+	}
+	return types.VerifierRequest{
+		AccessTypeIsPub: (buf[0] & consts.BIT_7) != 0,
+		Token:           buf[1:],
+	}, nil
+}
+
+// funcs.ParseIssuerRequest with legacyConnRead, without the options field which requests here do not have
+func legacyParseIssuerRequest(ctx context.Context, conn net.Conn, timeout time.Duration) (types.IssuerRequest, error) {
+	buf := make([]byte, 2)
+	if n, err := legacyConnRead(ctx, conn, buf[:1], timeout); err != nil || n != 1 {
+		return types.IssuerRequest{}, fmt.Errorf("failed reading the flag field of an issuer request")
+	}
+	flag := buf[0]
+	request := types.IssuerRequest{
+		AccessTypeIsPub:                   (flag & consts.BIT_7) != 0,
+		PayloadAEADRequested:              (flag & consts.BIT_6) != 0,
+		NumberOfTokensDividedByMultiplier: flag & 0x1F,
+	}
+	if request.PayloadAEADRequested {
+		if n, err := legacyConnRead(ctx, conn, buf[:1], timeout); err != nil || n != 1 {
+			return request, fmt.Errorf("failed reading payload AEAD type field of an issuer request")
+		}
+		request.PayloadAEADType = types.PayloadAEADType(buf[0])
+	}
+	if n, err := legacyConnRead(ctx, conn, buf, timeout); err != nil || n != 2 {
+		return request, fmt.Errorf("failed reading the length of Topic field of an issuer request")
+	}
+	topicLen := binary.BigEndian.Uint16(buf)
+	if topicLen > consts.MAX_UTF8_ENCODED_STRING_SIZE {
+		return request, fmt.Errorf("invalid Topic length")
+	}
+	request.Topic = make([]byte, topicLen)
+	if n, err := legacyConnRead(ctx, conn, request.Topic, timeout); err != nil || n != int(topicLen) {
+		return request, fmt.Errorf("failed reading Topic field of an issuer request")
+	}
+	return request, nil
+}
+
+// Reads of packets written ahead by the peer
+func BenchmarkConnIO_ReadPacket(b *testing.B) {
+	client, server := tcpPipe(b)
+	defer client.Close()
+	defer server.Close()
+	packet := samplePublish()
+	writeAhead(b.N, func() (err error) {
+		_, err = client.Write(packet)
+		return
+	})
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	reader := funcs.NewConnReader(ctx, server)
+	defer reader.Release()
+	bufp := funcs.GetBuf()
+	defer funcs.PutBuf(bufp)
+	b.ReportAllocs()
+	b.SetBytes(int64(len(packet)))
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		if err := readPacket(reader, bufp, time.Second*5); err != nil {
+			b.Fatal(err)
+		}
+	}
+}
+
+func BenchmarkConnIO_ReadPacket_Legacy(b *testing.B) {
+	client, server := tcpPipe(b)
+	defer client.Close()
+	defer server.Close()
+	packet := samplePublish()
+	writeAhead(b.N, func() (err error) {
+		_, err = client.Write(packet)
+		return
+	})
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	buf := make([]byte, 0)
+	b.ReportAllocs()
+	b.SetBytes(int64(len(packet)))
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		if err := legacyReadPacket(ctx, server, &buf, time.Second*5); err != nil {
+			b.Fatal(err)
+		}
+	}
+}
+
+// Verifier requests sent with funcs.SendVerifierRequest ahead of the parses
+func BenchmarkConnIO_ParseVerifierRequest(b *testing.B) {
+	client, server := tcpPipe(b)
+	defer client.Close()
+	defer server.Close()
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	writeAhead(b.N, func() error {
+		return funcs.SendVerifierRequest(ctx, client, time.Second*5, sampleVerifierRequest())
+	})
+
+	reader := funcs.NewConnReader(ctx, server)
+	defer reader.Release()
+	b.ReportAllocs()
+	b.SetBytes(1 + consts.TOKEN_SIZE)
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		if _, err := funcs.ParseVerifierRequest(reader, time.Second*5); err != nil {
+			b.Fatal(err)
+		}
+	}
+}
+
+func BenchmarkConnIO_ParseVerifierRequest_Legacy(b *testing.B) {
+	client, server := tcpPipe(b)
+	defer client.Close()
+	defer server.Close()
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	writeAhead(b.N, func() error {
+		return funcs.SendVerifierRequest(ctx, client, time.Second*5, sampleVerifierRequest())
+	})
+
+	b.ReportAllocs()
+	b.SetBytes(1 + consts.TOKEN_SIZE)
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		if _, err := legacyParseVerifierRequest(ctx, server, time.Second*5); err != nil {
+			b.Fatal(err)
+		}
+	}
+}
+
+// Issuer requests sent with funcs.SendIssuerRequest ahead of the parses
+func BenchmarkConnIO_ParseIssuerRequest(b *testing.B) {
+	client, server := tcpPipe(b)
+	defer client.Close()
+	defer server.Close()
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	writeAhead(b.N, func() error {
+		return funcs.SendIssuerRequest(ctx, client, time.Second*5, sampleIssuerRequest())
+	})
+
+	reader := funcs.NewConnReader(ctx, server)
+	defer reader.Release()
+	b.ReportAllocs()
+	b.SetBytes(1 + 1 + 2 + sampleTopicLen)
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		if _, err := funcs.ParseIssuerRequest(reader, time.Second*5); err != nil {
+			b.Fatal(err)
+		}
+	}
+}
+
+func BenchmarkConnIO_ParseIssuerRequest_Legacy(b *testing.B) {
+	client, server := tcpPipe(b)
+	defer client.Close()
+	defer server.Close()
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	writeAhead(b.N, func() error {
+		return funcs.SendIssuerRequest(ctx, client, time.Second*5, sampleIssuerRequest())
+	})
+
+	b.ReportAllocs()
+	b.SetBytes(1 + 1 + 2 + sampleTopicLen)
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		if _, err := legacyParseIssuerRequest(ctx, server, time.Second*5); err != nil {
+			b.Fatal(err)
+		}
+	}
+}
+
+// Write of a packet and read of it by the peer, one at a time
+func BenchmarkConnIO_RoundTrip(b *testing.B) {
+	client, server := tcpPipe(b)
+	defer client.Close()
+	defer server.Close()
+	packet := samplePublish()
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	reader := funcs.NewConnReader(ctx, server)
+	defer reader.Release()
+	bufp := funcs.GetBuf()
+	defer funcs.PutBuf(bufp)
+	b.ReportAllocs()
+	b.SetBytes(int64(len(packet)))
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		if _, err := funcs.ConnWrite(ctx, client, packet, time.Second*5); err != nil {
+			b.Fatal(err)
+		}
+		if err := readPacket(reader, bufp, time.Second*5); err != nil {
+			b.Fatal(err)
+		}
+	}
+}
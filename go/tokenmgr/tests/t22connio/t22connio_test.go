@@ -0,0 +1,79 @@
+package t22connio
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"mqttmtd/funcs"
+	"net"
+	"testing"
+	"time"
+)
+
+// go test -x -v
+func TestConnIO_ReadPacket(t *testing.T) {
+	client, server := tcpPipe(t)
+	defer client.Close()
+	defer server.Close()
+	reader := funcs.NewConnReader(context.Background(), server)
+	defer reader.Release()
+
+	packet := samplePublish()
+	// Split in the middle of the fixed header and of the payload
+	go func() {
+		for _, part := range [][]byte{packet[:1], packet[1:10], packet[10:]} {
+			client.Write(part)
+			time.Sleep(time.Millisecond * 10)
+		}
+	}()
+	buf := make([]byte, 0, 4)
+	if err := readPacket(reader, &buf, time.Second); err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(buf, packet[2:]) {
+		t.Fatalf("unexpected packet: %x", buf)
+	}
+}
+
+func TestConnIO_Timeout(t *testing.T) {
+	client, server := tcpPipe(t)
+	defer client.Close()
+	defer server.Close()
+	reader := funcs.NewConnReader(context.Background(), server)
+	defer reader.Release()
+
+	var netErr net.Error
+	if _, err := reader.ReadByteWithin(time.Millisecond * 100); !errors.As(err, &netErr) || !netErr.Timeout() {
+		t.Fatalf("timeout not observed: %v", err)
+	}
+}
+
+func TestConnIO_Cancel(t *testing.T) {
+	client, server := tcpPipe(t)
+	defer client.Close()
+	defer server.Close()
+	ctx, cancel := context.WithCancel(context.Background())
+	reader := funcs.NewConnReader(ctx, server)
+	defer reader.Release()
+
+	// Blocked without deadline until the cancel
+	time.AfterFunc(time.Millisecond*100, cancel)
+	started := time.Now()
+	if _, err := reader.ReadFull(make([]byte, 1), 0); !errors.Is(err, context.Canceled) {
+		t.Fatalf("cancel not observed: %v", err)
+	}
+	if elapsed := time.Since(started); elapsed > time.Second {
+		t.Fatalf("cancel observed late: %v", elapsed)
+	}
+	if _, err := funcs.ConnWrite(ctx, client, []byte{0x00}, time.Second); !errors.Is(err, context.Canceled) {
+		t.Fatalf("cancel not observed on write: %v", err)
+	}
+}
+
+func TestConnIO_SetLenKeepsContent(t *testing.T) {
+	buf := []byte{0x01, 0x02, 0x03}
+	funcs.SetLen(&buf, 1024)
+	if !bytes.Equal(buf[:3], []byte{0x01, 0x02, 0x03}) || len(buf) != 1024 || cap(buf) < 1024 {
+		t.Fatalf("unexpected buffer: len %d, cap %d, %x", len(buf), cap(buf), buf[:3])
+	}
+}
@@ -0,0 +1,99 @@
+package t23logging
+
+import (
+	"bufio"
+	"context"
+	"encoding/json"
+	"log/slog"
+	"mqttmtd/config"
+	"mqttmtd/logging"
+	"os"
+	"testing"
+)
+
+// Records written to stdout while f runs, decoded from JSON
+func captureRecords(t *testing.T, conf config.LogConfig, f func()) (records []map[string]any) {
+	r, w, err := os.Pipe()
+	if err != nil {
+		t.Fatal(err)
+	}
+	stdout := os.Stdout
+	os.Stdout = w
+	conf.Format = logging.FORMAT_JSON
+	err = logging.Init(conf, "test")
+	os.Stdout = stdout
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer logging.Init(config.LogConfig{}, "test")
+
+	f()
+	w.Close()
+	scanner := bufio.NewScanner(r)
+	for scanner.Scan() {
+		var record map[string]any
+		if err := json.Unmarshal(scanner.Bytes(), &record); err != nil {
+			t.Fatalf("invalid record %q: %v", scanner.Text(), err)
+		}
+		records = append(records, record)
+	}
+	return
+}
+
+// go test -x -v
+func TestLogging_Redaction(t *testing.T) {
+	logger := logging.For("t23")
+	secret := []byte{0xDE, 0xAD, 0xBE, 0xEF}
+
+	records := captureRecords(t, config.LogConfig{}, func() {
+		logger.Info("redacted", "token", "deadbeef", "topicname", logging.Secret(secret), "packet", logging.Hex(secret))
+	})
+	if len(records) != 1 {
+		t.Fatalf("expected 1 record, got %d", len(records))
+	}
+	for _, key := range []string{"token", "topicname"} {
+		if records[0][key] != logging.REDACTED {
+			t.Errorf("%s not redacted: %v", key, records[0][key])
+		}
+	}
+	if records[0]["packet"] != "deadbeef" || records[0][logging.KEY_COMPONENT] != "t23" {
+		t.Errorf("unexpected record: %v", records[0])
+	}
+
+	records = captureRecords(t, config.LogConfig{Unredacted: true}, func() {
+		logger.Info("unredacted", "token", "deadbeef", "topicname", logging.Secret(secret))
+	})
+	if len(records) != 1 || records[0]["token"] != "deadbeef" || records[0]["topicname"] != "deadbeef" {
+		t.Fatalf("unexpected records: %v", records)
+	}
+}
+
+func TestLogging_ComponentLevels(t *testing.T) {
+	// Made before Init, which must still apply
+	quiet, verbose := logging.For("quiet"), logging.For("verbose").With("remote", "127.0.0.1:1883")
+
+	var enabled bool
+	records := captureRecords(t, config.LogConfig{Level: "warn", Components: map[string]string{"verbose": "debug"}}, func() {
+		quiet.Info("dropped")
+		quiet.Warn("kept")
+		verbose.Debug("kept")
+		enabled = verbose.Enabled(context.Background(), slog.LevelDebug) && !quiet.Enabled(context.Background(), slog.LevelInfo)
+	})
+	if len(records) != 2 {
+		t.Fatalf("expected 2 records, got %v", records)
+	}
+	if records[1][logging.KEY_COMPONENT] != "verbose" || records[1]["remote"] != "127.0.0.1:1883" {
+		t.Fatalf("unexpected record: %v", records[1])
+	}
+	if !enabled {
+		t.Fatal("unexpected levels")
+	}
+}
+
+func TestLogging_InvalidConfig(t *testing.T) {
+	for _, conf := range []config.LogConfig{{Level: "verbose"}, {Format: "xml"}, {Components: map[string]string{"x": "loud"}}} {
+		if err := logging.Init(conf, "test"); err == nil {
+			t.Errorf("%+v accepted", conf)
+		}
+	}
+}
@@ -0,0 +1,126 @@
+package t24metrics
+
+import (
+	"bufio"
+	"io"
+	"mqttmtd/metrics"
+	"mqttmtd/tokenmgr/tests/testutil"
+	"mqttmtd/types"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"strings"
+	"testing"
+)
+
+// Samples of an exposition by name with labels, e.g. `mqttmtd_verifications_total{access="pub",result="success"}`
+func scrape(t *testing.T, url string) (samples map[string]float64) {
+	resp, err := http.Get(url)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		t.Fatalf("unexpected status: %s", resp.Status)
+	}
+	samples = make(map[string]float64)
+	scanner := bufio.NewScanner(resp.Body)
+	for scanner.Scan() {
+		line := scanner.Text()
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		sep := strings.LastIndexByte(line, ' ')
+		v, err := strconv.ParseFloat(line[sep+1:], 64)
+		if err != nil {
+			t.Fatalf("invalid sample %q: %v", line, err)
+		}
+		samples[line[:sep]] = v
+	}
+	return
+}
+
+// go test -x -v
+func TestMetrics_Exposition(t *testing.T) {
+	counter := metrics.NewCounterVec("t24_requests_total", "Requests\nby result", metrics.LABEL_RESULT)
+	counter.Inc(metrics.RESULT_OK)
+	counter.Add(2, `quoted "result"`)
+	metrics.NewGaugeFunc("t24_entries", "Entries", func() float64 { return 3 })
+	histogram := metrics.NewHistogramVec("t24_duration_seconds", "Duration", []float64{0.1, 1}, metrics.LABEL_ACCESS)
+	histogram.Observe(0.05, metrics.ACCESS_PUB)
+	histogram.Observe(0.1, metrics.ACCESS_PUB)
+	histogram.Observe(5, metrics.ACCESS_PUB)
+
+	server := httptest.NewServer(metrics.Handler())
+	defer server.Close()
+	resp, err := http.Get(server.URL)
+	if err != nil {
+		t.Fatal(err)
+	}
+	body, _ := io.ReadAll(resp.Body)
+	resp.Body.Close()
+	expected := `# HELP t24_requests_total Requests\nby result
+# TYPE t24_requests_total counter
+t24_requests_total{result="ok"} 1
+t24_requests_total{result="quoted \"result\""} 2
+# HELP t24_entries Entries
+# TYPE t24_entries gauge
+t24_entries 3
+# HELP t24_duration_seconds Duration
+# TYPE t24_duration_seconds histogram
+t24_duration_seconds_bucket{access="pub",le="0.1"} 2
+t24_duration_seconds_bucket{access="pub",le="1"} 2
+t24_duration_seconds_bucket{access="pub",le="+Inf"} 3
+t24_duration_seconds_sum{access="pub"} 5.15
+t24_duration_seconds_count{access="pub"} 3
+`
+	if string(body) != expected {
+		t.Fatalf("unexpected exposition:\n%s", body)
+	}
+}
+
+func TestMetrics_Scrape(t *testing.T) {
+	topic := testutil.SAMPLE_TOPIC_PUB
+	testutil.LoadClientConfig(t)
+	fetchReq := testutil.PrepareFetchReq(true, types.PAYLOAD_AEAD_NONE)
+	testutil.RemoveTokenFile(topic, *fetchReq)
+	_, _, token := testutil.GetTokenTest(t, topic, *fetchReq, true)
+	testutil.AutopahoPublish(t, token, []byte("TestMetrics_Scrape"), types.PAYLOAD_AEAD_NONE, nil, 0)
+	testutil.RemoveTokenFile(topic, *fetchReq)
+
+	authserver := scrape(t, testutil.ADDR_METRICS_AUTHSERVER)
+	for _, name := range []string{
+		`mqttmtd_verifications_total{access="pub",result="success"}`,
+		`mqttmtd_verification_duration_seconds_count{access="pub"}`,
+	} {
+		if authserver[name] < 1 {
+			t.Errorf("authserver: %s not counted", name)
+		}
+	}
+	issued := false
+	for name, v := range authserver {
+		// Whichever client name the certificate has
+		if strings.HasPrefix(name, "mqttmtd_tokens_issued_total{") && strings.HasSuffix(name, `,topic="/sample/topic/pub",access="pub"}`) && v >= 1 {
+			issued = true
+		}
+	}
+	if !issued {
+		t.Error("authserver: mqttmtd_tokens_issued_total not counted")
+	}
+	if _, found := authserver["mqttmtd_atl_entries"]; !found {
+		t.Error("authserver: mqttmtd_atl_entries not found")
+	}
+
+	mqttInterface := scrape(t, testutil.ADDR_METRICS_MQTT_INTERFACE)
+	for _, name := range []string{
+		`mqttmtd_verifications_total{access="pub",result="success"}`,
+		`mqttmtd_verification_duration_seconds_count{access="pub"}`,
+		`mqttmtd_interface_bytes_total{direction="cli2mqtt"}`,
+		`mqttmtd_interface_bytes_total{direction="mqtt2cli"}`,
+		`mqttmtd_interface_messages_total{kind="realpublish"}`,
+	} {
+		if mqttInterface[name] < 1 {
+			t.Errorf("mqttinterface: %s not counted", name)
+		}
+	}
+}
@@ -0,0 +1,176 @@
+package t25adminapi
+
+import (
+	"bytes"
+	"encoding/json"
+	"mqttmtd/metrics"
+	"mqttmtd/tokenmgr/tests/testutil"
+	"mqttmtd/types"
+	"net/http"
+	"net/url"
+	"strings"
+	"testing"
+)
+
+const API_URL = testutil.ADDR_DASHBOARD + "/api/v1"
+
+type atlEntry struct {
+	ID     string `json:"id"`
+	Client string `json:"client"`
+	Topic  string `json:"topic"`
+	Access string `json:"access"`
+}
+
+type aclGrant struct {
+	Client  string            `json:"client,omitempty"`
+	Topic   string            `json:"topic"`
+	Access  string            `json:"access"`
+	Padding map[string]string `json:"padding"`
+}
+
+// Status of the request, with the response decoded into v if non-nil
+func call(t *testing.T, method string, path string, body any, v any) int {
+	var reqBody bytes.Buffer
+	if body != nil {
+		if err := json.NewEncoder(&reqBody).Encode(body); err != nil {
+			t.Fatal(err)
+		}
+	}
+	req, err := http.NewRequest(method, API_URL+path, &reqBody)
+	if err != nil {
+		t.Fatal(err)
+	}
+	req.SetBasicAuth(testutil.DASHBOARD_ADMIN_USER, testutil.DASHBOARD_ADMIN_PASSWORD)
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer resp.Body.Close()
+	if v != nil && resp.StatusCode < 300 {
+		if err = json.NewDecoder(resp.Body).Decode(v); err != nil {
+			t.Fatal(err)
+		}
+	}
+	return resp.StatusCode
+}
+
+func listATL(t *testing.T, query url.Values) []atlEntry {
+	var resp struct {
+		Entries []atlEntry `json:"entries"`
+	}
+	if status := call(t, http.MethodGet, "/atl?"+query.Encode(), nil, &resp); status != http.StatusOK {
+		t.Fatalf("unexpected status: %d", status)
+	}
+	return resp.Entries
+}
+
+// go test -x -v
+func TestAdminAPI_RevokeEntry(t *testing.T) {
+	topic := testutil.SAMPLE_TOPIC_PUBSUB
+	testutil.LoadClientConfig(t)
+	fetchReq := testutil.PrepareFetchReq(false, types.PAYLOAD_AEAD_NONE)
+	testutil.RemoveTokenFile(topic, *fetchReq)
+	defer testutil.RemoveTokenFile(topic, *fetchReq)
+	_, _, token := testutil.GetTokenTest(t, topic, *fetchReq, true)
+
+	query := url.Values{"topic": {topic}, "access": {"sub"}, "cover": {"false"}}
+	entries := listATL(t, query)
+	if len(entries) == 0 {
+		t.Fatal("issued entry not listed")
+	}
+	entry := entries[len(entries)-1]
+	if status := call(t, http.MethodDelete, "/atl/"+entry.ID, nil, nil); status != http.StatusOK {
+		t.Fatalf("unexpected status on revocation: %d", status)
+	}
+	for _, e := range listATL(t, query) {
+		if e.ID == entry.ID {
+			t.Fatal("revoked entry still listed")
+		}
+	}
+	if status := call(t, http.MethodDelete, "/atl/"+entry.ID, nil, nil); status != http.StatusNotFound {
+		t.Fatalf("unexpected status on second revocation: %d", status)
+	}
+
+	// The token of the revoked entry no longer verifies
+	testutil.AutopahoSubscribe(t, token, true, nil, []byte{}, types.PAYLOAD_AEAD_NONE, nil)
+}
+
+func TestAdminAPI_RevokeByFilter(t *testing.T) {
+	if status := call(t, http.MethodDelete, "/atl", nil, nil); status != http.StatusBadRequest {
+		t.Fatalf("revocation without filter answered %d", status)
+	}
+	if status := call(t, http.MethodGet, "/atl?access=both", nil, nil); status != http.StatusBadRequest {
+		t.Fatalf("invalid access answered %d", status)
+	}
+	var resp struct {
+		Revoked []atlEntry `json:"revoked"`
+	}
+	if status := call(t, http.MethodDelete, "/atl?client=t25nonexistent", nil, &resp); status != http.StatusOK || len(resp.Revoked) != 0 {
+		t.Fatalf("unexpected revocation: %d %v", status, resp.Revoked)
+	}
+}
+
+func TestAdminAPI_ACL(t *testing.T) {
+	const client = "t25client"
+	grant := aclGrant{Topic: "/t25/#", Access: "PubSub", Padding: map[string]string{"pub": "bucket:64"}}
+	if status := call(t, http.MethodPut, "/acl/"+client, grant, nil); status != http.StatusOK {
+		t.Fatalf("unexpected status on put: %d", status)
+	}
+	defer call(t, http.MethodDelete, "/acl/"+client, nil, nil)
+
+	var resp struct {
+		Grants []aclGrant `json:"grants"`
+	}
+	if status := call(t, http.MethodGet, "/acl?client="+client, nil, &resp); status != http.StatusOK {
+		t.Fatalf("unexpected status: %d", status)
+	}
+	if len(resp.Grants) != 1 || resp.Grants[0].Access != "PubSub" || resp.Grants[0].Padding["pub"] != "bucket:64" || resp.Grants[0].Padding["sub"] != "none" {
+		t.Fatalf("unexpected grants: %v", resp.Grants)
+	}
+
+	for _, invalid := range []aclGrant{{Topic: "/t25/#/x", Access: "Pub"}, {Topic: "/t25", Access: "All"}, {Topic: "/t25", Access: "Pub", Padding: map[string]string{"sub": "fixed"}}} {
+		if status := call(t, http.MethodPut, "/acl/"+client, invalid, nil); status != http.StatusBadRequest {
+			t.Errorf("%v answered %d", invalid, status)
+		}
+	}
+
+	if status := call(t, http.MethodDelete, "/acl/"+client+"?topic="+url.QueryEscape("/t25/#"), nil, nil); status != http.StatusNoContent {
+		t.Fatalf("unexpected status on delete: %d", status)
+	}
+	if status := call(t, http.MethodDelete, "/acl/"+client+"?topic="+url.QueryEscape("/t25/#"), nil, nil); status != http.StatusNotFound {
+		t.Fatalf("unexpected status on second delete: %d", status)
+	}
+}
+
+func TestAdminAPI_SweepAndSessions(t *testing.T) {
+	var sweep struct {
+		Removed *int `json:"removed"`
+	}
+	if status := call(t, http.MethodPost, "/atl/sweep", nil, &sweep); status != http.StatusOK || sweep.Removed == nil {
+		t.Fatalf("unexpected sweep: %d", status)
+	}
+	conn := testutil.ConnectV5Raw(t, nil)
+	defer conn.Close()
+	var sessions struct {
+		Sessions []map[string]any `json:"sessions"`
+	}
+	if status := call(t, http.MethodGet, "/sessions", nil, &sessions); status != http.StatusOK || len(sessions.Sessions) == 0 {
+		t.Fatalf("unexpected sessions: %d", status)
+	}
+	for _, session := range sessions.Sessions {
+		// Real and cover traffic are not told apart
+		if _, ok := session["messages"]; !ok || session["traffic"] != nil {
+			t.Fatalf("unexpected session: %v", session)
+		}
+	}
+
+	// Not served on the metrics port
+	resp, err := http.Get(strings.TrimSuffix(testutil.ADDR_METRICS_MQTT_INTERFACE, metrics.METRICS_PATH) + "/api/v1/sessions")
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusNotFound {
+		t.Fatalf("unexpected status of sessions on the metrics port: %s", resp.Status)
+	}
+}
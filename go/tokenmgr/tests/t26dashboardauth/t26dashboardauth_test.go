@@ -0,0 +1,139 @@
+package t26dashboardauth
+
+import (
+	"encoding/json"
+	"io"
+	"mqttmtd/tokenmgr/tests/testutil"
+	"mqttmtd/types"
+	"net/http"
+	"net/url"
+	"strings"
+	"testing"
+)
+
+const ATL_URL = testutil.ADDR_DASHBOARD + "/api/v1/atl"
+
+type atlEntry struct {
+	ID                string `json:"id"`
+	CurrentRandomData string `json:"currentrandomdata"`
+}
+
+// Response of the request, authenticated by auth if non-nil
+func request(t *testing.T, method string, url string, auth func(req *http.Request)) *http.Response {
+	req, err := http.NewRequest(method, url, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if auth != nil {
+		auth(req)
+	}
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { resp.Body.Close() })
+	return resp
+}
+
+func basicAuth(user, password string) func(req *http.Request) {
+	return func(req *http.Request) { req.SetBasicAuth(user, password) }
+}
+
+func bearerAuth(token string) func(req *http.Request) {
+	return func(req *http.Request) { req.Header.Set("Authorization", "Bearer "+token) }
+}
+
+func listATL(t *testing.T, auth func(req *http.Request), topic string) []atlEntry {
+	resp := request(t, http.MethodGet, ATL_URL+"?"+url.Values{"topic": {topic}}.Encode(), auth)
+	if resp.StatusCode != http.StatusOK {
+		t.Fatalf("unexpected status: %d", resp.StatusCode)
+	}
+	var body struct {
+		Entries []atlEntry `json:"entries"`
+	}
+	if err := json.NewDecoder(resp.Body).Decode(&body); err != nil {
+		t.Fatal(err)
+	}
+	return body.Entries
+}
+
+// go test -x -v
+func TestDashboardAuth_Unauthenticated(t *testing.T) {
+	for _, c := range []struct {
+		name string
+		auth func(req *http.Request)
+	}{
+		{"anonymous", nil},
+		{"wrong password", basicAuth(testutil.DASHBOARD_ADMIN_USER, "wrong")},
+		{"unknown user", basicAuth("unknown", testutil.DASHBOARD_ADMIN_PASSWORD)},
+		{"wrong token", bearerAuth("wrong")},
+	} {
+		t.Run(c.name, func(t *testing.T) {
+			resp := request(t, http.MethodGet, ATL_URL, c.auth)
+			if resp.StatusCode != http.StatusUnauthorized {
+				t.Fatalf("expected 401, got %d", resp.StatusCode)
+			}
+			if !strings.HasPrefix(resp.Header.Get("WWW-Authenticate"), "Basic ") {
+				t.Fatalf("unexpected WWW-Authenticate: %q", resp.Header.Get("WWW-Authenticate"))
+			}
+		})
+	}
+}
+
+// go test -x -v
+func TestDashboardAuth_Roles(t *testing.T) {
+	topic := testutil.SAMPLE_TOPIC_PUBSUB
+	testutil.LoadClientConfig(t)
+	fetchReq := testutil.PrepareFetchReq(false, types.PAYLOAD_AEAD_NONE)
+	testutil.RemoveTokenFile(topic, *fetchReq)
+	defer testutil.RemoveTokenFile(topic, *fetchReq)
+	testutil.GetTokenTest(t, topic, *fetchReq, true)
+
+	viewer := basicAuth(testutil.DASHBOARD_VIEWER_USER, testutil.DASHBOARD_VIEWER_PASSWORD)
+	entries := listATL(t, viewer, topic)
+	if len(entries) == 0 {
+		t.Fatal("issued entry not listed")
+	}
+	for _, entry := range entries {
+		if entry.CurrentRandomData != "" {
+			t.Fatal("current random data shown to readonly user")
+		}
+	}
+	if resp := request(t, http.MethodDelete, ATL_URL+"/"+entries[0].ID, viewer); resp.StatusCode != http.StatusForbidden {
+		t.Fatalf("expected 403 on revocation by readonly user, got %d", resp.StatusCode)
+	}
+
+	for name, admin := range map[string]func(req *http.Request){
+		"basic":  basicAuth(testutil.DASHBOARD_ADMIN_USER, testutil.DASHBOARD_ADMIN_PASSWORD),
+		"bearer": bearerAuth(testutil.DASHBOARD_ADMIN_TOKEN),
+	} {
+		t.Run(name, func(t *testing.T) {
+			entries := listATL(t, admin, topic)
+			if len(entries) == 0 || entries[len(entries)-1].CurrentRandomData == "" {
+				t.Fatal("current random data not shown to admin")
+			}
+		})
+	}
+}
+
+// go test -x -v
+func TestDashboardAuth_HTMLHidesRandomData(t *testing.T) {
+	topic := testutil.SAMPLE_TOPIC_PUBSUB
+	testutil.LoadClientConfig(t)
+	fetchReq := testutil.PrepareFetchReq(false, types.PAYLOAD_AEAD_NONE)
+	testutil.RemoveTokenFile(topic, *fetchReq)
+	defer testutil.RemoveTokenFile(topic, *fetchReq)
+	testutil.GetTokenTest(t, topic, *fetchReq, true)
+
+	resp := request(t, http.MethodGet, testutil.ADDR_DASHBOARD+"/", basicAuth(testutil.DASHBOARD_VIEWER_USER, testutil.DASHBOARD_VIEWER_PASSWORD))
+	if resp.StatusCode != http.StatusOK {
+		t.Fatalf("unexpected status: %d", resp.StatusCode)
+	}
+	body, err := io.ReadAll(resp.Body)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !strings.Contains(string(body), "(hidden)") {
+		t.Fatal("current random data not hidden from readonly user")
+	}
+}
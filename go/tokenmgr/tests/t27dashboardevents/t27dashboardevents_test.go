@@ -0,0 +1,170 @@
+package t27dashboardevents
+
+import (
+	"bufio"
+	"encoding/json"
+	"mqttmtd/tokenmgr/tests/testutil"
+	"mqttmtd/types"
+	"net/http"
+	"net/url"
+	"strings"
+	"testing"
+	"time"
+)
+
+const (
+	API_URL    = testutil.ADDR_DASHBOARD + "/api/v1"
+	EVENTS_URL = API_URL + "/events"
+
+	EVENT_TIMEOUT = 5 * time.Second
+)
+
+type event struct {
+	Seq        uint64 `json:"seq"`
+	Kind       string `json:"kind"`
+	ID         string `json:"id"`
+	Topic      string `json:"topic"`
+	Access     string `json:"access"`
+	TokenIndex uint16 `json:"tokenindex"`
+	Reason     string `json:"reason"`
+}
+
+func adminRequest(t *testing.T, method string, url string) *http.Response {
+	req, err := http.NewRequest(method, url, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	req.SetBasicAuth(testutil.DASHBOARD_ADMIN_USER, testutil.DASHBOARD_ADMIN_PASSWORD)
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { resp.Body.Close() })
+	return resp
+}
+
+// Events of the stream, including the history, until the test ends
+func subscribe(t *testing.T) <-chan event {
+	resp := adminRequest(t, http.MethodGet, EVENTS_URL)
+	if resp.StatusCode != http.StatusOK {
+		t.Fatalf("unexpected status: %d", resp.StatusCode)
+	}
+	if contentType := resp.Header.Get("Content-Type"); contentType != "text/event-stream" {
+		t.Fatalf("unexpected content type: %s", contentType)
+	}
+	events := make(chan event, 1024)
+	go func() {
+		defer close(events)
+		var (
+			scanner = bufio.NewScanner(resp.Body)
+			name    string
+		)
+		for scanner.Scan() {
+			line := scanner.Text()
+			if v, found := strings.CutPrefix(line, "event: "); found {
+				name = v
+			} else if v, found := strings.CutPrefix(line, "data: "); found {
+				var e event
+				if err := json.Unmarshal([]byte(v), &e); err != nil || e.Kind != name {
+					t.Errorf("malformed event %q: %v", line, err)
+					return
+				}
+				events <- e
+			}
+		}
+	}()
+	return events
+}
+
+// Next event of the entry, skipping the others
+func nextEvent(t *testing.T, events <-chan event, id string) event {
+	timeout := time.After(EVENT_TIMEOUT)
+	for {
+		select {
+		case e, ok := <-events:
+			if !ok {
+				t.Fatal("event stream closed")
+			}
+			if e.ID == id {
+				return e
+			}
+		case <-timeout:
+			t.Fatalf("no event of %s", id)
+		}
+	}
+}
+
+// ID of the newest entry of the topic and access
+func entryID(t *testing.T, topic string, access string) string {
+	resp := adminRequest(t, http.MethodGet, API_URL+"/atl?"+url.Values{"topic": {topic}, "access": {access}, "cover": {"false"}}.Encode())
+	var body struct {
+		Entries []struct {
+			ID string `json:"id"`
+		} `json:"entries"`
+	}
+	if err := json.NewDecoder(resp.Body).Decode(&body); err != nil {
+		t.Fatal(err)
+	}
+	if len(body.Entries) == 0 {
+		t.Fatal("issued entry not listed")
+	}
+	return body.Entries[len(body.Entries)-1].ID
+}
+
+// go test -x -v
+func TestDashboardEvents_Unauthenticated(t *testing.T) {
+	resp, err := http.Get(EVENTS_URL)
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusUnauthorized {
+		t.Fatalf("expected 401, got %d", resp.StatusCode)
+	}
+}
+
+// go test -x -v
+func TestDashboardEvents_Lifecycle(t *testing.T) {
+	events := subscribe(t)
+	topic := testutil.SAMPLE_TOPIC_PUB
+	testutil.LoadClientConfig(t)
+	fetchReq := testutil.PrepareFetchReq(true, types.PAYLOAD_AEAD_NONE)
+	testutil.RemoveTokenFile(topic, *fetchReq)
+	defer testutil.RemoveTokenFile(topic, *fetchReq)
+	_, _, token := testutil.GetTokenTest(t, topic, *fetchReq, true)
+	id := entryID(t, topic, "pub")
+
+	if e := nextEvent(t, events, id); e.Kind != "issue" || e.Topic != topic || e.Access != "pub" || e.TokenIndex != 0 {
+		t.Fatalf("unexpected event: %+v", e)
+	}
+	testutil.AutopahoPublish(t, token, []byte("TestDashboardEvents_Lifecycle"), types.PAYLOAD_AEAD_NONE, nil, 0)
+	if e := nextEvent(t, events, id); e.Kind != "advance" || e.TokenIndex != 1 {
+		t.Fatalf("unexpected event: %+v", e)
+	}
+	if resp := adminRequest(t, http.MethodDelete, API_URL+"/atl/"+id); resp.StatusCode != http.StatusOK {
+		t.Fatalf("unexpected status: %d", resp.StatusCode)
+	}
+	if e := nextEvent(t, events, id); e.Kind != "revoke" || e.Reason != "admin" {
+		t.Fatalf("unexpected event: %+v", e)
+	}
+}
+
+// go test -x -v
+func TestDashboardEvents_Suspicious(t *testing.T) {
+	events := subscribe(t)
+	topic := testutil.SAMPLE_TOPIC_SUB
+	testutil.LoadClientConfig(t)
+	fetchReq := testutil.PrepareFetchReq(false, types.PAYLOAD_AEAD_NONE)
+	testutil.RemoveTokenFile(topic, *fetchReq)
+	defer testutil.RemoveTokenFile(topic, *fetchReq)
+	_, _, token := testutil.GetTokenTest(t, topic, *fetchReq, true)
+	id := entryID(t, topic, "sub")
+
+	if e := nextEvent(t, events, id); e.Kind != "issue" {
+		t.Fatalf("unexpected event: %+v", e)
+	}
+	testutil.AutopahoPublish(t, token, []byte("TestDashboardEvents_Suspicious"), types.PAYLOAD_AEAD_NONE, nil, 0)
+	if e := nextEvent(t, events, id); e.Kind != "suspicious" || e.Reason != "access type mismatch" {
+		t.Fatalf("unexpected event: %+v", e)
+	}
+}
@@ -0,0 +1,148 @@
+package t28acetoken
+
+import (
+	"bytes"
+	"encoding/base64"
+	"fmt"
+	"io"
+	"mqttmtd/consts"
+	"mqttmtd/tokenmgr/tests/testutil"
+	"mqttmtd/types"
+	"net/http"
+	"testing"
+)
+
+// Parameters of ACE token requests and responses, see issuerAce.go
+const (
+	ACE_PARAM_ACCESS_TOKEN = 1
+	ACE_PARAM_SCOPE        = 9
+	ACE_PARAM_ERROR        = 30
+	ACE_PARAM_GRANT_TYPE   = 33
+	ACE_PARAM_NUM_TOKENS   = -65537
+	ACE_PARAM_TOKEN_FORMAT = -65539
+	ACE_PARAM_TIMESTAMP    = -65541
+	ACE_PARAM_RANDOM_BYTES = -65542
+	ACE_PARAM_CWT_TOKENS   = -65544
+
+	ACE_GRANT_TYPE_PASSWORD           = 1
+	ACE_GRANT_TYPE_CLIENT_CREDENTIALS = 2
+
+	ACE_ERROR_INVALID_REQUEST        = 1
+	ACE_ERROR_UNSUPPORTED_GRANT_TYPE = 5
+	ACE_ERROR_INVALID_SCOPE          = 6
+
+	ACE_CONTENT_FORMAT           = "application/ace+cbor"
+	FIRST_BYTE_PUBLISH_QOS1 byte = 0x32
+)
+
+// pushd ../../certcreate; ./generate_certs.sh -c ../certs; popd
+// set ports.ace of the server conf, and filepaths.cwtkey for TestAce_CWT
+// go test -x -v
+func TestAce_Pub(t *testing.T) {
+	response := requestToken(t, http.StatusCreated, "pub:"+testutil.SAMPLE_TOPIC_PUB, ACE_GRANT_TYPE_CLIENT_CREDENTIALS, consts.TOKEN_NUM_MULTIPLIER, types.TokenFormatRandomBytes)
+
+	// access_token is the first token of the batch
+	accessToken := cborBytes(t, response, ACE_PARAM_ACCESS_TOKEN)
+	timestamp, randomBytes := cborBytes(t, response, ACE_PARAM_TIMESTAMP), cborBytes(t, response, ACE_PARAM_RANDOM_BYTES)
+	if len(randomBytes) != consts.TOKEN_NUM_MULTIPLIER*consts.RANDOM_BYTES_LEN {
+		testutil.Fatal(t, fmt.Errorf("unexpected length of random bytes: %d", len(randomBytes)))
+	}
+	if !bytes.Equal(accessToken, append(bytes.Clone(timestamp), randomBytes[:consts.RANDOM_BYTES_LEN]...)) {
+		testutil.Fatal(t, fmt.Errorf("access_token is not the first token: %x", accessToken))
+	}
+
+	// Accepted by MQTT Interface
+	conn := testutil.ConnectV5Raw(t, nil)
+	defer conn.Close()
+	testutil.WriteRawPacket(t, conn, FIRST_BYTE_PUBLISH_QOS1, testutil.NewPublish(base64.URLEncoding.EncodeToString(accessToken), 1, nil, []byte("TestAce_Pub")))
+	testutil.ExpectPubResponse(t, testutil.ReadRawPacket(t, conn), 0x40, 1, false)
+}
+
+func TestAce_Sub(t *testing.T) {
+	response := requestToken(t, http.StatusCreated, "sub:"+testutil.SAMPLE_TOPIC_SUB, ACE_GRANT_TYPE_CLIENT_CREDENTIALS, consts.TOKEN_NUM_MULTIPLIER, types.TokenFormatRandomBytes)
+
+	conn := testutil.ConnectV5Raw(t, nil)
+	defer conn.Close()
+	testutil.SubscribeRaw(t, conn, 1, base64.URLEncoding.EncodeToString(cborBytes(t, response, ACE_PARAM_ACCESS_TOKEN)), nil)
+}
+
+func TestAce_InvalidRequests(t *testing.T) {
+	for _, c := range []struct {
+		name          string
+		scope         string
+		grantType     int64
+		numTokens     int64
+		expectedError uint64
+	}{
+		{"scope without access type", testutil.SAMPLE_TOPIC_PUB, ACE_GRANT_TYPE_CLIENT_CREDENTIALS, consts.TOKEN_NUM_MULTIPLIER, ACE_ERROR_INVALID_SCOPE},
+		{"scope not in acl", "pub:" + testutil.SAMPLE_TOPIC_SUB, ACE_GRANT_TYPE_CLIENT_CREDENTIALS, consts.TOKEN_NUM_MULTIPLIER, ACE_ERROR_INVALID_SCOPE},
+		{"password grant", "pub:" + testutil.SAMPLE_TOPIC_PUB, ACE_GRANT_TYPE_PASSWORD, consts.TOKEN_NUM_MULTIPLIER, ACE_ERROR_UNSUPPORTED_GRANT_TYPE},
+		{"tokens not a multiple", "pub:" + testutil.SAMPLE_TOPIC_PUB, ACE_GRANT_TYPE_CLIENT_CREDENTIALS, consts.TOKEN_NUM_MULTIPLIER + 1, ACE_ERROR_INVALID_REQUEST},
+		{"too many tokens", "pub:" + testutil.SAMPLE_TOPIC_PUB, ACE_GRANT_TYPE_CLIENT_CREDENTIALS, 0x20 * consts.TOKEN_NUM_MULTIPLIER, ACE_ERROR_INVALID_REQUEST},
+	} {
+		response := requestToken(t, http.StatusBadRequest, c.scope, c.grantType, c.numTokens, types.TokenFormatRandomBytes)
+		if aceError, _ := types.CBORMapGet(response, ACE_PARAM_ERROR); aceError != c.expectedError {
+			testutil.Fatal(t, fmt.Errorf("%s: unexpected error: %v", c.name, aceError))
+		}
+	}
+}
+
+func TestAce_CWT(t *testing.T) {
+	response := requestToken(t, http.StatusCreated, "pub:"+testutil.SAMPLE_TOPIC_PUB, ACE_GRANT_TYPE_CLIENT_CREDENTIALS, consts.TOKEN_NUM_MULTIPLIER, types.TokenFormatCWT)
+
+	cwtTokens, _ := types.CBORMapGet(response, ACE_PARAM_CWT_TOKENS)
+	tokens, ok := cwtTokens.([]any)
+	if !ok || len(tokens) != consts.TOKEN_NUM_MULTIPLIER {
+		testutil.Fatal(t, fmt.Errorf("unexpected cwt tokens: %v", cwtTokens))
+	}
+	if first, _ := tokens[0].([]byte); !bytes.Equal(cborBytes(t, response, ACE_PARAM_ACCESS_TOKEN), first) {
+		testutil.Fatal(t, fmt.Errorf("access_token is not the first cwt token"))
+	}
+}
+
+// POST of a token request over mTLS, expected to be answered with status
+func requestToken(tb testing.TB, status int, scope string, grantType int64, numTokens int64, tokenFormat types.TokenFormat) (response map[any]any) {
+	body := types.CBORAppendMapHead(nil, 4)
+	body = types.CBORAppendInt(body, ACE_PARAM_GRANT_TYPE)
+	body = types.CBORAppendInt(body, grantType)
+	body = types.CBORAppendInt(body, ACE_PARAM_SCOPE)
+	body = types.CBORAppendText(body, scope)
+	body = types.CBORAppendInt(body, ACE_PARAM_NUM_TOKENS)
+	body = types.CBORAppendInt(body, numTokens)
+	body = types.CBORAppendInt(body, ACE_PARAM_TOKEN_FORMAT)
+	body = types.CBORAppendInt(body, int64(tokenFormat))
+
+	client := &http.Client{Transport: &http.Transport{TLSClientConfig: testutil.ClientTLSConfig(tb, true)}}
+	resp, err := client.Post(testutil.ADDR_ACE+"/token", ACE_CONTENT_FORMAT, bytes.NewReader(body))
+	if err != nil {
+		testutil.Fatal(tb, err)
+	}
+	defer resp.Body.Close()
+	respBody, err := io.ReadAll(resp.Body)
+	if err != nil {
+		testutil.Fatal(tb, err)
+	}
+	if resp.StatusCode != status {
+		testutil.Fatal(tb, fmt.Errorf("unexpected status: %s %x", resp.Status, respBody))
+	}
+	if contentType := resp.Header.Get("Content-Type"); contentType != ACE_CONTENT_FORMAT {
+		testutil.Fatal(tb, fmt.Errorf("unexpected content type: %s", contentType))
+	}
+	decoded, _, err := types.CBORDecode(respBody)
+	if err != nil {
+		testutil.Fatal(tb, err)
+	}
+	if response, _ = decoded.(map[any]any); response == nil {
+		testutil.Fatal(tb, fmt.Errorf("response is not a map: %x", respBody))
+	}
+	return
+}
+
+func cborBytes(tb testing.TB, m map[any]any, key int64) []byte {
+	v, _ := types.CBORMapGet(m, key)
+	b, ok := v.([]byte)
+	if !ok {
+		testutil.Fatal(tb, fmt.Errorf("parameter %d is not a byte string: %v", key, v))
+	}
+	return b
+}
@@ -0,0 +1,146 @@
+package t29upstream
+
+import (
+	"bytes"
+	"encoding/binary"
+	"fmt"
+	"mqttmtd/tokenmgr/tests/testutil"
+	"net"
+	"testing"
+	"time"
+)
+
+// mqttinterface.upstream.brokers of the server conf, in this order
+var UPSTREAM_BROKER_ADDRS = []string{"127.0.0.1:11884", "127.0.0.1:11885"}
+
+const (
+	REASON_CODE_SERVER_UNAVAILABLE byte = 0x88
+	REASON_CODE_SERVER_BUSY        byte = 0x89
+)
+
+// Broker answering every CONNECT with success, reporting its index on accepted when connected
+type fakeBroker struct {
+	index          int
+	listener       net.Listener
+	accepted       chan int
+	closeOnConnack bool
+}
+
+func startFakeBroker(tb testing.TB, index int, accepted chan int, closeOnConnack bool) *fakeBroker {
+	listener, err := net.Listen("tcp", UPSTREAM_BROKER_ADDRS[index])
+	if err != nil {
+		testutil.Fatal(tb, err)
+	}
+	broker := &fakeBroker{index: index, listener: listener, accepted: accepted, closeOnConnack: closeOnConnack}
+	go broker.serve()
+	tb.Cleanup(func() { listener.Close() })
+	return broker
+}
+
+func (b *fakeBroker) serve() {
+	for {
+		conn, err := b.listener.Accept()
+		if err != nil {
+			return
+		}
+		go func() {
+			defer conn.Close()
+			conn.SetReadDeadline(time.Now().Add(time.Second * 5))
+			if connect, err := testutil.TryReadRawPacket(conn); err != nil || connect[0] != 0x10 {
+				return
+			}
+			if _, err := conn.Write([]byte{0x20, 0x03, 0x00, 0x00, 0x00}); err != nil {
+				return
+			}
+			b.accepted <- b.index
+			if b.closeOnConnack {
+				return
+			}
+			for {
+				conn.SetReadDeadline(time.Now().Add(time.Second * 5))
+				if _, err := testutil.TryReadRawPacket(conn); err != nil {
+					return
+				}
+			}
+		}()
+	}
+}
+
+// Index of the fake broker that the last CONNECT reached, failing rather than waiting for one that another broker took
+func waitAccepted(tb testing.TB, accepted chan int) (index int) {
+	select {
+	case index = <-accepted:
+	case <-time.After(time.Second * 5):
+		testutil.Fatal(tb, fmt.Errorf("no fake broker connected, see mqttinterface.upstream of the server conf"))
+	}
+	return
+}
+
+// CONNECT of MQTT v5.0 to MQTT Interface, returning its CONNACK
+func connect(tb testing.TB) (conn net.Conn, connack []byte) {
+	conn = testutil.DialMqttInterface(tb)
+	connectVarHdr := []byte{0x00, 0x04, 'M', 'Q', 'T', 'T', 0x05, 0x02, 0x00, 0x3C, 0x00}
+	testutil.WriteRawPacket(tb, conn, 0x10, binary.BigEndian.AppendUint16(connectVarHdr, 0))
+	connack = testutil.ReadRawPacket(tb, conn)
+	return
+}
+
+// set mqttinterface.upstream of the server conf to brokers UPSTREAM_BROKER_ADDRS as tcp:// urls, with strategy: roundrobin
+// go test -x -v
+func TestUpstream_Failover(t *testing.T) {
+	// Only the second broker is alive, while round-robin starts from each of them in turn
+	accepted := make(chan int, 4)
+	startFakeBroker(t, 1, accepted, false)
+	for i := 0; i < 2; i++ {
+		conn, connack := connect(t)
+		defer conn.Close()
+		if len(connack) < 4 || connack[0] != 0x20 || connack[3] != 0x00 {
+			testutil.Fatal(t, fmt.Errorf("unexpected CONNACK: %x", connack))
+		}
+		if index := waitAccepted(t, accepted); index != 1 {
+			testutil.Fatal(t, fmt.Errorf("connected to broker %d", index))
+		}
+	}
+}
+
+func TestUpstream_NoBroker(t *testing.T) {
+	conn, connack := connect(t)
+	defer conn.Close()
+	if !bytes.Equal(connack, []byte{0x20, 0x03, 0x00, REASON_CODE_SERVER_UNAVAILABLE, 0x00}) {
+		testutil.Fatal(t, fmt.Errorf("unexpected CONNACK: %x", connack))
+	}
+}
+
+func TestUpstream_BrokerLost(t *testing.T) {
+	// Lost after its CONNACK is forwarded
+	accepted := make(chan int, 4)
+	startFakeBroker(t, 0, accepted, true)
+	startFakeBroker(t, 1, accepted, true)
+	conn, connack := connect(t)
+	defer conn.Close()
+	if len(connack) < 4 || connack[0] != 0x20 || connack[3] != 0x00 {
+		testutil.Fatal(t, fmt.Errorf("unexpected CONNACK: %x", connack))
+	}
+	if disconnect := testutil.ReadRawPacket(t, conn); !bytes.Equal(disconnect, []byte{0xE0, 0x02, REASON_CODE_SERVER_BUSY, 0x00}) {
+		testutil.Fatal(t, fmt.Errorf("unexpected DISCONNECT: %x", disconnect))
+	}
+}
+
+func TestUpstream_RoundRobin(t *testing.T) {
+	accepted := make(chan int, 4)
+	startFakeBroker(t, 0, accepted, false)
+	startFakeBroker(t, 1, accepted, false)
+	previous := -1
+	for i := 0; i < 4; i++ {
+		conn, connack := connect(t)
+		defer conn.Close()
+		if len(connack) < 4 || connack[0] != 0x20 || connack[3] != 0x00 {
+			testutil.Fatal(t, fmt.Errorf("unexpected CONNACK: %x", connack))
+		}
+		index := waitAccepted(t, accepted)
+		if index == previous {
+			testutil.Fatal(t, fmt.Errorf("connected to broker %d twice in a row", index))
+		}
+		previous = index
+	}
+}
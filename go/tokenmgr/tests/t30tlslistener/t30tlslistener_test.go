@@ -0,0 +1,64 @@
+package t30tlslistener
+
+import (
+	"crypto/tls"
+	"encoding/binary"
+	"fmt"
+	"mqttmtd/tokenmgr/tests/testutil"
+	"net"
+	"strings"
+	"testing"
+	"time"
+)
+
+const (
+	// ports.mqttinterfacetls of the server conf
+	ADDR_MQTT_INTERFACE_TLS string = "server:8884"
+
+	FIRST_BYTE_PUBLISH_QOS1 byte = 0x32
+)
+
+// CONNECT of MQTT v5.0 over TLS, returning the CONNACK or the error reading it
+func connectTLS(tb testing.TB, withClientCert bool) (conn net.Conn, connack []byte, err error) {
+	if conn, err = tls.Dial("tcp", ADDR_MQTT_INTERFACE_TLS, testutil.ClientTLSConfig(tb, withClientCert)); err != nil {
+		return
+	}
+	connectVarHdr := []byte{0x00, 0x04, 'M', 'Q', 'T', 'T', 0x05, 0x02, 0x00, 0x3C, 0x00}
+	if _, err = conn.Write(testutil.EncodeRawPacket(0x10, binary.BigEndian.AppendUint16(connectVarHdr, 0))); err != nil {
+		return
+	}
+	conn.SetReadDeadline(time.Now().Add(time.Second * 5))
+	connack, err = testutil.TryReadRawPacket(conn)
+	return
+}
+
+// pushd ../../certcreate; ./generate_certs.sh -c ../certs; popd
+// set ports.mqttinterfacetls, and mqttinterface.tlsclientauth to require of the server conf
+// go test -x -v
+func TestTLS_Connect(t *testing.T) {
+	conn, connack, err := connectTLS(t, true)
+	if err != nil {
+		testutil.Fatal(t, err)
+	}
+	defer conn.Close()
+	if len(connack) < 4 || connack[0] != 0x20 || connack[3] != 0x00 {
+		testutil.Fatal(t, fmt.Errorf("unexpected CONNACK: %x", connack))
+	}
+
+	// Tokens are verified as on plain TCP
+	testutil.WriteRawPacket(t, conn, FIRST_BYTE_PUBLISH_QOS1, testutil.NewPublish(testutil.NewTokenB64(t, testutil.SAMPLE_TOPIC_PUB, true, false), 1, nil, []byte("TestTLS_Connect")))
+	testutil.ExpectPubResponse(t, testutil.ReadRawPacket(t, conn), 0x40, 1, false)
+}
+
+func TestTLS_RequireWithoutClientCert(t *testing.T) {
+	// With TLS 1.3, the server rejects the certificate after the client finishes its handshake
+	conn, connack, err := connectTLS(t, false)
+	if conn != nil {
+		defer conn.Close()
+	}
+	if err == nil {
+		testutil.Fatal(t, fmt.Errorf("connected without a client certificate: %x", connack))
+	} else if !strings.Contains(err.Error(), "certificate required") {
+		testutil.Fatal(t, fmt.Errorf("unexpected error: %w", err))
+	}
+}
@@ -3,12 +3,19 @@ package testutil
 import (
 	"bytes"
 	"context"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
 	"encoding/base64"
+	"encoding/binary"
+	"errors"
 	"fmt"
+	"io"
 	"mqttmtd/config"
 	"mqttmtd/consts"
 	"mqttmtd/tokenmgr"
 	"mqttmtd/types"
+	"net"
 	"net/url"
 	"os"
 	"reflect"
@@ -30,7 +37,21 @@ const (
 	// if server uses mDNS
 	// ADDR_MQTT_INTERFACE string = "mqtt://server.local:1883"
 	// else (like docker)
-	ADDR_MQTT_INTERFACE string = "mqtt://server:1883"
+	ADDR_MQTT_INTERFACE    string = "mqtt://server:1883"
+	ADDR_MQTT_INTERFACE_WS string = "ws://server:8083/mqtt"
+	ADDR_HTTP_AUTH         string = "http://server:8081"
+	ADDR_DASHBOARD         string = "http://server:8080"
+	ADDR_ACE               string = "https://server:18443"
+
+	// Credentials of dashboard.users in the server conf
+	DASHBOARD_ADMIN_USER      string = "admin"
+	DASHBOARD_ADMIN_PASSWORD  string = "admin"
+	DASHBOARD_VIEWER_USER     string = "viewer"
+	DASHBOARD_VIEWER_PASSWORD string = "viewer"
+	DASHBOARD_ADMIN_TOKEN     string = "mqttmtd-dashboard-token"
+
+	ADDR_METRICS_AUTHSERVER     string = "http://server:9100/metrics"
+	ADDR_METRICS_MQTT_INTERFACE string = "http://server:9101/metrics"
 
 	// CONFIG_FILEPATH string = "/Users/kentarou/git/research-mqtt-mtd/go/config/client_conf.yml"
 	// CONFIG_FILEPATH string = "/Users/kentarou/git/research-mqtt-mtd/go/config/client_conf.yml"
@@ -38,13 +59,18 @@ const (
 )
 
 var (
-	NumTokens uint16 = 0x10 * 16
+	NumTokens         uint16 = 0x10 * 16
+	MqttInterfaceAddr string = ADDR_MQTT_INTERFACE
 )
 
 func SetNumTokens(numTokens uint16) {
 	NumTokens = numTokens
 }
 
+func SetMqttInterfaceAddr(addr string) {
+	MqttInterfaceAddr = addr
+}
+
 func Fatal(tb testing.TB, err error) {
 	fmt.Printf("%v\n", err)
 	tb.Fatal()
@@ -163,14 +189,13 @@ func AutopahoPublish(tb testing.TB, token []byte, msg []byte, aeadType types.Pay
 	if b, ok := tb.(*testing.B); ok {
 		b.StartTimer()
 	}
-	b64Encoded := make([]byte, consts.TOKEN_SIZE/3*4)
-	base64.URLEncoding.Encode(b64Encoded, token)
+	b64Encoded := base64.URLEncoding.EncodeToString(token)
 
 	if b, ok := tb.(*testing.B); ok {
 		b.StopTimer()
 	}
 
-	u, err := url.Parse(ADDR_MQTT_INTERFACE)
+	u, err := url.Parse(MqttInterfaceAddr)
 	if err != nil {
 		Fatal(tb, err)
 	}
@@ -229,7 +254,7 @@ func AutopahoPublish(tb testing.TB, token []byte, msg []byte, aeadType types.Pay
 		// Payload AEAD Encryption Enabled
 		if _, err = cm.Publish(ctx, &paho.Publish{
 			QoS:     0,
-			Topic:   string(b64Encoded),
+			Topic:   b64Encoded,
 			Payload: sealMessage(tb, aeadType, encKey, tokenIndex, msg),
 		}); err != nil {
 			if ctx.Err() == nil {
@@ -240,7 +265,7 @@ func AutopahoPublish(tb testing.TB, token []byte, msg []byte, aeadType types.Pay
 		// Payload AEAD Encryption Disabled
 		if _, err = cm.Publish(ctx, &paho.Publish{
 			QoS:     0,
-			Topic:   string(b64Encoded),
+			Topic:   b64Encoded,
 			Payload: msg,
 		}); err != nil {
 			if ctx.Err() == nil {
@@ -255,19 +280,27 @@ func AutopahoPublish(tb testing.TB, token []byte, msg []byte, aeadType types.Pay
 }
 
 func AutopahoSubscribe(tb testing.TB, token []byte, isErrorExpected bool, subscribeChan chan struct{}, waitForPublish []byte, aeadType types.PayloadAEADType, encKey []byte) {
+	autopahoSubscribe(tb, token, isErrorExpected, subscribeChan, waitForPublish, aeadType, encKey, false)
+}
+
+// Same as AutopahoSubscribe, but encKey is used as the chain key of the payload key ratchet
+func AutopahoSubscribeRatchet(tb testing.TB, token []byte, isErrorExpected bool, subscribeChan chan struct{}, waitForPublish []byte, aeadType types.PayloadAEADType, encKey []byte) {
+	autopahoSubscribe(tb, token, isErrorExpected, subscribeChan, waitForPublish, aeadType, encKey, true)
+}
+
+func autopahoSubscribe(tb testing.TB, token []byte, isErrorExpected bool, subscribeChan chan struct{}, waitForPublish []byte, aeadType types.PayloadAEADType, encKey []byte, keyRatchet bool) {
 	var pubSeqNum uint64 = 0
 
 	if b, ok := tb.(*testing.B); ok {
 		b.StartTimer()
 	}
-	b64Encoded := make([]byte, consts.TOKEN_SIZE/3*4)
-	base64.URLEncoding.Encode(b64Encoded, token)
+	b64Encoded := base64.URLEncoding.EncodeToString(token)
 
 	if b, ok := tb.(*testing.B); ok {
 		b.StopTimer()
 	}
 
-	u, err := url.Parse(ADDR_MQTT_INTERFACE)
+	u, err := url.Parse(MqttInterfaceAddr)
 	if err != nil {
 		Fatal(tb, err)
 	}
@@ -284,7 +317,17 @@ func AutopahoSubscribe(tb testing.TB, token []byte, isErrorExpected bool, subscr
 	received := make(chan struct{})
 	onPublishReceivedFunc := func(pr paho.PublishReceived) (bool, error) {
 		if aeadType.IsEncryptionEnabled() {
-			opened := openMessage(tb, aeadType, encKey, pubSeqNum, pr.Packet.Payload)
+			msgKey := encKey
+			if keyRatchet {
+				var err error
+				if msgKey, err = aeadType.RatchetPayloadKey(encKey, pubSeqNum); err != nil {
+					Fatal(tb, err)
+				}
+			}
+			opened := openMessage(tb, aeadType, msgKey, pubSeqNum, pr.Packet.Payload)
+			if keyRatchet {
+				pubSeqNum++
+			}
 			fmt.Printf("received sealed message on topic \"%s\"; body: %s (retain: %t)\n", pr.Packet.Topic, opened, pr.Packet.Retain)
 			if bytes.Equal(opened, waitForPublish) {
 				received <- struct{}{}
@@ -344,7 +387,7 @@ func AutopahoSubscribe(tb testing.TB, token []byte, isErrorExpected bool, subscr
 	if _, err = cm.Subscribe(ctx, &paho.Subscribe{
 		Subscriptions: []paho.SubscribeOptions{{
 			QoS:   0,
-			Topic: string(b64Encoded),
+			Topic: b64Encoded,
 		}},
 	}); err != nil {
 		if ctx.Err() == nil && !isErrorExpected {
@@ -382,6 +425,28 @@ func LoadClientConfig(tb testing.TB) {
 	}
 }
 
+// TLS of the client conf, presenting its certificate to the server if withClientCert
+func ClientTLSConfig(tb testing.TB, withClientCert bool) (tlsConf *tls.Config) {
+	LoadClientConfig(tb)
+	caCert, err := os.ReadFile(config.Client.Certs.CaCertFilePath)
+	if err != nil {
+		Fatal(tb, err)
+	}
+	tlsConf = &tls.Config{
+		RootCAs:    x509.NewCertPool(),
+		ServerName: "server.local",
+	}
+	tlsConf.RootCAs.AppendCertsFromPEM(caCert)
+	if withClientCert {
+		cert, err := tls.LoadX509KeyPair(config.Client.Certs.ClientCertFilePath, config.Client.Certs.ClientKeyFilePath)
+		if err != nil {
+			Fatal(tb, err)
+		}
+		tlsConf.Certificates = []tls.Certificate{cert}
+	}
+	return
+}
+
 func RemoveTokenFile(topic string, fetchReq tokenmgr.FetchRequest) {
 	var accessTypeStr string
 	if fetchReq.AccessTypeIsPub {
@@ -389,6 +454,9 @@ func RemoveTokenFile(topic string, fetchReq tokenmgr.FetchRequest) {
 	} else {
 		accessTypeStr = "SUB"
 	}
+	if fetchReq.CoverTraffic {
+		accessTypeStr = "COVER" + accessTypeStr
+	}
 	tokenFilePath := config.Client.FilePaths.TokensDirPath + accessTypeStr + base64.URLEncoding.EncodeToString(unsafe.Slice(unsafe.StringData(topic), len(topic)))
 	os.Remove(tokenFilePath)
 }
@@ -406,7 +474,7 @@ func GetTokenTest(tb testing.TB, topic string, fetchReq tokenmgr.FetchRequest, e
 		if err != nil {
 			Fatal(tb, err)
 		}
-		if len(token) != consts.TOKEN_SIZE {
+		if (fetchReq.TokenFormat == types.TokenFormatCWT && len(token) == consts.TOKEN_SIZE) || (fetchReq.TokenFormat != types.TokenFormatCWT && len(token) != consts.TOKEN_SIZE) {
 			Fatal(tb, fmt.Errorf("length invalid"))
 		}
 		if (fetchReq.PayloadAEADType.IsEncryptionEnabled() && encKey == nil) || (!fetchReq.PayloadAEADType.IsEncryptionEnabled() && encKey != nil) {
@@ -414,10 +482,184 @@ func GetTokenTest(tb testing.TB, topic string, fetchReq tokenmgr.FetchRequest, e
 		}
 		return
 	} else {
-		if err == nil && len(token) == consts.TOKEN_SIZE &&
+		if err == nil && len(token) > 0 &&
 			((fetchReq.PayloadAEADType.IsEncryptionEnabled() && encKey != nil) || (!fetchReq.PayloadAEADType.IsEncryptionEnabled() && encKey == nil)) {
 			Fatal(tb, fmt.Errorf("no error observed"))
 		}
 		return
 	}
 }
+
+// Raw MQTT packets on conn, for the flows paho does not expose
+func WriteRawPacket(tb testing.TB, conn net.Conn, firstByte byte, varHdrAndPayload []byte) {
+	if _, err := conn.Write(EncodeRawPacket(firstByte, varHdrAndPayload)); err != nil {
+		Fatal(tb, err)
+	}
+}
+
+func EncodeRawPacket(firstByte byte, varHdrAndPayload []byte) (packet []byte) {
+	packet = []byte{firstByte}
+	remainingLen := len(varHdrAndPayload)
+	for {
+		b := byte(remainingLen % 0x80)
+		if remainingLen /= 0x80; remainingLen > 0 {
+			b |= 0x80
+		}
+		packet = append(packet, b)
+		if remainingLen == 0 {
+			break
+		}
+	}
+	return append(packet, varHdrAndPayload...)
+}
+
+func ReadRawPacket(tb testing.TB, conn net.Conn) []byte {
+	conn.SetReadDeadline(time.Now().Add(time.Second * 5))
+	packet, err := TryReadRawPacket(conn)
+	if err != nil {
+		Fatal(tb, err)
+	}
+	return packet
+}
+
+// Next packet on conn within the read deadline already set on it, for reads expected to fail or to span packets
+func TryReadRawPacket(conn net.Conn) (packet []byte, err error) {
+	header := make([]byte, 1, 5)
+	if _, err = io.ReadFull(conn, header); err != nil {
+		return
+	}
+	remainingLen, multiplier := 0, 1
+	for {
+		b := make([]byte, 1)
+		if _, err = io.ReadFull(conn, b); err != nil {
+			return
+		}
+		header = append(header, b[0])
+		remainingLen += int(b[0]&0x7F) * multiplier
+		if b[0]&0x80 == 0 {
+			break
+		}
+		if multiplier *= 0x80; multiplier > 0x80*0x80*0x80 {
+			err = errors.New("malformed remaining length")
+			return
+		}
+	}
+	packet = make([]byte, len(header)+remainingLen)
+	copy(packet, header)
+	_, err = io.ReadFull(conn, packet[len(header):])
+	return
+}
+
+func SkipFixedHeader(packet []byte) (varHdrAndPayload []byte) {
+	offset := 1
+	for packet[offset]&0x80 != 0 {
+		offset++
+	}
+	return packet[offset+1:]
+}
+
+func DialMqttInterface(tb testing.TB) net.Conn {
+	u, err := url.Parse(ADDR_MQTT_INTERFACE)
+	if err != nil {
+		Fatal(tb, err)
+	}
+	conn, err := net.Dial("tcp", u.Host)
+	if err != nil {
+		Fatal(tb, err)
+	}
+	return conn
+}
+
+// MQTT v5.0 connection with clean start, keepalive 60, the CONNECT properties and an empty client id
+func ConnectV5Raw(tb testing.TB, properties []byte) net.Conn {
+	return ConnectV5RawWithClientID(tb, "", properties)
+}
+
+func ConnectV5RawWithClientID(tb testing.TB, clientID string, properties []byte) net.Conn {
+	conn := DialMqttInterface(tb)
+	connect := []byte{0x00, 0x04, 'M', 'Q', 'T', 'T', 0x05, 0x02, 0x00, 0x3C, byte(len(properties))}
+	connect = append(connect, properties...)
+	connect = binary.BigEndian.AppendUint16(connect, uint16(len(clientID)))
+	WriteRawPacket(tb, conn, 0x10, append(connect, clientID...))
+	if connack := ReadRawPacket(tb, conn); len(connack) < 4 || connack[0] != 0x20 || connack[3] != 0x00 {
+		Fatal(tb, fmt.Errorf("unexpected CONNACK: %x", connack))
+	}
+	return conn
+}
+
+// SUBSCRIBE of MQTT v5.0 at QoS 0
+func NewSubscribe(packetID uint16, filter string, properties []byte) (varHdrAndPayload []byte) {
+	varHdrAndPayload = binary.BigEndian.AppendUint16(nil, packetID)
+	varHdrAndPayload = append(varHdrAndPayload, byte(len(properties)))
+	varHdrAndPayload = append(varHdrAndPayload, properties...)
+	varHdrAndPayload = binary.BigEndian.AppendUint16(varHdrAndPayload, uint16(len(filter)))
+	return append(append(varHdrAndPayload, filter...), 0x00)
+}
+
+// NewSubscribe sent on conn, with its SUBACK expected to grant it
+func SubscribeRaw(tb testing.TB, conn net.Conn, packetID uint16, filter string, properties []byte) {
+	WriteRawPacket(tb, conn, 0x82, NewSubscribe(packetID, filter, properties))
+	if suback := ReadRawPacket(tb, conn); len(suback) < 5 || suback[0] != 0x90 || binary.BigEndian.Uint16(suback[2:4]) != packetID || suback[len(suback)-1] != 0x00 {
+		Fatal(tb, fmt.Errorf("unexpected SUBACK: %x", suback))
+	}
+}
+
+// Variable header and payload of PUBLISH of MQTT v5.0 at QoS 1 or 2
+func NewPublish(topic string, packetID uint16, properties []byte, payload []byte) (varHdrAndPayload []byte) {
+	varHdrAndPayload = binary.BigEndian.AppendUint16(nil, uint16(len(topic)))
+	varHdrAndPayload = append(varHdrAndPayload, topic...)
+	varHdrAndPayload = binary.BigEndian.AppendUint16(varHdrAndPayload, packetID)
+	varHdrAndPayload = append(varHdrAndPayload, byte(len(properties)))
+	varHdrAndPayload = append(varHdrAndPayload, properties...)
+	return append(varHdrAndPayload, payload...)
+}
+
+// PUBACK, PUBREC or PUBCOMP of packetID, either successful or with Not authorized
+func ExpectPubResponse(tb testing.TB, packet []byte, firstByte byte, packetID uint16, notAuthorized bool) {
+	if len(packet) < 4 || packet[0] != firstByte || binary.BigEndian.Uint16(packet[2:4]) != packetID {
+		Fatal(tb, fmt.Errorf("unexpected packet: %x", packet))
+	}
+	reasonCode := byte(0x00)
+	if len(packet) > 4 {
+		reasonCode = packet[4]
+	}
+	if (reasonCode == 0x87) != notAuthorized || (!notAuthorized && reasonCode != 0x00) {
+		Fatal(tb, fmt.Errorf("unexpected reason code: %x", packet))
+	}
+}
+
+// PUBLISH of MQTT v5.0 at QoS 0, as delivered to the QoS 0 subscriptions of the tests
+func ParseRawPublish(tb testing.TB, packet []byte) (topicName string, properties []byte, payload []byte) {
+	if len(packet) < 2 || packet[0]&0xF6 != 0x30 {
+		Fatal(tb, fmt.Errorf("unexpected packet: %x", packet))
+	}
+	varHdrAndPayload := SkipFixedHeader(packet)
+	topicLen := int(binary.BigEndian.Uint16(varHdrAndPayload))
+	topicName = string(varHdrAndPayload[2 : 2+topicLen])
+	varHdrAndPayload = varHdrAndPayload[2+topicLen:]
+	properties = varHdrAndPayload[1 : 1+int(varHdrAndPayload[0])]
+	payload = varHdrAndPayload[1+len(properties):]
+	return
+}
+
+// Token of the topic from tokenmgr, without payload encryption
+func NewToken(tb testing.TB, topic string, accessTypeIsPub bool, coverTraffic bool) []byte {
+	LoadClientConfig(tb)
+	fetchReq := PrepareFetchReq(accessTypeIsPub, types.PAYLOAD_AEAD_NONE)
+	fetchReq.CoverTraffic = coverTraffic
+	_, _, token := GetTokenTest(tb, topic, *fetchReq, true)
+	return token
+}
+
+func NewTokenB64(tb testing.TB, topic string, accessTypeIsPub bool, coverTraffic bool) string {
+	return base64.URLEncoding.EncodeToString(NewToken(tb, topic, accessTypeIsPub, coverTraffic))
+}
+
+// Random token of the right length that no ATL entry matches
+func InvalidToken(tb testing.TB) string {
+	token := make([]byte, consts.TOKEN_SIZE)
+	if _, err := rand.Read(token); err != nil {
+		Fatal(tb, err)
+	}
+	return base64.URLEncoding.EncodeToString(token)
+}
@@ -7,7 +7,6 @@ import (
 	"encoding/base64"
 	"encoding/binary"
 	"fmt"
-	"log"
 	"os"
 	"strings"
 	"unicode/utf8"
@@ -16,13 +15,49 @@ import (
 	"mqttmtd/config"
 	"mqttmtd/consts"
 	"mqttmtd/funcs"
+	"mqttmtd/logging"
 	"mqttmtd/types"
 )
 
+var logger = logging.For("tokenmgr")
+
 type FetchRequest struct {
-	NumTokens       uint16
-	AccessTypeIsPub bool
-	PayloadAEADType types.PayloadAEADType
+	NumTokens         uint16
+	AccessTypeIsPub   bool
+	PayloadAEADType   types.PayloadAEADType
+	PayloadKeyRatchet bool
+	TokenFormat       types.TokenFormat
+	CoverTraffic      bool // decoy tokens, whose messages are discarded by MQTT Interface, kept apart from the real ones
+	Padding           bool // receive the padding policy of the topic to pad payloads with (requires payload AEAD)
+}
+
+// Options of the issuer request for req, which token files keep next to the payload AEAD type
+func (req FetchRequest) issuerRequestOptions() (options types.IssuerRequestOptions) {
+	if req.PayloadKeyRatchet {
+		options |= types.OptionPayloadKeyRatchet
+	}
+	if req.CoverTraffic {
+		options |= types.OptionCoverTraffic
+	}
+	if req.Padding {
+		options |= types.OptionPadding
+	}
+	return options.WithTokenFormat(req.TokenFormat)
+}
+
+// Payload AEAD type and options of a token file, read from its first two bytes. found is false without a readable one
+func readTokenFileHeader(tokenFilePath string) (aeadType types.PayloadAEADType, options types.IssuerRequestOptions, found bool) {
+	tokenFile, err := os.Open(tokenFilePath)
+	if err != nil {
+		return
+	}
+	defer tokenFile.Close()
+
+	header := make([]byte, 2)
+	if n, err := tokenFile.Read(header); err != nil || n != 2 {
+		return
+	}
+	return types.PayloadAEADType(header[0]), types.IssuerRequestOptions(header[1]), true
 }
 
 func saveTokenInfo(issuerRequest types.IssuerRequest, issuerResponse types.IssuerResponse, tokenFilePath string) (err error) {
@@ -39,28 +74,36 @@ func saveTokenInfo(issuerRequest types.IssuerRequest, issuerResponse types.Issue
 	defer func() {
 		tokenFile.Close()
 		if !completed {
-			fmt.Println("Ended token saving incomplete : ", err)
+			logger.Warn("token saving incomplete", "err", err)
 			if err = os.Remove(tokenFilePath); err != nil {
-				fmt.Printf("failed removing file %s to recover from tokenFile creation failure: %v\n", tokenFilePath, err)
+				logger.Error("failed removing file to recover from token file creation failure", "path", tokenFilePath, "err", err)
 				return
 			}
 		}
 	}()
 
-	// Payload AEAD
+	// Payload AEAD and Options
 	buf := make([]byte, 2)
 	buf[0] = byte(issuerRequest.PayloadAEADType)
-	if _, err = tokenFile.Write(buf[:1]); err != nil {
-		return fmt.Errorf("failed writing aead type: %v", err)
+	buf[1] = byte(issuerRequest.Options)
+	if _, err = tokenFile.Write(buf); err != nil {
+		return fmt.Errorf("failed writing aead type and options: %v", err)
 	}
 	if issuerRequest.PayloadAEADType.IsEncryptionEnabled() {
-		// Encryption Key
+		// Encryption Key (initial chain key if the payload key ratchet is enabled)
 		if _, err = tokenFile.Write(issuerResponse.EncryptionKey); err != nil {
 			return fmt.Errorf("failed writing encryption key: %v", err)
 		}
 
+		// Padding Policy
+		if issuerRequest.Options&types.OptionPadding != 0 {
+			if _, err = tokenFile.Write(issuerResponse.Padding.AppendBytes(nil)); err != nil {
+				return fmt.Errorf("failed writing padding policy: %v", err)
+			}
+		}
+
 		// Token Index
-		binary.BigEndian.PutUint16(buf, uint16(issuerRequest.NumberOfTokensDividedByMultiplier*consts.TOKEN_NUM_MULTIPLIER))
+		binary.BigEndian.PutUint16(buf, 0)
 		if _, err = tokenFile.Write(buf); err != nil {
 			return fmt.Errorf("failed writing token index: %v", err)
 		}
@@ -79,7 +122,7 @@ func saveTokenInfo(issuerRequest types.IssuerRequest, issuerResponse types.Issue
 	return
 }
 
-func popTokenInfo(tokenFilePath string) (encKey []byte, tokenIndex uint16, token []byte, err error) {
+func popTokenInfo(tokenFilePath string) (encKey []byte, tokenIndex uint16, token []byte, padding types.PaddingPolicy, err error) {
 	var (
 		n               int
 		tokenFile       *os.File
@@ -89,7 +132,10 @@ func popTokenInfo(tokenFilePath string) (encKey []byte, tokenIndex uint16, token
 		tempFileRenamed bool = false
 
 		aeadType        types.PayloadAEADType
+		options         types.IssuerRequestOptions
 		aeadTypeBytes   []byte
+		storedKey       []byte
+		paddingBytes    []byte
 		tokenIndexBytes []byte
 		randomBytes     []byte
 	)
@@ -104,27 +150,28 @@ func popTokenInfo(tokenFilePath string) (encKey []byte, tokenIndex uint16, token
 			tokenFile.Close()
 		}
 		if !completed {
-			fmt.Println("Ended token popping incomplete : ", err)
+			logger.Warn("token popping incomplete", "err", err)
 			if err = os.Remove(tokenFilePath); err != nil {
-				fmt.Printf("failed removing file %s to recover from tokenFile creation failure: %v\n", tokenFilePath, err)
+				logger.Error("failed removing file to recover from token file creation failure", "path", tokenFilePath, "err", err)
 				return
 			}
 		}
 	}()
-	// Payload AEAD
-	aeadTypeBytes = make([]byte, 1)
+	// Payload AEAD and Options
+	aeadTypeBytes = make([]byte, 2)
 	if n, err = tokenFile.Read(aeadTypeBytes); err != nil {
-		err = fmt.Errorf("failed writing aead type: %v", err)
+		err = fmt.Errorf("failed reading aead type and options: %v", err)
 		goto popTokenInfoErr
-	} else if n != 1 {
-		err = fmt.Errorf("failed reading aead type, length too short")
+	} else if n != 2 {
+		err = fmt.Errorf("failed reading aead type and options, length too short")
 		goto popTokenInfoErr
 	}
 	aeadType = types.PayloadAEADType(aeadTypeBytes[0])
+	options = types.IssuerRequestOptions(aeadTypeBytes[1])
 	if aeadType.IsEncryptionEnabled() {
 		// Encryption Key
-		encKey = make([]byte, aeadType.GetKeyLen())
-		if n, err = tokenFile.Read(encKey); err != nil {
+		storedKey = make([]byte, aeadType.GetKeyLen())
+		if n, err = tokenFile.Read(storedKey); err != nil {
 			err = fmt.Errorf("failed reading encKey: %v", err)
 			goto popTokenInfoErr
 		} else if n != aeadType.GetKeyLen() {
@@ -132,6 +179,22 @@ func popTokenInfo(tokenFilePath string) (encKey []byte, tokenIndex uint16, token
 			goto popTokenInfoErr
 		}
 
+		// Padding Policy
+		if options&types.OptionPadding != 0 {
+			paddingBytes = make([]byte, types.PADDING_POLICY_LEN)
+			if n, err = tokenFile.Read(paddingBytes); err != nil {
+				err = fmt.Errorf("failed reading padding policy: %v", err)
+				goto popTokenInfoErr
+			} else if n != types.PADDING_POLICY_LEN {
+				err = fmt.Errorf("failed reading padding policy, length too short")
+				goto popTokenInfoErr
+			}
+			if padding, err = types.ParsePaddingPolicy(paddingBytes); err != nil {
+				err = fmt.Errorf("failed parsing padding policy: %v", err)
+				goto popTokenInfoErr
+			}
+		}
+
 		// Token Index
 		tokenIndexBytes = make([]byte, 2)
 		if n, err = tokenFile.Read(tokenIndexBytes); err != nil {
@@ -142,6 +205,15 @@ func popTokenInfo(tokenFilePath string) (encKey []byte, tokenIndex uint16, token
 			goto popTokenInfoErr
 		}
 		tokenIndex = binary.BigEndian.Uint16(tokenIndexBytes)
+
+		encKey = storedKey
+		if options&types.OptionPayloadKeyRatchet != 0 {
+			// storedKey is the chain key, step it so that only the next chain key is written back
+			if encKey, err = aeadType.RatchetPayloadKey(storedKey, uint64(tokenIndex)); err != nil {
+				err = fmt.Errorf("failed payload key ratchet: %v", err)
+				goto popTokenInfoErr
+			}
+		}
 	}
 
 	// Token
@@ -158,10 +230,10 @@ func popTokenInfo(tokenFilePath string) (encKey []byte, tokenIndex uint16, token
 	randomBytes = make([]byte, consts.RANDOM_BYTES_LEN)
 	if n, err = tokenFile.Read(randomBytes); err != nil {
 		// no remaining, remove file
-		fmt.Printf("removing file %s since no token left\n", tokenFilePath)
+		logger.Debug("removing file since no token left", "path", tokenFilePath)
 		tokenFile.Close()
 		if err = os.Remove(tokenFilePath); err != nil {
-			fmt.Printf("failed removing file %s since no token left: %v\n", tokenFilePath, err)
+			logger.Error("failed removing file since no token left", "path", tokenFilePath, "err", err)
 			return
 		}
 		closeNotNeeded = true
@@ -169,10 +241,10 @@ func popTokenInfo(tokenFilePath string) (encKey []byte, tokenIndex uint16, token
 		return
 	} else if n != consts.RANDOM_BYTES_LEN {
 		// illegal remaining, remove file
-		fmt.Printf("removing file %s since token illegaly left\n", tokenFilePath)
+		logger.Warn("removing file since token illegally left", "path", tokenFilePath)
 		tokenFile.Close()
 		if err = os.Remove(tokenFilePath); err != nil {
-			fmt.Printf("failed removing file %s since token illegaly left: %v\n", tokenFilePath, err)
+			logger.Error("failed removing file since token illegally left", "path", tokenFilePath, "err", err)
 			return
 		}
 		closeNotNeeded = true
@@ -191,29 +263,34 @@ func popTokenInfo(tokenFilePath string) (encKey []byte, tokenIndex uint16, token
 			tokenTempFile.Close()
 		}
 		if !tempFileRenamed {
-			fmt.Println("Ended token popping incomplete : ", err)
+			logger.Warn("token popping incomplete", "err", err)
 			if err = os.Remove(tokenFilePath + ".tmp"); err != nil {
-				fmt.Printf("failed removing temp file %s to recover from tokenFile creation failure: %v\n", tokenFilePath, err)
+				logger.Error("failed removing temp file to recover from token file creation failure", "path", tokenFilePath, "err", err)
 				return
 			}
 		}
 	}()
 
-	// Payload AEAD
+	// Payload AEAD and Options
 	if _, err = tokenTempFile.Write(aeadTypeBytes); err != nil {
-		err = fmt.Errorf("failed writing aead to temp: %v", err)
+		err = fmt.Errorf("failed writing aead and options to temp: %v", err)
 		goto popTokenInfoErr
 	}
 	if aeadType.IsEncryptionEnabled() {
 		// Encryption Key
-		if _, err = tokenTempFile.Write(encKey); err != nil {
+		if _, err = tokenTempFile.Write(storedKey); err != nil {
 			err = fmt.Errorf("failed writing encryption key to temp: %v", err)
 			goto popTokenInfoErr
 		}
 
+		// Padding Policy
+		if _, err = tokenTempFile.Write(paddingBytes); err != nil {
+			err = fmt.Errorf("failed writing padding policy to temp: %v", err)
+			goto popTokenInfoErr
+		}
+
 		// Token Index
-		tokenIndex++
-		binary.BigEndian.PutUint16(tokenIndexBytes, tokenIndex)
+		binary.BigEndian.PutUint16(tokenIndexBytes, tokenIndex+1)
 		if _, err = tokenTempFile.Write(tokenIndexBytes); err != nil {
 			err = fmt.Errorf("failed writing token index to temp: %v", err)
 			goto popTokenInfoErr
@@ -252,6 +329,7 @@ func popTokenInfo(tokenFilePath string) (encKey []byte, tokenIndex uint16, token
 popTokenInfoErr:
 	encKey = nil
 	token = nil
+	padding = types.PaddingPolicy{}
 	return
 }
 
@@ -268,6 +346,26 @@ func fetchTokens(req FetchRequest, topic []byte, tokenFilePath string) (err erro
 		err = fmt.Errorf("failed fetching: numTokens is inappropriate: %d", req.NumTokens)
 		return
 	}
+	if req.PayloadKeyRatchet && !req.PayloadAEADType.IsEncryptionEnabled() {
+		err = fmt.Errorf("failed fetching: payload key ratchet requires payload AEAD")
+		return
+	}
+	if req.Padding && !req.PayloadAEADType.IsEncryptionEnabled() {
+		err = fmt.Errorf("failed fetching: padding requires payload AEAD")
+		return
+	}
+	if !req.TokenFormat.IsValid() {
+		err = fmt.Errorf("failed fetching: token format is unknown: %d", req.TokenFormat)
+		return
+	}
+	if req.PayloadKeyRatchet && req.TokenFormat == types.TokenFormatCWT {
+		err = fmt.Errorf("failed fetching: payload key ratchet is not available for cwt tokens")
+		return
+	}
+	if req.CoverTraffic && req.TokenFormat == types.TokenFormatCWT {
+		err = fmt.Errorf("failed fetching: cover traffic is not available for cwt tokens")
+		return
+	}
 
 	cert, err := tls.LoadX509KeyPair(config.Client.Certs.ClientCertFilePath, config.Client.Certs.ClientKeyFilePath)
 	if err != nil {
@@ -294,10 +392,10 @@ func fetchTokens(req FetchRequest, topic []byte, tokenFilePath string) (err erro
 		err = fmt.Errorf("error connecting to mTLS server: %v", err)
 		return
 	}
-	fmt.Println("Opened mTLS connection with ", conn.RemoteAddr().String())
+	logger.Debug("opened mTLS connection", "remote", conn.RemoteAddr().String())
 	defer func() {
 		conn.Close()
-		fmt.Println("Closed mTLS connection with ", conn.RemoteAddr().String())
+		logger.Debug("closed mTLS connection", "remote", conn.RemoteAddr().String())
 	}()
 
 	// Send Issue Request
@@ -307,6 +405,7 @@ func fetchTokens(req FetchRequest, topic []byte, tokenFilePath string) (err erro
 		NumberOfTokensDividedByMultiplier: byte(req.NumTokens / consts.TOKEN_NUM_MULTIPLIER),
 		PayloadAEADType:                   req.PayloadAEADType,
 		Topic:                             topic,
+		Options:                           req.issuerRequestOptions(),
 	}
 	err = funcs.SendIssuerRequest(context.TODO(), conn, config.Client.SocketTimeout.External, request)
 	if err != nil {
@@ -315,25 +414,42 @@ func fetchTokens(req FetchRequest, topic []byte, tokenFilePath string) (err erro
 
 	// Receive Issuer Response
 	var response types.IssuerResponse
-	response, err = funcs.ParseIssuerResponse(context.TODO(), conn, config.Client.SocketTimeout.External, request)
+	reader := funcs.NewConnReader(context.TODO(), conn)
+	defer reader.Release()
+	response, err = funcs.ParseIssuerResponse(reader, config.Client.SocketTimeout.External, request)
 	if err != nil {
 		return
 	}
 
 	// Save Response
-	err = saveTokenInfo(request, response, tokenFilePath)
+	if req.TokenFormat.IsSeedBased() {
+		err = saveSeedTokenInfo(request, response, tokenFilePath)
+	} else if req.TokenFormat == types.TokenFormatCWT {
+		err = saveCWTTokenInfo(request, response, tokenFilePath)
+	} else {
+		err = saveTokenInfo(request, response, tokenFilePath)
+	}
 
 	return
 }
 
 func GetToken(topic string, fetchReq FetchRequest) (encKey []byte, tokenIndex uint16, token []byte, err error) {
+	encKey, tokenIndex, token, _, err = GetPaddedToken(topic, fetchReq)
+	return
+}
+
+/*
+GetToken with the padding policy of the token, which the payloads of PUBLISH must be padded with before sealing, or
+removed from those received after opening, as of its access type. Padding is disabled unless fetchReq.Padding is set.
+*/
+func GetPaddedToken(topic string, fetchReq FetchRequest) (encKey []byte, tokenIndex uint16, token []byte, padding types.PaddingPolicy, err error) {
 	if fetchReq.NumTokens < consts.TOKEN_NUM_MULTIPLIER || 0x1F*consts.TOKEN_NUM_MULTIPLIER < fetchReq.NumTokens || fetchReq.NumTokens%consts.TOKEN_NUM_MULTIPLIER != 0 {
-		log.Fatalf("Invalid number of token generation. It must be between [%d, 0x1F*%d] and multiples of %d\n", consts.TOKEN_NUM_MULTIPLIER, consts.TOKEN_NUM_MULTIPLIER, consts.TOKEN_NUM_MULTIPLIER)
+		logging.Fatal(logger, "invalid number of token generation", "tokens", fetchReq.NumTokens, "min", consts.TOKEN_NUM_MULTIPLIER, "max", 0x1F*consts.TOKEN_NUM_MULTIPLIER, "multipleof", consts.TOKEN_NUM_MULTIPLIER)
 	}
 	topic = strings.TrimSpace(topic)
 
 	if err := os.MkdirAll(config.Client.FilePaths.TokensDirPath, 0666); err != nil {
-		log.Fatalf("Failed creating Tokens directory at %s: %v", config.Client.FilePaths.TokensDirPath, err)
+		logging.Fatal(logger, "failed creating tokens directory", "path", config.Client.FilePaths.TokensDirPath, "err", err)
 	}
 	var accessTypeStr string
 	if fetchReq.AccessTypeIsPub {
@@ -341,16 +457,27 @@ func GetToken(topic string, fetchReq FetchRequest) (encKey []byte, tokenIndex ui
 	} else {
 		accessTypeStr = "SUB"
 	}
+	if fetchReq.CoverTraffic {
+		accessTypeStr = "COVER" + accessTypeStr
+	}
 	tokenFilePath := config.Client.FilePaths.TokensDirPath + accessTypeStr + base64.URLEncoding.EncodeToString(unsafe.Slice(unsafe.StringData(topic), len(topic)))
-	if _, err = os.Stat(tokenFilePath); err != nil {
-		// fetch needed
+	options := fetchReq.issuerRequestOptions()
+	if aeadType, fileOptions, found := readTokenFileHeader(tokenFilePath); !found || aeadType != fetchReq.PayloadAEADType || fileOptions != options {
+		// fetch needed, also when the token file was fetched with other options, which is overwritten
 		err = fetchTokens(fetchReq, unsafe.Slice(unsafe.StringData(topic), len(topic)), tokenFilePath)
 		if err != nil {
 			err = fmt.Errorf("error when fetching random bytes from server: %v", err)
 			return
 		}
 	}
-	encKey, tokenIndex, token, err = popTokenInfo(tokenFilePath)
+	switch tokenFormat := options.TokenFormat(); {
+	case tokenFormat.IsSeedBased():
+		encKey, tokenIndex, token, padding, err = popSeedTokenInfo(tokenFilePath)
+	case tokenFormat == types.TokenFormatCWT:
+		encKey, tokenIndex, token, padding, err = popCWTTokenInfo(tokenFilePath)
+	default:
+		encKey, tokenIndex, token, padding, err = popTokenInfo(tokenFilePath)
+	}
 	if err != nil {
 		err = fmt.Errorf("error when popping random bytes from file: %v", err)
 		return
@@ -0,0 +1,150 @@
+package tokenmgr
+
+import (
+	"encoding/binary"
+	"fmt"
+	"os"
+
+	"mqttmtd/types"
+)
+
+// Token files of CWT tokens keep the remaining tokens with their lengths:
+// [aead type][options][encryption key (if enabled)][padding policy (if requested)][token index][token length][token][token length][token]...
+
+func encodeCWTTokenFile(aeadType types.PayloadAEADType, options types.IssuerRequestOptions, encKey []byte, padding types.PaddingPolicy, tokenIndex uint16, cwtTokens [][]byte) []byte {
+	dataLen := 2 + len(encKey) + types.PADDING_POLICY_LEN + 2
+	for _, cwtToken := range cwtTokens {
+		dataLen += 2 + len(cwtToken)
+	}
+	data := make([]byte, 0, dataLen)
+	data = append(data, byte(aeadType), byte(options))
+	data = append(data, encKey...)
+	if options&types.OptionPadding != 0 {
+		data = padding.AppendBytes(data)
+	}
+	data = binary.BigEndian.AppendUint16(data, tokenIndex)
+	for _, cwtToken := range cwtTokens {
+		data = binary.BigEndian.AppendUint16(data, uint16(len(cwtToken)))
+		data = append(data, cwtToken...)
+	}
+	return data
+}
+
+func saveCWTTokenInfo(issuerRequest types.IssuerRequest, issuerResponse types.IssuerResponse, tokenFilePath string) (err error) {
+	if len(issuerResponse.CWTTokens) == 0 {
+		err = fmt.Errorf("no cwt token in the issuer response")
+		return
+	}
+	data := encodeCWTTokenFile(issuerRequest.PayloadAEADType, issuerRequest.Options, issuerResponse.EncryptionKey, issuerResponse.Padding, 0, issuerResponse.CWTTokens)
+	if err = os.WriteFile(tokenFilePath, data, 0666); err != nil {
+		err = fmt.Errorf("failed saving tokens: %v", err)
+	}
+	return
+}
+
+func popCWTTokenInfo(tokenFilePath string) (encKey []byte, tokenIndex uint16, token []byte, padding types.PaddingPolicy, err error) {
+	var (
+		data       []byte
+		offset     int = 2
+		aeadType   types.PayloadAEADType
+		options    types.IssuerRequestOptions
+		storedKey  []byte
+		tokenLen   int
+		restTokens []byte
+	)
+	if data, err = os.ReadFile(tokenFilePath); err != nil {
+		err = fmt.Errorf("failed reading token file: %v", err)
+		return
+	}
+	if len(data) < offset {
+		err = fmt.Errorf("failed reading aead type and options, length too short")
+		goto popCWTTokenInfoErr
+	}
+	aeadType = types.PayloadAEADType(data[0])
+	options = types.IssuerRequestOptions(data[1])
+
+	// Encryption Key
+	if aeadType.IsEncryptionEnabled() {
+		if len(data) < offset+aeadType.GetKeyLen() {
+			err = fmt.Errorf("failed reading encKey, length too short")
+			goto popCWTTokenInfoErr
+		}
+		storedKey = data[offset : offset+aeadType.GetKeyLen()]
+		offset += len(storedKey)
+	}
+
+	// Padding Policy
+	if options&types.OptionPadding != 0 {
+		if len(data) < offset+types.PADDING_POLICY_LEN {
+			err = fmt.Errorf("failed reading padding policy, length too short")
+			goto popCWTTokenInfoErr
+		}
+		if padding, err = types.ParsePaddingPolicy(data[offset : offset+types.PADDING_POLICY_LEN]); err != nil {
+			err = fmt.Errorf("failed parsing padding policy: %v", err)
+			goto popCWTTokenInfoErr
+		}
+		offset += types.PADDING_POLICY_LEN
+	}
+
+	// Token Index
+	if len(data) < offset+2 {
+		err = fmt.Errorf("failed reading tokenIndex, length too short")
+		goto popCWTTokenInfoErr
+	}
+	tokenIndex = binary.BigEndian.Uint16(data[offset:])
+	offset += 2
+
+	// Token
+	if len(data) < offset+2 {
+		err = fmt.Errorf("failed reading token length, length too short")
+		goto popCWTTokenInfoErr
+	}
+	tokenLen = int(binary.BigEndian.Uint16(data[offset:]))
+	offset += 2
+	if len(data) < offset+tokenLen {
+		err = fmt.Errorf("failed reading token, length too short")
+		goto popCWTTokenInfoErr
+	}
+	token = make([]byte, tokenLen)
+	copy(token, data[offset:])
+	offset += tokenLen
+	restTokens = data[offset:]
+
+	if aeadType.IsEncryptionEnabled() {
+		encKey = make([]byte, len(storedKey))
+		copy(encKey, storedKey)
+	}
+
+	if len(restTokens) == 0 {
+		// no remaining, remove file
+		logger.Debug("removing file since no token left", "path", tokenFilePath)
+		if err = os.Remove(tokenFilePath); err != nil {
+			logger.Error("failed removing file since no token left", "path", tokenFilePath, "err", err)
+		}
+		return
+	}
+
+	// Write back the remaining tokens through a temp file
+	data = append(encodeCWTTokenFile(aeadType, options, storedKey, padding, tokenIndex+1, nil), restTokens...)
+	if err = os.WriteFile(tokenFilePath+".tmp", data, 0666); err != nil {
+		err = fmt.Errorf("failed writing temp file: %v", err)
+		os.Remove(tokenFilePath + ".tmp")
+		goto popCWTTokenInfoErr
+	}
+	if err = os.Rename(tokenFilePath+".tmp", tokenFilePath); err != nil {
+		err = fmt.Errorf("failed renaming tmp file: %v", err)
+		os.Remove(tokenFilePath + ".tmp")
+		goto popCWTTokenInfoErr
+	}
+	return
+
+popCWTTokenInfoErr:
+	logger.Warn("token popping incomplete", "err", err)
+	if rmErr := os.Remove(tokenFilePath); rmErr != nil {
+		logger.Error("failed removing file to recover from token popping failure", "path", tokenFilePath, "err", rmErr)
+	}
+	encKey = nil
+	token = nil
+	padding = types.PaddingPolicy{}
+	return
+}
@@ -0,0 +1,162 @@
+package tokenmgr
+
+import (
+	"encoding/binary"
+	"fmt"
+	"os"
+
+	"mqttmtd/consts"
+	"mqttmtd/types"
+)
+
+// Token files of seed-based formats keep only the seed and the next token index:
+// [aead type][options][encryption key (if enabled)][padding policy (if requested)][token index][token count][timestamp][token seed]
+
+func encodeSeedTokenFile(aeadType types.PayloadAEADType, options types.IssuerRequestOptions, storedKey []byte, padding types.PaddingPolicy, tokenIndex uint16, tokenCount uint16, timestamp []byte, tokenSeed []byte) []byte {
+	data := make([]byte, 0, 2+len(storedKey)+types.PADDING_POLICY_LEN+2+2+consts.TIMESTAMP_LEN+consts.TOKEN_SEED_LEN)
+	data = append(data, byte(aeadType), byte(options))
+	data = append(data, storedKey...)
+	if options&types.OptionPadding != 0 {
+		data = padding.AppendBytes(data)
+	}
+	data = binary.BigEndian.AppendUint16(data, tokenIndex)
+	data = binary.BigEndian.AppendUint16(data, tokenCount)
+	data = append(data, timestamp...)
+	data = append(data, tokenSeed...)
+	return data
+}
+
+func saveSeedTokenInfo(issuerRequest types.IssuerRequest, issuerResponse types.IssuerResponse, tokenFilePath string) (err error) {
+	if len(issuerResponse.TokenSeed) != consts.TOKEN_SEED_LEN {
+		err = fmt.Errorf("length of token seed %d is not %d", len(issuerResponse.TokenSeed), consts.TOKEN_SEED_LEN)
+		return
+	}
+	data := encodeSeedTokenFile(
+		issuerRequest.PayloadAEADType,
+		issuerRequest.Options,
+		issuerResponse.EncryptionKey,
+		issuerResponse.Padding,
+		0,
+		uint16(issuerRequest.NumberOfTokensDividedByMultiplier)*consts.TOKEN_NUM_MULTIPLIER,
+		issuerResponse.Timestamp,
+		issuerResponse.TokenSeed,
+	)
+	if err = os.WriteFile(tokenFilePath, data, 0666); err != nil {
+		err = fmt.Errorf("failed saving tokens: %v", err)
+	}
+	return
+}
+
+func popSeedTokenInfo(tokenFilePath string) (encKey []byte, tokenIndex uint16, token []byte, padding types.PaddingPolicy, err error) {
+	var (
+		data        []byte
+		offset      int = 2
+		aeadType    types.PayloadAEADType
+		options     types.IssuerRequestOptions
+		storedKey   []byte
+		tokenCount  uint16
+		timestamp   []byte
+		tokenSeed   []byte
+		randomBytes []byte
+	)
+	if data, err = os.ReadFile(tokenFilePath); err != nil {
+		err = fmt.Errorf("failed reading token file: %v", err)
+		return
+	}
+	if len(data) < offset {
+		err = fmt.Errorf("failed reading aead type and options, length too short")
+		goto popSeedTokenInfoErr
+	}
+	aeadType = types.PayloadAEADType(data[0])
+	options = types.IssuerRequestOptions(data[1])
+
+	// Encryption Key
+	if aeadType.IsEncryptionEnabled() {
+		storedKey = make([]byte, aeadType.GetKeyLen())
+		if len(data) < offset+len(storedKey) {
+			err = fmt.Errorf("failed reading encKey, length too short")
+			goto popSeedTokenInfoErr
+		}
+		copy(storedKey, data[offset:])
+		offset += len(storedKey)
+	}
+
+	// Padding Policy
+	if options&types.OptionPadding != 0 {
+		if len(data) < offset+types.PADDING_POLICY_LEN {
+			err = fmt.Errorf("failed reading padding policy, length too short")
+			goto popSeedTokenInfoErr
+		}
+		if padding, err = types.ParsePaddingPolicy(data[offset : offset+types.PADDING_POLICY_LEN]); err != nil {
+			err = fmt.Errorf("failed parsing padding policy: %v", err)
+			goto popSeedTokenInfoErr
+		}
+		offset += types.PADDING_POLICY_LEN
+	}
+
+	// Token Index, Token Count, Timestamp and Token Seed
+	if len(data) != offset+2+2+consts.TIMESTAMP_LEN+consts.TOKEN_SEED_LEN {
+		err = fmt.Errorf("failed reading token seed, length invalid")
+		goto popSeedTokenInfoErr
+	}
+	tokenIndex = binary.BigEndian.Uint16(data[offset:])
+	offset += 2
+	tokenCount = binary.BigEndian.Uint16(data[offset:])
+	offset += 2
+	timestamp = data[offset : offset+consts.TIMESTAMP_LEN]
+	offset += consts.TIMESTAMP_LEN
+	tokenSeed = data[offset : offset+consts.TOKEN_SEED_LEN]
+
+	// Token
+	if randomBytes, err = options.TokenFormat().DeriveRandomBytes(tokenSeed, tokenCount, tokenIndex); err != nil {
+		err = fmt.Errorf("failed deriving token: %v", err)
+		goto popSeedTokenInfoErr
+	}
+	token = make([]byte, 0, consts.TOKEN_SIZE)
+	token = append(token, timestamp...)
+	token = append(token, randomBytes...)
+
+	if aeadType.IsEncryptionEnabled() {
+		encKey = storedKey
+		if options&types.OptionPayloadKeyRatchet != 0 {
+			// storedKey is the chain key, step it so that only the next chain key is written back
+			if encKey, err = aeadType.RatchetPayloadKey(storedKey, uint64(tokenIndex)); err != nil {
+				err = fmt.Errorf("failed payload key ratchet: %v", err)
+				goto popSeedTokenInfoErr
+			}
+		}
+	}
+
+	if tokenIndex+1 >= tokenCount {
+		// no remaining, remove file
+		logger.Debug("removing file since no token left", "path", tokenFilePath)
+		if err = os.Remove(tokenFilePath); err != nil {
+			logger.Error("failed removing file since no token left", "path", tokenFilePath, "err", err)
+		}
+		return
+	}
+
+	// Write back the next token index through a temp file
+	data = encodeSeedTokenFile(aeadType, options, storedKey, padding, tokenIndex+1, tokenCount, timestamp, tokenSeed)
+	if err = os.WriteFile(tokenFilePath+".tmp", data, 0666); err != nil {
+		err = fmt.Errorf("failed writing temp file: %v", err)
+		os.Remove(tokenFilePath + ".tmp")
+		goto popSeedTokenInfoErr
+	}
+	if err = os.Rename(tokenFilePath+".tmp", tokenFilePath); err != nil {
+		err = fmt.Errorf("failed renaming tmp file: %v", err)
+		os.Remove(tokenFilePath + ".tmp")
+		goto popSeedTokenInfoErr
+	}
+	return
+
+popSeedTokenInfoErr:
+	logger.Warn("token popping incomplete", "err", err)
+	if rmErr := os.Remove(tokenFilePath); rmErr != nil {
+		logger.Error("failed removing file to recover from token popping failure", "path", tokenFilePath, "err", rmErr)
+	}
+	encKey = nil
+	token = nil
+	padding = types.PaddingPolicy{}
+	return
+}
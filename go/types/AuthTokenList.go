@@ -2,6 +2,7 @@ package types
 
 import (
 	"bytes"
+	"encoding/hex"
 	"fmt"
 	"mqttmtd/consts"
 	"sync"
@@ -23,20 +24,60 @@ type ATLEntry struct {
 	// Token Info
 	AccessTypeIsPub        bool
 	Timestamp              [1 + consts.TIMESTAMP_LEN]byte // size = 1 + consts.TIMESTAMP_LEN, in order to distinguish expired tokens
-	AllRandomData          []byte                         // onmemory: all random data / localfile: utf8-encoded filepath
+	AllRandomData          []byte                         // onmemory: all random data / localfile: utf8-encoded filepath / seed-based: token seed
 	CurrentValidRandomData []byte
 	TokenCount             uint16
 	CurrentValidTokenIdx   uint16
+	TokenFormat            TokenFormat
 
 	// Payload AEAD
 	PayloadAEADType PayloadAEADType
 	PayloadEncKey   []byte // must be nil if PayloadAEADType.IsEncryptionEnabled() == false
+	// PayloadEncKey is the current chain key of the payload key ratchet when true
+	PayloadKeyRatchet bool
+	// Padding of the payloads of the direction of AccessTypeIsPub, applied only with payload AEAD
+	Padding PaddingPolicy
+
+	// Decoy tokens for cover traffic, kept apart from the real ones of the same topic and access type
+	CoverTraffic bool
 
 	// Doubly Linked List Properties
 	prev *ATLEntry
 	next *ATLEntry
 }
 
+// Result code for a successful verification of a token of this entry, VerfCover for cover traffic
+func (entry *ATLEntry) SuccessResultCode(reloadNeeded bool) (resultCode VerificationResultCode) {
+	if entry.CoverTraffic {
+		resultCode = VerfCover
+	} else if entry.PayloadKeyRatchet {
+		resultCode = VerfSuccessRatchetKey
+	} else if entry.PayloadAEADType.IsEncryptionEnabled() {
+		resultCode = VerfSuccessEncKey
+	} else {
+		resultCode = VerfSuccess
+	}
+	if reloadNeeded {
+		resultCode |= VerfSuccessReloadNeeded
+	}
+	return
+}
+
+// Time the tokens of this entry were issued at, from which they expire after consts.TOKEN_EXPIRATION_DURATION
+func (entry *ATLEntry) IssuedAt() time.Time {
+	var entryTime uint64
+	for i := 0; i < 1+consts.TIMESTAMP_LEN; i++ {
+		entryTime |= uint64(entry.Timestamp[i])
+		entryTime <<= 8
+	}
+	return time.Unix(0, int64(entryTime))
+}
+
+// Hex of the timestamp, which identifies the batch of this entry
+func (entry *ATLEntry) ID() string {
+	return hex.EncodeToString(entry.Timestamp[:])
+}
+
 func (atl *AuthTokenList) removeFirst() bool {
 	if atl.head == nil {
 		return false
@@ -44,6 +85,8 @@ func (atl *AuthTokenList) removeFirst() bool {
 	atl.head = atl.head.next
 	if atl.head == nil {
 		atl.tail = nil
+	} else {
+		atl.head.prev = nil
 	}
 	return true
 }
@@ -55,32 +98,34 @@ func (atl *AuthTokenList) Remove(entry *ATLEntry) bool {
 	if entry.prev == nil {
 		// entry is head
 		atl.removeFirst()
-	} else {
-		entry.prev.next = entry.next
+		return true
 	}
 
+	entry.prev.next = entry.next
 	if entry.next == nil {
 		// entry is tail
 		atl.tail = entry.prev
+	} else {
+		entry.next.prev = entry.prev
 	}
 	return true
 }
 
-func (atl *AuthTokenList) RevokeEntry(clientName []byte, topic []byte, accessTypeIsPub bool) (err error) {
-	var entry *ATLEntry
-	entry, err = atl.lookupEntryWithClientNameTopicAndAccessType(clientName, topic, accessTypeIsPub)
+// revoked is the entry removed, nil if none matched
+func (atl *AuthTokenList) RevokeEntry(clientName []byte, topic []byte, accessTypeIsPub bool, coverTraffic bool) (revoked *ATLEntry, err error) {
+	revoked, err = atl.lookupEntryWithClientNameTopicAndAccessType(clientName, topic, accessTypeIsPub, coverTraffic)
 	if err != nil {
 		err = fmt.Errorf("found error during revocation: %v", err)
 		return
 	}
-	if entry != nil {
-		if entry.prev == nil {
+	if revoked != nil {
+		if revoked.prev == nil {
 			atl.removeFirst()
 		} else {
-			atl.Remove(entry)
+			atl.Remove(revoked)
 		}
 	}
-	return nil
+	return
 }
 
 func (atl *AuthTokenList) AppendEntry(entry *ATLEntry) (err error) {
@@ -99,7 +144,8 @@ func (atl *AuthTokenList) AppendEntry(entry *ATLEntry) (err error) {
 	return
 }
 
-func (atl *AuthTokenList) RemoveExpired() {
+// removed are the expired entries, from the oldest
+func (atl *AuthTokenList) RemoveExpired() (removed []*ATLEntry) {
 	var (
 		entryTime uint64
 		newHead   *ATLEntry = atl.head
@@ -115,6 +161,7 @@ func (atl *AuthTokenList) RemoveExpired() {
 		if entryTime > uint64(time.Now().Add(-1*consts.TOKEN_EXPIRATION_DURATION).UnixNano()) {
 			break
 		}
+		removed = append(removed, newHead)
 	}
 	if newHead == nil {
 		newTail = nil
@@ -127,6 +174,7 @@ func (atl *AuthTokenList) RemoveExpired() {
 	if newTail != nil {
 		atl.tail.next = nil
 	}
+	return
 }
 
 func (atl *AuthTokenList) LookupEntryWithToken(token []byte) (entry *ATLEntry, err error) {
@@ -176,13 +224,13 @@ func (atl *AuthTokenList) LookupEntryWithToken(token []byte) (entry *ATLEntry, e
 	return
 }
 
-func (atl *AuthTokenList) lookupEntryWithClientNameTopicAndAccessType(clientName []byte, topic []byte, accessTypeIsPub bool) (entry *ATLEntry, err error) {
+func (atl *AuthTokenList) lookupEntryWithClientNameTopicAndAccessType(clientName []byte, topic []byte, accessTypeIsPub bool, coverTraffic bool) (entry *ATLEntry, err error) {
 	if len(topic) == 0 {
 		err = fmt.Errorf("length of topic %v is zero", topic)
 		return
 	}
 	for entry = atl.head; entry != nil; entry = entry.next {
-		if bytes.Equal(topic, entry.Topic) && bytes.Equal(clientName, entry.ClientName) && accessTypeIsPub == entry.AccessTypeIsPub {
+		if bytes.Equal(topic, entry.Topic) && bytes.Equal(clientName, entry.ClientName) && accessTypeIsPub == entry.AccessTypeIsPub && coverTraffic == entry.CoverTraffic {
 			break
 		}
 	}
@@ -0,0 +1,310 @@
+package types
+
+import (
+	"bytes"
+	"crypto/hmac"
+	"crypto/sha256"
+	"fmt"
+	"io"
+	"math"
+	"os"
+	"sync"
+	"time"
+
+	"mqttmtd/consts"
+
+	"golang.org/x/crypto/hkdf"
+)
+
+// Stateless tokens (TokenFormatCWT): CBOR Web Tokens (RFC 8392) in a COSE_Mac0 structure (RFC 9052) MACed with
+// HMAC 256/64 under a key shared between Issuer and MQTT Interface, so that they can be verified without Verifier.
+// The claims are in clear (see TokenFormatCWT).
+const (
+	coseTagMac0          = 17
+	coseHeaderAlg        = 1
+	coseAlgHMAC256_64    = 4
+	coseMac0Context      = "MAC0"
+	coseHMAC256_64MacLen = 8
+
+	cwtClaimSub   = 2
+	cwtClaimExp   = 4
+	cwtClaimCti   = 7
+	cwtClaimScope = 9
+	// private use claim keys (< -65536)
+	cwtClaimAccessTypeIsPub = -65537
+	cwtClaimTokenIndex      = -65538
+	cwtClaimPayloadAEADType = -65539
+	cwtClaimPadding         = -65540
+
+	cwtPayloadKeyInfo = "mqttmtd cwt payload key"
+
+	// Length of the batch id (cti): timestamp + random bytes
+	CWT_BATCH_ID_LEN = consts.TIMESTAMP_LEN + 10
+	// Minimum length of the key to MAC CWTs
+	CWT_KEY_MIN_LEN = 32
+)
+
+/*
+Claims carried by a CWT token.
+*/
+type CWTClaims struct {
+	// sub
+	ClientName []byte
+	// scope
+	Topic []byte
+	// cti, shared by all tokens of a batch
+	BatchID []byte
+	// exp
+	ExpiresAt time.Time
+
+	AccessTypeIsPub bool
+	TokenIndex      uint16
+	PayloadAEADType PayloadAEADType
+	// Present only with payload AEAD
+	Padding PaddingPolicy
+}
+
+// Read the MAC key of CWT tokens from keyFilePath
+func LoadCWTKey(keyFilePath string) (key []byte, err error) {
+	if key, err = os.ReadFile(keyFilePath); err != nil {
+		return
+	}
+	if len(key) < CWT_KEY_MIN_LEN {
+		err = fmt.Errorf("length of cwt key %d is less than %d", len(key), CWT_KEY_MIN_LEN)
+		key = nil
+	}
+	return
+}
+
+func cwtProtectedHeader() []byte {
+	protected := CBORAppendMapHead(nil, 1)
+	protected = CBORAppendInt(protected, coseHeaderAlg)
+	return CBORAppendInt(protected, coseAlgHMAC256_64)
+}
+
+func cwtMac0Tag(key []byte, protected []byte, payload []byte) []byte {
+	// MAC_structure = ["MAC0", protected, external_aad, payload]
+	toBeMaced := CBORAppendArrayHead(nil, 4)
+	toBeMaced = CBORAppendText(toBeMaced, coseMac0Context)
+	toBeMaced = CBORAppendBytes(toBeMaced, protected)
+	toBeMaced = CBORAppendBytes(toBeMaced, nil)
+	toBeMaced = CBORAppendBytes(toBeMaced, payload)
+	mac := hmac.New(sha256.New, key)
+	mac.Write(toBeMaced)
+	return mac.Sum(nil)[:coseHMAC256_64MacLen]
+}
+
+// Encode the claims to a CWT and MAC it with key
+func (c CWTClaims) Seal(key []byte) (token []byte) {
+	numClaims := 6
+	if c.PayloadAEADType.IsEncryptionEnabled() {
+		numClaims++
+		if c.Padding.IsEnabled() {
+			numClaims++
+		}
+	}
+	payload := CBORAppendMapHead(nil, numClaims)
+	payload = CBORAppendInt(payload, cwtClaimSub)
+	payload = CBORAppendText(payload, string(c.ClientName))
+	payload = CBORAppendInt(payload, cwtClaimExp)
+	payload = CBORAppendInt(payload, c.ExpiresAt.Unix())
+	payload = CBORAppendInt(payload, cwtClaimCti)
+	payload = CBORAppendBytes(payload, c.BatchID)
+	payload = CBORAppendInt(payload, cwtClaimScope)
+	payload = CBORAppendText(payload, string(c.Topic))
+	payload = CBORAppendInt(payload, cwtClaimAccessTypeIsPub)
+	payload = CBORAppendBool(payload, c.AccessTypeIsPub)
+	payload = CBORAppendInt(payload, cwtClaimTokenIndex)
+	payload = CBORAppendInt(payload, int64(c.TokenIndex))
+	if c.PayloadAEADType.IsEncryptionEnabled() {
+		payload = CBORAppendInt(payload, cwtClaimPayloadAEADType)
+		payload = CBORAppendInt(payload, int64(c.PayloadAEADType))
+		if c.Padding.IsEnabled() {
+			payload = CBORAppendInt(payload, cwtClaimPadding)
+			payload = CBORAppendBytes(payload, c.Padding.AppendBytes(nil))
+		}
+	}
+
+	protected := cwtProtectedHeader()
+	token = CBORAppendTag(nil, coseTagMac0)
+	token = CBORAppendArrayHead(token, 4)
+	token = CBORAppendBytes(token, protected)
+	token = CBORAppendMapHead(token, 0)
+	token = CBORAppendBytes(token, payload)
+	token = CBORAppendBytes(token, cwtMac0Tag(key, protected, payload))
+	return
+}
+
+// Check the MAC of a CWT token with key and decode its claims. Expiration is not checked here.
+func OpenCWTToken(token []byte, key []byte) (claims CWTClaims, err error) {
+	var (
+		decoded   any
+		rest      []byte
+		tag       CBORTag
+		mac0      []any
+		protected []byte
+		payload   []byte
+		macTag    []byte
+		ok        bool
+	)
+	if decoded, rest, err = CBORDecode(token); err != nil {
+		return
+	}
+	if len(rest) != 0 {
+		err = fmt.Errorf("cwt: trailing bytes after COSE_Mac0")
+		return
+	}
+	if tag, ok = decoded.(CBORTag); !ok || tag.Number != coseTagMac0 {
+		err = fmt.Errorf("cwt: not a tagged COSE_Mac0")
+		return
+	}
+	if mac0, ok = tag.Content.([]any); !ok || len(mac0) != 4 {
+		err = fmt.Errorf("cwt: malformed COSE_Mac0")
+		return
+	}
+	protected, ok1 := mac0[0].([]byte)
+	payload, ok2 := mac0[2].([]byte)
+	macTag, ok3 := mac0[3].([]byte)
+	if !ok1 || !ok2 || !ok3 {
+		err = fmt.Errorf("cwt: malformed COSE_Mac0 fields")
+		return
+	}
+	if !bytes.Equal(protected, cwtProtectedHeader()) {
+		err = fmt.Errorf("cwt: unsupported protected header")
+		return
+	}
+	if !hmac.Equal(macTag, cwtMac0Tag(key, protected, payload)) {
+		err = fmt.Errorf("cwt: MAC mismatch")
+		return
+	}
+
+	// Claims
+	if decoded, rest, err = CBORDecode(payload); err != nil {
+		return
+	}
+	claimsMap, ok := decoded.(map[any]any)
+	if !ok || len(rest) != 0 {
+		err = fmt.Errorf("cwt: claims are not a map")
+		return
+	}
+	var (
+		sub, scope             string
+		exp, index, aeadType   uint64
+		okSub, okScope, okExp  bool
+		okCti, okAccess, okIdx bool
+		claimValue             any
+		found                  bool
+	)
+	claimValue, _ = CBORMapGet(claimsMap, cwtClaimSub)
+	sub, okSub = claimValue.(string)
+	claimValue, _ = CBORMapGet(claimsMap, cwtClaimScope)
+	scope, okScope = claimValue.(string)
+	claimValue, _ = CBORMapGet(claimsMap, cwtClaimExp)
+	exp, okExp = claimValue.(uint64)
+	claimValue, _ = CBORMapGet(claimsMap, cwtClaimCti)
+	claims.BatchID, okCti = claimValue.([]byte)
+	claimValue, _ = CBORMapGet(claimsMap, cwtClaimAccessTypeIsPub)
+	claims.AccessTypeIsPub, okAccess = claimValue.(bool)
+	claimValue, _ = CBORMapGet(claimsMap, cwtClaimTokenIndex)
+	index, okIdx = claimValue.(uint64)
+	if !okSub || !okScope || !okExp || !okCti || !okAccess || !okIdx || exp > math.MaxInt64 || index > math.MaxUint16 || len(claims.BatchID) != CWT_BATCH_ID_LEN {
+		err = fmt.Errorf("cwt: missing or invalid claims")
+		claims = CWTClaims{}
+		return
+	}
+	if claimValue, found = CBORMapGet(claimsMap, cwtClaimPayloadAEADType); found {
+		if aeadType, ok = claimValue.(uint64); !ok || !PayloadAEADType(aeadType).IsEncryptionEnabled() {
+			err = fmt.Errorf("cwt: invalid payload AEAD type claim")
+			claims = CWTClaims{}
+			return
+		}
+		claims.PayloadAEADType = PayloadAEADType(aeadType)
+	}
+	if claimValue, found = CBORMapGet(claimsMap, cwtClaimPadding); found {
+		paddingBytes, okPadding := claimValue.([]byte)
+		if !okPadding || !claims.PayloadAEADType.IsEncryptionEnabled() {
+			err = fmt.Errorf("cwt: invalid padding claim")
+			claims = CWTClaims{}
+			return
+		}
+		if claims.Padding, err = ParsePaddingPolicy(paddingBytes); err != nil {
+			err = fmt.Errorf("cwt: invalid padding claim: %w", err)
+			claims = CWTClaims{}
+			return
+		}
+	}
+	claims.ClientName = []byte(sub)
+	claims.Topic = []byte(scope)
+	claims.ExpiresAt = time.Unix(int64(exp), 0)
+	claims.TokenIndex = uint16(index)
+	return
+}
+
+// Derive the payload key of a CWT token batch from the CWT key, so that MQTT Interface can recompute it from the token
+func (p PayloadAEADType) DeriveCWTPayloadKey(cwtKey []byte, batchID []byte) (key []byte, err error) {
+	keyLen := p.GetKeyLen()
+	if keyLen == 0 {
+		err = fmt.Errorf("payload AEAD type %d does not use a key", p)
+		return
+	}
+	info := make([]byte, 0, len(cwtPayloadKeyInfo)+len(batchID))
+	info = append(info, cwtPayloadKeyInfo...)
+	info = append(info, batchID...)
+	key = make([]byte, keyLen)
+	if _, err = io.ReadFull(hkdf.New(sha256.New, cwtKey, nil, info), key); err != nil {
+		err = fmt.Errorf("failed deriving cwt payload key: %w", err)
+		key = nil
+	}
+	return
+}
+
+/*
+Replay protection of CWT tokens: a bitmap of used token indices per batch, kept until the batch expires.
+Every MQTT Interface instance holds its own guard, so a token is caught as a replay only by the instance that took it
+first. Clients must be routed to the same instance every time, see mqttinterface.cwtstickyrouting.
+*/
+type CWTReplayGuard struct {
+	sync.Mutex
+	batches map[string]*cwtBatchUsage
+}
+
+type cwtBatchUsage struct {
+	expiresAt time.Time
+	used      []uint64
+}
+
+// Mark the token as used. Returns false if it has been used before.
+func (g *CWTReplayGuard) MarkUsed(claims CWTClaims) (firstUse bool) {
+	g.Lock()
+	defer g.Unlock()
+	if g.batches == nil {
+		g.batches = make(map[string]*cwtBatchUsage)
+	}
+	usage, found := g.batches[string(claims.BatchID)]
+	if !found {
+		usage = &cwtBatchUsage{expiresAt: claims.ExpiresAt}
+		g.batches[string(claims.BatchID)] = usage
+	}
+	word, bit := int(claims.TokenIndex/64), uint64(1)<<(claims.TokenIndex%64)
+	if word >= len(usage.used) {
+		usage.used = append(usage.used, make([]uint64, word+1-len(usage.used))...)
+	}
+	if usage.used[word]&bit != 0 {
+		return false
+	}
+	usage.used[word] |= bit
+	return true
+}
+
+// Forget batches expired before now
+func (g *CWTReplayGuard) RemoveExpired(now time.Time) (removed int) {
+	g.Lock()
+	defer g.Unlock()
+	for batchID, usage := range g.batches {
+		if usage.expiresAt.Before(now) {
+			delete(g.batches, batchID)
+			removed++
+		}
+	}
+	return
+}
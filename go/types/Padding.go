@@ -0,0 +1,243 @@
+package types
+
+import (
+	"encoding/binary"
+	"fmt"
+	"strconv"
+	"strings"
+)
+
+/*
+Padding of payloads, so that the lengths of sealed messages do not tell what they carry. Applied to the plaintext
+before sealing and removed after opening, by the publisher and MQTT Interface for Client->Server and by MQTT Interface
+and the subscriber for Server->Client. Padding follows ISO/IEC 7816-4: a 0x80 byte and as many 0x00 bytes as needed.
+*/
+type PaddingMode byte
+
+const (
+	PADDING_NONE PaddingMode = 0x0
+	// Pad to the smallest of Size, Size*2, Size*4, ...
+	PADDING_BUCKET PaddingMode = 0x1
+	// Pad to Size exactly, longer payloads are refused
+	PADDING_FIXED PaddingMode = 0x2
+)
+
+const (
+	// Mode - 1 byte, Size - 2 bytes
+	PADDING_POLICY_LEN = 3
+
+	paddingMarker byte = 0x80
+)
+
+func (m PaddingMode) String() string {
+	switch m {
+	case PADDING_NONE:
+		return "none"
+	case PADDING_BUCKET:
+		return "bucket"
+	case PADDING_FIXED:
+		return "fixed"
+	}
+	return fmt.Sprintf("unknown(%d)", byte(m))
+}
+
+type PaddingPolicy struct {
+	Mode PaddingMode
+	Size uint16 // bucket or fixed size in bytes, 0 if Mode is PADDING_NONE
+}
+
+func (p PaddingPolicy) IsEnabled() bool {
+	return p.Mode != PADDING_NONE
+}
+
+func (p PaddingPolicy) String() string {
+	if !p.IsEnabled() {
+		return p.Mode.String()
+	}
+	return fmt.Sprintf("%s:%d", p.Mode, p.Size)
+}
+
+func (p PaddingPolicy) validate() error {
+	switch p.Mode {
+	case PADDING_NONE:
+		if p.Size != 0 {
+			return fmt.Errorf("size given to padding none")
+		}
+	case PADDING_BUCKET, PADDING_FIXED:
+		if p.Size == 0 {
+			return fmt.Errorf("padding %s needs a positive size", p.Mode)
+		}
+	default:
+		return fmt.Errorf("unknown padding mode: %d", p.Mode)
+	}
+	return nil
+}
+
+// Parse a policy in the form of "none", "bucket:<size>" or "fixed:<size>"
+func ParsePaddingPolicyString(s string) (p PaddingPolicy, err error) {
+	modeStr, sizeStr, hasSize := strings.Cut(strings.TrimSpace(s), ":")
+	switch modeStr {
+	case "none":
+		p.Mode = PADDING_NONE
+	case "bucket":
+		p.Mode = PADDING_BUCKET
+	case "fixed":
+		p.Mode = PADDING_FIXED
+	default:
+		err = fmt.Errorf("invalid padding policy: %s", s)
+		return
+	}
+	if hasSize {
+		var size uint64
+		if size, err = strconv.ParseUint(sizeStr, 10, 16); err != nil {
+			err = fmt.Errorf("invalid padding size: %s", s)
+			return
+		}
+		p.Size = uint16(size)
+	}
+	if err = p.validate(); err != nil {
+		p = PaddingPolicy{}
+	}
+	return
+}
+
+func (p *PaddingPolicy) UnmarshalYAML(unmarshal func(interface{}) error) (err error) {
+	var s string
+	if err = unmarshal(&s); err != nil {
+		return
+	}
+	*p, err = ParsePaddingPolicyString(s)
+	return
+}
+
+// Append the policy in PADDING_POLICY_LEN bytes
+func (p PaddingPolicy) AppendBytes(b []byte) []byte {
+	return binary.BigEndian.AppendUint16(append(b, byte(p.Mode)), p.Size)
+}
+
+// Parse a policy of PADDING_POLICY_LEN bytes
+func ParsePaddingPolicy(b []byte) (p PaddingPolicy, err error) {
+	if len(b) != PADDING_POLICY_LEN {
+		err = fmt.Errorf("length of padding policy %d is not %d", len(b), PADDING_POLICY_LEN)
+		return
+	}
+	p = PaddingPolicy{Mode: PaddingMode(b[0]), Size: binary.BigEndian.Uint16(b[1:])}
+	if err = p.validate(); err != nil {
+		p = PaddingPolicy{}
+	}
+	return
+}
+
+// Length of a payload of plaintextLen bytes once padded, which is at least plaintextLen+1 for the marker
+func (p PaddingPolicy) PaddedLen(plaintextLen int) (paddedLen int, err error) {
+	switch p.Mode {
+	case PADDING_NONE:
+		paddedLen = plaintextLen
+	case PADDING_BUCKET:
+		for paddedLen = int(p.Size); paddedLen < plaintextLen+1; paddedLen *= 2 {
+		}
+	case PADDING_FIXED:
+		if paddedLen = int(p.Size); paddedLen < plaintextLen+1 {
+			err = fmt.Errorf("payload of %d bytes does not fit in padding %s", plaintextLen, p)
+		}
+	default:
+		err = fmt.Errorf("unknown padding mode: %d", p.Mode)
+	}
+	return
+}
+
+// Whether paddedLen is one of the lengths that the policy produces
+func (p PaddingPolicy) isPaddedLen(paddedLen int) bool {
+	switch p.Mode {
+	case PADDING_BUCKET:
+		size := int(p.Size)
+		for ; size < paddedLen; size *= 2 {
+		}
+		return size == paddedLen
+	case PADDING_FIXED:
+		return int(p.Size) == paddedLen
+	}
+	return true
+}
+
+// Pad the plaintext according to the policy. The plaintext is returned as is when padding is disabled.
+func (p PaddingPolicy) Pad(plaintext []byte) (padded []byte, err error) {
+	if !p.IsEnabled() {
+		padded = plaintext
+		return
+	}
+	var paddedLen int
+	if paddedLen, err = p.PaddedLen(len(plaintext)); err != nil {
+		return
+	}
+	padded = make([]byte, paddedLen)
+	copy(padded, plaintext)
+	padded[len(plaintext)] = paddingMarker
+	return
+}
+
+// Remove the padding from a payload padded according to the policy. The payload is returned as is when padding is disabled.
+func (p PaddingPolicy) Unpad(padded []byte) (plaintext []byte, err error) {
+	if !p.IsEnabled() {
+		plaintext = padded
+		return
+	}
+	if !p.isPaddedLen(len(padded)) {
+		err = fmt.Errorf("length %d is not padded with %s", len(padded), p)
+		return
+	}
+	i := len(padded) - 1
+	for ; i >= 0 && padded[i] == 0x00; i-- {
+	}
+	if i < 0 || padded[i] != paddingMarker {
+		err = fmt.Errorf("padding marker not found")
+		return
+	}
+	plaintext = padded[:i]
+	return
+}
+
+// Padding policies of both directions of a topic in ACL
+type PaddingPolicies struct {
+	Pub PaddingPolicy `yaml:"pub"` // Client->Server, applied to PUBLISH from the client
+	Sub PaddingPolicy `yaml:"sub"` // Server->Client, applied to PUBLISH to the subscriber
+}
+
+// Either a policy for both directions, such as "bucket:64", or a map of pub and sub
+func (pp *PaddingPolicies) UnmarshalYAML(unmarshal func(interface{}) error) (err error) {
+	var s string
+	if unmarshal(&s) == nil {
+		var both PaddingPolicy
+		if both, err = ParsePaddingPolicyString(s); err == nil {
+			*pp = PaddingPolicies{Pub: both, Sub: both}
+		}
+		return
+	}
+	type plain PaddingPolicies
+	var perDirection plain
+	if err = unmarshal(&perDirection); err != nil {
+		return
+	}
+	*pp = PaddingPolicies(perDirection)
+	return
+}
+
+func (pp PaddingPolicies) ForAccessType(accessTypeIsPub bool) PaddingPolicy {
+	if accessTypeIsPub {
+		return pp.Pub
+	}
+	return pp.Sub
+}
+
+/*
+The stronger of two policies, which hides lengths at least as well as both. A policy pads every payload shorter than its
+Size to Size, so the larger Size is stronger whatever the modes, as bucket:256 over fixed:64. For the same Size, fixed
+is stronger than bucket, which still tells longer payloads apart by their buckets. Any padding is stronger than none.
+Used to pick one policy when several ACL entries with wildcards cover a topic, whatever the order they are visited in.
+*/
+func (p PaddingPolicy) Stronger(other PaddingPolicy) PaddingPolicy {
+	if other.Size > p.Size || (other.Size == p.Size && other.Mode == PADDING_FIXED) {
+		return other
+	}
+	return p
+}
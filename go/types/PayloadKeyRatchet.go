@@ -0,0 +1,51 @@
+package types
+
+import (
+	"crypto/sha256"
+	"encoding/binary"
+	"fmt"
+	"io"
+
+	"golang.org/x/crypto/hkdf"
+)
+
+// Payload Key Ratchet: the batch key is used as the initial chain key, and every step derives a message key for one token
+// and replaces the chain key with the next one in place. Keys of already used tokens can't be recomputed from the current state.
+const (
+	payloadKeyRatchetMessageInfo = "mqttmtd payload key"
+	payloadKeyRatchetChainInfo   = "mqttmtd chain key"
+)
+
+func (p PayloadAEADType) RatchetPayloadKey(chainKey []byte, index uint64) (messageKey []byte, err error) {
+	keyLen := p.GetKeyLen()
+	if keyLen == 0 {
+		err = fmt.Errorf("payload AEAD type %d does not use a key", p)
+		return
+	}
+	if len(chainKey) != keyLen {
+		err = fmt.Errorf("length of chain key %d is not %d", len(chainKey), keyLen)
+		return
+	}
+
+	// Message Key
+	info := make([]byte, len(payloadKeyRatchetMessageInfo)+8)
+	copy(info, payloadKeyRatchetMessageInfo)
+	binary.BigEndian.PutUint64(info[len(payloadKeyRatchetMessageInfo):], index)
+	messageKey = make([]byte, keyLen)
+	if _, err = io.ReadFull(hkdf.New(sha256.New, chainKey, nil, info), messageKey); err != nil {
+		err = fmt.Errorf("failed deriving message key: %w", err)
+		messageKey = nil
+		return
+	}
+
+	// Next Chain Key, overwriting the current one
+	nextChainKey := make([]byte, keyLen)
+	if _, err = io.ReadFull(hkdf.New(sha256.New, chainKey, nil, []byte(payloadKeyRatchetChainInfo)), nextChainKey); err != nil {
+		err = fmt.Errorf("failed deriving next chain key: %w", err)
+		messageKey = nil
+		return
+	}
+	copy(chainKey, nextChainKey)
+	clear(nextChainKey)
+	return
+}
@@ -0,0 +1,92 @@
+package types
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/binary"
+	"fmt"
+	"mqttmtd/consts"
+)
+
+/*
+Formats of tokens that Issuer can issue. Selected per request with the options of IssuerRequest.
+*/
+type TokenFormat byte
+
+const (
+	// Random bytes of all tokens are generated, stored and sent to the client
+	TokenFormatRandomBytes TokenFormat = 0x0
+	// Random bytes of each token are derived from a per-batch seed with HMAC-SHA256 over the token index
+	TokenFormatSeedHMAC TokenFormat = 0x1
+	// Random bytes of each token are taken from a SHA-256 hash chain over a per-batch seed, used from its end
+	TokenFormatHashChain TokenFormat = 0x2
+	/*
+		Each token is a CBOR Web Token MACed by Issuer, verified by MQTT Interface without Verifier (see CWTToken.go).
+		Its claims are authenticated but not encrypted: anyone who sees the token, such as the topic name of a PUBLISH on
+		the client link or the token file, can read the client name, the real topic, the access type and the token
+		index. Unlike the other formats, it does not hide the topic from the network between client and MQTT Interface,
+		so use it on TLS links only.
+	*/
+	TokenFormatCWT TokenFormat = 0x3
+)
+
+const tokenFormatSeedHMACLabel = "mqttmtd token"
+
+func (f TokenFormat) String() string {
+	switch f {
+	case TokenFormatRandomBytes:
+		return "RandomBytes"
+	case TokenFormatSeedHMAC:
+		return "SeedHMAC"
+	case TokenFormatHashChain:
+		return "HashChain"
+	case TokenFormatCWT:
+		return "CWT"
+	}
+	return "Unknown"
+}
+
+func (f TokenFormat) IsValid() bool {
+	return f == TokenFormatRandomBytes ||
+		f.IsSeedBased() ||
+		f == TokenFormatCWT
+}
+
+func (f TokenFormat) IsSeedBased() bool {
+	return f == TokenFormatSeedHMAC ||
+		f == TokenFormatHashChain
+}
+
+// Derive the random bytes of the token at index in a batch of tokenCount tokens generated from seed
+func (f TokenFormat) DeriveRandomBytes(seed []byte, tokenCount uint16, index uint16) (randomBytes []byte, err error) {
+	if len(seed) != consts.TOKEN_SEED_LEN {
+		err = fmt.Errorf("length of seed %d is not %d", len(seed), consts.TOKEN_SEED_LEN)
+		return
+	}
+	if index >= tokenCount {
+		err = fmt.Errorf("token index %d is out of the batch of %d tokens", index, tokenCount)
+		return
+	}
+
+	switch f {
+	case TokenFormatSeedHMAC:
+		msg := make([]byte, len(tokenFormatSeedHMACLabel)+2)
+		copy(msg, tokenFormatSeedHMACLabel)
+		binary.BigEndian.PutUint16(msg[len(tokenFormatSeedHMACLabel):], index)
+		mac := hmac.New(sha256.New, seed)
+		mac.Write(msg)
+		randomBytes = mac.Sum(nil)[:consts.RANDOM_BYTES_LEN]
+	case TokenFormatHashChain:
+		// v_0 = seed, v_{j+1} = SHA256(v_j); token i uses v_{tokenCount-i}, so earlier tokens don't reveal later ones
+		var v [sha256.Size]byte
+		copy(v[:], seed)
+		for j := uint16(0); j < tokenCount-index; j++ {
+			v = sha256.Sum256(v[:])
+		}
+		randomBytes = make([]byte, consts.RANDOM_BYTES_LEN)
+		copy(randomBytes, v[:consts.RANDOM_BYTES_LEN])
+	default:
+		err = fmt.Errorf("token format %s is not seed-based", f)
+	}
+	return
+}
@@ -0,0 +1,68 @@
+package types
+
+import (
+	"fmt"
+	"strings"
+)
+
+/*
+MQTT topic filters with wildcards, used by ACL entries and Sub tokens.
+*/
+const (
+	TOPIC_LEVEL_SEPARATOR     = "/"
+	TOPIC_WILDCARD_SINGLE     = "+"
+	TOPIC_WILDCARD_MULTI      = "#"
+	TOPIC_SYSTEM_TOPIC_PREFIX = "$"
+)
+
+func IsWildcardTopicFilter(filter string) bool {
+	return strings.ContainsAny(filter, TOPIC_WILDCARD_SINGLE+TOPIC_WILDCARD_MULTI)
+}
+
+// Wildcards must occupy entire levels, and "#" must be the last level [MQTT-4.7.1-1, MQTT-4.7.1-2]
+func ValidateTopicFilter(filter string) error {
+	if filter == "" {
+		return fmt.Errorf("empty topic filter")
+	}
+	levels := strings.Split(filter, TOPIC_LEVEL_SEPARATOR)
+	for i, level := range levels {
+		if level == TOPIC_WILDCARD_MULTI {
+			if i != len(levels)-1 {
+				return fmt.Errorf("%s not at the last level: %s", TOPIC_WILDCARD_MULTI, filter)
+			}
+		} else if level != TOPIC_WILDCARD_SINGLE && IsWildcardTopicFilter(level) {
+			return fmt.Errorf("wildcard not occupying an entire level: %s", filter)
+		}
+	}
+	return nil
+}
+
+/*
+Whether everything that requested matches is also matched by filter. requested may be a topic name or another topic filter,
+so that ACL entries with wildcards can grant narrower Sub filters. Topics starting with "$" are not matched by a wildcard
+at the first level [MQTT-4.7.2-1].
+*/
+func TopicFilterCovers(filter string, requested string) bool {
+	if strings.HasPrefix(requested, TOPIC_SYSTEM_TOPIC_PREFIX) != strings.HasPrefix(filter, TOPIC_SYSTEM_TOPIC_PREFIX) {
+		return false
+	}
+	filterLevels := strings.Split(filter, TOPIC_LEVEL_SEPARATOR)
+	requestedLevels := strings.Split(requested, TOPIC_LEVEL_SEPARATOR)
+	for i, filterLevel := range filterLevels {
+		if filterLevel == TOPIC_WILDCARD_MULTI {
+			// also matches the parent level, as "a/#" matches "a"
+			return true
+		}
+		if i >= len(requestedLevels) {
+			return false
+		}
+		switch requestedLevel := requestedLevels[i]; {
+		case requestedLevel == TOPIC_WILDCARD_MULTI:
+			return false
+		case filterLevel == TOPIC_WILDCARD_SINGLE:
+		case filterLevel != requestedLevel:
+			return false
+		}
+	}
+	return len(filterLevels) == len(requestedLevels)
+}
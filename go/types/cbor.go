@@ -0,0 +1,208 @@
+package types
+
+import (
+	"encoding/binary"
+	"fmt"
+	"math"
+)
+
+// Minimal CBOR (RFC 8949) support for CWT/COSE structures: definite-length integers, byte/text strings, arrays, maps,
+// tags and simple values only.
+
+const (
+	cborMajorUint   byte = 0
+	cborMajorNegInt byte = 1
+	cborMajorBytes  byte = 2
+	cborMajorText   byte = 3
+	cborMajorArray  byte = 4
+	cborMajorMap    byte = 5
+	cborMajorTag    byte = 6
+	cborMajorSimple byte = 7
+
+	cborSimpleFalse byte = 20
+	cborSimpleTrue  byte = 21
+	cborSimpleNull  byte = 22
+)
+
+// Decoded CBOR tag
+type CBORTag struct {
+	Number  uint64
+	Content any
+}
+
+func appendCBORHead(dst []byte, major byte, n uint64) []byte {
+	major <<= 5
+	switch {
+	case n < 24:
+		return append(dst, major|byte(n))
+	case n <= math.MaxUint8:
+		return append(dst, major|24, byte(n))
+	case n <= math.MaxUint16:
+		return binary.BigEndian.AppendUint16(append(dst, major|25), uint16(n))
+	case n <= math.MaxUint32:
+		return binary.BigEndian.AppendUint32(append(dst, major|26), uint32(n))
+	}
+	return binary.BigEndian.AppendUint64(append(dst, major|27), n)
+}
+
+func CBORAppendInt(dst []byte, v int64) []byte {
+	if v < 0 {
+		return appendCBORHead(dst, cborMajorNegInt, uint64(-1-v))
+	}
+	return appendCBORHead(dst, cborMajorUint, uint64(v))
+}
+
+func CBORAppendBytes(dst []byte, b []byte) []byte {
+	return append(appendCBORHead(dst, cborMajorBytes, uint64(len(b))), b...)
+}
+
+func CBORAppendText(dst []byte, s string) []byte {
+	return append(appendCBORHead(dst, cborMajorText, uint64(len(s))), s...)
+}
+
+func CBORAppendBool(dst []byte, b bool) []byte {
+	if b {
+		return append(dst, cborMajorSimple<<5|cborSimpleTrue)
+	}
+	return append(dst, cborMajorSimple<<5|cborSimpleFalse)
+}
+
+func CBORAppendArrayHead(dst []byte, n int) []byte {
+	return appendCBORHead(dst, cborMajorArray, uint64(n))
+}
+
+func CBORAppendMapHead(dst []byte, n int) []byte {
+	return appendCBORHead(dst, cborMajorMap, uint64(n))
+}
+
+func CBORAppendTag(dst []byte, number uint64) []byte {
+	return appendCBORHead(dst, cborMajorTag, number)
+}
+
+/*
+Decode one CBOR data item from src. Values are returned as uint64 / int64 (negative only) / []byte / string / bool / nil /
+[]any / map[any]any / CBORTag.
+*/
+func CBORDecode(src []byte) (value any, rest []byte, err error) {
+	return cborDecode(src, 0)
+}
+
+func cborDecode(src []byte, depth int) (value any, rest []byte, err error) {
+	if depth > 16 {
+		err = fmt.Errorf("cbor: nested too deep")
+		return
+	}
+	if len(src) == 0 {
+		err = fmt.Errorf("cbor: unexpected end of data")
+		return
+	}
+	major := src[0] >> 5
+	info := src[0] & 0x1F
+	rest = src[1:]
+
+	var n uint64
+	switch {
+	case info < 24:
+		n = uint64(info)
+	case info == 24 && len(rest) >= 1:
+		n = uint64(rest[0])
+		rest = rest[1:]
+	case info == 25 && len(rest) >= 2:
+		n = uint64(binary.BigEndian.Uint16(rest))
+		rest = rest[2:]
+	case info == 26 && len(rest) >= 4:
+		n = uint64(binary.BigEndian.Uint32(rest))
+		rest = rest[4:]
+	case info == 27 && len(rest) >= 8:
+		n = binary.BigEndian.Uint64(rest)
+		rest = rest[8:]
+	default:
+		err = fmt.Errorf("cbor: unsupported or truncated argument (major %d, info %d)", major, info)
+		return
+	}
+
+	switch major {
+	case cborMajorUint:
+		value = n
+	case cborMajorNegInt:
+		if n > math.MaxInt64 {
+			err = fmt.Errorf("cbor: negative integer out of range")
+			return
+		}
+		value = -1 - int64(n)
+	case cborMajorBytes, cborMajorText:
+		if n > uint64(len(rest)) {
+			err = fmt.Errorf("cbor: string length %d exceeds data", n)
+			return
+		}
+		if major == cborMajorBytes {
+			value = rest[:n]
+		} else {
+			value = string(rest[:n])
+		}
+		rest = rest[n:]
+	case cborMajorArray:
+		if n > uint64(len(rest)) {
+			err = fmt.Errorf("cbor: array length %d exceeds data", n)
+			return
+		}
+		arr := make([]any, n)
+		for i := range arr {
+			if arr[i], rest, err = cborDecode(rest, depth+1); err != nil {
+				return
+			}
+		}
+		value = arr
+	case cborMajorMap:
+		if n > uint64(len(rest)) {
+			err = fmt.Errorf("cbor: map length %d exceeds data", n)
+			return
+		}
+		m := make(map[any]any, n)
+		for i := uint64(0); i < n; i++ {
+			var k, v any
+			if k, rest, err = cborDecode(rest, depth+1); err != nil {
+				return
+			}
+			switch k.(type) {
+			case uint64, int64, string:
+			default:
+				err = fmt.Errorf("cbor: unsupported map key type %T", k)
+				return
+			}
+			if v, rest, err = cborDecode(rest, depth+1); err != nil {
+				return
+			}
+			m[k] = v
+		}
+		value = m
+	case cborMajorTag:
+		var content any
+		if content, rest, err = cborDecode(rest, depth+1); err != nil {
+			return
+		}
+		value = CBORTag{Number: n, Content: content}
+	case cborMajorSimple:
+		switch info {
+		case cborSimpleFalse:
+			value = false
+		case cborSimpleTrue:
+			value = true
+		case cborSimpleNull:
+			value = nil
+		default:
+			err = fmt.Errorf("cbor: unsupported simple value %d", info)
+		}
+	}
+	return
+}
+
+// Look up an integer key of a decoded CBOR map
+func CBORMapGet(m map[any]any, key int64) (value any, found bool) {
+	if key < 0 {
+		value, found = m[key]
+	} else {
+		value, found = m[uint64(key)]
+	}
+	return
+}
@@ -6,6 +6,7 @@ import (
 	"encoding/binary"
 	"fmt"
 	"mqttmtd/consts"
+	"mqttmtd/logging"
 	"os"
 	"sync"
 
@@ -13,6 +14,8 @@ import (
 	"gopkg.in/yaml.v2"
 )
 
+var logger = logging.For("types")
+
 /*
 Access Type expression for ACL.
 */
@@ -31,21 +34,55 @@ func (a ACLAccessType) String() string {
 	return [...]string{"Pub", "Sub", "PubSub"}[a-1]
 }
 
-func (a *ACLAccessType) UnmarshalYAML(unmarshal func(interface{}) error) error {
-	var s string
-	if err := unmarshal(&s); err != nil {
-		return err
-	}
+// Parse "Pub", "Sub" or "PubSub"
+func ParseACLAccessType(s string) (a ACLAccessType, err error) {
 	switch s {
 	case "Pub":
-		*a = AccessPub
+		a = AccessPub
 	case "Sub":
-		*a = AccessSub
+		a = AccessSub
 	case "PubSub":
-		*a = AccessPubSub
+		a = AccessPubSub
 	default:
-		return fmt.Errorf("invalid access type: %s", s)
+		err = fmt.Errorf("invalid access type: %s", s)
+	}
+	return
+}
+
+func (a *ACLAccessType) UnmarshalYAML(unmarshal func(interface{}) error) (err error) {
+	var s string
+	if err = unmarshal(&s); err != nil {
+		return
 	}
+	*a, err = ParseACLAccessType(s)
+	return
+}
+
+/*
+Grant of an ACL entry: the access type, and the padding policies applied to the payloads of the topic. Written either
+as an access type alone, such as "PubSub", or as a map such as {access: PubSub, padding: "bucket:64"}, where padding
+is for both directions or a map of pub and sub.
+*/
+type ACLGrant struct {
+	Access  ACLAccessType   `yaml:"access"`
+	Padding PaddingPolicies `yaml:"padding"`
+}
+
+func (g *ACLGrant) UnmarshalYAML(unmarshal func(interface{}) error) error {
+	var s string
+	if unmarshal(&s) == nil {
+		g.Padding = PaddingPolicies{}
+		return unmarshal(&g.Access)
+	}
+	type plain ACLGrant
+	var grant plain
+	if err := unmarshal(&grant); err != nil {
+		return err
+	}
+	if grant.Access == 0 {
+		return fmt.Errorf("access type missing")
+	}
+	*g = ACLGrant(grant)
 	return nil
 }
 
@@ -54,7 +91,7 @@ Access Control List that Issuer will refer to. Entries can be loaded from the .y
 */
 type AccessControlList struct {
 	sync.Mutex
-	Entries map[string]map[string]ACLAccessType
+	Entries map[string]map[string]ACLGrant
 }
 
 func (acl *AccessControlList) LoadFile(filepath string) error {
@@ -83,6 +120,20 @@ const (
 	PAYLOAD_AEAD_CHACHA20_POLY1305 PayloadAEADType = 0x3
 )
 
+func (p PayloadAEADType) String() string {
+	switch p {
+	case PAYLOAD_AEAD_NONE:
+		return "none"
+	case PAYLOAD_AEAD_AES_128_GCM:
+		return "aes128gcm"
+	case PAYLOAD_AEAD_AES_256_GCM:
+		return "aes256gcm"
+	case PAYLOAD_AEAD_CHACHA20_POLY1305:
+		return "chacha20poly1305"
+	}
+	return fmt.Sprintf("0x%02x", byte(p))
+}
+
 func (p PayloadAEADType) IsEncryptionEnabled() bool {
 	return p == PAYLOAD_AEAD_AES_128_GCM ||
 		p == PAYLOAD_AEAD_AES_256_GCM ||
@@ -113,11 +164,24 @@ func (p PayloadAEADType) GetNonceLen() int {
 	return 0
 }
 
+// Length that sealing adds to the plaintext, which is of the tag as the nonce is not sent
+func (p PayloadAEADType) GetTagLen() int {
+	switch p {
+	case PAYLOAD_AEAD_AES_128_GCM:
+		fallthrough
+	case PAYLOAD_AEAD_CHACHA20_POLY1305:
+		fallthrough
+	case PAYLOAD_AEAD_AES_256_GCM:
+		return 16
+	}
+	return 0
+}
+
 func (p PayloadAEADType) SealMessage(plaintext []byte, encKey []byte, nonceSpice uint64) (sealed []byte, err error) {
 	var (
 		nonce []byte
 	)
-	fmt.Printf("Sealing Message. Type: %d\n", p)
+	logger.Debug("sealing message", "aead", p)
 	switch p {
 	case PAYLOAD_AEAD_AES_128_GCM:
 		fallthrough
@@ -159,7 +223,7 @@ func (p PayloadAEADType) OpenMessage(payload []byte, encKey []byte, nonceSpice u
 	var (
 		nonce []byte
 	)
-	fmt.Printf("Opening Message. Type: %d\n", p)
+	logger.Debug("opening message", "aead", p)
 	switch p {
 	case PAYLOAD_AEAD_AES_128_GCM:
 		fallthrough
@@ -201,6 +265,30 @@ func (p PayloadAEADType) OpenMessage(payload []byte, encKey []byte, nonceSpice u
 	return
 }
 
+/*
+Optional features that can be requested to Issuer.
+*/
+type IssuerRequestOptions byte
+
+const (
+	// Derive a fresh payload key for every token from the batch key with HKDF (requires Payload AEAD)
+	OptionPayloadKeyRatchet IssuerRequestOptions = consts.BIT_7
+	// Decoy tokens for cover traffic, which the verifier consumes and answers with VerfCover so that the messages are discarded
+	OptionCoverTraffic IssuerRequestOptions = consts.BIT_6
+	// Pad payloads with the padding policy of the topic in ACL, which is returned in the response (requires Payload AEAD)
+	OptionPadding IssuerRequestOptions = consts.BIT_5
+	// bit 1-0: TokenFormat
+	optionTokenFormatMask IssuerRequestOptions = consts.BIT_1 | consts.BIT_0
+)
+
+func (o IssuerRequestOptions) TokenFormat() TokenFormat {
+	return TokenFormat(o & optionTokenFormatMask)
+}
+
+func (o IssuerRequestOptions) WithTokenFormat(format TokenFormat) IssuerRequestOptions {
+	return (o &^ optionTokenFormatMask) | IssuerRequestOptions(format)&optionTokenFormatMask
+}
+
 /*
 Request To Issuer.
 */
@@ -208,11 +296,15 @@ type IssuerRequest struct {
 	// Flag - 1 byte
 	AccessTypeIsPub                   bool // bit 7
 	PayloadAEADRequested              bool // bit 6
-	NumberOfTokensDividedByMultiplier byte // bit 5-0, [1, 0x1F], the actual number is calculated after multiplication with consts.TOKEN_NUM_MULTIPLIER
+	NumberOfTokensDividedByMultiplier byte // bit 4-0, [1, 0x1F], the actual number is calculated after multiplication with consts.TOKEN_NUM_MULTIPLIER
+	// bit 5 is set when Options != 0
 
 	// Payload AEAD Type - 1 byte (absent when PayloadAEADRequested == false)
 	PayloadAEADType PayloadAEADType
 
+	// Options - 1 byte (absent when bit 5 of Flag is not set)
+	Options IssuerRequestOptions
+
 	// Topic - 2 bytes (length) + variable num of bytes (content) when parsed to bytes
 	Topic []byte
 }
@@ -227,8 +319,17 @@ type IssuerResponse struct {
 	// Timestamp - (consts.TIMESTAMP_LEN) bytes
 	Timestamp []byte
 
-	// All Random Bytes Generated
+	// Padding Policy - (PADDING_POLICY_LEN) bytes (present only when OptionPadding is requested)
+	Padding PaddingPolicy
+
+	// All Random Bytes Generated (absent when the token format is seed-based or CWT)
 	AllRandomBytes []byte
+
+	// Token Seed - (consts.TOKEN_SEED_LEN) bytes (present only when the token format is seed-based)
+	TokenSeed []byte
+
+	// CWT Tokens - 2 bytes (length) + variable num of bytes (content) each (present only when the token format is CWT)
+	CWTTokens [][]byte
 }
 
 /*
@@ -249,19 +350,56 @@ const (
 	VerfSuccessReloadNeeded       VerificationResultCode = 0x1
 	VerfSuccessEncKey             VerificationResultCode = 0x20
 	VerfSuccessEncKeyReloadNeeded VerificationResultCode = 0x21
-	VerfFail                      VerificationResultCode = 0x80
-	VerfSuspicious                VerificationResultCode = 0x81
+	// Encryption Key is a per-token key derived with the payload key ratchet
+	VerfSuccessRatchetKey             VerificationResultCode = 0x22
+	VerfSuccessRatchetKeyReloadNeeded VerificationResultCode = 0x23
+	// Token is a decoy of cover traffic, valid but granting nothing
+	VerfCover             VerificationResultCode = 0x40
+	VerfCoverReloadNeeded VerificationResultCode = 0x41
+	VerfFail              VerificationResultCode = 0x80
+	VerfSuspicious        VerificationResultCode = 0x81
 )
 
 func (vrescode VerificationResultCode) IsSuccess() bool {
 	return vrescode == VerfSuccess ||
 		vrescode == VerfSuccessReloadNeeded ||
-		vrescode == VerfSuccessEncKey ||
-		vrescode == VerfSuccessEncKeyReloadNeeded
+		vrescode.IsSuccessEncKey()
 }
 func (vrescode VerificationResultCode) IsSuccessEncKey() bool {
 	return vrescode == VerfSuccessEncKey ||
-		vrescode == VerfSuccessEncKeyReloadNeeded
+		vrescode == VerfSuccessEncKeyReloadNeeded ||
+		vrescode.IsRatchetKey()
+}
+func (vrescode VerificationResultCode) IsCover() bool {
+	return vrescode == VerfCover ||
+		vrescode == VerfCoverReloadNeeded
+}
+func (vrescode VerificationResultCode) IsRatchetKey() bool {
+	return vrescode == VerfSuccessRatchetKey ||
+		vrescode == VerfSuccessRatchetKeyReloadNeeded
+}
+func (vrescode VerificationResultCode) IsReloadNeeded() bool {
+	return vrescode < VerfFail && vrescode&VerfSuccessReloadNeeded != 0
+}
+
+var verificationResultCodeNames = map[VerificationResultCode]string{
+	VerfSuccess:                       "success",
+	VerfSuccessReloadNeeded:           "success_reload",
+	VerfSuccessEncKey:                 "success_enckey",
+	VerfSuccessEncKeyReloadNeeded:     "success_enckey_reload",
+	VerfSuccessRatchetKey:             "success_ratchetkey",
+	VerfSuccessRatchetKeyReloadNeeded: "success_ratchetkey_reload",
+	VerfCover:                         "cover",
+	VerfCoverReloadNeeded:             "cover_reload",
+	VerfFail:                          "fail",
+	VerfSuspicious:                    "suspicious",
+}
+
+func (vrescode VerificationResultCode) String() string {
+	if name, found := verificationResultCodeNames[vrescode]; found {
+		return name
+	}
+	return fmt.Sprintf("0x%02x", byte(vrescode))
 }
 
 /*
@@ -280,6 +418,9 @@ type VerifierResponse struct {
 	// Encryption Key (present only if ResultCode is of SuccessEncKey)
 	EncryptionKey []byte
 
+	// Padding Policy (present only if ResultCode is of SuccessEncKey) - (PADDING_POLICY_LEN) bytes
+	Padding PaddingPolicy
+
 	// Topic (present only if ResultCode is of Success) - 2 bytes (length) + variable num of bytes (content) when parsed to bytes
 	Topic []byte
 }